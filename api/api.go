@@ -8,43 +8,89 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"github.com/tsuru/kubernetes-router/backend"
+	"github.com/tsuru/kubernetes-router/observability"
 	"github.com/tsuru/kubernetes-router/router"
 )
 
+const defaultLockTimeout = 15 * time.Second
+
 // RouterAPI implements Tsuru HTTP router API
 type RouterAPI struct {
 	Backend backend.Backend
+
+	// Locker serializes the operations changing the same app, defaults to
+	// a LocalLocker
+	Locker Locker
+
+	// LockTimeout is the maximum time an operation waits for another one
+	// on the same app to finish
+	LockTimeout time.Duration
+
+	// Auditor, when set, records the changes requested to the API
+	Auditor *Auditor
+
+	localLocker LocalLocker
 }
 
 // Routes returns an mux for the API routes
 func (a *RouterAPI) Routes() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(withLogAttrs)
 	a.registerRoutes(r.PathPrefix("/api").Subrouter())
 	a.registerRoutes(r.PathPrefix("/api/{mode}").Subrouter())
 	return r
 }
 
+// withLogAttrs adds the app, instance, mode and cluster of the request to
+// the entries logged while serving it
+func withLogAttrs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var attrs []slog.Attr
+		for _, attr := range []slog.Attr{
+			slog.String(observability.LogKeyApp, vars["name"]),
+			slog.String(observability.LogKeyInstance, r.Header.Get("X-Router-Instance")),
+			slog.String(observability.LogKeyMode, vars["mode"]),
+			slog.String(observability.LogKeyCluster, r.Header.Get("X-Tsuru-Cluster-Name")),
+		} {
+			if attr.Value.String() != "" {
+				attrs = append(attrs, attr)
+			}
+		}
+		if len(attrs) > 0 {
+			r = r.WithContext(observability.WithLogAttrs(r.Context(), attrs...))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (a *RouterAPI) registerRoutes(r *mux.Router) {
 	r.Handle("/backend/{name}", handler(a.getBackend)).Methods(http.MethodGet)
-	r.Handle("/backend/{name}", handler(a.ensureBackend)).Methods(http.MethodPut)
-	r.Handle("/backend/{name}", handler(a.removeBackend)).Methods(http.MethodDelete)
+	r.Handle("/backend/{name}", a.audited("ensure", a.ensureBackend)).Methods(http.MethodPut)
+	r.Handle("/backend/{name}", a.audited("remove", a.removeBackend)).Methods(http.MethodDelete)
 	r.Handle("/backend/{name}/status", handler(a.status)).Methods(http.MethodGet)
 	r.Handle("/backend/{name}/routes", handler(a.getRoutes)).Methods(http.MethodGet)
+	r.Handle("/backend/{name}/swap", a.audited("swap", a.swap)).Methods(http.MethodPost)
 	r.Handle("/info", handler(a.info)).Methods(http.MethodGet)
+	r.Handle("/gc", handler(a.garbage)).Methods(http.MethodGet)
 
 	// TLS
-	r.Handle("/backend/{name}/certificate/{certname}", handler(a.addCertificate)).Methods(http.MethodPut)
+	r.Handle("/backend/{name}/certificate/{certname}", a.audited("cert_add", a.addCertificate)).Methods(http.MethodPut)
 	r.Handle("/backend/{name}/certificate/{certname}", handler(a.getCertificate)).Methods(http.MethodGet)
-	r.Handle("/backend/{name}/certificate/{certname}", handler(a.removeCertificate)).Methods(http.MethodDelete)
+	r.Handle("/backend/{name}/certificate/{certname}", a.audited("cert_remove", a.removeCertificate)).Methods(http.MethodDelete)
 
 	// Supports
 	r.Handle("/support/tls", handler(a.supportTLS)).Methods(http.MethodGet)
+	r.Handle("/support/swap", handler(a.supportSwap)).Methods(http.MethodGet)
 	r.Handle("/support/info", handler(func(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusOK)
 		return nil
@@ -66,9 +112,64 @@ func (a *RouterAPI) registerRoutes(r *mux.Router) {
 func (a *RouterAPI) router(ctx context.Context, mode string, header http.Header) (router.Router, error) {
 	router, err := a.Backend.Router(ctx, mode, header)
 	if err == backend.ErrBackendNotFound {
-		return nil, httpError{Status: http.StatusNotFound}
+		return nil, httpError{Status: http.StatusNotFound, Body: err.Error()}
+	}
+	return router, err
+}
+
+// lock waits for the locks of the apps of ids, failing with a locked error
+// when another operation holds them for longer than LockTimeout. The
+// context returned, used by the operation, is canceled if a lock is lost.
+func (a *RouterAPI) lock(ctx context.Context, ids ...router.InstanceID) (context.Context, func(), error) {
+	locker := a.Locker
+	if locker == nil {
+		locker = &a.localLocker
+	}
+	timeout := a.LockTimeout
+	if timeout == 0 {
+		timeout = defaultLockTimeout
+	}
+	var keys []string
+	for _, id := range ids {
+		key := router.LockKey(id)
+		if !containsKey(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	// locks are always taken in the same order, so operations on the same
+	// apps, like swaps, don't wait for each other forever
+	sort.Strings(keys)
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	opCtx, cancelOp := context.WithCancel(ctx)
+	var unlocks []func()
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+		cancelOp()
+	}
+	for _, key := range keys {
+		release, err := locker.Lock(lockCtx, key, cancelOp)
+		if err != nil {
+			unlock()
+			if ctx.Err() == nil && lockCtx.Err() == context.DeadlineExceeded {
+				return nil, nil, router.NewError(router.ErrorCodeLocked, fmt.Errorf("another operation on %s is still running after %v", key, timeout))
+			}
+			return nil, nil, err
+		}
+		unlocks = append(unlocks, release)
+	}
+	return opCtx, unlock, nil
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
 	}
-	return router, nil
+	return false
 }
 
 func instanceID(r *http.Request) router.InstanceID {
@@ -118,12 +219,13 @@ func (a *RouterAPI) status(w http.ResponseWriter, r *http.Request) error {
 		Detail string               `json:"detail"`
 	}
 
-	statusRouter, ok := svc.(router.RouterStatus)
+	_, ok := router.Unwrap(svc).(router.RouterStatus)
 	if !ok {
 		return json.NewEncoder(w).Encode(&statusResp{
 			Status: router.BackendStatusReady,
 		})
 	}
+	statusRouter := svc.(router.RouterStatus)
 
 	status, detail, err := statusRouter.GetStatus(ctx, instanceID(r))
 	if err != nil {
@@ -144,6 +246,22 @@ func (a *RouterAPI) removeBackend(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
+	planner, err := dryRunPlanner(r, svc)
+	if err != nil {
+		return err
+	}
+	if planner != nil {
+		plan, err := planner.PlanRemove(ctx, instanceID(r))
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(plan)
+	}
+	ctx, unlock, err := a.lock(ctx, instanceID(r))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return svc.Remove(ctx, instanceID(r))
 }
 
@@ -159,7 +277,7 @@ func (a *RouterAPI) ensureBackend(w http.ResponseWriter, r *http.Request) error
 	}
 	err := json.NewDecoder(r.Body).Decode(opts)
 	if err != nil {
-		return err
+		return httpError{Status: http.StatusBadRequest, Body: err.Error()}
 	}
 
 	if len(opts.Opts.Domain) > 0 && len(opts.Opts.Route) == 0 {
@@ -171,9 +289,143 @@ func (a *RouterAPI) ensureBackend(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
+	var schema map[string]router.OptionSchema
+	if schemaRouter, ok := svc.(router.RouterOptionsSchema); ok {
+		schema = schemaRouter.OptionsSchema(ctx)
+	}
+	err = opts.Validate(schema)
+	if err != nil {
+		return err
+	}
+
+	if opts.HasWeightedTargets() {
+		err = validateWeightedTargets(ctx, svc, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	planner, err := dryRunPlanner(r, svc)
+	if err != nil {
+		return err
+	}
+	if planner != nil {
+		plan, err := planner.PlanEnsure(ctx, instanceID(r), *opts)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(plan)
+	}
+
+	ctx, unlock, err := a.lock(ctx, instanceID(r))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return svc.Ensure(ctx, instanceID(r), *opts)
 }
 
+// dryRunPlanner returns the planner of svc when the request asks for a
+// dry-run with the dryRun query parameter
+func dryRunPlanner(r *http.Request, svc router.Router) (router.RouterPlanner, error) {
+	value := r.URL.Query().Get("dryRun")
+	if value == "" {
+		return nil, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, httpError{Status: http.StatusBadRequest, Body: fmt.Sprintf("invalid dryRun %q", value)}
+	}
+	if !dryRun {
+		return nil, nil
+	}
+	_, ok := router.Unwrap(svc).(router.RouterPlanner)
+	if !ok {
+		return nil, httpError{Status: http.StatusNotFound, Code: router.ErrorCodeNotSupported, Body: "dry-run is not supported by this router mode"}
+	}
+	return svc.(router.RouterPlanner), nil
+}
+
+func validateWeightedTargets(ctx context.Context, svc router.Router, opts *router.EnsureBackendOpts) error {
+	_, ok := router.Unwrap(svc).(router.RouterWeighted)
+	if !ok {
+		return httpError{Status: http.StatusBadRequest, Code: router.ErrorCodeNotSupported, Body: "weighted targets are not supported by this router mode"}
+	}
+	weightedRouter := svc.(router.RouterWeighted)
+	err := opts.NormalizeWeightedTargets()
+	if err != nil {
+		return httpError{Status: http.StatusBadRequest, Body: err.Error()}
+	}
+	err = weightedRouter.ValidateWeightedTargets(ctx, opts.Prefixes)
+	if err != nil {
+		return httpError{Status: http.StatusBadRequest, Body: err.Error()}
+	}
+	return nil
+}
+
+// swap exchanges the backends of the app with the ones of the target app
+func (a *RouterAPI) swap(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	var req struct {
+		Target         string `json:"target"`
+		TargetInstance string `json:"targetInstance"`
+		CNameOnly      bool   `json:"cnameOnly"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return httpError{Status: http.StatusBadRequest, Body: err.Error()}
+	}
+	if req.Target == "" {
+		return httpError{Status: http.StatusBadRequest, Body: "target is required"}
+	}
+	svc, err := a.router(ctx, vars["mode"], r.Header)
+	if err != nil {
+		return err
+	}
+	_, ok := router.Unwrap(svc).(router.RouterSwap)
+	if !ok {
+		return httpError{Status: http.StatusNotFound, Code: router.ErrorCodeNotSupported, Body: "No Swap Capabilities"}
+	}
+	swapRouter := svc.(router.RouterSwap)
+	src := instanceID(r)
+	dst := router.InstanceID{AppName: req.Target, InstanceName: req.TargetInstance}
+	if dst.InstanceName == "" {
+		dst.InstanceName = src.InstanceName
+	}
+	ctx, unlock, err := a.lock(ctx, src, dst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	slog.InfoContext(ctx, "Swapping backends", "src", src.AppName, "dst", dst.AppName, "cnameOnly", req.CNameOnly)
+	return swapRouter.Swap(ctx, src, dst, router.SwapOpts{CNameOnly: req.CNameOnly})
+}
+
+// garbage reports the resources that would be removed by the next
+// garbage collection of the router
+func (a *RouterAPI) garbage(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	svc, err := a.router(ctx, vars["mode"], r.Header)
+	if err != nil {
+		return err
+	}
+	_, ok := router.Unwrap(svc).(router.RouterGarbageCollector)
+	if !ok {
+		return httpError{Status: http.StatusNotFound, Code: router.ErrorCodeNotSupported, Body: "No GC Capabilities"}
+	}
+	gcRouter := svc.(router.RouterGarbageCollector)
+	garbage, err := gcRouter.CollectGarbage(ctx, true)
+	if err != nil {
+		return err
+	}
+	type gcResp struct {
+		Resources []router.GarbageResource `json:"resources"`
+	}
+	return json.NewEncoder(w).Encode(gcResp{Resources: garbage})
+}
+
 // getRoutes always returns an empty address list to force tsuru to call
 // addRoutes on every routes rebuild call.
 func (a *RouterAPI) getRoutes(w http.ResponseWriter, r *http.Request) error {
@@ -203,11 +455,25 @@ func (a *RouterAPI) info(w http.ResponseWriter, r *http.Request) error {
 	return json.NewEncoder(w).Encode(info)
 }
 
-// Healthcheck checks the health of the service
+// Healthcheck checks the health of the service, backends reporting the
+// health of each cluster answer with the JSON report when asked for JSON
 func (a *RouterAPI) Healthcheck(w http.ResponseWriter, r *http.Request) {
+	if reporter, ok := a.Backend.(backend.HealthReporter); ok && strings.Contains(r.Header.Get("Accept"), "application/json") {
+		report := reporter.HealthReport(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			slog.ErrorContext(r.Context(), "Healthcheck failed", "report", report)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write healthcheck", "error", err)
+		}
+		return
+	}
 	err := a.Backend.Healthcheck(r.Context())
 	if err != nil {
-		glog.Errorf("failed to write healthcheck: %v", err)
+		slog.ErrorContext(r.Context(), "Healthcheck failed", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err.Error())
 		return
@@ -220,18 +486,22 @@ func (a *RouterAPI) Healthcheck(w http.ResponseWriter, r *http.Request) {
 func (a *RouterAPI) addCertificate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	vars := mux.Vars(r)
-	name := vars["name"]
 	certName := vars["certname"]
-	log.Printf("Adding on %s certificate %s", name, certName)
+	slog.InfoContext(ctx, "Adding certificate", "certificate", certName)
 	cert := router.CertData{}
 	err := json.NewDecoder(r.Body).Decode(&cert)
 	if err != nil {
-		return err
+		return httpError{Status: http.StatusBadRequest, Body: err.Error()}
 	}
 	svc, err := a.router(ctx, vars["mode"], r.Header)
 	if err != nil {
 		return err
 	}
+	ctx, unlock, err := a.lock(ctx, instanceID(r))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	return svc.(router.RouterTLS).AddCertificate(ctx, instanceID(r), certName, cert)
 }
 
@@ -239,17 +509,15 @@ func (a *RouterAPI) addCertificate(w http.ResponseWriter, r *http.Request) error
 func (a *RouterAPI) getCertificate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	vars := mux.Vars(r)
-	name := vars["name"]
 	certName := vars["certname"]
-	log.Printf("Getting certificate %s from %s", certName, name)
+	slog.DebugContext(ctx, "Getting certificate", "certificate", certName)
 	svc, err := a.router(ctx, vars["mode"], r.Header)
 	if err != nil {
 		return err
 	}
 	cert, err := svc.(router.RouterTLS).GetCertificate(ctx, instanceID(r), certName)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return err
+		return certificateError(err)
 	}
 	b, err := json.Marshal(&cert)
 	if err != nil {
@@ -264,18 +532,31 @@ func (a *RouterAPI) getCertificate(w http.ResponseWriter, r *http.Request) error
 func (a *RouterAPI) removeCertificate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	vars := mux.Vars(r)
-	name := vars["name"]
 	certName := vars["certname"]
-	log.Printf("Removing certificate %s from %s", certName, name)
+	slog.InfoContext(ctx, "Removing certificate", "certificate", certName)
 	svc, err := a.router(ctx, vars["mode"], r.Header)
 	if err != nil {
 		return err
 	}
+	ctx, unlock, err := a.lock(ctx, instanceID(r))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	err = svc.(router.RouterTLS).RemoveCertificate(ctx, instanceID(r), certName)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		return certificateError(err)
 	}
-	return err
+	return nil
+}
+
+// certificateError reports the certificates not found with their own code
+func certificateError(err error) error {
+	routerErr := router.AsError(err)
+	if routerErr.Code == router.ErrorCodeNotFound {
+		return router.NewError(router.ErrorCodeCertificateNotFound, err)
+	}
+	return routerErr
 }
 
 // Check for TLS Support
@@ -286,7 +567,7 @@ func (a *RouterAPI) supportTLS(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	_, ok := svc.(router.RouterTLS)
+	_, ok := router.Unwrap(svc).(router.RouterTLS)
 	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		_, err = w.Write([]byte("No TLS Capabilities"))
@@ -295,3 +576,20 @@ func (a *RouterAPI) supportTLS(w http.ResponseWriter, r *http.Request) error {
 	_, err = w.Write([]byte("OK"))
 	return err
 }
+
+// Check for Swap Support
+func (a *RouterAPI) supportSwap(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	svc, err := a.router(r.Context(), vars["mode"], r.Header)
+	if err != nil {
+		return err
+	}
+	_, ok := router.Unwrap(svc).(router.RouterSwap)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, err = w.Write([]byte("No Swap Capabilities"))
+		return err
+	}
+	_, err = w.Write([]byte("OK"))
+	return err
+}
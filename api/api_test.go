@@ -6,16 +6,22 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 	"github.com/tsuru/kubernetes-router/backend"
 	"github.com/tsuru/kubernetes-router/router"
 	"github.com/tsuru/kubernetes-router/router/mock"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 type RouterAPISuite struct {
@@ -56,6 +62,34 @@ func (s *RouterAPISuite) TestHealthcheckOK() {
 	s.Equal("WORKING", string(body))
 }
 
+type reportingBackend struct {
+	backend.LocalCluster
+	report backend.HealthReport
+}
+
+func (b *reportingBackend) HealthReport(context.Context) backend.HealthReport {
+	return b.report
+}
+
+func (s *RouterAPISuite) TestHealthcheckReport() {
+	s.api.Backend = &reportingBackend{report: backend.HealthReport{
+		Clusters: []backend.ClusterHealth{
+			{Name: "c1", Critical: true, Duration: "1s", Errors: []string{"cannot list services"}},
+		},
+	}}
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+
+	s.api.Healthcheck(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	s.Equal(http.StatusInternalServerError, resp.StatusCode)
+	s.Equal("application/json", resp.Header.Get("Content-Type"))
+	s.JSONEq(`{"healthy":false,"clusters":[{"name":"c1","critical":true,"healthy":false,"duration":"1s","errors":["cannot list services"]}]}`, string(body))
+}
+
 func (s *RouterAPISuite) TestGetBackend() {
 	s.mockRouter.GetAddressesFn = func(id router.InstanceID) ([]string, error) {
 		s.Assert().Equal("myapp", id.AppName)
@@ -108,6 +142,69 @@ func (s *RouterAPISuite) TestGetBackendInvalidMode() {
 	s.Equal(http.StatusNotFound, resp.StatusCode)
 }
 
+func (s *RouterAPISuite) TestErrorResponses() {
+	tests := []struct {
+		err    error
+		status int
+		body   string
+	}{
+		{
+			err:    k8sErrors.NewConflict(schema.GroupResource{Resource: "ingresses"}, "myapp", errors.New("modified")),
+			status: http.StatusConflict,
+			body:   `{"code":"conflict","message":"Operation cannot be fulfilled on ingresses \"myapp\": modified"}`,
+		},
+		{
+			err:    k8sErrors.NewForbidden(schema.GroupResource{Resource: "services"}, "myapp", errors.New("denied")),
+			status: http.StatusForbidden,
+			body:   `{"code":"forbidden","message":"services \"myapp\" is forbidden: denied"}`,
+		},
+		{
+			err:    k8sErrors.NewServiceUnavailable("overloaded"),
+			status: http.StatusServiceUnavailable,
+			body:   `{"code":"unavailable","message":"overloaded"}`,
+		},
+		{
+			err:    router.ErrIngressAlreadyExists,
+			status: http.StatusConflict,
+			body:   `{"code":"already_exists","message":"ingress already exists"}`,
+		},
+		{
+			err:    router.NewError(router.ErrorCodeServiceNotFound, errors.New("no service found")),
+			status: http.StatusNotFound,
+			body:   `{"code":"service_not_found","message":"no service found"}`,
+		},
+		{
+			err:    errors.New("unexpected"),
+			status: http.StatusInternalServerError,
+			body:   `{"code":"internal","message":"unexpected"}`,
+		},
+	}
+	for _, tt := range tests {
+		s.mockRouter.GetAddressesFn = func(id router.InstanceID) ([]string, error) {
+			return nil, tt.err
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/api/backend/myapp", nil)
+		w := httptest.NewRecorder()
+
+		s.handler.ServeHTTP(w, req)
+		s.Equal(tt.status, w.Code)
+		s.Equal("application/json", w.Header().Get("Content-Type"))
+		s.JSONEq(tt.body, w.Body.String())
+	}
+}
+
+func (s *RouterAPISuite) TestGetCertificateNotFound() {
+	s.mockRouter.GetCertificateFn = func(id router.InstanceID, certName string) (*router.CertData, error) {
+		return nil, k8sErrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "kr-myapp-certname")
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/api/backend/myapp/certificate/certname", nil)
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	s.Equal(http.StatusNotFound, w.Code)
+	s.JSONEq(`{"code":"certificate_not_found","message":"secrets \"kr-myapp-certname\" not found"}`, w.Body.String())
+}
+
 func (s *RouterAPISuite) TestEnsureBackend() {
 	s.mockRouter.EnsureFn = func(id router.InstanceID, o router.EnsureBackendOpts) error {
 		s.Equal("myapp", id.AppName)
@@ -195,6 +292,46 @@ func (s *RouterAPISuite) TestEnsureBackendWithHeaderOpts() {
 	s.True(s.mockRouter.EnsureInvoked)
 }
 
+func (s *RouterAPISuite) TestEnsureBackendInvalidOpts() {
+	s.mockRouter.OptionsSchemaFn = func() map[string]router.OptionSchema {
+		return map[string]router.OptionSchema{
+			router.ExposedPort:           {Type: router.OptionTypePort},
+			router.ExternalTrafficPolicy: {Type: router.OptionTypeString, Values: []string{"Cluster", "Local"}},
+			router.Domain:                {Type: router.OptionTypeDomain},
+			"custom":                     {Type: router.OptionTypeString, Required: true},
+		}
+	}
+	reqData, _ := json.Marshal(
+		map[string]interface{}{
+			"opts": map[string]interface{}{
+				"exposed-port":            "70000",
+				"external-traffic-policy": "Nowhere",
+				"domain":                  "my_app.io",
+			},
+			"cnames": []string{"myapp.io", "-invalid.io"},
+		})
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp", bytes.NewReader(reqData))
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	s.False(s.mockRouter.EnsureInvoked)
+	var routerErr struct {
+		Code    router.ErrorCode   `json:"code"`
+		Details []router.Violation `json:"details"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&routerErr))
+	s.Equal(router.ErrorCodeInvalid, routerErr.Code)
+	s.Equal([]router.Violation{
+		{Field: "opts.custom", Message: "is required"},
+		{Field: "opts.domain", Message: `"my_app.io" is not a valid DNS name`},
+		{Field: "opts.exposed-port", Message: `"70000" is not a port between 1 and 65535`},
+		{Field: "opts.external-traffic-policy", Message: `"Nowhere" must be one of Cluster, Local`},
+		{Field: "cnames[1]", Message: `"-invalid.io" is not a valid DNS name`},
+	}, routerErr.Details)
+}
+
 func (s *RouterAPISuite) TestRemoveBackend() {
 	s.mockRouter.RemoveFn = func(id router.InstanceID) error {
 		s.Equal("myapp", id.AppName)
@@ -213,6 +350,88 @@ func (s *RouterAPISuite) TestRemoveBackend() {
 	}
 }
 
+func (s *RouterAPISuite) TestRemoveBackendDryRun() {
+	s.mockRouter.PlanRemoveFn = func(id router.InstanceID) (*router.Plan, error) {
+		s.Equal("myapp", id.AppName)
+		return &router.Plan{Changes: []router.PlannedChange{
+			{Action: router.ChangeDelete, Kind: "Service", Namespace: "tsuru", Name: "myapp-router-lb"},
+		}}, nil
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "http://localhost/api/backend/myapp?dryRun=true", nil)
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+	s.JSONEq(`{"changes":[{"action":"delete","kind":"Service","namespace":"tsuru","name":"myapp-router-lb"}]}`, w.Body.String())
+	s.False(s.mockRouter.RemoveInvoked)
+}
+
+func (s *RouterAPISuite) TestEnsureBackendDryRun() {
+	s.mockRouter.PlanEnsureFn = func(id router.InstanceID, o router.EnsureBackendOpts) (*router.Plan, error) {
+		s.Equal("myapp", id.AppName)
+		s.Equal([]string{"myapp.io"}, o.CNames)
+		return &router.Plan{Changes: []router.PlannedChange{
+			{Action: router.ChangeUpdate, Kind: "Ingress", Namespace: "tsuru", Name: "kubernetes-router-myapp-ingress", Fields: []string{"metadata.annotations.router.tsuru.io/cnames"}},
+		}}, nil
+	}
+	body := strings.NewReader(`{"cnames":["myapp.io"],"prefixes":[{"prefix":"","target":{"service":"myapp-web","namespace":"tsuru"}}]}`)
+
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp?dryRun=true", body)
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+	s.JSONEq(`{"changes":[{"action":"update","kind":"Ingress","namespace":"tsuru","name":"kubernetes-router-myapp-ingress","fields":["metadata.annotations.router.tsuru.io/cnames"]}]}`, w.Body.String())
+	s.False(s.mockRouter.EnsureInvoked)
+
+	req = httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp?dryRun=maybe", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.False(s.mockRouter.EnsureInvoked)
+}
+
+func (s *RouterAPISuite) TestEnsureBackendLocked() {
+	s.mockRouter.EnsureFn = func(id router.InstanceID, o router.EnsureBackendOpts) error {
+		return nil
+	}
+	s.api.LockTimeout = 10 * time.Millisecond
+	unlock, err := s.api.localLocker.Lock(context.Background(), "myapp", nil)
+	s.Require().NoError(err)
+	body := `{"prefixes":[{"prefix":"","target":{"service":"myapp-web","namespace":"tsuru"}}]}`
+
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	s.Equal(http.StatusLocked, w.Code)
+	s.JSONEq(`{"code":"locked","message":"another operation on myapp is still running after 10ms"}`, w.Body.String())
+	s.False(s.mockRouter.EnsureInvoked)
+
+	unlock()
+	req = httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	s.Equal(http.StatusOK, w.Code)
+	s.True(s.mockRouter.EnsureInvoked)
+}
+
+func (s *RouterAPISuite) TestSwapLocksBothApps() {
+	s.mockRouter.SwapFn = func(src, dst router.InstanceID, opts router.SwapOpts) error {
+		return nil
+	}
+	s.api.LockTimeout = 10 * time.Millisecond
+	unlock, err := s.api.localLocker.Lock(context.Background(), "otherapp", nil)
+	s.Require().NoError(err)
+	defer unlock()
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/backend/myapp/swap", strings.NewReader(`{"target":"otherapp"}`))
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	s.Equal(http.StatusLocked, w.Code)
+	s.False(s.mockRouter.SwapInvoked)
+}
+
 func (s *RouterAPISuite) TestInfo() {
 	s.mockRouter.SupportedOptionsFn = func() map[string]string {
 		return map[string]string{router.ExposedPort: "", router.Domain: "Custom help."}
@@ -236,6 +455,24 @@ func (s *RouterAPISuite) TestInfo() {
 	s.Equal(expected, info)
 }
 
+func (s *RouterAPISuite) TestGarbage() {
+	s.mockRouter.CollectGarbageFn = func(dryRun bool) ([]router.GarbageResource, error) {
+		s.True(dryRun)
+		return []router.GarbageResource{
+			{Kind: "Ingress", Namespace: "tsuru", Name: "kubernetes-router-cname-myapp.io", App: "myapp"},
+		}, nil
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/api/gc", nil)
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.True(s.mockRouter.CollectGarbageInvoked)
+	s.JSONEq(`{"resources":[{"kind":"Ingress","namespace":"tsuru","name":"kubernetes-router-cname-myapp.io","app":"myapp"}]}`, w.Body.String())
+}
+
 func (s *RouterAPISuite) TestGetRoutes() {
 	req := httptest.NewRequest(http.MethodGet, "http://localhost/api/backend/myapp/routes", nil)
 	w := httptest.NewRecorder()
@@ -312,3 +549,176 @@ func (s *RouterAPISuite) TestRemoveCertificate() {
 		s.Fail("Service Addresses function not invoked")
 	}
 }
+
+func (s *RouterAPISuite) TestSwap() {
+	s.mockRouter.SwapFn = func(src, dst router.InstanceID, opts router.SwapOpts) error {
+		s.Equal(router.InstanceID{AppName: "myapp", InstanceName: "blue"}, src)
+		s.Equal(router.InstanceID{AppName: "otherapp", InstanceName: "blue"}, dst)
+		s.Equal(router.SwapOpts{}, opts)
+		return nil
+	}
+
+	reqData, _ := json.Marshal(map[string]string{"target": "otherapp"})
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/backend/myapp/swap", bytes.NewReader(reqData))
+	req.Header.Set("X-Router-Instance", "blue")
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.True(s.mockRouter.SwapInvoked)
+}
+
+func (s *RouterAPISuite) TestSwapCNameOnlyWithTargetInstance() {
+	s.mockRouter.SwapFn = func(src, dst router.InstanceID, opts router.SwapOpts) error {
+		s.Equal(router.InstanceID{AppName: "myapp", InstanceName: "blue"}, src)
+		s.Equal(router.InstanceID{AppName: "otherapp", InstanceName: "green"}, dst)
+		s.Equal(router.SwapOpts{CNameOnly: true}, opts)
+		return nil
+	}
+
+	reqData, _ := json.Marshal(map[string]interface{}{"target": "otherapp", "targetInstance": "green", "cnameOnly": true})
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/backend/myapp/swap", bytes.NewReader(reqData))
+	req.Header.Set("X-Router-Instance", "blue")
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.True(s.mockRouter.SwapInvoked)
+}
+
+func (s *RouterAPISuite) TestSwapCNameOnlyUnsupported() {
+	s.mockRouter.SwapFn = func(src, dst router.InstanceID, opts router.SwapOpts) error {
+		return router.ErrSwapCNameOnlyUnsupported
+	}
+
+	reqData, _ := json.Marshal(map[string]interface{}{"target": "otherapp", "cnameOnly": true})
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/backend/myapp/swap", bytes.NewReader(reqData))
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *RouterAPISuite) TestSwapWithoutTarget() {
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/backend/myapp/swap", bytes.NewReader([]byte(`{}`)))
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+	s.False(s.mockRouter.SwapInvoked)
+}
+
+func (s *RouterAPISuite) TestSwapDifferentNamespaces() {
+	s.mockRouter.SwapFn = func(src, dst router.InstanceID, opts router.SwapOpts) error {
+		return router.ErrSwapDifferentNamespaces
+	}
+
+	reqData, _ := json.Marshal(map[string]string{"target": "otherapp"})
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/backend/myapp/swap", bytes.NewReader(reqData))
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *RouterAPISuite) TestEnsureBackendWeightedTargets() {
+	stable := router.BackendTarget{Namespace: "tsuru", Service: "myapp-web"}
+	canary := router.BackendTarget{Namespace: "tsuru", Service: "myapp-canary-web"}
+	s.mockRouter.ValidateWeightedFn = func(prefixes []router.BackendPrefix) error {
+		s.Equal(stable, prefixes[0].Target)
+		return nil
+	}
+	s.mockRouter.EnsureFn = func(id router.InstanceID, o router.EnsureBackendOpts) error {
+		s.Equal([]router.BackendPrefix{
+			{
+				Target: stable,
+				Targets: []router.WeightedBackendTarget{
+					{BackendTarget: stable, Weight: 90},
+					{BackendTarget: canary, Weight: 10},
+				},
+			},
+		}, o.Prefixes)
+		return nil
+	}
+
+	reqData, _ := json.Marshal(map[string]interface{}{
+		"prefixes": []map[string]interface{}{
+			{
+				"prefix": "",
+				"targets": []map[string]interface{}{
+					{"service": "myapp-web", "namespace": "tsuru", "weight": 90},
+					{"service": "myapp-canary-web", "namespace": "tsuru", "weight": 10},
+				},
+			},
+		},
+	})
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp", bytes.NewReader(reqData))
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.True(s.mockRouter.EnsureInvoked)
+}
+
+func (s *RouterAPISuite) TestEnsureBackendInvalidWeights() {
+	s.mockRouter.ValidateWeightedFn = func(prefixes []router.BackendPrefix) error {
+		return nil
+	}
+
+	reqData, _ := json.Marshal(map[string]interface{}{
+		"prefixes": []map[string]interface{}{
+			{
+				"prefix": "",
+				"targets": []map[string]interface{}{
+					{"service": "myapp-web", "namespace": "tsuru", "weight": 80},
+					{"service": "myapp-canary-web", "namespace": "tsuru", "weight": 10},
+				},
+			},
+		},
+	})
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp", bytes.NewReader(reqData))
+	w := httptest.NewRecorder()
+
+	s.handler.ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+	s.False(s.mockRouter.EnsureInvoked)
+}
+
+func (s *RouterAPISuite) TestEnsureBackendWeightedTargetsNotSupported() {
+	type basicRouter struct {
+		router.Router
+	}
+	api := RouterAPI{
+		Backend: &backend.LocalCluster{
+			DefaultMode: "mymode",
+			Routers:     map[string]router.Router{"mymode": basicRouter{s.mockRouter}},
+		},
+	}
+
+	reqData, _ := json.Marshal(map[string]interface{}{
+		"prefixes": []map[string]interface{}{
+			{
+				"prefix": "",
+				"targets": []map[string]interface{}{
+					{"service": "myapp-web", "namespace": "tsuru", "weight": 90},
+					{"service": "myapp-canary-web", "namespace": "tsuru", "weight": 10},
+				},
+			},
+		},
+	})
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp", bytes.NewReader(reqData))
+	w := httptest.NewRecorder()
+
+	api.Routes().ServeHTTP(w, req)
+	resp := w.Result()
+	s.Equal(http.StatusBadRequest, resp.StatusCode)
+	s.JSONEq(`{"code":"not_supported","message":"weighted targets are not supported by this router mode"}`, w.Body.String())
+	s.False(s.mockRouter.EnsureInvoked)
+}
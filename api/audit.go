@@ -0,0 +1,304 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tsuru/kubernetes-router/observability"
+)
+
+const (
+	defaultAuditRecent       = 1000
+	defaultAuditQueryLimit   = 100
+	defaultAuditWebhookQueue = 1000
+	auditWebhookTimeout      = 10 * time.Second
+
+	auditResultSuccess = "success"
+	redactedValue      = "REDACTED"
+)
+
+// redactedFields are the fields of the request bodies left out of the audit
+// entries, like the private key of certificates
+var redactedFields = []string{"key"}
+
+// AuditEntry records a change requested to the API
+type AuditEntry struct {
+	Time       time.Time       `json:"time"`
+	RequestID  string          `json:"requestID,omitempty"`
+	User       string          `json:"user,omitempty"`
+	RemoteAddr string          `json:"remoteAddr,omitempty"`
+	Operation  string          `json:"operation"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Mode       string          `json:"mode,omitempty"`
+	Cluster    string          `json:"cluster,omitempty"`
+	App        string          `json:"app"`
+	Instance   string          `json:"instance,omitempty"`
+	DryRun     bool            `json:"dryRun,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Status     int             `json:"status"`
+	Result     string          `json:"result"`
+	Error      string          `json:"error,omitempty"`
+	Duration   float64         `json:"durationSeconds"`
+}
+
+// AuditSink stores the audit entries
+type AuditSink interface {
+	Write(ctx context.Context, entry AuditEntry) error
+}
+
+// Auditor records the changes requested to the API on its sinks, keeping
+// the most recent entries in memory to be queried
+type Auditor struct {
+	Sinks []AuditSink
+
+	// Recent is the number of entries kept in memory, defaults to 1000
+	Recent int
+
+	mu      sync.Mutex
+	entries []AuditEntry
+	next    int
+}
+
+// Record keeps entry and writes it to every sink, failures of a sink are
+// logged without affecting the others
+func (a *Auditor) Record(ctx context.Context, entry AuditEntry) {
+	a.keep(entry)
+	for _, sink := range a.Sinks {
+		err := sink.Write(ctx, entry)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to write audit entry", "sink", fmt.Sprintf("%T", sink), "error", err)
+		}
+	}
+}
+
+func (a *Auditor) keep(entry AuditEntry) {
+	recent := a.Recent
+	if recent <= 0 {
+		recent = defaultAuditRecent
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) < recent {
+		a.entries = append(a.entries, entry)
+		return
+	}
+	a.entries[a.next] = entry
+	a.next = (a.next + 1) % len(a.entries)
+}
+
+// AuditFilter selects the entries returned by Auditor.Entries, empty
+// fields match every entry
+type AuditFilter struct {
+	App       string
+	Operation string
+	User      string
+}
+
+func (f AuditFilter) match(entry AuditEntry) bool {
+	return (f.App == "" || f.App == entry.App) &&
+		(f.Operation == "" || f.Operation == entry.Operation) &&
+		(f.User == "" || f.User == entry.User)
+}
+
+// Entries returns up to limit of the entries kept matching filter, the most
+// recent first
+func (a *Auditor) Entries(filter AuditFilter, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := []AuditEntry{}
+	for i := 0; i < len(a.entries) && len(result) < limit; i++ {
+		// the newest entry is the one before next
+		entry := a.entries[(a.next-1-i+2*len(a.entries))%len(a.entries)]
+		if filter.match(entry) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// Handler serves the most recent entries, filtered by the app, operation
+// and user query parameters and limited by limit, 100 by default
+func (a *Auditor) Handler() http.Handler {
+	return handler(func(w http.ResponseWriter, r *http.Request) error {
+		query := r.URL.Query()
+		limit := defaultAuditQueryLimit
+		if value := query.Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				return httpError{Status: http.StatusBadRequest, Body: fmt.Sprintf("invalid limit %q", value)}
+			}
+		}
+		entries := a.Entries(AuditFilter{
+			App:       query.Get("app"),
+			Operation: query.Get("operation"),
+			User:      query.Get("user"),
+		}, limit)
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(struct {
+			Entries []AuditEntry `json:"entries"`
+		}{Entries: entries})
+	})
+}
+
+// audited records the requests served by h as operation on the Auditor
+func (a *RouterAPI) audited(operation string, h handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if a.Auditor == nil {
+			return h(w, r)
+		}
+		start := time.Now()
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return httpError{Status: http.StatusBadRequest, Body: err.Error()}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		vars := mux.Vars(r)
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+		entry := AuditEntry{
+			Time:       start.UTC(),
+			RequestID:  r.Header.Get("X-Request-ID"),
+			User:       callerFromContext(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Operation:  operation,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Mode:       vars["mode"],
+			Cluster:    r.Header.Get("X-Tsuru-Cluster-Name"),
+			App:        vars["name"],
+			Instance:   r.Header.Get("X-Router-Instance"),
+			DryRun:     dryRun,
+			Body:       redactBody(body),
+			Status:     http.StatusOK,
+			Result:     auditResultSuccess,
+		}
+		err = h(w, r)
+		if err != nil {
+			routerErr, status := errorResponse(err)
+			entry.Status = status
+			entry.Result = string(routerErr.Code)
+			entry.Error = routerErr.Message
+		}
+		entry.Duration = time.Since(start).Seconds()
+		a.Auditor.Record(r.Context(), entry)
+		return err
+	}
+}
+
+// redactBody returns body with the redactedFields replaced, bodies which
+// are not JSON objects are left out
+func redactBody(body []byte) json.RawMessage {
+	var fields map[string]interface{}
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil
+	}
+	for _, field := range redactedFields {
+		if value, ok := fields[field]; ok && value != "" {
+			fields[field] = redactedValue
+		}
+	}
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// AuditWriterSink writes the entries to W as JSON lines
+type AuditWriterSink struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+// NewAuditFileSink returns a sink appending the entries to the file in
+// path, created when missing
+func NewAuditFileSink(path string) (*AuditWriterSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditWriterSink{W: file}, nil
+}
+
+func (s *AuditWriterSink) Write(ctx context.Context, entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.W.Write(append(data, '\n'))
+	return err
+}
+
+// AuditWebhookSink posts each entry as JSON to URL. Entries are posted in
+// background, in order, and dropped when the queue is full.
+type AuditWebhookSink struct {
+	URL    string
+	Client *http.Client
+
+	queue chan AuditEntry
+}
+
+// NewAuditWebhookSink returns a sink posting the entries to url
+func NewAuditWebhookSink(url string) *AuditWebhookSink {
+	s := &AuditWebhookSink{
+		URL:    url,
+		Client: &http.Client{Timeout: auditWebhookTimeout},
+		queue:  make(chan AuditEntry, defaultAuditWebhookQueue),
+	}
+	go s.run()
+	return s
+}
+
+func (s *AuditWebhookSink) Write(ctx context.Context, entry AuditEntry) error {
+	select {
+	case s.queue <- entry:
+		return nil
+	default:
+		return fmt.Errorf("webhook queue is full, entry of request %q dropped", entry.RequestID)
+	}
+}
+
+func (s *AuditWebhookSink) run() {
+	for entry := range s.queue {
+		err := s.post(entry)
+		if err != nil {
+			slog.Error("Failed to post audit entry", "url", s.URL, observability.LogKeyRequestID, entry.RequestID, "error", err)
+		}
+	}
+}
+
+func (s *AuditWebhookSink) post(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	rsp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	_, _ = io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", rsp.StatusCode)
+	}
+	return nil
+}
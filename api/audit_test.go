@@ -0,0 +1,219 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/backend"
+	"github.com/tsuru/kubernetes-router/router"
+	"github.com/tsuru/kubernetes-router/router/mock"
+	"github.com/urfave/negroni"
+)
+
+type recordingSink struct {
+	entries []AuditEntry
+}
+
+func (s *recordingSink) Write(ctx context.Context, entry AuditEntry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func auditedAPI(routerMock *mock.RouterMock, sink AuditSink) (*RouterAPI, http.Handler) {
+	api := &RouterAPI{
+		Backend: &backend.LocalCluster{
+			DefaultMode: "mymode",
+			Routers: map[string]router.Router{
+				"mymode": routerMock,
+			},
+		},
+		Auditor: &Auditor{Sinks: []AuditSink{sink}},
+	}
+	auth := AuthMiddleware{User: "tsuru", Pass: "secret"}
+	return api, negroni.New(auth, negroni.Wrap(api.Routes()))
+}
+
+func TestAuditEnsure(t *testing.T) {
+	sink := &recordingSink{}
+	_, h := auditedAPI(&mock.RouterMock{
+		EnsureFn: func(router.InstanceID, router.EnsureBackendOpts) error { return nil },
+	}, sink)
+
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/mymode/backend/myapp", strings.NewReader(`{"cnames":["myapp.io"]}`))
+	req.SetBasicAuth("tsuru", "secret")
+	req.Header.Set("X-Request-ID", "req-1")
+	req.Header.Set("X-Router-Instance", "blue")
+	req.Header.Set("X-Tsuru-Cluster-Name", "c1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	require.Len(t, sink.entries, 1)
+	entry := sink.entries[0]
+	assert.Equal(t, "req-1", entry.RequestID)
+	assert.Equal(t, "tsuru", entry.User)
+	assert.Equal(t, "ensure", entry.Operation)
+	assert.Equal(t, http.MethodPut, entry.Method)
+	assert.Equal(t, "mymode", entry.Mode)
+	assert.Equal(t, "c1", entry.Cluster)
+	assert.Equal(t, "myapp", entry.App)
+	assert.Equal(t, "blue", entry.Instance)
+	assert.JSONEq(t, `{"cnames":["myapp.io"]}`, string(entry.Body))
+	assert.Equal(t, http.StatusOK, entry.Status)
+	assert.Equal(t, "success", entry.Result)
+	assert.Empty(t, entry.Error)
+}
+
+func TestAuditAddCertificateRedactsKey(t *testing.T) {
+	sink := &recordingSink{}
+	var received router.CertData
+	_, h := auditedAPI(&mock.RouterMock{
+		AddCertificateFn: func(id router.InstanceID, certName string, cert router.CertData) error {
+			received = cert
+			return nil
+		},
+	}, sink)
+
+	req := httptest.NewRequest(http.MethodPut, "http://localhost/api/backend/myapp/certificate/myapp.io", strings.NewReader(`{"certificate":"Certz","key":"keyz"}`))
+	req.SetBasicAuth("tsuru", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the router still gets the key
+	assert.Equal(t, router.CertData{Certificate: "Certz", Key: "keyz"}, received)
+	require.Len(t, sink.entries, 1)
+	assert.Equal(t, "cert_add", sink.entries[0].Operation)
+	assert.JSONEq(t, `{"certificate":"Certz","key":"REDACTED"}`, string(sink.entries[0].Body))
+}
+
+func TestAuditFailure(t *testing.T) {
+	sink := &recordingSink{}
+	_, h := auditedAPI(&mock.RouterMock{
+		RemoveFn: func(router.InstanceID) error {
+			return router.NewError(router.ErrorCodeForbidden, errors.New("services is forbidden"))
+		},
+	}, sink)
+
+	req := httptest.NewRequest(http.MethodDelete, "http://localhost/api/backend/myapp", nil)
+	req.SetBasicAuth("tsuru", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	require.Len(t, sink.entries, 1)
+	entry := sink.entries[0]
+	assert.Equal(t, "remove", entry.Operation)
+	assert.Nil(t, entry.Body)
+	assert.Equal(t, http.StatusForbidden, entry.Status)
+	assert.Equal(t, "forbidden", entry.Result)
+	assert.Equal(t, "services is forbidden", entry.Error)
+}
+
+func TestAuditSkipsReads(t *testing.T) {
+	sink := &recordingSink{}
+	_, h := auditedAPI(&mock.RouterMock{
+		GetAddressesFn: func(router.InstanceID) ([]string, error) { return []string{"myapp.io"}, nil },
+	}, sink)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/api/backend/myapp", nil)
+	req.SetBasicAuth("tsuru", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, sink.entries)
+}
+
+func TestAuditorEntries(t *testing.T) {
+	auditor := &Auditor{Recent: 3}
+	for _, entry := range []AuditEntry{
+		{App: "app1", Operation: "ensure", RequestID: "1"},
+		{App: "app2", Operation: "ensure", RequestID: "2"},
+		{App: "app1", Operation: "cert_add", RequestID: "3"},
+		{App: "app1", Operation: "ensure", RequestID: "4"},
+	} {
+		auditor.Record(context.Background(), entry)
+	}
+	requestIDs := func(entries []AuditEntry) []string {
+		ids := []string{}
+		for _, entry := range entries {
+			ids = append(ids, entry.RequestID)
+		}
+		return ids
+	}
+	// only the 3 most recent are kept, the newest first
+	assert.Equal(t, []string{"4", "3", "2"}, requestIDs(auditor.Entries(AuditFilter{}, 10)))
+	assert.Equal(t, []string{"4", "3"}, requestIDs(auditor.Entries(AuditFilter{}, 2)))
+	assert.Equal(t, []string{"4", "3"}, requestIDs(auditor.Entries(AuditFilter{App: "app1"}, 10)))
+	assert.Equal(t, []string{"4", "2"}, requestIDs(auditor.Entries(AuditFilter{Operation: "ensure"}, 10)))
+}
+
+func TestAuditorHandler(t *testing.T) {
+	auditor := &Auditor{}
+	auditor.Record(context.Background(), AuditEntry{App: "app1", Operation: "ensure", Result: "success"})
+	auditor.Record(context.Background(), AuditEntry{App: "app2", Operation: "remove", Result: "success"})
+
+	w := httptest.NewRecorder()
+	auditor.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/admin/audit?app=app2", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var rsp struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rsp))
+	require.Len(t, rsp.Entries, 1)
+	assert.Equal(t, "remove", rsp.Entries[0].Operation)
+
+	w = httptest.NewRecorder()
+	auditor.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/admin/audit?limit=none", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAuditWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &AuditWriterSink{W: &buf}
+	require.NoError(t, sink.Write(context.Background(), AuditEntry{App: "app1", Operation: "ensure"}))
+	require.NoError(t, sink.Write(context.Background(), AuditEntry{App: "app2", Operation: "remove"}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var entry AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "app2", entry.App)
+	assert.Equal(t, "remove", entry.Operation)
+}
+
+func TestAuditWebhookSink(t *testing.T) {
+	received := make(chan AuditEntry, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry AuditEntry
+		body, _ := io.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(body, &entry))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		received <- entry
+	}))
+	defer server.Close()
+
+	sink := NewAuditWebhookSink(server.URL)
+	require.NoError(t, sink.Write(context.Background(), AuditEntry{App: "app1", Operation: "swap"}))
+	select {
+	case entry := <-received:
+		assert.Equal(t, "app1", entry.App)
+		assert.Equal(t, "swap", entry.Operation)
+	case <-time.After(5 * time.Second):
+		t.Fatal("entry not posted")
+	}
+}
@@ -5,7 +5,9 @@
 package api
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"log/slog"
 	"net/http"
 
 	"github.com/tsuru/kubernetes-router/router"
@@ -14,12 +16,37 @@ import (
 type httpError struct {
 	Body   string
 	Status int
+	Code   router.ErrorCode
 }
 
 func (h httpError) Error() string {
 	return h.Body
 }
 
+// statusCodes are the default codes of the errors created by the API
+var statusCodes = map[int]router.ErrorCode{
+	http.StatusBadRequest:          router.ErrorCodeBadRequest,
+	http.StatusNotFound:            router.ErrorCodeNotFound,
+	http.StatusUnprocessableEntity: router.ErrorCodeInvalid,
+}
+
+// codeStatuses are the statuses of the responses of each error code
+var codeStatuses = map[router.ErrorCode]int{
+	router.ErrorCodeInternal:            http.StatusInternalServerError,
+	router.ErrorCodeBadRequest:          http.StatusBadRequest,
+	router.ErrorCodeInvalid:             http.StatusUnprocessableEntity,
+	router.ErrorCodeNotFound:            http.StatusNotFound,
+	router.ErrorCodeNotSupported:        http.StatusNotFound,
+	router.ErrorCodeServiceNotFound:     http.StatusNotFound,
+	router.ErrorCodeNoBackendTarget:     http.StatusUnprocessableEntity,
+	router.ErrorCodeCertificateNotFound: http.StatusNotFound,
+	router.ErrorCodeAlreadyExists:       http.StatusConflict,
+	router.ErrorCodeConflict:            http.StatusConflict,
+	router.ErrorCodeForbidden:           http.StatusForbidden,
+	router.ErrorCodeUnavailable:         http.StatusServiceUnavailable,
+	router.ErrorCodeLocked:              http.StatusLocked,
+}
+
 type handler func(http.ResponseWriter, *http.Request) error
 
 // ServeHTTP serves an HTTP request
@@ -27,19 +54,40 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handleError(h(w, r), w, r)
 }
 
+// handleError writes err as a JSON body with its code, message and details
 func handleError(err error, w http.ResponseWriter, r *http.Request) {
+	if err == nil {
+		return
+	}
+	slog.WarnContext(r.Context(), "Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	routerErr, status := errorResponse(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(routerErr)
 	if err != nil {
-		log.Printf("error during request %v %v: %v", r.Method, r.URL.Path, err)
-		if httpErr, ok := err.(httpError); ok {
-			http.Error(w, httpErr.Error(), httpErr.Status)
-			return
+		slog.ErrorContext(r.Context(), "Failed to write error response", "error", err)
+	}
+}
+
+// errorResponse returns the body and the status of the response to err
+func errorResponse(err error) (*router.Error, int) {
+	if httpErr, ok := err.(httpError); ok {
+		code := httpErr.Code
+		if code == "" {
+			code = statusCodes[httpErr.Status]
 		}
-		if err == router.ErrIngressAlreadyExists {
-			http.Error(w, err.Error(), http.StatusConflict)
-			return
+		if code == "" {
+			code = router.ErrorCodeInternal
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return &router.Error{Code: code, Message: httpErr.Body}, httpErr.Status
+	}
+	routerErr := router.AsError(err)
+	status := http.StatusInternalServerError
+	if codeStatus, ok := codeStatuses[routerErr.Code]; ok {
+		status = codeStatus
 	}
+	return routerErr, status
 }
 
 // AuthMiddleware is an http.Handler with Basic Auth
@@ -61,5 +109,14 @@ func (h AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next h
 		http.Error(w, "Not Authorized", http.StatusUnauthorized)
 		return
 	}
-	next(w, r)
+	next(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, rUser)))
+}
+
+type callerKey struct{}
+
+// callerFromContext returns the user authenticated by AuthMiddleware, empty
+// when the authentication is disabled
+func callerFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(callerKey{}).(string)
+	return user
 }
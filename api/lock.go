@@ -0,0 +1,336 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultLeaseRetry    = 500 * time.Millisecond
+	leaseReleaseTimeout  = 10 * time.Second
+
+	leaseKeyAnnotation = "router.tsuru.io/lock-key"
+)
+
+var errLeaseNotHeld = errors.New("lease is held by another replica")
+
+// Locker serializes the operations sharing a key
+type Locker interface {
+	// Lock waits until the lock of key is acquired or ctx is done,
+	// returning the function releasing it. lost, when not nil, is called
+	// if the lock is lost before being released, the operation holding
+	// it must then stop.
+	Lock(ctx context.Context, key string, lost func()) (func(), error)
+}
+
+var (
+	_ Locker = &LocalLocker{}
+	_ Locker = &LeaseLocker{}
+)
+
+// LocalLocker is a Locker serializing the operations of a single router
+// replica, its zero value is ready to use
+type LocalLocker struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+// Lock waits until the lock of key is acquired or ctx is done, local locks
+// are never lost
+func (l *LocalLocker) Lock(ctx context.Context, key string, lost func()) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &keyLock{held: make(chan struct{}, 1)}
+		l.locks[key] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+	case <-ctx.Done():
+		l.done(key, lock)
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-lock.held
+			l.done(key, lock)
+		})
+	}, nil
+}
+
+// done drops the lock of key once nobody holds or waits for it
+func (l *LocalLocker) done(key string, lock *keyLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.waiters--
+	if lock.waiters == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// LeaseLocker is a Locker serializing the operations of every router
+// replica with a Kubernetes Lease for each key. A Lease is held while
+// renewed by its holder, Leases of replicas gone are taken over once
+// LeaseDuration has passed since their last renewal.
+type LeaseLocker struct {
+	Client    kubernetes.Interface
+	Namespace string
+
+	// Identity is the holder of the Leases acquired by the replica,
+	// defaults to the hostname with a random suffix
+	Identity string
+
+	// LeaseDuration is the time a Lease is held without being renewed
+	LeaseDuration time.Duration
+
+	// RetryPeriod is the interval between the attempts to acquire a
+	// Lease held by another replica
+	RetryPeriod time.Duration
+
+	local        LocalLocker
+	identityOnce sync.Once
+}
+
+// Lock waits until the Lease of key is acquired or ctx is done. The Lease
+// is lost when taken by another replica or when it expires before being
+// renewed.
+func (l *LeaseLocker) Lock(ctx context.Context, key string, lost func()) (func(), error) {
+	// operations of the same replica wait for each other locally, only
+	// one of them polls the Lease
+	unlock, err := l.local.Lock(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	name := leaseName(key)
+	for {
+		var acquired bool
+		acquired, err = l.tryAcquire(ctx, name, key)
+		if err != nil || acquired {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(l.retryPeriod()):
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go l.renew(name, lost, stop, stopped)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+			l.release(name)
+			unlock()
+		})
+	}, nil
+}
+
+// tryAcquire takes the Lease when it is free or expired, returning false
+// when it is held by another replica
+func (l *LeaseLocker) tryAcquire(ctx context.Context, name, key string) (bool, error) {
+	leases := l.Client.CoordinationV1().Leases(l.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   l.Namespace,
+				Annotations: map[string]string{leaseKeyAnnotation: key},
+			},
+		}
+		l.hold(lease, now)
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		if k8sErrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if isLeaseHeld(lease, now.Time) {
+		return false, nil
+	}
+	l.hold(lease, now)
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if k8sErrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *LeaseLocker) hold(lease *coordinationv1.Lease, now metav1.MicroTime) {
+	identity := l.identity()
+	duration := int32(l.leaseDuration().Seconds())
+	transitions := int32(0)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions = *lease.Spec.LeaseTransitions + 1
+	}
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseTransitions = &transitions
+}
+
+// renew keeps the Lease held until stop is closed, calling lost and giving
+// up once the Lease is held by another replica or expires before the next
+// renewal
+func (l *LeaseLocker) renew(name string, lost func(), stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	interval := l.leaseDuration() / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		err := l.renewHeld(name, now)
+		if err == nil {
+			renewed = now
+			continue
+		}
+		if err != errLeaseNotHeld && time.Since(renewed)+interval < l.leaseDuration() {
+			slog.Warn("Failed to renew lease", "namespace", l.Namespace, "lease", name, "error", err)
+			continue
+		}
+		slog.Error("Lost lease, stopping the operation holding it", "namespace", l.Namespace, "lease", name, "error", err)
+		if lost != nil {
+			lost()
+		}
+		return
+	}
+}
+
+func (l *LeaseLocker) renewHeld(name string, now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+	defer cancel()
+	lease, err := l.getHeld(ctx, name)
+	if err != nil {
+		return err
+	}
+	renewTime := metav1.NewMicroTime(now)
+	lease.Spec.RenewTime = &renewTime
+	_, err = l.Client.CoordinationV1().Leases(l.Namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// release frees the Lease for the other replicas, deleting it only if
+// unchanged since read as held by the replica
+func (l *LeaseLocker) release(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+	defer cancel()
+	lease, err := l.getHeld(ctx, name)
+	if err == nil {
+		err = l.Client.CoordinationV1().Leases(l.Namespace).Delete(ctx, name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+	}
+	if err != nil {
+		slog.Warn("Failed to release lease", "namespace", l.Namespace, "lease", name, "error", err)
+	}
+}
+
+// getHeld returns the Lease, failing with errLeaseNotHeld when it is not
+// held by the replica
+func (l *LeaseLocker) getHeld(ctx context.Context, name string) (*coordinationv1.Lease, error) {
+	lease, err := l.Client.CoordinationV1().Leases(l.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return nil, errLeaseNotHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity() {
+		return nil, errLeaseNotHeld
+	}
+	return lease, nil
+}
+
+func (l *LeaseLocker) identity() string {
+	l.identityOnce.Do(func() {
+		if l.Identity != "" {
+			return
+		}
+		hostname, _ := os.Hostname()
+		suffix := make([]byte, 4)
+		_, _ = rand.Read(suffix)
+		l.Identity = hostname + "_" + hex.EncodeToString(suffix)
+	})
+	return l.Identity
+}
+
+func (l *LeaseLocker) leaseDuration() time.Duration {
+	if l.LeaseDuration > 0 {
+		return l.LeaseDuration
+	}
+	return defaultLeaseDuration
+}
+
+func (l *LeaseLocker) retryPeriod() time.Duration {
+	if l.RetryPeriod > 0 {
+		return l.RetryPeriod
+	}
+	return defaultLeaseRetry
+}
+
+// isLeaseHeld returns whether lease has a holder renewing it
+func isLeaseHeld(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return now.Before(expiry)
+}
+
+// leaseName returns a valid name for the Lease of key, which may hold any
+// character
+func leaseName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "kubernetes-router-lock-" + hex.EncodeToString(sum[:10])
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLocalLocker(t *testing.T) {
+	locker := &LocalLocker{}
+	unlock, err := locker.Lock(context.Background(), "myapp", nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(ctx, "myapp", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	otherUnlock, err := locker.Lock(context.Background(), "otherapp", nil)
+	require.NoError(t, err)
+	otherUnlock()
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := locker.Lock(context.Background(), "myapp", nil)
+		assert.NoError(t, err)
+		close(acquired)
+		unlock()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+	assert.Empty(t, locker.locks)
+}
+
+func TestLeaseLocker(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	replica1 := &LeaseLocker{Client: client, Namespace: "tsuru", Identity: "replica1", RetryPeriod: 10 * time.Millisecond}
+	replica2 := &LeaseLocker{Client: client, Namespace: "tsuru", Identity: "replica2", RetryPeriod: 10 * time.Millisecond}
+
+	unlock, err := replica1.Lock(context.Background(), "myapp", nil)
+	require.NoError(t, err)
+	lease, err := client.CoordinationV1().Leases("tsuru").Get(context.Background(), leaseName("myapp"), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "replica1", *lease.Spec.HolderIdentity)
+	assert.Equal(t, "myapp", lease.Annotations[leaseKeyAnnotation])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = replica2.Lock(ctx, "myapp", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	unlock()
+	_, err = client.CoordinationV1().Leases("tsuru").Get(context.Background(), leaseName("myapp"), metav1.GetOptions{})
+	assert.True(t, k8sErrors.IsNotFound(err))
+
+	unlock, err = replica2.Lock(context.Background(), "myapp", nil)
+	require.NoError(t, err)
+	defer unlock()
+	lease, err = client.CoordinationV1().Leases("tsuru").Get(context.Background(), leaseName("myapp"), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "replica2", *lease.Spec.HolderIdentity)
+}
+
+func TestLeaseLockerLostLease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	locker := &LeaseLocker{Client: client, Namespace: "tsuru", Identity: "replica1", LeaseDuration: 300 * time.Millisecond}
+	lost := make(chan struct{})
+	unlock, err := locker.Lock(context.Background(), "myapp", func() { close(lost) })
+	require.NoError(t, err)
+
+	// another replica takes the Lease, the operation holding it is stopped
+	leases := client.CoordinationV1().Leases("tsuru")
+	lease, err := leases.Get(context.Background(), leaseName("myapp"), metav1.GetOptions{})
+	require.NoError(t, err)
+	holder := "replica2"
+	lease.Spec.HolderIdentity = &holder
+	_, err = leases.Update(context.Background(), lease, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lost lease not reported")
+	}
+
+	// the Lease of the other replica is not released
+	unlock()
+	lease, err = leases.Get(context.Background(), leaseName("myapp"), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "replica2", *lease.Spec.HolderIdentity)
+}
+
+func TestLeaseLockerTakesOverExpiredLeases(t *testing.T) {
+	holder := "gone"
+	duration := int32(15)
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	client := fake.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: leaseName("myapp"), Namespace: "tsuru"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renewed,
+		},
+	})
+	locker := &LeaseLocker{Client: client, Namespace: "tsuru", Identity: "replica1"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlock, err := locker.Lock(ctx, "myapp", nil)
+	require.NoError(t, err)
+	defer unlock()
+	lease, err := client.CoordinationV1().Leases("tsuru").Get(context.Background(), leaseName("myapp"), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "replica1", *lease.Spec.HolderIdentity)
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/kubernetes-router/kubernetes"
+	"github.com/tsuru/kubernetes-router/router"
+	tsuruv1clientset "github.com/tsuru/tsuru/provision/kubernetes/pkg/client/clientset/versioned"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/client-go/dynamic"
+	kubernetesGO "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	defaultClusterCacheTTL  = 10 * time.Minute
+	defaultClusterCacheSize = 100
+
+	// evictedEventsGrace is the time requests still using an evicted entry
+	// have to record their events before its recorder is stopped
+	evictedEventsGrace = time.Minute
+)
+
+var (
+	clusterCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubernetes_router_cluster_cache_requests_total",
+		Help: "The number of lookups on the cache of cluster clients by result.",
+	}, []string{"result"})
+
+	clusterCacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubernetes_router_cluster_cache_evictions_total",
+		Help: "The number of cluster clients evicted from the cache by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(clusterCacheRequests, clusterCacheEvictions)
+}
+
+// clusterCacheKey identifies the clients of a cluster, a token rotation
+// results in a new key
+type clusterCacheKey struct {
+	name    string
+	address string
+	token   string
+}
+
+type clusterCacheEntry struct {
+	cluster  ClusterConfig
+	base     *kubernetes.BaseService
+	created  time.Time
+	lastUsed time.Time
+
+	mu      sync.Mutex
+	routers map[string]router.Router
+}
+
+// clusterCache keeps the BaseService, and so the clientsets and their
+// connections, of the clusters used by MultiCluster between requests.
+// Entries expire after ttl and the least recently used entry is evicted
+// when the cache is full.
+type clusterCache struct {
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[clusterCacheKey]*clusterCacheEntry
+}
+
+func newClusterCache(ttl time.Duration, maxSize int) *clusterCache {
+	if ttl <= 0 {
+		ttl = defaultClusterCacheTTL
+	}
+	if maxSize <= 0 {
+		maxSize = defaultClusterCacheSize
+	}
+	return &clusterCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+		entries: map[clusterCacheKey]*clusterCacheEntry{},
+	}
+}
+
+// get returns the cached entry of the cluster requested by name, creating
+// the clients from config on a miss
+func (c *clusterCache) get(name string, cluster ClusterConfig, config *rest.Config, namespace string) (*clusterCacheEntry, error) {
+	key := clusterCacheKey{name: name, address: config.Host, token: config.BearerToken}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && now.Sub(entry.created) > c.ttl {
+		c.evict(key, "expired")
+		ok = false
+	}
+	if ok && !reflect.DeepEqual(entry.cluster, cluster) {
+		c.evict(key, "changed")
+		ok = false
+	}
+	if ok {
+		clusterCacheRequests.WithLabelValues("hit").Inc()
+		entry.lastUsed = now
+		return entry, nil
+	}
+	clusterCacheRequests.WithLabelValues("miss").Inc()
+
+	// the clients of a previous token are no longer valid
+	for other := range c.entries {
+		if other.name == key.name && other.address == key.address {
+			c.evict(other, "token")
+		}
+	}
+	base, err := newBaseService(config, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for len(c.entries) >= c.maxSize {
+		c.evictLeastRecentlyUsed()
+	}
+	entry = &clusterCacheEntry{
+		cluster:  cluster,
+		base:     base,
+		created:  now,
+		lastUsed: now,
+		routers:  map[string]router.Router{},
+	}
+	c.entries[key] = entry
+	return entry, nil
+}
+
+func (c *clusterCache) evict(key clusterCacheKey, reason string) {
+	if entry, ok := c.entries[key]; ok {
+		time.AfterFunc(evictedEventsGrace, entry.base.CloseEvents)
+	}
+	delete(c.entries, key)
+	clusterCacheEvictions.WithLabelValues(reason).Inc()
+}
+
+func (c *clusterCache) evictLeastRecentlyUsed() {
+	var oldest clusterCacheKey
+	var oldestUsed time.Time
+	for key, entry := range c.entries {
+		if oldestUsed.IsZero() || entry.lastUsed.Before(oldestUsed) {
+			oldest, oldestUsed = key, entry.lastUsed
+		}
+	}
+	c.evict(oldest, "size")
+}
+
+// router returns the router of the entry for the mode, created by build on
+// the first use
+func (e *clusterCacheEntry) router(mode string, build func(*kubernetes.BaseService) (router.Router, error)) (router.Router, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if rt, ok := e.routers[mode]; ok {
+		return rt, nil
+	}
+	rt, err := build(e.base)
+	if err != nil {
+		return nil, err
+	}
+	e.routers[mode] = rt
+	return rt, nil
+}
+
+// newBaseService creates every client of the BaseService upfront, so the
+// service can be shared by concurrent requests
+func newBaseService(config *rest.Config, namespace string) (*kubernetes.BaseService, error) {
+	client, err := kubernetesGO.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	tsuruClient, err := tsuruv1clientset.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	extensionsClient, err := apiextensionsclientset.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kubernetes.BaseService{
+		Namespace:        namespace,
+		Timeout:          config.Timeout,
+		RestConfig:       config,
+		Client:           client,
+		DynamicClient:    dynamicClient,
+		TsuruClient:      tsuruClient,
+		ExtensionsClient: extensionsClient,
+	}, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/kubernetes"
+	"github.com/tsuru/kubernetes-router/router"
+	"k8s.io/client-go/rest"
+)
+
+func TestMultiClusterReusesClients(t *testing.T) {
+	backend := &MultiCluster{
+		Namespace: "tsuru-test",
+		Fallback:  &fakeBackend{},
+		Clusters:  []ClusterConfig{{Name: "my-cluster", Token: "my-token"}},
+	}
+	headers := http.Header{
+		"X-Tsuru-Cluster-Name":      {"my-cluster"},
+		"X-Tsuru-Cluster-Addresses": {"https://mycluster.com"},
+	}
+	hits := testutil.ToFloat64(clusterCacheRequests.WithLabelValues("hit"))
+	first, err := backend.Router(ctx, "service", headers)
+	require.NoError(t, err)
+	second, err := backend.Router(ctx, "service", headers)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Equal(t, hits+1, testutil.ToFloat64(clusterCacheRequests.WithLabelValues("hit")))
+
+	ingress, err := backend.Router(ctx, "ingress", headers)
+	require.NoError(t, err)
+	assert.Same(t, router.Unwrap(first).(*kubernetes.LBService).BaseService, router.Unwrap(ingress).(*kubernetes.IngressService).BaseService)
+
+	backend.Clusters = []ClusterConfig{{Name: "my-cluster", Token: "new-token"}}
+	third, err := backend.Router(ctx, "service", headers)
+	require.NoError(t, err)
+	assert.NotSame(t, first, third)
+	assert.Equal(t, "new-token", router.Unwrap(third).(*kubernetes.LBService).BaseService.RestConfig.BearerToken)
+	assert.Len(t, backend.cache.entries, 1)
+}
+
+func TestClusterCacheExpiresAndEvicts(t *testing.T) {
+	now := time.Now()
+	cache := newClusterCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+	config := func(host string) *rest.Config {
+		return &rest.Config{Host: host, BearerToken: "my-token"}
+	}
+
+	c1, err := cache.get("c1", ClusterConfig{Name: "c1"}, config("https://c1.com"), "tsuru")
+	require.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	cached, err := cache.get("c1", ClusterConfig{Name: "c1"}, config("https://c1.com"), "tsuru")
+	require.NoError(t, err)
+	assert.Same(t, c1, cached)
+
+	now = now.Add(31 * time.Second)
+	expired, err := cache.get("c1", ClusterConfig{Name: "c1"}, config("https://c1.com"), "tsuru")
+	require.NoError(t, err)
+	assert.NotSame(t, c1, expired)
+
+	now = now.Add(time.Second)
+	_, err = cache.get("c2", ClusterConfig{Name: "c2"}, config("https://c2.com"), "tsuru")
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	_, err = cache.get("c3", ClusterConfig{Name: "c3"}, config("https://c3.com"), "tsuru")
+	require.NoError(t, err)
+	assert.Len(t, cache.entries, 2)
+	assert.NotContains(t, cache.entries, clusterCacheKey{name: "c1", address: "https://c1.com", token: "my-token"})
+}
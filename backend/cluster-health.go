@@ -0,0 +1,286 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const defaultHealthcheckTimeout = 5 * time.Second
+
+// HealthReporter is implemented by the backends able to detail the health
+// of each cluster they route to
+type HealthReporter interface {
+	HealthReport(ctx context.Context) HealthReport
+}
+
+// HealthReport is the result of the health check of a backend, it is
+// healthy when the fallback and every critical cluster are healthy
+type HealthReport struct {
+	Healthy  bool            `json:"healthy"`
+	Fallback string          `json:"fallback,omitempty"`
+	Clusters []ClusterHealth `json:"clusters"`
+}
+
+// ClusterHealth is the result of the health check of a cluster
+type ClusterHealth struct {
+	Name     string   `json:"name"`
+	Address  string   `json:"address,omitempty"`
+	Critical bool     `json:"critical"`
+	Healthy  bool     `json:"healthy"`
+	Skipped  string   `json:"skipped,omitempty"`
+	Duration string   `json:"duration"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Error summarizes the failures of the report
+func (r HealthReport) Error() string {
+	var failures []string
+	if r.Fallback != "" {
+		failures = append(failures, r.Fallback)
+	}
+	for _, cluster := range r.Clusters {
+		if cluster.Healthy {
+			continue
+		}
+		failure := fmt.Sprintf("cluster %s: %s", cluster.Name, strings.Join(cluster.Errors, ", "))
+		if !cluster.Critical {
+			failure += " (non critical)"
+		}
+		failures = append(failures, failure)
+	}
+	return strings.Join(failures, " - ")
+}
+
+type resourcePermission struct {
+	namespace string
+	group     string
+	resource  string
+	verbs     []string
+
+	// gateway permissions are needed on the namespace of the gateway of
+	// the mode, when one is configured
+	gateway bool
+	// legacyGroup is checked instead of group on the clusters not serving
+	// the v1 version of the resource
+	legacyGroup string
+}
+
+var (
+	managedVerbs = []string{"get", "list", "create", "update", "patch", "delete"}
+
+	// eventsPermission is needed by every mode, to record events and read
+	// them on the status of the backends
+	eventsPermission = resourcePermission{resource: "events", verbs: []string{"get", "list", "create", "patch"}}
+
+	// modePermissions are the permissions needed on the namespace of the
+	// router by each mode
+	modePermissions = map[string][]resourcePermission{
+		"service": {
+			{resource: "services", verbs: managedVerbs},
+			eventsPermission,
+		},
+		"ingress": {
+			{resource: "services", verbs: []string{"get", "list"}},
+			{resource: "endpoints", verbs: []string{"get"}},
+			{resource: "secrets", verbs: managedVerbs},
+			{group: "networking.k8s.io", resource: "ingresses", verbs: managedVerbs, legacyGroup: "extensions"},
+			eventsPermission,
+		},
+		"istio-gateway": {
+			{resource: "services", verbs: []string{"get", "list"}},
+			{resource: "endpoints", verbs: []string{"get"}},
+			{resource: "secrets", verbs: managedVerbs, gateway: true},
+			{resource: "pods", verbs: []string{"list"}, gateway: true},
+			{group: "networking.istio.io", resource: "gateways", verbs: managedVerbs},
+			{group: "networking.istio.io", resource: "virtualservices", verbs: managedVerbs},
+			eventsPermission,
+		},
+		"gateway-api": {
+			{resource: "services", verbs: []string{"get", "list"}},
+			{resource: "secrets", verbs: managedVerbs, gateway: true},
+			{group: "gateway.networking.k8s.io", resource: "httproutes", verbs: managedVerbs},
+			eventsPermission,
+		},
+	}
+
+	modeAliases = map[string]string{
+		"":              "service",
+		"loadbalancer":  "service",
+		"ingress-nginx": "ingress",
+		"nginx-ingress": "ingress",
+	}
+)
+
+// HealthReport probes every cluster in parallel, listing the services on
+// Namespace and checking the permissions needed by the enabled modes.
+// Clusters without address are probed on the address last sent by tsuru
+// for them, they are skipped until the first request.
+func (m *MultiCluster) HealthReport(ctx context.Context) HealthReport {
+	timeout := m.HealthcheckTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthcheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	clusters := m.clusters()
+	report := HealthReport{Clusters: make([]ClusterHealth, len(clusters))}
+	var wg sync.WaitGroup
+	for i := range clusters {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			report.Clusters[i] = m.checkCluster(ctx, clusters[i], timeout)
+		}(i)
+	}
+	if err := m.Fallback.Healthcheck(ctx); err != nil {
+		report.Fallback = err.Error()
+	}
+	wg.Wait()
+
+	report.Healthy = report.Fallback == ""
+	for _, cluster := range report.Clusters {
+		if cluster.Critical && !cluster.Healthy {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+func (m *MultiCluster) checkCluster(ctx context.Context, cluster ClusterConfig, timeout time.Duration) ClusterHealth {
+	start := time.Now()
+	config := restConfig(cluster, m.requestedAddress(cluster.Name), timeout)
+	health := ClusterHealth{
+		Name:     cluster.Name,
+		Address:  config.Host,
+		Critical: !cluster.NonCritical,
+	}
+	defer func() {
+		health.Duration = time.Since(start).String()
+	}()
+	if config.Host == "" {
+		health.Healthy = true
+		health.Skipped = "no address known"
+		return health
+	}
+	entry, err := m.clientCache().get(cluster.Name, cluster, config, m.Namespace)
+	if err != nil {
+		health.Errors = append(health.Errors, err.Error())
+		return health
+	}
+	client := entry.base.Client
+	_, err = client.CoreV1().Services(m.Namespace).List(ctx, metav1.ListOptions{Limit: 1})
+	if err != nil {
+		health.Errors = append(health.Errors, fmt.Sprintf("could not list services: %v", err))
+		return health
+	}
+	for _, permission := range m.requiredPermissions(cluster) {
+		if permission.legacyGroup != "" {
+			served, err := entry.base.ServesResource(schema.GroupVersion{Group: permission.group, Version: "v1"}, permission.resource)
+			if err != nil {
+				health.Errors = append(health.Errors, fmt.Sprintf("could not discover %s: %v", qualifiedResource(permission), err))
+				return health
+			}
+			if !served {
+				permission.group = permission.legacyGroup
+			}
+		}
+		for _, verb := range permission.verbs {
+			review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace: permission.namespace,
+						Verb:      verb,
+						Group:     permission.group,
+						Resource:  permission.resource,
+					},
+				},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				health.Errors = append(health.Errors, fmt.Sprintf("could not review access: %v", err))
+				return health
+			}
+			if !review.Status.Allowed {
+				failure := fmt.Sprintf("cannot %s %s", verb, qualifiedResource(permission))
+				if permission.namespace != m.Namespace {
+					failure += " in namespace " + permission.namespace
+				}
+				health.Errors = append(health.Errors, failure)
+			}
+		}
+	}
+	health.Healthy = len(health.Errors) == 0
+	return health
+}
+
+// requiredPermissions returns the permissions needed on cluster by the
+// enabled modes, without duplicates
+func (m *MultiCluster) requiredPermissions(cluster ClusterConfig) []resourcePermission {
+	modes := m.Modes
+	if len(modes) == 0 {
+		modes = []string{"service"}
+	}
+	type resourceKey struct{ namespace, group, resource string }
+	permissions := map[resourceKey]*resourcePermission{}
+	verbs := map[resourceKey]map[string]bool{}
+	for _, mode := range modes {
+		config := cluster.Modes[canonicalMode(mode)].merge(m.ModeDefaults[canonicalMode(mode)])
+		if alias, ok := modeAliases[mode]; ok {
+			mode = alias
+		}
+		for _, permission := range modePermissions[mode] {
+			namespace := m.Namespace
+			if permission.gateway && config.GatewayNamespace != "" {
+				namespace = config.GatewayNamespace
+			}
+			key := resourceKey{namespace: namespace, group: permission.group, resource: permission.resource}
+			if permissions[key] == nil {
+				permissions[key] = &resourcePermission{
+					namespace:   namespace,
+					group:       permission.group,
+					resource:    permission.resource,
+					legacyGroup: permission.legacyGroup,
+				}
+				verbs[key] = map[string]bool{}
+			}
+			for _, verb := range permission.verbs {
+				verbs[key][verb] = true
+			}
+		}
+	}
+	var result []resourcePermission
+	for key, permission := range permissions {
+		for _, verb := range managedVerbs {
+			if verbs[key][verb] {
+				permission.verbs = append(permission.verbs, verb)
+			}
+		}
+		result = append(result, *permission)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if qualifiedResource(result[i]) != qualifiedResource(result[j]) {
+			return qualifiedResource(result[i]) < qualifiedResource(result[j])
+		}
+		return result[i].namespace < result[j].namespace
+	})
+	return result
+}
+
+func qualifiedResource(permission resourcePermission) string {
+	if permission.group == "" {
+		return permission.resource
+	}
+	return permission.resource + "." + permission.group
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/kubernetes"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+type healthyBackend struct {
+	fakeBackend
+}
+
+func (*healthyBackend) Healthcheck(context.Context) error {
+	return nil
+}
+
+// cacheFakeClient makes the cluster use client on the health checks
+func cacheFakeClient(m *MultiCluster, cluster ClusterConfig, client *fake.Clientset) {
+	address := restConfig(cluster, m.requestedAddress(cluster.Name), 0).Host
+	key := clusterCacheKey{name: cluster.Name, address: address, token: cluster.Token}
+	m.clientCache().entries[key] = &clusterCacheEntry{
+		cluster: cluster,
+		base:    &kubernetes.BaseService{Client: client},
+		created: time.Now(),
+	}
+}
+
+func fakeAccessReviews(denied map[string]bool) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action ktesting.Action) (bool, runtime.Object, error) {
+		review := action.(ktesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = !denied[attributes.Verb+" "+attributes.Resource]
+		return true, review, nil
+	})
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "networking.k8s.io/v1",
+			APIResources: []metav1.APIResource{{Name: "ingresses", Namespaced: true, Kind: "Ingress"}},
+		},
+	}
+	return client
+}
+
+func TestMultiClusterHealthReport(t *testing.T) {
+	c1 := ClusterConfig{Name: "c1", Address: "https://c1.com", Token: "t1"}
+	c2 := ClusterConfig{Name: "c2", Address: "https://c2.com", Token: "t2", NonCritical: true}
+	c3 := ClusterConfig{Name: "c3"}
+	backend := &MultiCluster{
+		Namespace: "tsuru",
+		Fallback:  &healthyBackend{},
+		Modes:     []string{"service", "ingress"},
+		Clusters:  []ClusterConfig{c1, c2, c3},
+	}
+	cacheFakeClient(backend, c1, fakeAccessReviews(nil))
+	cacheFakeClient(backend, c2, fakeAccessReviews(map[string]bool{"delete secrets": true}))
+
+	report := backend.HealthReport(ctx)
+	assert.True(t, report.Healthy)
+	require.Len(t, report.Clusters, 3)
+	assert.Equal(t, "c1", report.Clusters[0].Name)
+	assert.True(t, report.Clusters[0].Healthy)
+	assert.True(t, report.Clusters[0].Critical)
+	assert.Equal(t, "c2", report.Clusters[1].Name)
+	assert.False(t, report.Clusters[1].Healthy)
+	assert.False(t, report.Clusters[1].Critical)
+	assert.Equal(t, []string{"cannot delete secrets"}, report.Clusters[1].Errors)
+	assert.Equal(t, "c3", report.Clusters[2].Name)
+	assert.True(t, report.Clusters[2].Healthy)
+	assert.Equal(t, "no address known", report.Clusters[2].Skipped)
+	assert.NoError(t, backend.Healthcheck(ctx))
+
+	// c3 is probed on the address sent by tsuru
+	_, err := backend.Router(ctx, "service", http.Header{
+		"X-Tsuru-Cluster-Name":      {"c3"},
+		"X-Tsuru-Cluster-Addresses": {"https://c3.com"},
+	})
+	require.NoError(t, err)
+	cacheFakeClient(backend, c3, fakeAccessReviews(map[string]bool{"create events": true}))
+	report = backend.HealthReport(ctx)
+	assert.False(t, report.Healthy)
+	assert.Equal(t, "https://c3.com", report.Clusters[2].Address)
+	assert.Empty(t, report.Clusters[2].Skipped)
+	assert.Equal(t, []string{"cannot create events"}, report.Clusters[2].Errors)
+	cacheFakeClient(backend, c3, fakeAccessReviews(nil))
+
+	cacheFakeClient(backend, c1, fakeAccessReviews(map[string]bool{"create ingresses": true}))
+	err = backend.Healthcheck(ctx)
+	require.Error(t, err)
+	assert.Equal(t, "cluster c1: cannot create ingresses.networking.k8s.io - cluster c2: cannot delete secrets (non critical)", err.Error())
+}
+
+func TestMultiClusterHealthReportListFailure(t *testing.T) {
+	c1 := ClusterConfig{Name: "c1", Address: "https://c1.com", Token: "t1"}
+	backend := &MultiCluster{
+		Namespace: "tsuru",
+		Fallback:  &healthyBackend{},
+		Clusters:  []ClusterConfig{c1},
+	}
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "services", func(ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("Unauthorized")
+	})
+	cacheFakeClient(backend, c1, client)
+
+	report := backend.HealthReport(ctx)
+	assert.False(t, report.Healthy)
+	require.Len(t, report.Clusters, 1)
+	assert.Equal(t, []string{"could not list services: Unauthorized"}, report.Clusters[0].Errors)
+}
+
+func TestMultiClusterHealthReportLegacyIngresses(t *testing.T) {
+	c1 := ClusterConfig{Name: "c1", Address: "https://c1.com", Token: "t1"}
+	backend := &MultiCluster{
+		Namespace: "tsuru",
+		Fallback:  &healthyBackend{},
+		Modes:     []string{"ingress"},
+		Clusters:  []ClusterConfig{c1},
+	}
+	client := fakeAccessReviews(map[string]bool{"create ingresses": true})
+	client.Resources = nil
+	cacheFakeClient(backend, c1, client)
+
+	report := backend.HealthReport(ctx)
+	require.Len(t, report.Clusters, 1)
+	assert.Equal(t, []string{"cannot create ingresses.extensions"}, report.Clusters[0].Errors)
+}
+
+func TestMultiClusterHealthReportGatewayNamespace(t *testing.T) {
+	c1 := ClusterConfig{Name: "c1", Address: "https://c1.com", Token: "t1"}
+	backend := &MultiCluster{
+		Namespace: "tsuru",
+		Fallback:  &healthyBackend{},
+		Modes:     []string{"istio-gateway"},
+		ModeDefaults: map[string]ModeConfig{
+			"istio-gateway": {GatewayNamespace: "istio-system"},
+		},
+		Clusters: []ClusterConfig{c1},
+	}
+	cacheFakeClient(backend, c1, fakeAccessReviews(map[string]bool{"list pods": true}))
+
+	report := backend.HealthReport(ctx)
+	require.Len(t, report.Clusters, 1)
+	assert.Equal(t, []string{"cannot list pods in namespace istio-system"}, report.Clusters[0].Errors)
+}
+
+func TestMultiClusterRequiredPermissions(t *testing.T) {
+	backend := &MultiCluster{
+		Namespace: "tsuru",
+		Modes:     []string{"loadbalancer", "istio-gateway"},
+		ModeDefaults: map[string]ModeConfig{
+			"istio-gateway": {GatewayNamespace: "istio-system"},
+		},
+	}
+	assert.Equal(t, []resourcePermission{
+		{namespace: "tsuru", resource: "endpoints", verbs: []string{"get"}},
+		{namespace: "tsuru", resource: "events", verbs: []string{"get", "list", "create", "patch"}},
+		{namespace: "tsuru", group: "networking.istio.io", resource: "gateways", verbs: managedVerbs},
+		{namespace: "istio-system", resource: "pods", verbs: []string{"list"}},
+		{namespace: "istio-system", resource: "secrets", verbs: managedVerbs},
+		{namespace: "tsuru", resource: "services", verbs: managedVerbs},
+		{namespace: "tsuru", group: "networking.istio.io", resource: "virtualservices", verbs: managedVerbs},
+	}, backend.requiredPermissions(ClusterConfig{}))
+
+	// the gateway namespace of the cluster overrides the default one
+	cluster := ClusterConfig{Modes: map[string]ModeConfig{
+		"istio-gateway": {GatewayNamespace: "gateways"},
+	}}
+	for _, permission := range backend.requiredPermissions(cluster) {
+		if permission.resource == "pods" {
+			assert.Equal(t, "gateways", permission.namespace)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/tsuru/kubernetes-router/observability"
 	"github.com/tsuru/kubernetes-router/router"
 )
 
@@ -27,7 +28,7 @@ func (m *LocalCluster) Router(ctx context.Context, mode string, _ http.Header) (
 	if !ok {
 		return nil, ErrBackendNotFound
 	}
-	return svc, nil
+	return observability.InstrumentRouter(svc, mode, "local"), nil
 }
 
 func (m *LocalCluster) Healthcheck(ctx context.Context) error {
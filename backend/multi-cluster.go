@@ -5,16 +5,18 @@ package backend
 
 import (
 	"context"
-	"errors"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
 	"github.com/tsuru/kubernetes-router/kubernetes"
 	"github.com/tsuru/kubernetes-router/observability"
 	"github.com/tsuru/kubernetes-router/router"
-	kubernetesGO "k8s.io/client-go/kubernetes"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/client-go/transport"
 )
 
@@ -25,6 +27,107 @@ type ClusterConfig struct {
 	Default bool   `json:"default"`
 	Address string `json:"address"`
 	Token   string `json:"token"`
+
+	// CA is the PEM encoded CA bundle used to verify the API server
+	CA string `json:"ca,omitempty" yaml:"ca,omitempty"`
+
+	// ClientCertificate and ClientKey are the PEM encoded client
+	// certificate used to authenticate on the API server
+	ClientCertificate string `json:"clientCertificate,omitempty" yaml:"clientCertificate,omitempty"`
+	ClientKey         string `json:"clientKey,omitempty" yaml:"clientKey,omitempty"`
+
+	// Exec runs a command to get the credentials used on the API server
+	Exec *ClusterExecConfig `json:"exec,omitempty" yaml:"exec,omitempty"`
+
+	// NonCritical clusters are reported by the health check without
+	// making it fail
+	NonCritical bool `json:"nonCritical,omitempty" yaml:"nonCritical,omitempty"`
+
+	// Modes overrides, by mode, the settings of the routers of the cluster
+	Modes map[string]ModeConfig `json:"modes,omitempty" yaml:"modes,omitempty"`
+}
+
+// ModeConfig holds the settings of the router of a mode, empty fields keep
+// the defaults of the mode
+type ModeConfig struct {
+	DomainSuffix string `json:"domainSuffix,omitempty" yaml:"domainSuffix,omitempty"`
+
+	// IngressClass and AnnotationsPrefix are used by the ingress modes
+	IngressClass          string            `json:"ingressClass,omitempty" yaml:"ingressClass,omitempty"`
+	AnnotationsPrefix     string            `json:"annotationsPrefix,omitempty" yaml:"annotationsPrefix,omitempty"`
+	OptsAsAnnotations     map[string]string `json:"optsAsAnnotations,omitempty" yaml:"optsAsAnnotations,omitempty"`
+	OptsAsAnnotationsDocs map[string]string `json:"optsAsAnnotationsDocs,omitempty" yaml:"optsAsAnnotationsDocs,omitempty"`
+
+	// OptsAsLabels and PoolLabels are used by the service mode
+	OptsAsLabels     map[string]string            `json:"optsAsLabels,omitempty" yaml:"optsAsLabels,omitempty"`
+	OptsAsLabelsDocs map[string]string            `json:"optsAsLabelsDocs,omitempty" yaml:"optsAsLabelsDocs,omitempty"`
+	PoolLabels       map[string]map[string]string `json:"poolLabels,omitempty" yaml:"poolLabels,omitempty"`
+
+	// GatewaySelector is used by the istio-gateway mode, GatewayName by the
+	// gateway-api mode and GatewayNamespace by both
+	GatewaySelector  map[string]string `json:"gatewaySelector,omitempty" yaml:"gatewaySelector,omitempty"`
+	GatewayName      string            `json:"gatewayName,omitempty" yaml:"gatewayName,omitempty"`
+	GatewayNamespace string            `json:"gatewayNamespace,omitempty" yaml:"gatewayNamespace,omitempty"`
+}
+
+// merge returns the config with the empty fields filled from defaults
+func (c ModeConfig) merge(defaults ModeConfig) ModeConfig {
+	if c.DomainSuffix == "" {
+		c.DomainSuffix = defaults.DomainSuffix
+	}
+	if c.IngressClass == "" {
+		c.IngressClass = defaults.IngressClass
+	}
+	if c.AnnotationsPrefix == "" {
+		c.AnnotationsPrefix = defaults.AnnotationsPrefix
+	}
+	if c.OptsAsAnnotations == nil {
+		c.OptsAsAnnotations = defaults.OptsAsAnnotations
+	}
+	if c.OptsAsAnnotationsDocs == nil {
+		c.OptsAsAnnotationsDocs = defaults.OptsAsAnnotationsDocs
+	}
+	if c.OptsAsLabels == nil {
+		c.OptsAsLabels = defaults.OptsAsLabels
+	}
+	if c.OptsAsLabelsDocs == nil {
+		c.OptsAsLabelsDocs = defaults.OptsAsLabelsDocs
+	}
+	if c.PoolLabels == nil {
+		c.PoolLabels = defaults.PoolLabels
+	}
+	if c.GatewaySelector == nil {
+		c.GatewaySelector = defaults.GatewaySelector
+	}
+	if c.GatewayName == "" {
+		c.GatewayName = defaults.GatewayName
+	}
+	if c.GatewayNamespace == "" {
+		c.GatewayNamespace = defaults.GatewayNamespace
+	}
+	return c
+}
+
+// canonicalModes maps the alternative names of the modes
+var canonicalModes = map[string]string{
+	"loadbalancer":  "service",
+	"nginx-ingress": "ingress-nginx",
+}
+
+func canonicalMode(mode string) string {
+	if canonical, ok := canonicalModes[mode]; ok {
+		return canonical
+	}
+	return mode
+}
+
+// ClusterExecConfig is an exec-based credential plugin, as used by kubeconfig
+// files
+type ClusterExecConfig struct {
+	Command    string            `json:"command" yaml:"command"`
+	Args       []string          `json:"args,omitempty" yaml:"args,omitempty"`
+	Env        map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	APIVersion string            `json:"apiVersion,omitempty" yaml:"apiVersion,omitempty"`
 }
 
 type ClustersFile struct {
@@ -35,8 +138,34 @@ type MultiCluster struct {
 	Namespace  string
 	Fallback   Backend
 	K8sTimeout *time.Duration
-	Modes      []string
 	Clusters   []ClusterConfig
+
+	// Modes are the enabled modes, the first one is used when no mode is
+	// requested. Every mode is enabled when empty.
+	Modes []string
+
+	// ModeDefaults holds the settings of each mode, overridden by the
+	// Modes of each cluster
+	ModeDefaults map[string]ModeConfig
+
+	// Registry, when set, provides the clusters instead of Clusters
+	Registry *ClusterRegistry
+
+	// ClientCacheTTL and ClientCacheSize bound the cache of the clients of
+	// each cluster, reused between requests
+	ClientCacheTTL  time.Duration
+	ClientCacheSize int
+
+	// HealthcheckTimeout bounds the probe of every cluster on Healthcheck
+	HealthcheckTimeout time.Duration
+
+	cacheOnce sync.Once
+	cache     *clusterCache
+
+	// addresses are the last addresses sent by tsuru for each cluster,
+	// used to probe the clusters configured without address
+	addressesMu sync.Mutex
+	addresses   map[string]string
 }
 
 func (m *MultiCluster) Router(ctx context.Context, mode string, headers http.Header) (router.Router, error) {
@@ -47,81 +176,189 @@ func (m *MultiCluster) Router(ctx context.Context, mode string, headers http.Hea
 		return m.Fallback.Router(ctx, mode, headers)
 	}
 
-	span := opentracing.SpanFromContext(ctx)
-	if span != nil {
-		span.SetTag("cluster.name", name)
-		span.SetTag("cluster.address", address)
+	mode, err := m.enabledMode(mode)
+	if err != nil {
+		return nil, err
 	}
+	m.rememberAddress(name, address)
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("cluster.name", name),
+		attribute.String("cluster.address", address),
+	)
 
 	timeout := time.Second * 10
 	if m.K8sTimeout != nil {
 		timeout = *m.K8sTimeout
 	}
 
-	kubernetesRestConfig := &rest.Config{
-		Host:        address,
-		BearerToken: m.getToken(name),
-		Timeout:     timeout,
-		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
-			return transport.DebugWrappers(observability.WrapTransport(rt))
-		},
-	}
+	cluster := m.getCluster(name)
+	kubernetesRestConfig := restConfig(cluster, address, timeout)
 
-	k8sClient, err := kubernetesGO.NewForConfig(kubernetesRestConfig)
+	entry, err := m.clientCache().get(name, cluster, kubernetesRestConfig, m.Namespace)
 	if err != nil {
 		return nil, err
 	}
+	config := cluster.Modes[mode].merge(m.ModeDefaults[mode])
+	return entry.router(mode, func(baseService *kubernetes.BaseService) (router.Router, error) {
+		rt, err := newRouter(mode, baseService, config)
+		if err != nil {
+			return nil, err
+		}
+		return observability.InstrumentRouter(rt, mode, name), nil
+	})
+}
 
-	baseService := &kubernetes.BaseService{
-		Namespace:  m.Namespace,
-		Timeout:    timeout,
-		Client:     k8sClient,
-		RestConfig: kubernetesRestConfig,
+// enabledMode returns the canonical name of the requested mode, failing
+// with ErrBackendNotFound when it is not enabled
+func (m *MultiCluster) enabledMode(mode string) (string, error) {
+	if mode == "" {
+		mode = "service"
+		if len(m.Modes) > 0 {
+			mode = m.Modes[0]
+		}
+	}
+	mode = canonicalMode(mode)
+	if len(m.Modes) == 0 {
+		return mode, nil
 	}
+	for _, enabled := range m.Modes {
+		if canonicalMode(enabled) == mode {
+			return mode, nil
+		}
+	}
+	return "", ErrBackendNotFound
+}
 
-	if mode == "service" || mode == "loadbalancer" || mode == "" {
+func newRouter(mode string, baseService *kubernetes.BaseService, config ModeConfig) (router.Router, error) {
+	switch mode {
+	case "service":
 		return &kubernetes.LBService{
-			BaseService: baseService,
+			BaseService:      baseService,
+			OptsAsLabels:     config.OptsAsLabels,
+			OptsAsLabelsDocs: config.OptsAsLabelsDocs,
+			PoolLabels:       config.PoolLabels,
 		}, nil
-	}
-
-	if mode == "ingress" {
+	case "ingress-nginx":
+		config = config.merge(ModeConfig{
+			IngressClass:      "nginx",
+			AnnotationsPrefix: "nginx.ingress.kubernetes.io",
+		})
+		fallthrough
+	case "ingress":
 		return &kubernetes.IngressService{
-			BaseService: baseService,
+			BaseService:           baseService,
+			DomainSuffix:          config.DomainSuffix,
+			IngressClass:          config.IngressClass,
+			AnnotationsPrefix:     config.AnnotationsPrefix,
+			OptsAsAnnotations:     config.OptsAsAnnotations,
+			OptsAsAnnotationsDocs: config.OptsAsAnnotationsDocs,
+		}, nil
+	case "istio-gateway":
+		return &kubernetes.IstioGateway{
+			BaseService:      baseService,
+			DomainSuffix:     config.DomainSuffix,
+			GatewaySelector:  config.GatewaySelector,
+			GatewayNamespace: config.GatewayNamespace,
+		}, nil
+	case "gateway-api":
+		return &kubernetes.GatewayAPI{
+			BaseService:      baseService,
+			DomainSuffix:     config.DomainSuffix,
+			GatewayName:      config.GatewayName,
+			GatewayNamespace: config.GatewayNamespace,
 		}, nil
 	}
+	return nil, ErrBackendNotFound
+}
 
-	if mode == "nginx-ingress" {
-		return &kubernetes.IngressService{
-			BaseService:       baseService,
-			IngressClass:      "nginx",
-			AnnotationsPrefix: "nginx.ingress.kubernetes.io",
-			// TODO(wpjunior): may router opts plugged in here ?
-		}, nil
+// Healthcheck fails when the fallback or a critical cluster is unhealthy,
+// the details of each cluster are available on HealthReport
+func (m *MultiCluster) Healthcheck(ctx context.Context) error {
+	report := m.HealthReport(ctx)
+	if !report.Healthy {
+		return report
 	}
+	return nil
+}
 
-	if mode == "istio-gateway" {
-		return &kubernetes.IstioGateway{
-			BaseService: baseService,
-		}, nil
+func (m *MultiCluster) clientCache() *clusterCache {
+	m.cacheOnce.Do(func() {
+		m.cache = newClusterCache(m.ClientCacheTTL, m.ClientCacheSize)
+	})
+	return m.cache
+}
+
+func (m *MultiCluster) rememberAddress(name, address string) {
+	m.addressesMu.Lock()
+	defer m.addressesMu.Unlock()
+	if m.addresses == nil {
+		m.addresses = map[string]string{}
 	}
+	m.addresses[name] = address
+}
 
-	return nil, errors.New("Mode not found")
+// requestedAddress returns the last address sent by tsuru for the cluster
+func (m *MultiCluster) requestedAddress(name string) string {
+	m.addressesMu.Lock()
+	defer m.addressesMu.Unlock()
+	return m.addresses[name]
 }
 
-func (m *MultiCluster) Healthcheck(ctx context.Context) error {
-	return m.Fallback.Healthcheck(ctx)
+func (m *MultiCluster) clusters() []ClusterConfig {
+	if m.Registry != nil {
+		return m.Registry.Clusters()
+	}
+	return m.Clusters
 }
 
-func (m *MultiCluster) getToken(clusterName string) string {
-	defaultToken := ""
-	for _, cluster := range m.Clusters {
+// getCluster returns the cluster with the given name, falling back to the
+// default cluster
+func (m *MultiCluster) getCluster(clusterName string) ClusterConfig {
+	var defaultCluster ClusterConfig
+	for _, cluster := range m.clusters() {
 		if cluster.Default {
-			defaultToken = cluster.Token
+			defaultCluster = cluster
 		}
 		if cluster.Name == clusterName {
-			return cluster.Token
+			return cluster
+		}
+	}
+	return defaultCluster
+}
+
+// restConfig builds the config to access the cluster, the address sent by
+// tsuru takes precedence over the configured one, used only when tsuru has
+// not sent any
+func restConfig(cluster ClusterConfig, address string, timeout time.Duration) *rest.Config {
+	if address == "" {
+		address = cluster.Address
+	}
+	config := &rest.Config{
+		Host:        address,
+		BearerToken: cluster.Token,
+		Timeout:     timeout,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData:   []byte(cluster.CA),
+			CertData: []byte(cluster.ClientCertificate),
+			KeyData:  []byte(cluster.ClientKey),
+		},
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			return transport.DebugWrappers(observability.WrapTransport(rt))
+		},
+	}
+	if cluster.Exec != nil {
+		config.ExecProvider = &clientcmdapi.ExecConfig{
+			Command:    cluster.Exec.Command,
+			Args:       cluster.Exec.Args,
+			APIVersion: cluster.Exec.APIVersion,
+		}
+		for name, value := range cluster.Exec.Env {
+			config.ExecProvider.Env = append(config.ExecProvider.Env, clientcmdapi.ExecEnvVar{Name: name, Value: value})
 		}
+		sort.Slice(config.ExecProvider.Env, func(i, j int) bool {
+			return config.ExecProvider.Env[i].Name < config.ExecProvider.Env[j].Name
+		})
 	}
-	return defaultToken
+	return config
 }
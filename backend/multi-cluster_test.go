@@ -11,12 +11,13 @@ import (
 	"testing"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tsuru/kubernetes-router/kubernetes"
 	"github.com/tsuru/kubernetes-router/router"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var _ Backend = &fakeBackend{}
@@ -36,11 +37,11 @@ func TestMultiClusterFallback(t *testing.T) {
 		Namespace: "tsuru-test",
 		Fallback:  &fakeBackend{},
 	}
-	router, err := backend.Router(ctx, "service", http.Header{})
+	rt, err := backend.Router(ctx, "service", http.Header{})
 	if assert.Error(t, err) {
 		assert.Equal(t, err.Error(), "not implemented yet")
 	}
-	assert.Nil(t, router)
+	assert.Nil(t, rt)
 }
 
 func TestMultiClusterHealthcheck(t *testing.T) {
@@ -65,10 +66,10 @@ func TestMultiClusterService(t *testing.T) {
 			},
 		},
 	}
-	mockTracer := mocktracer.New()
-	span := mockTracer.StartSpan("test")
-	spanCtx := opentracing.ContextWithSpan(ctx, span)
-	router, err := backend.Router(spanCtx, "service", http.Header{
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	spanCtx, span := provider.Tracer("test").Start(ctx, "test")
+	rt, err := backend.Router(spanCtx, "service", http.Header{
 		"X-Tsuru-Cluster-Name": {
 			"my-cluster",
 		},
@@ -77,16 +78,45 @@ func TestMultiClusterService(t *testing.T) {
 		},
 	})
 	assert.NoError(t, err)
-	lbService, ok := router.(*kubernetes.LBService)
+	lbService, ok := router.Unwrap(rt).(*kubernetes.LBService)
 	require.True(t, ok)
 	assert.Equal(t, "tsuru-test", lbService.BaseService.Namespace)
 	assert.Equal(t, 10*time.Second, lbService.BaseService.Timeout)
 	assert.Equal(t, "https://mycluster.com", lbService.BaseService.RestConfig.Host)
 	assert.Equal(t, "my-token", lbService.BaseService.RestConfig.BearerToken)
-	assert.Equal(t, span.(*mocktracer.MockSpan).Tags(), map[string]interface{}{
-		"cluster.address": "https://mycluster.com",
-		"cluster.name":    "my-cluster",
+	span.End()
+	require.Len(t, recorder.Ended(), 1)
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String("cluster.name", "my-cluster"),
+		attribute.String("cluster.address", "https://mycluster.com"),
+	}, recorder.Ended()[0].Attributes())
+}
+
+func TestMultiClusterAddressPrecedence(t *testing.T) {
+	backend := &MultiCluster{
+		Namespace: "tsuru-test",
+		Fallback:  &fakeBackend{},
+		Clusters: []ClusterConfig{
+			{
+				Name:    "my-cluster",
+				Address: "https://configured.com",
+				Token:   "my-token",
+			},
+		},
+	}
+	// the address sent by tsuru wins over the configured one
+	rt, err := backend.Router(ctx, "service", http.Header{
+		"X-Tsuru-Cluster-Name":      {"my-cluster"},
+		"X-Tsuru-Cluster-Addresses": {"https://mycluster.com"},
 	})
+	require.NoError(t, err)
+	lbService, ok := router.Unwrap(rt).(*kubernetes.LBService)
+	require.True(t, ok)
+	assert.Equal(t, "https://mycluster.com", lbService.BaseService.RestConfig.Host)
+
+	// the configured address is used while tsuru has not sent any
+	assert.Equal(t, "https://configured.com", restConfig(backend.Clusters[0], "", 0).Host)
+	assert.Equal(t, "", restConfig(ClusterConfig{Name: "other"}, "", 0).Host)
 }
 
 func TestMultiClusterIngress(t *testing.T) {
@@ -101,7 +131,7 @@ func TestMultiClusterIngress(t *testing.T) {
 			},
 		},
 	}
-	router, err := backend.Router(ctx, "ingress", http.Header{
+	rt, err := backend.Router(ctx, "ingress", http.Header{
 		"X-Tsuru-Cluster-Name": {
 			"my-cluster",
 		},
@@ -110,7 +140,7 @@ func TestMultiClusterIngress(t *testing.T) {
 		},
 	})
 	assert.NoError(t, err)
-	ingressService, ok := router.(*kubernetes.IngressService)
+	ingressService, ok := router.Unwrap(rt).(*kubernetes.IngressService)
 	require.True(t, ok)
 	assert.Equal(t, "tsuru-test", ingressService.BaseService.Namespace)
 	assert.Equal(t, "", ingressService.IngressClass)
@@ -131,7 +161,7 @@ func TestMultiClusterNginxIngress(t *testing.T) {
 			},
 		},
 	}
-	router, err := backend.Router(ctx, "nginx-ingress", http.Header{
+	rt, err := backend.Router(ctx, "nginx-ingress", http.Header{
 		"X-Tsuru-Cluster-Name": {
 			"my-cluster",
 		},
@@ -140,7 +170,7 @@ func TestMultiClusterNginxIngress(t *testing.T) {
 		},
 	})
 	assert.NoError(t, err)
-	ingressService, ok := router.(*kubernetes.IngressService)
+	ingressService, ok := router.Unwrap(rt).(*kubernetes.IngressService)
 	require.True(t, ok)
 	assert.Equal(t, "tsuru-test", ingressService.BaseService.Namespace)
 	assert.Equal(t, "nginx", ingressService.IngressClass)
@@ -162,7 +192,7 @@ func TestMultiClusterIstioGateway(t *testing.T) {
 			},
 		},
 	}
-	router, err := backend.Router(ctx, "istio-gateway", http.Header{
+	rt, err := backend.Router(ctx, "istio-gateway", http.Header{
 		"X-Tsuru-Cluster-Name": {
 			"my-cluster",
 		},
@@ -171,10 +201,68 @@ func TestMultiClusterIstioGateway(t *testing.T) {
 		},
 	})
 	assert.NoError(t, err)
-	istioGateway, ok := router.(*kubernetes.IstioGateway)
+	istioGateway, ok := router.Unwrap(rt).(*kubernetes.IstioGateway)
 	require.True(t, ok)
 	assert.Equal(t, "tsuru-test", istioGateway.BaseService.Namespace)
 	assert.Equal(t, 10*time.Second, istioGateway.BaseService.Timeout)
 	assert.Equal(t, "https://mycluster.com", istioGateway.BaseService.RestConfig.Host)
 	assert.Equal(t, "my-token", istioGateway.BaseService.RestConfig.BearerToken)
 }
+
+func TestMultiClusterModeConfig(t *testing.T) {
+	backend := &MultiCluster{
+		Namespace: "tsuru-test",
+		Fallback:  &fakeBackend{},
+		Modes:     []string{"ingress", "ingress-nginx", "service"},
+		ModeDefaults: map[string]ModeConfig{
+			"ingress": {
+				DomainSuffix:      "local",
+				IngressClass:      "default-class",
+				OptsAsAnnotations: map[string]string{"opt": "annotation"},
+			},
+			"ingress-nginx": {DomainSuffix: "local"},
+			"service":       {OptsAsLabels: map[string]string{"opt": "label"}},
+		},
+		Clusters: []ClusterConfig{
+			{
+				Name:  "my-cluster",
+				Token: "my-token",
+				Modes: map[string]ModeConfig{
+					"ingress":       {DomainSuffix: "remote.io", IngressClass: "traefik"},
+					"ingress-nginx": {AnnotationsPrefix: "custom.nginx.io"},
+				},
+			},
+		},
+	}
+	headers := http.Header{
+		"X-Tsuru-Cluster-Name":      {"my-cluster"},
+		"X-Tsuru-Cluster-Addresses": {"https://mycluster.com"},
+	}
+
+	rt, err := backend.Router(ctx, "", headers)
+	require.NoError(t, err)
+	ingressService, ok := router.Unwrap(rt).(*kubernetes.IngressService)
+	require.True(t, ok)
+	assert.Equal(t, "remote.io", ingressService.DomainSuffix)
+	assert.Equal(t, "traefik", ingressService.IngressClass)
+	assert.Equal(t, map[string]string{"opt": "annotation"}, ingressService.OptsAsAnnotations)
+
+	rt, err = backend.Router(ctx, "nginx-ingress", headers)
+	require.NoError(t, err)
+	nginxService, ok := router.Unwrap(rt).(*kubernetes.IngressService)
+	require.True(t, ok)
+	assert.Equal(t, "local", nginxService.DomainSuffix)
+	assert.Equal(t, "nginx", nginxService.IngressClass)
+	assert.Equal(t, "custom.nginx.io", nginxService.AnnotationsPrefix)
+
+	rt, err = backend.Router(ctx, "loadbalancer", headers)
+	require.NoError(t, err)
+	lbService, ok := router.Unwrap(rt).(*kubernetes.LBService)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"opt": "label"}, lbService.OptsAsLabels)
+
+	_, err = backend.Router(ctx, "istio-gateway", headers)
+	assert.Equal(t, ErrBackendNotFound, err)
+	_, err = backend.Router(ctx, "invalid", headers)
+	assert.Equal(t, ErrBackendNotFound, err)
+}
@@ -0,0 +1,262 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubernetesGO "k8s.io/client-go/kubernetes"
+)
+
+// ClusterSource loads the clusters known by a ClusterRegistry
+type ClusterSource interface {
+	LoadClusters(ctx context.Context) ([]ClusterConfig, error)
+}
+
+// ClusterWatcher is implemented by the sources able to notify changes on
+// their clusters, like files
+type ClusterWatcher interface {
+	Watch(ctx context.Context, changed func()) error
+}
+
+// ClusterRegistry keeps the clusters loaded from its source, reloading them
+// when the source changes and periodically, so clusters can be added and
+// tokens rotated without restarts. When a reload fails the last loaded
+// clusters are kept.
+type ClusterRegistry struct {
+	Source         ClusterSource
+	ReloadInterval time.Duration
+
+	mu       sync.RWMutex
+	clusters []ClusterConfig
+}
+
+// Start loads the clusters and keeps reloading them until ctx is done
+func (r *ClusterRegistry) Start(ctx context.Context) error {
+	err := r.Reload(ctx)
+	if err != nil {
+		return err
+	}
+	if watcher, ok := r.Source.(ClusterWatcher); ok {
+		err = watcher.Watch(ctx, func() {
+			if err := r.Reload(ctx); err != nil {
+				slog.WarnContext(ctx, "Failed to reload clusters, keeping the current ones", "error", err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if r.ReloadInterval <= 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(r.ReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := r.Reload(ctx); err != nil {
+				slog.WarnContext(ctx, "Failed to reload clusters, keeping the current ones", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Reload loads the clusters from the source
+func (r *ClusterRegistry) Reload(ctx context.Context) error {
+	clusters, err := r.Source.LoadClusters(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cluster := range clusters {
+		if cluster.Name == "" {
+			return errors.New("cluster without name found")
+		}
+	}
+	r.mu.Lock()
+	r.clusters = clusters
+	r.mu.Unlock()
+	return nil
+}
+
+// Clusters returns a copy of the last loaded clusters
+func (r *ClusterRegistry) Clusters() []ClusterConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clusters := make([]ClusterConfig, len(r.clusters))
+	copy(clusters, r.clusters)
+	return clusters
+}
+
+// FileClusterSource loads the clusters from a YAML or JSON clusters file
+type FileClusterSource struct {
+	Path string
+}
+
+func (s *FileClusterSource) LoadClusters(ctx context.Context) ([]ClusterConfig, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	clustersFile := &ClustersFile{}
+	err = yaml.NewDecoder(f).Decode(clustersFile)
+	if err != nil {
+		return nil, err
+	}
+	return clustersFile.Clusters, nil
+}
+
+// Watch calls changed whenever the file is written, replaced or renamed. The
+// directory is watched so the atomic symlink swaps of mounted ConfigMaps and
+// Secrets are noticed too.
+func (s *FileClusterSource) Watch(ctx context.Context, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = watcher.Add(filepath.Dir(s.Path))
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+					continue
+				}
+				changed()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("Failed to watch clusters file", "path", s.Path, "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+const (
+	clusterSecretName        = "name"
+	clusterSecretAddress     = "address"
+	clusterSecretToken       = "token"
+	clusterSecretDefault     = "default"
+	clusterSecretCA          = "ca.crt"
+	clusterSecretClientCert  = "tls.crt"
+	clusterSecretClientKey   = "tls.key"
+	clusterSecretExec        = "exec"
+	clusterSecretNonCritical = "nonCritical"
+	clusterSecretModes       = "modes"
+)
+
+// SecretClusterSource loads one cluster from each secret matching Selector,
+// the cluster is named after the secret unless its name key is set
+type SecretClusterSource struct {
+	Client    kubernetesGO.Interface
+	Namespace string
+	Selector  string
+}
+
+func (s *SecretClusterSource) LoadClusters(ctx context.Context) ([]ClusterConfig, error) {
+	secrets, err := s.Client.CoreV1().Secrets(s.Namespace).List(ctx, metav1.ListOptions{LabelSelector: s.Selector})
+	if err != nil {
+		return nil, err
+	}
+	var clusters []ClusterConfig
+	for _, secret := range secrets.Items {
+		cluster := ClusterConfig{
+			Name:              string(secret.Data[clusterSecretName]),
+			Address:           string(secret.Data[clusterSecretAddress]),
+			Token:             string(secret.Data[clusterSecretToken]),
+			CA:                string(secret.Data[clusterSecretCA]),
+			ClientCertificate: string(secret.Data[clusterSecretClientCert]),
+			ClientKey:         string(secret.Data[clusterSecretClientKey]),
+		}
+		if cluster.Name == "" {
+			cluster.Name = secret.Name
+		}
+		cluster.Default, _ = strconv.ParseBool(string(secret.Data[clusterSecretDefault]))
+		cluster.NonCritical, _ = strconv.ParseBool(string(secret.Data[clusterSecretNonCritical]))
+		if exec := secret.Data[clusterSecretExec]; len(exec) > 0 {
+			cluster.Exec = &ClusterExecConfig{}
+			err = json.Unmarshal(exec, cluster.Exec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exec config on secret %q: %v", secret.Name, err)
+			}
+		}
+		if modes := secret.Data[clusterSecretModes]; len(modes) > 0 {
+			err = json.Unmarshal(modes, &cluster.Modes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modes config on secret %q: %v", secret.Name, err)
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// HTTPClusterSource loads the clusters from an endpoint returning a JSON
+// clusters file
+type HTTPClusterSource struct {
+	URL    string
+	Header http.Header
+	Client *http.Client
+}
+
+func (s *HTTPClusterSource) LoadClusters(ctx context.Context) ([]ClusterConfig, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code loading clusters from %s: %d", s.URL, rsp.StatusCode)
+	}
+	clustersFile := &ClustersFile{}
+	err = json.NewDecoder(rsp.Body).Decode(clustersFile)
+	if err != nil {
+		return nil, err
+	}
+	return clustersFile.Clusters, nil
+}
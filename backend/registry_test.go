@@ -0,0 +1,176 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/kubernetes"
+	"github.com/tsuru/kubernetes-router/router"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeClusterSource struct {
+	clusters []ClusterConfig
+	err      error
+}
+
+func (s *fakeClusterSource) LoadClusters(context.Context) ([]ClusterConfig, error) {
+	return s.clusters, s.err
+}
+
+func TestClusterRegistryReloadKeepsClustersOnFailure(t *testing.T) {
+	source := &fakeClusterSource{clusters: []ClusterConfig{{Name: "c1", Token: "t1"}}}
+	registry := &ClusterRegistry{Source: source}
+	err := registry.Start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterConfig{{Name: "c1", Token: "t1"}}, registry.Clusters())
+
+	source.clusters = []ClusterConfig{{Name: "c1", Token: "t2"}}
+	err = registry.Reload(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterConfig{{Name: "c1", Token: "t2"}}, registry.Clusters())
+
+	source.err = errors.New("unavailable")
+	err = registry.Reload(ctx)
+	assert.Error(t, err)
+	source.err = nil
+	source.clusters = []ClusterConfig{{Token: "t3"}}
+	err = registry.Reload(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, []ClusterConfig{{Name: "c1", Token: "t2"}}, registry.Clusters())
+}
+
+func TestFileClusterSource(t *testing.T) {
+	f, err := ioutil.TempFile("", "clusters")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`clusters:
+- name: c1
+  address: https://c1.com
+  token: my-token
+  ca: my-ca
+  default: true
+- name: c2
+  clientCertificate: my-cert
+  clientKey: my-key
+  exec:
+    command: get-token
+    args: ["--cluster", "c2"]
+  nonCritical: true
+  modes:
+    ingress:
+      domainSuffix: remote.io
+      ingressClass: traefik
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	clusters, err := (&FileClusterSource{Path: f.Name()}).LoadClusters(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterConfig{
+		{Name: "c1", Address: "https://c1.com", Token: "my-token", CA: "my-ca", Default: true},
+		{Name: "c2", ClientCertificate: "my-cert", ClientKey: "my-key", Exec: &ClusterExecConfig{
+			Command: "get-token",
+			Args:    []string{"--cluster", "c2"},
+		}, NonCritical: true, Modes: map[string]ModeConfig{
+			"ingress": {DomainSuffix: "remote.io", IngressClass: "traefik"},
+		}},
+	}, clusters)
+}
+
+func TestClusterRegistryWatchesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clusters")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clusters.yaml")
+	err = ioutil.WriteFile(path, []byte("clusters: [{name: c1, token: t1}]"), 0644)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	registry := &ClusterRegistry{Source: &FileClusterSource{Path: path}}
+	err = registry.Start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterConfig{{Name: "c1", Token: "t1"}}, registry.Clusters())
+
+	err = ioutil.WriteFile(path, []byte("clusters: [{name: c1, token: t2}]"), 0644)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		clusters := registry.Clusters()
+		return len(clusters) == 1 && clusters[0].Token == "t2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSecretClusterSource(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "c1", Namespace: "tsuru", Labels: map[string]string{"tsuru.io/cluster": "true"}},
+			Data: map[string][]byte{
+				"address": []byte("https://c1.com"),
+				"token":   []byte("my-token"),
+				"ca.crt":  []byte("my-ca"),
+				"default": []byte("true"),
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "tsuru"},
+			Data:       map[string][]byte{"token": []byte("other-token")},
+		},
+	)
+	source := &SecretClusterSource{Client: client, Namespace: "tsuru", Selector: "tsuru.io/cluster=true"}
+	clusters, err := source.LoadClusters(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterConfig{
+		{Name: "c1", Address: "https://c1.com", Token: "my-token", CA: "my-ca", Default: true},
+	}, clusters)
+}
+
+func TestHTTPClusterSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"clusters": [{"name": "c1", "token": "my-token"}]}`))
+	}))
+	defer server.Close()
+	source := &HTTPClusterSource{URL: server.URL, Header: http.Header{"Authorization": {"Bearer secret"}}}
+	clusters, err := source.LoadClusters(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ClusterConfig{{Name: "c1", Token: "my-token"}}, clusters)
+}
+
+func TestMultiClusterRegistry(t *testing.T) {
+	registry := &ClusterRegistry{Source: &fakeClusterSource{clusters: []ClusterConfig{
+		{Name: "my-cluster", Address: "https://override.com", CA: "my-ca", ClientCertificate: "my-cert", ClientKey: "my-key"},
+	}}}
+	require.NoError(t, registry.Reload(ctx))
+	backend := &MultiCluster{
+		Namespace: "tsuru-test",
+		Fallback:  &fakeBackend{},
+		Registry:  registry,
+	}
+	rt, err := backend.Router(ctx, "service", http.Header{
+		"X-Tsuru-Cluster-Name":      {"my-cluster"},
+		"X-Tsuru-Cluster-Addresses": {"https://mycluster.com"},
+	})
+	require.NoError(t, err)
+	lbService, ok := router.Unwrap(rt).(*kubernetes.LBService)
+	require.True(t, ok)
+	assert.Equal(t, "https://override.com", lbService.BaseService.RestConfig.Host)
+	assert.Equal(t, []byte("my-ca"), lbService.BaseService.RestConfig.TLSClientConfig.CAData)
+	assert.Equal(t, []byte("my-cert"), lbService.BaseService.RestConfig.TLSClientConfig.CertData)
+	assert.Equal(t, []byte("my-key"), lbService.BaseService.RestConfig.TLSClientConfig.KeyData)
+}
@@ -2,7 +2,7 @@ package cmd
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -14,7 +14,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tsuru/kubernetes-router/api"
 	"github.com/tsuru/kubernetes-router/backend"
+	"github.com/tsuru/kubernetes-router/kubernetes"
 	"github.com/tsuru/kubernetes-router/observability"
+	"github.com/tsuru/kubernetes-router/router"
 	"github.com/urfave/negroni"
 )
 
@@ -24,22 +26,57 @@ type DaemonOpts struct {
 	Backend    backend.Backend
 	KeyFile    string
 	CertFile   string
+
+	// Reconciler, when set, repairs the resources managed by the routers
+	// while the daemon is running
+	Reconciler *kubernetes.Reconciler
+
+	// GCInterval is the interval between the garbage collections of the
+	// resources orphaned by GCRouters, zero disables them
+	GCInterval time.Duration
+	GCRouters  map[string]router.Router
+
+	// Locker serializes the operations on the same app, including the
+	// ones of the Reconciler, defaults to a lock local to the daemon
+	Locker api.Locker
+
+	// LockTimeout is the maximum time an operation waits for another one
+	// on the same app
+	LockTimeout time.Duration
+
+	// Auditor, when set, records the changes requested to the API and
+	// serves the recent ones on /admin/audit
+	Auditor *api.Auditor
 }
 
 func StartDaemon(opts DaemonOpts) {
+	if opts.Locker == nil {
+		opts.Locker = &api.LocalLocker{}
+	}
+	if opts.Reconciler != nil {
+		// the Ensure replayed waits for the operations of the API on the
+		// same app
+		opts.Reconciler.Locker = opts.Locker
+		opts.Reconciler.LockTimeout = opts.LockTimeout
+	}
 	routerAPI := api.RouterAPI{
-		Backend: opts.Backend,
+		Backend:     opts.Backend,
+		Locker:      opts.Locker,
+		LockTimeout: opts.LockTimeout,
+		Auditor:     opts.Auditor,
 	}
 
 	r := mux.NewRouter().StrictSlash(true)
 
-	r.PathPrefix("/api").Handler(negroni.New(
-		api.AuthMiddleware{
-			User: os.Getenv("ROUTER_API_USER"),
-			Pass: os.Getenv("ROUTER_API_PASSWORD"),
-		},
-		negroni.Wrap(routerAPI.Routes()),
-	))
+	auth := api.AuthMiddleware{
+		User: os.Getenv("ROUTER_API_USER"),
+		Pass: os.Getenv("ROUTER_API_PASSWORD"),
+	}
+	r.PathPrefix("/api").Handler(negroni.New(auth, negroni.Wrap(routerAPI.Routes())))
+	r.Handle("/admin/log-level", negroni.New(auth, negroni.Wrap(observability.LogLevelHandler())))
+	if opts.Auditor != nil {
+		r.Handle("/admin/audit", negroni.New(auth, negroni.Wrap(opts.Auditor.Handler()))).Methods(http.MethodGet)
+	}
 	r.HandleFunc("/healthcheck", routerAPI.Healthcheck)
 	r.Handle("/metrics", promhttp.Handler())
 
@@ -54,7 +91,7 @@ func StartDaemon(opts DaemonOpts) {
 	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	n := negroni.New(observability.Middleware(), negroni.NewLogger(), negroni.NewRecovery())
+	n := negroni.New(observability.Middleware(), negroni.NewRecovery())
 	n.UseHandler(r)
 
 	server := http.Server{
@@ -66,16 +103,55 @@ func StartDaemon(opts DaemonOpts) {
 
 	go handleSignals(&server)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if opts.Reconciler != nil {
+		go func() {
+			if err := opts.Reconciler.Run(ctx); err != nil {
+				slog.ErrorContext(ctx, "Failed to run reconciler", "error", err)
+			}
+		}()
+	}
+	if opts.GCInterval > 0 {
+		go collectGarbage(ctx, opts.GCInterval, opts.GCRouters)
+	}
+
 	if opts.KeyFile != "" && opts.CertFile != "" {
-		log.Printf("Started listening and serving TLS at %s", opts.ListenAddr)
+		slog.Info("Started listening and serving TLS", "addr", opts.ListenAddr)
 		if err := server.ListenAndServeTLS(opts.CertFile, opts.KeyFile); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("fail serve: %v", err)
+			Fatal("Failed to serve", "error", err)
 		}
 		return
 	}
-	log.Printf("Started listening and serving %s at %s", opts.Name, opts.ListenAddr)
+	slog.Info("Started listening and serving", "name", opts.Name, "addr", opts.ListenAddr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("fail serve: %v", err)
+		Fatal("Failed to serve", "error", err)
+	}
+}
+
+func collectGarbage(ctx context.Context, interval time.Duration, routers map[string]router.Router) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for mode, r := range routers {
+			gcRouter, ok := r.(router.RouterGarbageCollector)
+			if !ok {
+				continue
+			}
+			garbage, err := gcRouter.CollectGarbage(ctx, false)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to collect garbage", "mode", mode, "error", err)
+				continue
+			}
+			for _, resource := range garbage {
+				slog.InfoContext(ctx, "Collected garbage", "mode", mode, "kind", resource.Kind, "namespace", resource.Namespace, "name", resource.Name, "app", resource.App)
+			}
+		}
 	}
 }
 
@@ -83,12 +159,18 @@ func handleSignals(server *http.Server) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
 	sig := <-signals
-	log.Printf("Received %s. Terminating...", sig)
+	slog.Info("Received signal, terminating", "signal", sig.String())
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 	err := server.Shutdown(ctx)
 	if err != nil {
-		log.Fatalf("Error during server shutdown: %v", err)
+		Fatal("Failed to shutdown server", "error", err)
 	}
-	log.Print("Server shutdown succeeded.")
+	slog.Info("Server shutdown succeeded")
+}
+
+// Fatal logs msg as an error and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -5,17 +5,20 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
+	"github.com/tsuru/kubernetes-router/api"
 	"github.com/tsuru/kubernetes-router/backend"
 	"github.com/tsuru/kubernetes-router/cmd"
 	"github.com/tsuru/kubernetes-router/kubernetes"
-	_ "github.com/tsuru/kubernetes-router/observability"
+	"github.com/tsuru/kubernetes-router/observability"
 	"github.com/tsuru/kubernetes-router/router"
-	"gopkg.in/yaml.v2"
+	kubernetesGO "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 func main() {
@@ -27,12 +30,16 @@ func main() {
 	k8sAnnotations := &cmd.MapFlag{}
 	flag.Var(k8sAnnotations, "k8s-annotations", "Annotations to be added to each resource created. Expects KEY=VALUE format.")
 	runModes := cmd.StringSliceFlag{}
-	flag.Var(&runModes, "controller-modes", "Defines enabled controller running modes: service, ingress, ingress-nginx or istio-gateway.")
+	flag.Var(&runModes, "controller-modes", "Defines enabled controller running modes: service, ingress, ingress-nginx, istio-gateway or gateway-api.")
 
 	ingressDomain := flag.String("ingress-domain", "local", "Default domain to be used on created vhosts, local is the default. (eg: serviceName.local)")
 
 	istioGatewaySelector := &cmd.MapFlag{}
 	flag.Var(istioGatewaySelector, "istio-gateway.gateway-selector", "Gateway selector used in gateways created for apps.")
+	istioGatewayNamespace := flag.String("istio-gateway.gateway-namespace", "istio-system", "Namespace of the istio ingress gateway workload, where certificate secrets are stored.")
+
+	gatewayAPIGatewayName := flag.String("gateway-api.gateway-name", "", "Name of the parent Gateway used by HTTPRoutes created for apps.")
+	gatewayAPIGatewayNamespace := flag.String("gateway-api.gateway-namespace", "", "Namespace of the parent Gateway used by HTTPRoutes created for apps, defaults to the app namespace.")
 
 	certFile := flag.String("cert-file", "", "Path to certificate used to serve https requests")
 	keyFile := flag.String("key-file", "", "Path to private key used to serve https requests")
@@ -55,14 +62,49 @@ func main() {
 
 	poolLabels := &cmd.MultiMapFlag{}
 	flag.Var(poolLabels, "pool-labels", "Default labels for a given pool. Expects POOL={\"LABEL\":\"VALUE\"} format.")
-	clustersFilePath := flag.String("clusters-file", "", "Path to file that describes clusters, when inform this file enable the multi-cluster support")
+	reconcile := flag.Bool("reconcile", false, "Watch the resources managed by the router, repairing the ones edited or deleted outside of it")
+	reconcileResync := flag.Duration("reconcile-resync", time.Minute*10, "Interval in which every resource managed by the router is reconciled even without changes")
+	gcInterval := flag.Duration("gc-interval", 0, "Interval between the removals of CNAME ingresses and certificate secrets orphaned by the router, zero disables it")
+	clustersFilePath := flag.String("clusters-file", "", "Path to file that describes clusters, when inform this file enable the multi-cluster support. The file is reloaded when changed")
+	clustersSecretsSelector := flag.String("clusters-secrets-selector", "", "Label selector of the secrets that describe clusters, when informed enables the multi-cluster support")
+	clustersSecretsNamespace := flag.String("clusters-secrets-namespace", "", "Namespace of the secrets that describe clusters, defaults to k8s-namespace")
+	clustersURL := flag.String("clusters-url", "", "URL of an endpoint that describes clusters, when informed enables the multi-cluster support")
+	clustersReloadInterval := flag.Duration("clusters-reload-interval", time.Minute, "Interval in which clusters are reloaded besides the reloads on changes of the clusters file, zero disables it")
+	clustersClientCacheTTL := flag.Duration("clusters-client-cache-ttl", time.Minute*10, "Time the Kubernetes clients of a cluster are reused between requests")
+	clustersClientCacheSize := flag.Int("clusters-client-cache-size", 100, "Maximum number of clusters whose Kubernetes clients are reused between requests")
+	clustersHealthcheckTimeout := flag.Duration("clusters-healthcheck-timeout", time.Second*5, "Timeout of the probe of every cluster on healthchecks")
+	lockLeases := flag.Bool("lock-leases", false, "Serialize the operations on each app across router replicas with Kubernetes Leases stored in k8s-namespace")
+	lockTimeout := flag.Duration("lock-timeout", time.Second*15, "Maximum time an operation waits for another one on the same app to finish")
+	logFormat := flag.String("log-format", "text", "Format of the log entries: text or json")
+	logLevel := flag.String("log-level", "info", "Minimum level of the log entries: debug, info, warn or error, can be changed at runtime on /admin/log-level")
+	auditFile := flag.String("audit-file", "", "Path to a file where the audit entries of the changes requested to the API are appended as JSON lines")
+	auditStdout := flag.Bool("audit-stdout", false, "Write the audit entries of the changes requested to the API to stdout as JSON lines")
+	auditWebhook := flag.String("audit-webhook", "", "URL where each audit entry of the changes requested to the API is posted as JSON")
+	auditRecent := flag.Int("audit-recent", 1000, "Number of the most recent audit entries kept in memory and served on /admin/audit")
 
 	flag.Parse()
 
-	err := flag.Lookup("logtostderr").Value.Set("true")
+	var level slog.Level
+	err := level.UnmarshalText([]byte(*logLevel))
+	if err != nil {
+		cmd.Fatal("Invalid log level", "error", err)
+	}
+	err = observability.InitLogger(os.Stderr, *logFormat, level)
+	if err != nil {
+		cmd.Fatal("Invalid log format", "error", err)
+	}
+
+	shutdownTracing, err := observability.InitTracing(context.Background())
 	if err != nil {
-		log.Printf("failed to set log to stderr: %v\n", err)
+		slog.Warn("Failed to initialize tracing, spans will not be exported", "error", err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Failed to flush spans", "error", err)
+		}
+	}()
 
 	base := &kubernetes.BaseService{
 		Namespace:   *k8sNamespace,
@@ -75,6 +117,38 @@ func main() {
 		runModes = append(runModes, "service")
 	}
 
+	// the settings of the local routers are the defaults of the remote
+	// clusters
+	modeDefaults := map[string]backend.ModeConfig{
+		"service": {
+			OptsAsLabels:     *optsToLabels,
+			OptsAsLabelsDocs: *optsToLabelsDocs,
+			PoolLabels:       *poolLabels,
+		},
+		"ingress": {
+			DomainSuffix:          *ingressDomain,
+			IngressClass:          *ingressClass,
+			AnnotationsPrefix:     *ingressAnnotationsPrefix,
+			OptsAsAnnotations:     *optsToIngressAnnotations,
+			OptsAsAnnotationsDocs: *optsToIngressAnnotationsDocs,
+		},
+		"ingress-nginx": {
+			DomainSuffix:          *ingressDomain,
+			OptsAsAnnotations:     *optsToIngressAnnotations,
+			OptsAsAnnotationsDocs: *optsToIngressAnnotationsDocs,
+		},
+		"istio-gateway": {
+			DomainSuffix:     *ingressDomain,
+			GatewaySelector:  *istioGatewaySelector,
+			GatewayNamespace: *istioGatewayNamespace,
+		},
+		"gateway-api": {
+			DomainSuffix:     *ingressDomain,
+			GatewayName:      *gatewayAPIGatewayName,
+			GatewayNamespace: *gatewayAPIGatewayNamespace,
+		},
+	}
+
 	localBackend := &backend.LocalCluster{
 		DefaultMode: runModes[0],
 		Routers:     map[string]router.Router{},
@@ -84,9 +158,17 @@ func main() {
 		switch mode {
 		case "istio-gateway":
 			localBackend.Routers[mode] = &kubernetes.IstioGateway{
-				BaseService:     base,
-				DomainSuffix:    *ingressDomain,
-				GatewaySelector: *istioGatewaySelector,
+				BaseService:      base,
+				DomainSuffix:     *ingressDomain,
+				GatewaySelector:  *istioGatewaySelector,
+				GatewayNamespace: *istioGatewayNamespace,
+			}
+		case "gateway-api":
+			localBackend.Routers[mode] = &kubernetes.GatewayAPI{
+				BaseService:      base,
+				DomainSuffix:     *ingressDomain,
+				GatewayName:      *gatewayAPIGatewayName,
+				GatewayNamespace: *gatewayAPIGatewayNamespace,
 			}
 		case "ingress-nginx":
 			*ingressClass = "nginx"
@@ -109,39 +191,116 @@ func main() {
 				PoolLabels:       *poolLabels,
 			}
 		default:
-			log.Fatalf("fail parameters: Use one of the following modes: service, ingress, ingress-nginx or istio-gateway.")
+			cmd.Fatal("Invalid mode, use one of the following modes: service, ingress, ingress-nginx, istio-gateway or gateway-api", "mode", mode)
+		}
+	}
+
+	var reconciler *kubernetes.Reconciler
+	if *reconcile {
+		reconciler = &kubernetes.Reconciler{
+			BaseService:  base,
+			Routers:      localBackend.Routers,
+			ResyncPeriod: *reconcileResync,
+		}
+	}
+
+	var locker api.Locker
+	if *lockLeases {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			cmd.Fatal("Failed to create lock leases client", "error", err)
+		}
+		client, err := kubernetesGO.NewForConfig(config)
+		if err != nil {
+			cmd.Fatal("Failed to create lock leases client", "error", err)
+		}
+		locker = &api.LeaseLocker{
+			Client:    client,
+			Namespace: *k8sNamespace,
 		}
 	}
 
 	var routerBackend backend.Backend = localBackend
-	// enable multi-cluster support when file is provided
-	if *clustersFilePath != "" {
-		f, err := os.Open(*clustersFilePath)
+	// enable multi-cluster support when a source of clusters is provided
+	var clusterSource backend.ClusterSource
+	switch {
+	case *clustersFilePath != "":
+		clusterSource = &backend.FileClusterSource{Path: *clustersFilePath}
+	case *clustersSecretsSelector != "":
+		config, err := rest.InClusterConfig()
 		if err != nil {
-			log.Printf("failed to load clusters file: %v\n", err)
-			return
+			cmd.Fatal("Failed to load clusters secrets", "error", err)
+		}
+		client, err := kubernetesGO.NewForConfig(config)
+		if err != nil {
+			cmd.Fatal("Failed to load clusters secrets", "error", err)
 		}
-		clustersFile := &backend.ClustersFile{}
-		err = yaml.NewDecoder(f).Decode(clustersFile)
+		namespace := *clustersSecretsNamespace
+		if namespace == "" {
+			namespace = *k8sNamespace
+		}
+		clusterSource = &backend.SecretClusterSource{
+			Client:    client,
+			Namespace: namespace,
+			Selector:  *clustersSecretsSelector,
+		}
+	case *clustersURL != "":
+		clusterSource = &backend.HTTPClusterSource{URL: *clustersURL}
+	}
+	if clusterSource != nil {
+		registry := &backend.ClusterRegistry{
+			Source:         clusterSource,
+			ReloadInterval: *clustersReloadInterval,
+		}
+		err = registry.Start(context.Background())
 		if err != nil {
-			log.Printf("failed to load clusters file: %v\n", err)
+			slog.Error("Failed to load clusters", "error", err)
 			return
 		}
 
 		routerBackend = &backend.MultiCluster{
-			Namespace:  *k8sNamespace,
-			Fallback:   routerBackend,
-			K8sTimeout: k8sTimeout,
-			Modes:      runModes,
-			Clusters:   clustersFile.Clusters,
+			Namespace:    *k8sNamespace,
+			Fallback:     routerBackend,
+			K8sTimeout:   k8sTimeout,
+			Modes:        runModes,
+			ModeDefaults: modeDefaults,
+			Registry:     registry,
+
+			ClientCacheTTL:  *clustersClientCacheTTL,
+			ClientCacheSize: *clustersClientCacheSize,
+
+			HealthcheckTimeout: *clustersHealthcheckTimeout,
 		}
 	}
 
+	auditor := &api.Auditor{Recent: *auditRecent}
+	if *auditFile != "" {
+		sink, err := api.NewAuditFileSink(*auditFile)
+		if err != nil {
+			cmd.Fatal("Failed to open audit file", "error", err)
+		}
+		auditor.Sinks = append(auditor.Sinks, sink)
+	}
+	if *auditStdout {
+		auditor.Sinks = append(auditor.Sinks, &api.AuditWriterSink{W: os.Stdout})
+	}
+	if *auditWebhook != "" {
+		auditor.Sinks = append(auditor.Sinks, api.NewAuditWebhookSink(*auditWebhook))
+	}
+
 	cmd.StartDaemon(cmd.DaemonOpts{
 		Name:       "kubernetes-router",
 		ListenAddr: *listenAddr,
 		Backend:    routerBackend,
 		KeyFile:    *keyFile,
 		CertFile:   *certFile,
+		Reconciler: reconciler,
+		GCInterval: *gcInterval,
+		GCRouters:  localBackend.Routers,
+
+		Locker:      locker,
+		LockTimeout: *lockTimeout,
+
+		Auditor: auditor,
 	})
 }
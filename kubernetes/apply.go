@@ -0,0 +1,117 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fieldManager is the manager of the fields applied by the router
+const fieldManager = "kubernetes-router"
+
+var (
+	secretGVK = v1.SchemeGroupVersion.WithKind("Secret")
+
+	// secretApplyFields are the fields of certificate secrets owned by the
+	// router
+	secretApplyFields = []string{
+		"metadata.labels",
+		"metadata.annotations",
+		"type",
+		"data",
+	}
+)
+
+// applyPatch sends data as an apply patch of the object with opts
+type applyPatch func(ctx context.Context, data []byte, opts metav1.PatchOptions) error
+
+// apply writes the owned fields of obj with a server-side apply. Fields set
+// by other managers are left untouched, while the owned ones previously
+// applied and now missing from obj are removed. Owned fields also set by
+// other managers conflict, the router is their source of truth so the apply
+// is retried taking over them. A resource version set on obj is kept as a
+// precondition, failing with a conflict when the resource has changed since
+// it was read.
+func apply(ctx context.Context, obj metav1.Object, gvk schema.GroupVersionKind, owned []string, patch applyPatch) error {
+	data, err := applyData(obj, gvk, owned)
+	if err != nil {
+		return err
+	}
+	err = patch(ctx, data, applyOptions(ctx, false))
+	if !isFieldManagerConflict(err) {
+		return err
+	}
+	slog.InfoContext(ctx, "Taking over fields", "kind", gvk.Kind, "namespace", obj.GetNamespace(), "name", obj.GetName(), "conflict", err)
+	return patch(ctx, data, applyOptions(ctx, true))
+}
+
+// isFieldManagerConflict returns whether err is a conflict of the applied
+// fields with other managers, not of a stale resource version
+func isFieldManagerConflict(err error) bool {
+	if !k8sErrors.IsConflict(err) {
+		return false
+	}
+	status, ok := err.(k8sErrors.APIStatus)
+	if !ok || status.Status().Details == nil {
+		return false
+	}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type == metav1.CauseTypeFieldManagerConflict {
+			return true
+		}
+	}
+	return false
+}
+
+func applyOptions(ctx context.Context, force bool) metav1.PatchOptions {
+	return metav1.PatchOptions{
+		FieldManager: fieldManager,
+		Force:        &force,
+		DryRun:       dryRun(ctx),
+	}
+}
+
+// applyData returns the apply patch of obj, holding only its identity, its
+// resource version when set and the owned fields, given as dotted paths
+func applyData(obj metav1.Object, gvk schema.GroupVersionKind, owned []string) ([]byte, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var content map[string]interface{}
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		return nil, err
+	}
+	apiVersion, kind := gvk.ToAPIVersionAndKind()
+	result := map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+	}
+	for _, path := range append([]string{"metadata.name", "metadata.namespace", "metadata.resourceVersion"}, owned...) {
+		fields := strings.Split(path, ".")
+		value, found, err := unstructured.NestedFieldNoCopy(content, fields...)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		err = unstructured.SetNestedField(result, value, fields...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(result)
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ktesting "k8s.io/client-go/testing"
+)
+
+// fakeClientset is implemented by the fake clientsets of client-go and istio
+type fakeClientset interface {
+	PrependReactor(verb, resource string, reaction ktesting.ReactionFunc)
+	Tracker() ktesting.ObjectTracker
+}
+
+// fakeApply makes client handle server-side applies, which its tracker does
+// not support. Maps are merged by key while other values are replaced, the
+// fields applied before and missing from an apply are removed.
+func fakeApply(client fakeClientset, scheme *runtime.Scheme) {
+	applied := map[string][][]string{}
+	client.PrependReactor("patch", "*", func(action ktesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(ktesting.PatchAction)
+		if patchAction.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		key := strings.Join([]string{action.GetResource().String(), action.GetNamespace(), patchAction.GetName()}, "/")
+		obj, isNew, err := fakeApplied(client.Tracker(), scheme, patchAction, applied[key])
+		if err != nil {
+			return true, nil, err
+		}
+		applied[key], err = applyPaths(patchAction.GetPatch())
+		if err != nil {
+			return true, nil, err
+		}
+		if isNew {
+			err = client.Tracker().Create(action.GetResource(), obj, action.GetNamespace())
+		} else {
+			err = client.Tracker().Update(action.GetResource(), obj, action.GetNamespace())
+		}
+		return true, obj, err
+	})
+}
+
+// fakeApplied returns the object resulting from the apply of action,
+// removing the previous fields missing from it
+func fakeApplied(tracker ktesting.ObjectTracker, scheme *runtime.Scheme, action ktesting.PatchAction, previous [][]string) (runtime.Object, bool, error) {
+	var patch map[string]interface{}
+	err := json.Unmarshal(action.GetPatch(), &patch)
+	if err != nil {
+		return nil, false, err
+	}
+	content := map[string]interface{}{}
+	current, err := tracker.Get(action.GetResource(), action.GetNamespace(), action.GetName())
+	isNew := k8sErrors.IsNotFound(err)
+	if err != nil && !isNew {
+		return nil, false, err
+	}
+	if !isNew {
+		data, err := json.Marshal(current)
+		if err != nil {
+			return nil, false, err
+		}
+		err = json.Unmarshal(data, &content)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	version, _, _ := unstructured.NestedString(patch, "metadata", "resourceVersion")
+	currentVersion, _, _ := unstructured.NestedString(content, "metadata", "resourceVersion")
+	if version != "" && version != currentVersion {
+		return nil, false, k8sErrors.NewConflict(action.GetResource().GroupResource(), action.GetName(), errors.New("the object has been modified"))
+	}
+	paths, err := applyPaths(action.GetPatch())
+	if err != nil {
+		return nil, false, err
+	}
+	for _, path := range previous {
+		if !containsPath(paths, path) {
+			unstructured.RemoveNestedField(content, path...)
+		}
+	}
+	for _, path := range paths {
+		value, _, _ := unstructured.NestedFieldNoCopy(patch, path...)
+		err = unstructured.SetNestedField(content, value, path...)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	apiVersion, _ := patch["apiVersion"].(string)
+	kind, _ := patch["kind"].(string)
+	obj, err := scheme.New(schema.FromAPIVersionAndKind(apiVersion, kind))
+	if err != nil {
+		return nil, false, err
+	}
+	delete(content, "apiVersion")
+	delete(content, "kind")
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, false, err
+	}
+	return obj, isNew, json.Unmarshal(data, obj)
+}
+
+// applyPaths returns the paths of the fields set by an apply patch, down to
+// the keys of maps
+func applyPaths(data []byte) ([][]string, error) {
+	var patch map[string]interface{}
+	err := json.Unmarshal(data, &patch)
+	if err != nil {
+		return nil, err
+	}
+	delete(patch, "apiVersion")
+	delete(patch, "kind")
+	return mapPaths(patch, nil), nil
+}
+
+func mapPaths(content map[string]interface{}, prefix []string) [][]string {
+	var paths [][]string
+	for key, value := range content {
+		path := append(append([]string{}, prefix...), key)
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			paths = append(paths, mapPaths(nested, path)...)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func containsPath(paths [][]string, path []string) bool {
+	for _, p := range paths {
+		if strings.Join(p, "\x00") == strings.Join(path, "\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApplyData(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "test-router-lb",
+			Namespace:       "default",
+			ResourceVersion: "42",
+			Labels:          map[string]string{"app": "test"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeLoadBalancer,
+			ClusterIP: "10.0.0.1",
+			Ports:     []v1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8888)}},
+		},
+	}
+	data, err := applyData(svc, v1.SchemeGroupVersion.WithKind("Service"), serviceApplyFields)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"apiVersion": "v1",
+		"kind": "Service",
+		"metadata": {"name": "test-router-lb", "namespace": "default", "resourceVersion": "42", "labels": {"app": "test"}},
+		"spec": {"type": "LoadBalancer", "ports": [{"port": 80, "targetPort": 8888}]}
+	}`, string(data))
+}
+
+func TestApplyRetriesConflictsForcing(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-router-lb", Namespace: "default"}}
+	var forced []bool
+	err := apply(context.Background(), svc, v1.SchemeGroupVersion.WithKind("Service"), serviceApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+		assert.Equal(t, fieldManager, opts.FieldManager)
+		forced = append(forced, *opts.Force)
+		if !*opts.Force {
+			return k8sErrors.NewApplyConflict([]metav1.StatusCause{{Type: metav1.CauseTypeFieldManagerConflict, Field: ".spec.type"}}, "conflict")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true}, forced)
+}
+
+func TestApplyDoesNotForceStaleResourceVersions(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-router-lb", Namespace: "default", ResourceVersion: "42"}}
+	calls := 0
+	err := apply(context.Background(), svc, v1.SchemeGroupVersion.WithKind("Service"), serviceApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+		calls++
+		return k8sErrors.NewConflict(schema.GroupResource{Resource: "services"}, svc.Name, errors.New("the object has been modified"))
+	})
+	assert.True(t, k8sErrors.IsConflict(err))
+	assert.Equal(t, 1, calls)
+}
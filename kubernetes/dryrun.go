@@ -0,0 +1,104 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/tsuru/kubernetes-router/router"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type planKey struct{}
+
+// planned runs fn with a context making its writes server-side dry-runs,
+// returning the changes they would make
+func planned(ctx context.Context, fn func(ctx context.Context) error) (*router.Plan, error) {
+	plan := &router.Plan{Changes: []router.PlannedChange{}}
+	err := fn(context.WithValue(ctx, planKey{}, plan))
+	return plan, err
+}
+
+func planFromContext(ctx context.Context) *router.Plan {
+	plan, _ := ctx.Value(planKey{}).(*router.Plan)
+	return plan
+}
+
+// dryRun returns the DryRun option of the writes made with ctx, every
+// write of a plan must use it
+func dryRun(ctx context.Context) []string {
+	if planFromContext(ctx) == nil {
+		return nil
+	}
+	return []string{metav1.DryRunAll}
+}
+
+// planChange records a change accepted by the server as a dry-run, current
+// and desired are left out of the plan for secrets
+func planChange(ctx context.Context, action router.ChangeAction, kind string, current, desired metav1.Object, fields []string) {
+	plan := planFromContext(ctx)
+	if plan == nil {
+		return
+	}
+	change := router.PlannedChange{Action: action, Kind: kind, Fields: fields}
+	for _, obj := range []metav1.Object{desired, current} {
+		if obj != nil {
+			change.Namespace = obj.GetNamespace()
+			change.Name = obj.GetName()
+			break
+		}
+	}
+	if kind != "Secret" {
+		if current != nil {
+			change.Current = current
+		}
+		if desired != nil {
+			change.Desired = desired
+		}
+	}
+	plan.Add(change)
+}
+
+// PlanEnsure returns the changes an Ensure would make
+func (s *LBService) PlanEnsure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (*router.Plan, error) {
+	return planned(ctx, func(ctx context.Context) error {
+		return s.Ensure(ctx, id, o)
+	})
+}
+
+// PlanRemove returns the changes a Remove would make
+func (s *LBService) PlanRemove(ctx context.Context, id router.InstanceID) (*router.Plan, error) {
+	return planned(ctx, func(ctx context.Context) error {
+		return s.Remove(ctx, id)
+	})
+}
+
+// PlanEnsure returns the changes an Ensure would make
+func (k *IngressService) PlanEnsure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (*router.Plan, error) {
+	return planned(ctx, func(ctx context.Context) error {
+		return k.Ensure(ctx, id, o)
+	})
+}
+
+// PlanRemove returns the changes a Remove would make
+func (k *IngressService) PlanRemove(ctx context.Context, id router.InstanceID) (*router.Plan, error) {
+	return planned(ctx, func(ctx context.Context) error {
+		return k.Remove(ctx, id)
+	})
+}
+
+// PlanEnsure returns the changes an Ensure would make
+func (k *IstioGateway) PlanEnsure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (*router.Plan, error) {
+	return planned(ctx, func(ctx context.Context) error {
+		return k.Ensure(ctx, id, o)
+	})
+}
+
+// PlanRemove returns the changes a Remove would make
+func (k *IstioGateway) PlanRemove(ctx context.Context, id router.InstanceID) (*router.Plan, error) {
+	return planned(ctx, func(ctx context.Context) error {
+		return k.Remove(ctx, id)
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/router"
+	fakeistio "istio.io/client-go/pkg/clientset/versioned/fake"
+	istioscheme "istio.io/client-go/pkg/clientset/versioned/scheme"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	ktesting "k8s.io/client-go/testing"
+)
+
+// fakeDryRun makes the writes on client answer without being applied, like
+// server-side dry-runs
+func fakeDryRun(client fakeClientset, scheme *runtime.Scheme) {
+	client.PrependReactor("*", "*", func(action ktesting.Action) (bool, runtime.Object, error) {
+		switch action.GetVerb() {
+		case "create":
+			return true, action.(ktesting.CreateAction).GetObject(), nil
+		case "update":
+			return true, action.(ktesting.UpdateAction).GetObject(), nil
+		case "patch":
+			patchAction := action.(ktesting.PatchAction)
+			if patchAction.GetPatchType() == types.ApplyPatchType {
+				obj, _, err := fakeApplied(client.Tracker(), scheme, patchAction, nil)
+				return true, obj, err
+			}
+			return true, nil, nil
+		case "delete":
+			return true, nil, nil
+		}
+		return false, nil, nil
+	})
+}
+
+func webOpts(namespace string) router.EnsureBackendOpts {
+	return router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{Target: router.BackendTarget{Service: "test-web", Namespace: namespace}},
+		},
+	}
+}
+
+func TestLBPlanEnsure(t *testing.T) {
+	svc := createFakeLBService()
+	err := createAppWebService(svc.Client, svc.Namespace, "test")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("test"), webOpts(svc.Namespace))
+	require.NoError(t, err)
+	fakeDryRun(svc.Client.(*fake.Clientset), kubescheme.Scheme)
+
+	opts := webOpts(svc.Namespace)
+	opts.Opts.ExternalTrafficPolicy = "Local"
+	plan, err := svc.PlanEnsure(ctx, idForApp("test"), opts)
+	require.NoError(t, err)
+	require.Len(t, plan.Changes, 1)
+	change := plan.Changes[0]
+	assert.Equal(t, router.ChangeUpdate, change.Action)
+	assert.Equal(t, "Service", change.Kind)
+	assert.Equal(t, "test-router-lb", change.Name)
+	assert.Equal(t, []string{"spec", "metadata.annotations.router.tsuru.io/opts"}, change.Fields)
+	assert.Equal(t, v1.ServiceExternalTrafficPolicyTypeLocal, change.Desired.(*v1.Service).Spec.ExternalTrafficPolicy)
+
+	current, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, v1.ServiceExternalTrafficPolicyType(""), current.Spec.ExternalTrafficPolicy)
+
+	plan, err = svc.PlanEnsure(ctx, idForApp("test"), webOpts(svc.Namespace))
+	require.NoError(t, err)
+	assert.Empty(t, plan.Changes)
+}
+
+func TestLBPlanRemove(t *testing.T) {
+	svc := createFakeLBService()
+	err := createAppWebService(svc.Client, svc.Namespace, "test")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("test"), webOpts(svc.Namespace))
+	require.NoError(t, err)
+	fakeDryRun(svc.Client.(*fake.Clientset), kubescheme.Scheme)
+
+	plan, err := svc.PlanRemove(ctx, idForApp("test"))
+	require.NoError(t, err)
+	require.Len(t, plan.Changes, 1)
+	assert.Equal(t, router.ChangeDelete, plan.Changes[0].Action)
+	assert.Equal(t, "test-router-lb", plan.Changes[0].Name)
+	assert.Nil(t, plan.Changes[0].Desired)
+
+	current, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, current.Annotations, router.OptsAnnotation)
+}
+
+func TestIngressPlanRemove(t *testing.T) {
+	svc := createFakeService()
+	opts := webOpts(svc.Namespace)
+	opts.CNames = []string{"test.io"}
+	err := svc.Ensure(ctx, idForApp("test"), opts)
+	require.NoError(t, err)
+	fakeDryRun(svc.Client.(*fake.Clientset), kubescheme.Scheme)
+
+	plan, err := svc.PlanRemove(ctx, idForApp("test"))
+	require.NoError(t, err)
+	var deleted []string
+	for _, change := range plan.Changes {
+		assert.Equal(t, router.ChangeDelete, change.Action)
+		assert.Equal(t, "Ingress", change.Kind)
+		deleted = append(deleted, change.Name)
+	}
+	assert.Equal(t, []string{svc.ingressCName(idForApp("test"), "test.io"), svc.ingressName(idForApp("test"))}, deleted)
+
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressName(idForApp("test")), metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestIstioGatewayPlanEnsure(t *testing.T) {
+	svc, _ := fakeService()
+	istio := fakeistio.NewSimpleClientset()
+	fakeApply(istio, istioscheme.Scheme)
+	svc.istioClient = istio.NetworkingV1beta1()
+	err := createAppWebService(svc.Client, svc.Namespace, "test")
+	require.NoError(t, err)
+	fakeDryRun(istio, istioscheme.Scheme)
+
+	plan, err := svc.PlanEnsure(ctx, idForApp("test"), webOpts(svc.Namespace))
+	require.NoError(t, err)
+	require.Len(t, plan.Changes, 2)
+	assert.Equal(t, router.ChangeCreate, plan.Changes[0].Action)
+	assert.Equal(t, "Gateway", plan.Changes[0].Kind)
+	assert.Equal(t, router.ChangeCreate, plan.Changes[1].Action)
+	assert.Equal(t, "VirtualService", plan.Changes[1].Kind)
+
+	_, err = istio.NetworkingV1beta1().Gateways(svc.Namespace).Get(ctx, "test", metav1.GetOptions{})
+	assert.True(t, k8sErrors.IsNotFound(err))
+}
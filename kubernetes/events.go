@@ -0,0 +1,154 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/tsuru/kubernetes-router/router"
+	istioScheme "istio.io/client-go/pkg/clientset/versioned/scheme"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedV1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events emitted by the router
+const (
+	eventReasonEnsured            = "Ensured"
+	eventReasonEnsureFailed       = "EnsureFailed"
+	eventReasonCNameAdded         = "CNameAdded"
+	eventReasonCNameRemoved       = "CNameRemoved"
+	eventReasonCertificateAdded   = "CertificateAdded"
+	eventReasonCertificateRotated = "CertificateRotated"
+	eventReasonCertificateRemoved = "CertificateRemoved"
+	eventReasonSwapped            = "Swapped"
+	eventReasonRemoved            = "Removed"
+)
+
+// eventScheme resolves the kinds of the objects the events are emitted on
+var eventScheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(scheme.AddToScheme(eventScheme))
+	utilruntime.Must(istioScheme.AddToScheme(eventScheme))
+}
+
+// eventRecorder returns the EventRecorder, creating one writing the events
+// with the client of the cluster when unset. It returns nil once the events
+// are closed.
+func (k *BaseService) eventRecorder() (record.EventRecorder, error) {
+	k.eventRecorderMu.Lock()
+	defer k.eventRecorderMu.Unlock()
+	if k.eventsClosed {
+		return nil, nil
+	}
+	if k.EventRecorder != nil {
+		return k.EventRecorder, nil
+	}
+	client, err := k.getClient()
+	if err != nil {
+		return nil, err
+	}
+	k.eventBroadcaster = record.NewBroadcaster()
+	k.eventBroadcaster.StartRecordingToSink(&typedV1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	k.EventRecorder = k.eventBroadcaster.NewRecorder(eventScheme, v1.EventSource{Component: fieldManager})
+	return k.EventRecorder, nil
+}
+
+// CloseEvents stops the recorder of events created by the service, the
+// events recorded afterwards are dropped
+func (k *BaseService) CloseEvents() {
+	k.eventRecorderMu.Lock()
+	defer k.eventRecorderMu.Unlock()
+	k.eventsClosed = true
+	if k.eventBroadcaster != nil {
+		k.eventBroadcaster.Shutdown()
+		k.eventBroadcaster = nil
+	}
+}
+
+// recordEvent emits an event on obj and on the target service it routes to,
+// named by its base service labels. Nothing is emitted on dry-runs.
+func (k *BaseService) recordEvent(ctx context.Context, obj runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	k.recordEvents(ctx, obj, true, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// recordRemovalEvent emits an event on the target service of obj, which was
+// removed and can no longer hold events itself
+func (k *BaseService) recordRemovalEvent(ctx context.Context, obj runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	k.recordEvents(ctx, obj, false, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (k *BaseService) recordEvents(ctx context.Context, obj runtime.Object, onObj bool, eventType, reason, message string) {
+	if len(dryRun(ctx)) > 0 {
+		return
+	}
+	recorder, err := k.eventRecorder()
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to record event", "reason", reason, "error", err)
+		return
+	}
+	if recorder == nil {
+		return
+	}
+	if onObj {
+		recorder.Event(obj, eventType, reason, message)
+	}
+	objMeta, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	name := objMeta.GetLabels()[appBaseServiceNameLabel]
+	namespace := objMeta.GetLabels()[appBaseServiceNamespaceLabel]
+	if name == "" || (onObj && name == objMeta.GetName() && namespace == objMeta.GetNamespace()) {
+		return
+	}
+	client, err := k.getClient()
+	if err != nil {
+		return
+	}
+	target, err := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		slog.DebugContext(ctx, "Failed to get the target service of the event", "reason", reason, "error", err)
+		return
+	}
+	recorder.Event(target, eventType, reason, message)
+}
+
+// recordEnsureFailure emits a warning about err on current, the managed
+// object when it exists, and on the target service of o
+func (k *BaseService) recordEnsureFailure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts, current runtime.Object, err error) {
+	if len(dryRun(ctx)) > 0 || err == router.ErrIngressAlreadyExists {
+		return
+	}
+	recorder, recorderErr := k.eventRecorder()
+	if recorderErr != nil {
+		slog.WarnContext(ctx, "Failed to record event", "reason", eventReasonEnsureFailed, "error", recorderErr)
+		return
+	}
+	if recorder == nil {
+		return
+	}
+	message := fmt.Sprintf("ensure failed: %v", err)
+	if current != nil {
+		recorder.Event(current, v1.EventTypeWarning, eventReasonEnsureFailed, message)
+	}
+	target, targetErr := k.getDefaultBackendTarget(o.Prefixes)
+	if targetErr != nil {
+		return
+	}
+	service, targetErr := k.getWebService(ctx, id.AppName, *target)
+	if targetErr != nil {
+		return
+	}
+	recorder.Event(service, v1.EventTypeWarning, eventReasonEnsureFailed, message)
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/router"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func webEnsureOpts(cnames ...string) router.EnsureBackendOpts {
+	return router.EnsureBackendOpts{
+		CNames: cnames,
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-web",
+					Namespace: "default",
+				},
+			},
+		},
+	}
+}
+
+func TestIngressEnsureEvents(t *testing.T) {
+	svc := createFakeService()
+	recorder := record.NewFakeRecorder(100)
+	svc.EventRecorder = recorder
+
+	err := svc.Ensure(ctx, idForApp("test"), webEnsureOpts("cname1.io"))
+	require.NoError(t, err)
+	// every event is emitted on the ingress and on the target service
+	assert.Equal(t, []string{
+		"Normal Ensured ingress kubernetes-router-test-ingress ensured for host test.",
+		"Normal Ensured ingress kubernetes-router-test-ingress ensured for host test.",
+		"Normal CNameAdded CNAME cname1.io added",
+		"Normal CNameAdded CNAME cname1.io added",
+	}, drainEvents(recorder))
+
+	err = svc.Ensure(ctx, idForApp("test"), webEnsureOpts("cname2.io"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Normal Ensured ingress kubernetes-router-test-ingress ensured for host test.",
+		"Normal Ensured ingress kubernetes-router-test-ingress ensured for host test.",
+		"Normal CNameAdded CNAME cname2.io added",
+		"Normal CNameAdded CNAME cname2.io added",
+		"Normal CNameRemoved CNAME cname1.io removed",
+		"Normal CNameRemoved CNAME cname1.io removed",
+	}, drainEvents(recorder))
+}
+
+func TestIngressEnsureFailureEvent(t *testing.T) {
+	svc := createFakeService()
+	recorder := record.NewFakeRecorder(100)
+	svc.EventRecorder = recorder
+	err := svc.Ensure(ctx, idForApp("test"), webEnsureOpts())
+	require.NoError(t, err)
+	drainEvents(recorder)
+
+	svc.Client.(*fake.Clientset).PrependReactor("patch", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("admission webhook denied the request")
+	})
+	err = svc.Ensure(ctx, idForApp("test"), webEnsureOpts())
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"Warning EnsureFailed ensure failed: admission webhook denied the request",
+		"Warning EnsureFailed ensure failed: admission webhook denied the request",
+	}, drainEvents(recorder))
+}
+
+func TestIngressCertificateEvents(t *testing.T) {
+	svc := createFakeService()
+	recorder := record.NewFakeRecorder(100)
+	svc.EventRecorder = recorder
+	err := svc.Ensure(ctx, idForApp("test"), webEnsureOpts())
+	require.NoError(t, err)
+	drainEvents(recorder)
+
+	cert := router.CertData{Certificate: "Certz", Key: "keyz"}
+	err = svc.AddCertificate(ctx, idForApp("test"), "mycert.io", cert)
+	require.NoError(t, err)
+	err = svc.AddCertificate(ctx, idForApp("test"), "mycert.io", cert)
+	require.NoError(t, err)
+	err = svc.RemoveCertificate(ctx, idForApp("test"), "mycert.io")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Normal CertificateAdded certificate added for mycert.io",
+		"Normal CertificateAdded certificate added for mycert.io",
+		"Normal CertificateRotated certificate rotated for mycert.io",
+		"Normal CertificateRotated certificate rotated for mycert.io",
+		"Normal CertificateRemoved certificate removed for mycert.io",
+		"Normal CertificateRemoved certificate removed for mycert.io",
+	}, drainEvents(recorder))
+}
+
+func TestIngressRemoveEvent(t *testing.T) {
+	svc := createFakeService()
+	recorder := record.NewFakeRecorder(100)
+	svc.EventRecorder = recorder
+	err := svc.Ensure(ctx, idForApp("test"), webEnsureOpts())
+	require.NoError(t, err)
+	drainEvents(recorder)
+
+	err = svc.Remove(ctx, idForApp("test"))
+	require.NoError(t, err)
+	// the ingress is gone, only the target service gets the event
+	assert.Equal(t, []string{
+		"Normal Removed ingress kubernetes-router-test-ingress removed",
+	}, drainEvents(recorder))
+}
+
+func TestLBEnsureEvents(t *testing.T) {
+	svc := createFakeLBService()
+	recorder := record.NewFakeRecorder(100)
+	svc.EventRecorder = recorder
+	err := createAppWebService(svc.Client, svc.Namespace, "test")
+	require.NoError(t, err)
+
+	err = svc.Ensure(ctx, idForApp("test"), webEnsureOpts())
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Normal Ensured service test-router-lb ensured",
+		"Normal Ensured service test-router-lb ensured",
+	}, drainEvents(recorder))
+}
+
+func TestEventsNotRecordedOnPlans(t *testing.T) {
+	svc := createFakeService()
+	recorder := record.NewFakeRecorder(100)
+	svc.EventRecorder = recorder
+
+	_, err := planned(ctx, func(ctx context.Context) error {
+		return svc.Ensure(ctx, idForApp("test"), webEnsureOpts("cname1.io"))
+	})
+	require.NoError(t, err)
+	assert.Empty(t, drainEvents(recorder))
+}
+
+func TestCloseEvents(t *testing.T) {
+	svc := createFakeService()
+	recorder := record.NewFakeRecorder(100)
+	svc.EventRecorder = recorder
+	svc.CloseEvents()
+
+	err := svc.Ensure(ctx, idForApp("test"), webEnsureOpts())
+	require.NoError(t, err)
+	assert.Empty(t, drainEvents(recorder))
+}
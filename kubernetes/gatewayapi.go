@@ -0,0 +1,603 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tsuru/kubernetes-router/router"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	gatewayAPIGroup = "gateway.networking.k8s.io"
+
+	gatewayHTTPSPort = 443
+)
+
+var (
+	// ErrGatewayAPINotServed is returned when the cluster has no Gateway API CRDs installed
+	ErrGatewayAPINotServed = errors.New("gateway api is not served by the cluster")
+	// ErrGatewayNotConfigured is returned when no parent Gateway is configured
+	ErrGatewayNotConfigured = errors.New("no parent gateway configured for gateway-api mode")
+
+	// gatewayAPIVersions lists the supported Gateway API versions by order of preference
+	gatewayAPIVersions = []string{"v1", "v1beta1"}
+)
+
+var (
+	_ router.Router              = &GatewayAPI{}
+	_ router.RouterStatus        = &GatewayAPI{}
+	_ router.RouterTLS           = &GatewayAPI{}
+	_ router.RouterOptionsSchema = &GatewayAPI{}
+)
+
+// GatewayAPI manages HTTPRoutes attached to a shared parent Gateway in a
+// Kubernetes cluster with the Gateway API CRDs installed.
+type GatewayAPI struct {
+	*BaseService
+	DomainSuffix string
+
+	// GatewayName and GatewayNamespace reference the parent Gateway used by
+	// every HTTPRoute, the app namespace is used when GatewayNamespace is empty
+	GatewayName      string
+	GatewayNamespace string
+}
+
+func (g *GatewayAPI) groupVersion() (schema.GroupVersion, error) {
+	for _, version := range gatewayAPIVersions {
+		gv := schema.GroupVersion{Group: gatewayAPIGroup, Version: version}
+		served, err := g.ServesResource(gv, "httproutes")
+		if err != nil {
+			return schema.GroupVersion{}, err
+		}
+		if served {
+			return gv, nil
+		}
+	}
+	return schema.GroupVersion{}, ErrGatewayAPINotServed
+}
+
+func (g *GatewayAPI) resourceClient(resource, namespace string) (dynamic.ResourceInterface, schema.GroupVersion, error) {
+	client, err := g.getDynamicClient()
+	if err != nil {
+		return nil, schema.GroupVersion{}, err
+	}
+	gv, err := g.groupVersion()
+	if err != nil {
+		return nil, schema.GroupVersion{}, err
+	}
+	return client.Resource(gv.WithResource(resource)).Namespace(namespace), gv, nil
+}
+
+func (g *GatewayAPI) routeName(id router.InstanceID) string {
+	return g.hashedResourceName(id, id.AppName, 63)
+}
+
+func (g *GatewayAPI) secretName(id router.InstanceID, certName string) string {
+	return g.hashedResourceName(id, "kr-"+id.AppName+"-"+certName, 253)
+}
+
+// listenerName returns the name of the gateway listener serving the
+// certificate secret, listener names must be valid DNS labels so the secret
+// name, which may contain dots, is hashed
+func listenerName(secretName string) string {
+	h := sha256.New()
+	h.Write([]byte(secretName))
+	return fmt.Sprintf("tls-%x", h.Sum(nil))[:20]
+}
+
+func (g *GatewayAPI) gatewayNamespace(ctx context.Context, id router.InstanceID) (string, error) {
+	if g.GatewayNamespace != "" {
+		return g.GatewayNamespace, nil
+	}
+	return g.getAppNamespace(ctx, id.AppName)
+}
+
+func (g *GatewayAPI) vhost(id router.InstanceID, opts router.Opts) string {
+	domainSuffix := opts.DomainSuffix
+	if g.DomainSuffix != "" {
+		domainSuffix = g.DomainSuffix
+	}
+	if opts.Domain != "" {
+		return opts.Domain
+	}
+	if opts.DomainPrefix != "" {
+		return fmt.Sprintf("%v.%v.%v", opts.DomainPrefix, id.AppName, domainSuffix)
+	}
+	return fmt.Sprintf("%v.%v", id.AppName, domainSuffix)
+}
+
+func (g *GatewayAPI) parentRef() map[string]interface{} {
+	ref := map[string]interface{}{
+		"group": gatewayAPIGroup,
+		"kind":  "Gateway",
+		"name":  g.GatewayName,
+	}
+	if g.GatewayNamespace != "" {
+		ref["namespace"] = g.GatewayNamespace
+	}
+	return ref
+}
+
+// Ensure creates or updates the HTTPRoute of the app, attaching it to the
+// parent Gateway
+func (g *GatewayAPI) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) error {
+	if g.GatewayName == "" {
+		return ErrGatewayNotConfigured
+	}
+	ns, err := g.getAppNamespace(ctx, id.AppName)
+	if err != nil {
+		return err
+	}
+	routeClient, gv, err := g.resourceClient("httproutes", ns)
+	if err != nil {
+		return err
+	}
+	defaultTarget, err := g.getDefaultBackendTarget(o.Prefixes)
+	if err != nil {
+		return err
+	}
+	service, err := g.getWebService(ctx, id.AppName, *defaultTarget)
+	if err != nil {
+		return err
+	}
+	backends, err := g.prefixBackends(ctx, id, service, o.Prefixes)
+	if err != nil {
+		return err
+	}
+	rules, err := httpRouteRules(ns, o.Opts.Route, backends)
+	if err != nil {
+		return err
+	}
+
+	route := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": gv.String(),
+			"kind":       "HTTPRoute",
+			"metadata": map[string]interface{}{
+				"name":      g.routeName(id),
+				"namespace": ns,
+			},
+			"spec": map[string]interface{}{
+				"parentRefs": []interface{}{g.parentRef()},
+				"hostnames":  httpRouteHostnames(g.vhost(id, o.Opts), o.CNames),
+				"rules":      rules,
+			},
+		},
+	}
+	optsAnnotations, err := o.Opts.ToAnnotations()
+	if err != nil {
+		return err
+	}
+	route.SetLabels(mergeMaps(g.Labels, map[string]string{
+		appLabel:                     id.AppName,
+		appBaseServiceNamespaceLabel: defaultTarget.Namespace,
+		appBaseServiceNameLabel:      defaultTarget.Service,
+	}))
+	route.SetAnnotations(mergeMaps(g.Annotations, optsAnnotations, o.Opts.AdditionalOpts))
+	route.SetOwnerReferences([]metav1.OwnerReference{
+		*metav1.NewControllerRef(service, schema.GroupVersionKind{
+			Group:   v1.SchemeGroupVersion.Group,
+			Version: v1.SchemeGroupVersion.Version,
+			Kind:    "Service",
+		}),
+	})
+
+	var applied, existing *unstructured.Unstructured
+	err = retryOnConflict(ctx, "ensureHTTPRoute", func() error {
+		var err error
+		existing, err = routeClient.Get(ctx, route.GetName(), metav1.GetOptions{})
+		if err != nil {
+			if !k8sErrors.IsNotFound(err) {
+				return err
+			}
+			existing = nil
+			applied, err = routeClient.Create(ctx, route, metav1.CreateOptions{})
+			return err
+		}
+		if !httpRouteHasChanges(existing, route) {
+			applied = nil
+			return nil
+		}
+		route.SetResourceVersion(existing.GetResourceVersion())
+		applied, err = routeClient.Update(ctx, route, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		var current runtime.Object
+		if existing != nil {
+			current = existing
+		}
+		g.recordEnsureFailure(ctx, id, o, current, err)
+		return err
+	}
+	if applied != nil {
+		g.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonEnsured, "httproute %s ensured", applied.GetName())
+	}
+	return nil
+}
+
+func httpRouteHostnames(vhost string, cnames []string) []interface{} {
+	hostnames := []interface{}{vhost}
+	for _, cname := range cnames {
+		if cname != vhost {
+			hostnames = append(hostnames, cname)
+		}
+	}
+	return hostnames
+}
+
+func httpRouteRules(namespace, route string, backends []prefixBackend) ([]interface{}, error) {
+	rules := make([]interface{}, 0, len(backends))
+	for _, backend := range backends {
+		if len(backend.service.Spec.Ports) == 0 {
+			return nil, errors.Errorf("service %q has no ports", backend.service.Name)
+		}
+		routePath := prefixPath(route, backend.prefix)
+		if routePath == "" {
+			routePath = "/"
+		}
+		backendRef := map[string]interface{}{
+			"group":  "",
+			"kind":   "Service",
+			"name":   backend.service.Name,
+			"port":   int64(backend.service.Spec.Ports[0].Port),
+			"weight": int64(1),
+		}
+		if backend.service.Namespace != "" && backend.service.Namespace != namespace {
+			backendRef["namespace"] = backend.service.Namespace
+		}
+		rules = append(rules, map[string]interface{}{
+			"matches": []interface{}{
+				map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":  "PathPrefix",
+						"value": routePath,
+					},
+				},
+			},
+			"backendRefs": []interface{}{backendRef},
+		})
+	}
+	return rules, nil
+}
+
+func httpRouteHasChanges(existing, route *unstructured.Unstructured) bool {
+	if !reflect.DeepEqual(existing.Object["spec"], route.Object["spec"]) {
+		return true
+	}
+	existingLabels := existing.GetLabels()
+	for key, value := range route.GetLabels() {
+		if existingLabels[key] != value {
+			return true
+		}
+	}
+	existingAnnotations := existing.GetAnnotations()
+	for key, value := range route.GetAnnotations() {
+		if existingAnnotations[key] != value {
+			return true
+		}
+	}
+	return !reflect.DeepEqual(existing.GetOwnerReferences(), route.GetOwnerReferences())
+}
+
+// Remove removes the HTTPRoute of the app, its certificates and the
+// gateway listeners referencing them
+func (g *GatewayAPI) Remove(ctx context.Context, id router.InstanceID) error {
+	ns, err := g.getAppNamespace(ctx, id.AppName)
+	if err != nil {
+		return err
+	}
+	routeClient, _, err := g.resourceClient("httproutes", ns)
+	if err != nil {
+		return err
+	}
+	err = routeClient.Delete(ctx, g.routeName(id), metav1.DeleteOptions{})
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+
+	gatewayNS, err := g.gatewayNamespace(ctx, id)
+	if err != nil {
+		return err
+	}
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	secrets, err := client.CoreV1().Secrets(gatewayNS).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{appLabel: id.AppName}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets.Items {
+		certName := secret.Labels[domainLabel]
+		if certName == "" || secret.Name != g.secretName(id, certName) {
+			continue
+		}
+		err = g.RemoveCertificate(ctx, id, certName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAddresses returns the main hostname of the app HTTPRoute
+func (g *GatewayAPI) GetAddresses(ctx context.Context, id router.InstanceID) ([]string, error) {
+	route, err := g.getRoute(ctx, id)
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return []string{""}, nil
+		}
+		return nil, err
+	}
+	hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	if len(hostnames) == 0 {
+		return []string{""}, nil
+	}
+	return []string{hostnames[0]}, nil
+}
+
+// GetStatus reports the conditions set by the gateway controller on the
+// HTTPRoute for the parent Gateway
+func (g *GatewayAPI) GetStatus(ctx context.Context, id router.InstanceID) (router.BackendStatus, string, error) {
+	route, err := g.getRoute(ctx, id)
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return router.BackendStatusNotReady, "waiting for deploy", nil
+		}
+		return router.BackendStatusNotReady, "", err
+	}
+	ready, conditionsDetail := g.parentStatus(route)
+	if ready {
+		return router.BackendStatusReady, "", nil
+	}
+	detail, err := g.getStatusForRuntimeObject(ctx, route.GetNamespace(), "HTTPRoute", route.GetUID())
+	if err != nil {
+		return router.BackendStatusNotReady, "", err
+	}
+	return router.BackendStatusNotReady, conditionsDetail + detail, nil
+}
+
+func (g *GatewayAPI) parentStatus(route *unstructured.Unstructured) (bool, string) {
+	parents, _, _ := unstructured.NestedSlice(route.Object, "status", "parents")
+	for _, rawParent := range parents {
+		parent, ok := rawParent.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		parentName, _, _ := unstructured.NestedString(parent, "parentRef", "name")
+		if parentName != g.GatewayName {
+			continue
+		}
+		conditions, _, _ := unstructured.NestedSlice(parent, "conditions")
+		var detail strings.Builder
+		accepted := false
+		ready := true
+		for _, rawCondition := range conditions {
+			condition, ok := rawCondition.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			conditionType, _, _ := unstructured.NestedString(condition, "type")
+			status, _, _ := unstructured.NestedString(condition, "status")
+			if conditionType == "Accepted" && status == string(metav1.ConditionTrue) {
+				accepted = true
+			}
+			if status == string(metav1.ConditionTrue) {
+				continue
+			}
+			ready = false
+			reason, _, _ := unstructured.NestedString(condition, "reason")
+			message, _, _ := unstructured.NestedString(condition, "message")
+			fmt.Fprintf(&detail, "%s - %s - %s\n", conditionType, reason, message)
+		}
+		return accepted && ready, detail.String()
+	}
+	return false, fmt.Sprintf("route not attached to gateway %q yet\n", g.GatewayName)
+}
+
+func (g *GatewayAPI) getRoute(ctx context.Context, id router.InstanceID) (*unstructured.Unstructured, error) {
+	ns, err := g.getAppNamespace(ctx, id.AppName)
+	if err != nil {
+		return nil, err
+	}
+	routeClient, _, err := g.resourceClient("httproutes", ns)
+	if err != nil {
+		return nil, err
+	}
+	return routeClient.Get(ctx, g.routeName(id), metav1.GetOptions{})
+}
+
+// AddCertificate stores the certificate as a Secret in the gateway namespace
+// and adds an HTTPS listener referencing it to the parent Gateway
+func (g *GatewayAPI) AddCertificate(ctx context.Context, id router.InstanceID, certCname string, cert router.CertData) error {
+	if g.GatewayName == "" {
+		return ErrGatewayNotConfigured
+	}
+	gatewayNS, err := g.gatewayNamespace(ctx, id)
+	if err != nil {
+		return err
+	}
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      g.secretName(id, certCname),
+			Namespace: gatewayNS,
+			Labels: map[string]string{
+				appLabel:    id.AppName,
+				domainLabel: certCname,
+			},
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       []byte(cert.Certificate),
+			v1.TLSPrivateKeyKey: []byte(cert.Key),
+		},
+	}
+	existingSecret, err := client.CoreV1().Secrets(gatewayNS).Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return err
+		}
+		_, err = client.CoreV1().Secrets(gatewayNS).Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		secret.ResourceVersion = existingSecret.ResourceVersion
+		_, err = client.CoreV1().Secrets(gatewayNS).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	return g.updateGatewayListeners(ctx, gatewayNS, func(listeners []interface{}) []interface{} {
+		listeners = removeListener(listeners, secret.Name)
+		return append(listeners, map[string]interface{}{
+			"name":     listenerName(secret.Name),
+			"hostname": certCname,
+			"port":     int64(gatewayHTTPSPort),
+			"protocol": "HTTPS",
+			"tls": map[string]interface{}{
+				"mode": "Terminate",
+				"certificateRefs": []interface{}{
+					map[string]interface{}{
+						"kind": "Secret",
+						"name": secret.Name,
+					},
+				},
+			},
+			"allowedRoutes": map[string]interface{}{
+				"namespaces": map[string]interface{}{
+					"from": "All",
+				},
+			},
+		})
+	})
+}
+
+// GetCertificate returns the certificate stored for the app
+func (g *GatewayAPI) GetCertificate(ctx context.Context, id router.InstanceID, certCname string) (*router.CertData, error) {
+	gatewayNS, err := g.gatewayNamespace(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	client, err := g.getClient()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := client.CoreV1().Secrets(gatewayNS).Get(ctx, g.secretName(id, certCname), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &router.CertData{
+		Certificate: string(secret.Data[v1.TLSCertKey]),
+		Key:         string(secret.Data[v1.TLSPrivateKeyKey]),
+	}, nil
+}
+
+// RemoveCertificate removes the gateway listener and the Secret of the certificate
+func (g *GatewayAPI) RemoveCertificate(ctx context.Context, id router.InstanceID, certCname string) error {
+	gatewayNS, err := g.gatewayNamespace(ctx, id)
+	if err != nil {
+		return err
+	}
+	name := g.secretName(id, certCname)
+	if g.GatewayName != "" {
+		err = g.updateGatewayListeners(ctx, gatewayNS, func(listeners []interface{}) []interface{} {
+			return removeListener(listeners, name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	client, err := g.getClient()
+	if err != nil {
+		return err
+	}
+	err = client.CoreV1().Secrets(gatewayNS).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (g *GatewayAPI) updateGatewayListeners(ctx context.Context, namespace string, fn func([]interface{}) []interface{}) error {
+	gatewayClient, _, err := g.resourceClient("gateways", namespace)
+	if err != nil {
+		return err
+	}
+	// the parent gateway is shared by every app, its listeners are
+	// updated concurrently
+	return retryOnConflict(ctx, "updateGatewayListeners", func() error {
+		gateway, err := gatewayClient.Get(ctx, g.GatewayName, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "could not get parent gateway %q", g.GatewayName)
+		}
+		listeners, _, err := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+		if err != nil {
+			return err
+		}
+		newListeners := fn(listeners)
+		if reflect.DeepEqual(listeners, newListeners) {
+			return nil
+		}
+		err = unstructured.SetNestedSlice(gateway.Object, newListeners, "spec", "listeners")
+		if err != nil {
+			return err
+		}
+		_, err = gatewayClient.Update(ctx, gateway, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// removeListener removes the listener serving the certificate secret, along
+// with listeners named after the secret by older versions of the router
+func removeListener(listeners []interface{}, secretName string) []interface{} {
+	name := listenerName(secretName)
+	result := make([]interface{}, 0, len(listeners))
+	for _, rawListener := range listeners {
+		listener, ok := rawListener.(map[string]interface{})
+		if ok && (listener["name"] == name || listener["name"] == secretName) {
+			continue
+		}
+		result = append(result, rawListener)
+	}
+	return result
+}
+
+// SupportedOptions returns the supported options
+func (g *GatewayAPI) SupportedOptions(ctx context.Context) map[string]string {
+	return map[string]string{
+		router.Domain: "",
+		router.Route:  "",
+	}
+}
+
+// OptionsSchema returns the schema of the supported options
+func (g *GatewayAPI) OptionsSchema(ctx context.Context) map[string]router.OptionSchema {
+	return map[string]router.OptionSchema{
+		router.Domain:       {Type: router.OptionTypeDomain},
+		router.DomainSuffix: {Type: router.OptionTypeDomain},
+		router.DomainPrefix: {Type: router.OptionTypeDomain},
+		router.Route:        {Type: router.OptionTypePath},
+	}
+}
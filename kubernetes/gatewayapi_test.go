@@ -0,0 +1,338 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/router"
+	faketsuru "github.com/tsuru/tsuru/provision/kubernetes/pkg/client/clientset/versioned/fake"
+	v1 "k8s.io/api/core/v1"
+	fakeapiextensions "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	httpRoutesResource = schema.GroupVersionResource{Group: gatewayAPIGroup, Version: "v1", Resource: "httproutes"}
+	gatewaysResource   = schema.GroupVersionResource{Group: gatewayAPIGroup, Version: "v1", Resource: "gateways"}
+)
+
+func fakeGatewayAPI(t *testing.T) (GatewayAPI, *dynamicfake.FakeDynamicClient) {
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: gatewayAPIGroup + "/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "httproutes", Namespaced: true, Kind: "HTTPRoute"},
+				{Name: "gateways", Namespaced: true, Kind: "Gateway"},
+			},
+		},
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	_, err := dynamicClient.Resource(gatewaysResource).Namespace("gateways").Create(ctx, &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": gatewayAPIGroup + "/v1",
+			"kind":       "Gateway",
+			"metadata": map[string]interface{}{
+				"name":      "shared",
+				"namespace": "gateways",
+			},
+			"spec": map[string]interface{}{
+				"gatewayClassName": "default",
+				"listeners": []interface{}{
+					map[string]interface{}{
+						"name":     "http",
+						"port":     int64(80),
+						"protocol": "HTTP",
+					},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	return GatewayAPI{
+		BaseService: &BaseService{
+			Namespace:        "default",
+			Client:           client,
+			TsuruClient:      faketsuru.NewSimpleClientset(),
+			ExtensionsClient: fakeapiextensions.NewSimpleClientset(),
+			DynamicClient:    dynamicClient,
+		},
+		DomainSuffix:     "my.domain",
+		GatewayName:      "shared",
+		GatewayNamespace: "gateways",
+	}, dynamicClient
+}
+
+func TestGatewayAPIEnsure(t *testing.T) {
+	svc, dynamicClient := fakeGatewayAPI(t)
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = createAppProcessService(svc.Client, svc.Namespace, "myapp", "api")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		CNames: []string{"myapp.example.com"},
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace},
+			},
+			{
+				Prefix: "api",
+				Target: router.BackendTarget{Service: "myapp-api", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	route, err := dynamicClient.Resource(httpRoutesResource).Namespace(svc.Namespace).Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		appLabel:                     "myapp",
+		appBaseServiceNamespaceLabel: svc.Namespace,
+		appBaseServiceNameLabel:      "myapp-web",
+	}, route.GetLabels())
+	require.Len(t, route.GetOwnerReferences(), 1)
+	assert.Equal(t, "myapp-web", route.GetOwnerReferences()[0].Name)
+
+	hostnames, _, err := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"myapp.my.domain", "myapp.example.com"}, hostnames)
+
+	parentRefs, _, err := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"group":     gatewayAPIGroup,
+			"kind":      "Gateway",
+			"name":      "shared",
+			"namespace": "gateways",
+		},
+	}, parentRefs)
+
+	rules, _, err := unstructured.NestedSlice(route.Object, "spec", "rules")
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "/api", rules[0].(map[string]interface{})["matches"].([]interface{})[0].(map[string]interface{})["path"].(map[string]interface{})["value"])
+	assert.Equal(t, "myapp-api", rules[0].(map[string]interface{})["backendRefs"].([]interface{})[0].(map[string]interface{})["name"])
+	assert.Equal(t, "/", rules[1].(map[string]interface{})["matches"].([]interface{})[0].(map[string]interface{})["path"].(map[string]interface{})["value"])
+	assert.Equal(t, "myapp-web", rules[1].(map[string]interface{})["backendRefs"].([]interface{})[0].(map[string]interface{})["name"])
+
+	addrs, err := svc.GetAddresses(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"myapp.my.domain"}, addrs)
+}
+
+func TestGatewayAPIRouteRulesWithoutPorts(t *testing.T) {
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "myapp-web", Namespace: "default"}}
+	_, err := httpRouteRules("default", "", []prefixBackend{{service: service}})
+	assert.EqualError(t, err, `service "myapp-web" has no ports`)
+}
+
+func TestGatewayAPIEnsureUpdatesRoute(t *testing.T) {
+	svc, dynamicClient := fakeGatewayAPI(t)
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	opts := router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace},
+			},
+		},
+	}
+	err = svc.Ensure(ctx, idForApp("myapp"), opts)
+	require.NoError(t, err)
+
+	opts.CNames = []string{"www.example.com"}
+	err = svc.Ensure(ctx, idForApp("myapp"), opts)
+	require.NoError(t, err)
+
+	route, err := dynamicClient.Resource(httpRoutesResource).Namespace(svc.Namespace).Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	hostnames, _, err := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"myapp.my.domain", "www.example.com"}, hostnames)
+}
+
+func TestGatewayAPIEnsureWithoutGateway(t *testing.T) {
+	svc, _ := fakeGatewayAPI(t)
+	svc.GatewayName = ""
+	err := svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{})
+	assert.Equal(t, ErrGatewayNotConfigured, err)
+}
+
+func TestGatewayAPINotServed(t *testing.T) {
+	svc, _ := fakeGatewayAPI(t)
+	svc.Client.(*fake.Clientset).Resources = nil
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace},
+			},
+		},
+	})
+	assert.Equal(t, ErrGatewayAPINotServed, err)
+}
+
+func TestGatewayAPIGetStatus(t *testing.T) {
+	svc, dynamicClient := fakeGatewayAPI(t)
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+
+	status, detail, err := svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "waiting for deploy", detail)
+
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	status, detail, err = svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "route not attached to gateway \"shared\" yet\n", detail)
+
+	routeClient := dynamicClient.Resource(httpRoutesResource).Namespace(svc.Namespace)
+	route, err := routeClient.Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	err = unstructured.SetNestedSlice(route.Object, []interface{}{
+		map[string]interface{}{
+			"parentRef": map[string]interface{}{"name": "shared"},
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Accepted", "status": "True"},
+				map[string]interface{}{"type": "ResolvedRefs", "status": "False", "reason": "BackendNotFound", "message": "service not found"},
+			},
+		},
+	}, "status", "parents")
+	require.NoError(t, err)
+	route, err = routeClient.Update(ctx, route, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	status, detail, err = svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "ResolvedRefs - BackendNotFound - service not found\n", detail)
+
+	err = unstructured.SetNestedSlice(route.Object, []interface{}{
+		map[string]interface{}{
+			"parentRef": map[string]interface{}{"name": "shared"},
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Accepted", "status": "True"},
+				map[string]interface{}{"type": "ResolvedRefs", "status": "True"},
+			},
+		},
+	}, "status", "parents")
+	require.NoError(t, err)
+	_, err = routeClient.Update(ctx, route, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	status, detail, err = svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusReady, status)
+	assert.Equal(t, "", detail)
+}
+
+func TestGatewayAPICertificate(t *testing.T) {
+	svc, dynamicClient := fakeGatewayAPI(t)
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	expectedCert := router.CertData{Certificate: "Certz", Key: "keyz"}
+	err = svc.AddCertificate(ctx, idForApp("myapp"), "myapp.my.domain", expectedCert)
+	require.NoError(t, err)
+
+	cert, err := svc.GetCertificate(ctx, idForApp("myapp"), "myapp.my.domain")
+	require.NoError(t, err)
+	assert.Equal(t, &expectedCert, cert)
+
+	secret, err := svc.Client.CoreV1().Secrets("gateways").Get(ctx, "kr-myapp-myapp.my.domain", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{appLabel: "myapp", domainLabel: "myapp.my.domain"}, secret.Labels)
+
+	gatewayClient := dynamicClient.Resource(gatewaysResource).Namespace("gateways")
+	gateway, err := gatewayClient.Get(ctx, "shared", metav1.GetOptions{})
+	require.NoError(t, err)
+	listeners, _, err := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	httpsListener := listeners[1].(map[string]interface{})
+	assert.Equal(t, listenerName("kr-myapp-myapp.my.domain"), httpsListener["name"])
+	assert.Regexp(t, "^[a-z0-9]([-a-z0-9]*[a-z0-9])?$", httpsListener["name"])
+	assert.Equal(t, "myapp.my.domain", httpsListener["hostname"])
+	assert.Equal(t, "HTTPS", httpsListener["protocol"])
+	assert.Equal(t, int64(443), httpsListener["port"])
+
+	err = svc.AddCertificate(ctx, idForApp("myapp"), "myapp.my.domain", router.CertData{Certificate: "Certz2", Key: "keyz2"})
+	require.NoError(t, err)
+	gateway, err = gatewayClient.Get(ctx, "shared", metav1.GetOptions{})
+	require.NoError(t, err)
+	listeners, _, err = unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	require.NoError(t, err)
+	assert.Len(t, listeners, 2)
+
+	err = svc.RemoveCertificate(ctx, idForApp("myapp"), "myapp.my.domain")
+	require.NoError(t, err)
+	_, err = svc.GetCertificate(ctx, idForApp("myapp"), "myapp.my.domain")
+	assert.Error(t, err)
+	gateway, err = gatewayClient.Get(ctx, "shared", metav1.GetOptions{})
+	require.NoError(t, err)
+	listeners, _, err = unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	assert.Equal(t, "http", listeners[0].(map[string]interface{})["name"])
+}
+
+func TestGatewayAPIRemove(t *testing.T) {
+	svc, dynamicClient := fakeGatewayAPI(t)
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+	err = svc.AddCertificate(ctx, idForApp("myapp"), "myapp.my.domain", router.CertData{Certificate: "Certz", Key: "keyz"})
+	require.NoError(t, err)
+
+	err = svc.Remove(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+
+	_, err = dynamicClient.Resource(httpRoutesResource).Namespace(svc.Namespace).Get(ctx, "myapp", metav1.GetOptions{})
+	assert.True(t, k8sErrors.IsNotFound(err))
+	secrets, err := svc.Client.CoreV1().Secrets("gateways").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, secrets.Items, 0)
+	gateway, err := dynamicClient.Resource(gatewaysResource).Namespace("gateways").Get(ctx, "shared", metav1.GetOptions{})
+	require.NoError(t, err)
+	listeners, _, err := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	require.NoError(t, err)
+	assert.Len(t, listeners, 1)
+}
@@ -7,21 +7,24 @@ package kubernetes
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"reflect"
 	"strings"
 
-	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
+	"github.com/tsuru/kubernetes-router/observability"
 	"github.com/tsuru/kubernetes-router/router"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
-	v1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/types"
 	typedV1 "k8s.io/client-go/kubernetes/typed/core/v1"
-	typedV1beta1 "k8s.io/client-go/kubernetes/typed/extensions/v1beta1"
 )
 
 var (
@@ -37,12 +40,26 @@ var (
 	defaultOptsAsAnnotationsDocs = map[string]string{
 		defaultClassOpt: "Ingress class for the Ingress object",
 	}
+
+	// ingressApplyFields are the fields of ingresses owned by the router, a
+	// default backend set by others is kept
+	ingressApplyFields = []string{
+		"metadata.labels",
+		"metadata.annotations",
+		"metadata.ownerReferences",
+		"spec.ingressClassName",
+		"spec.rules",
+		"spec.tls",
+	}
 )
 
 var (
-	_ router.Router       = &IngressService{}
-	_ router.RouterTLS    = &IngressService{}
-	_ router.RouterStatus = &IngressService{}
+	_ router.Router              = &IngressService{}
+	_ router.RouterTLS           = &IngressService{}
+	_ router.RouterStatus        = &IngressService{}
+	_ router.RouterSwap          = &IngressService{}
+	_ router.RouterOptionsSchema = &IngressService{}
+	_ router.RouterPlanner       = &IngressService{}
 )
 
 // IngressService manages ingresses in a Kubernetes cluster that uses ingress-nginx
@@ -62,44 +79,63 @@ type IngressService struct {
 // Ensure creates or updates an Ingress resource to point it to either
 // the only service or the one responsible for the process web
 func (k *IngressService) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ensureIngress")
-	defer span.Finish()
+	ctx, span := observability.Tracer().Start(ctx, "ensureIngress")
+	defer span.End()
 
-	span.SetTag("cnames", o.CNames)
-	span.SetTag("preserveOldCNames", o.PreserveOldCNames)
+	span.SetAttributes(
+		attribute.StringSlice("cnames", o.CNames),
+		attribute.Bool("preserveOldCNames", o.PreserveOldCNames),
+	)
 
-	ns, err := k.getAppNamespace(ctx, id.AppName)
+	err := retryOnConflict(ctx, "ensureIngress", func() error {
+		return k.ensure(ctx, id, o)
+	})
 	if err != nil {
 		setSpanError(span, err)
+		var current runtime.Object
+		if ingress, getErr := k.get(ctx, id); getErr == nil {
+			current = ingress
+		}
+		k.recordEnsureFailure(ctx, id, o, current, err)
+	}
+	return err
+}
+
+// ensure reads the ingresses of the app and merges them with o, it is
+// retried as a whole when they are changed concurrently
+func (k *IngressService) ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) error {
+	span := trace.SpanFromContext(ctx)
+
+	ns, err := k.getAppNamespace(ctx, id.AppName)
+	if err != nil {
 		return err
 	}
 	ingressClient, err := k.ingressClient(ns)
 	if err != nil {
-		setSpanError(span, err)
 		return err
 	}
-	isNew := false
 	existingIngress, err := k.get(ctx, id)
-	if err != nil {
-		if !k8sErrors.IsNotFound(err) {
-			setSpanError(span, err)
-			return err
-		}
-		isNew = true
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return err
 	}
 
 	defaultTarget, err := k.getDefaultBackendTarget(o.Prefixes)
 	if err != nil {
-		setSpanError(span, err)
 		return err
 	}
 
-	span.SetTag("defaultTarget.service", defaultTarget.Service)
-	span.SetTag("defaultTarget.namespace", defaultTarget.Namespace)
+	span.SetAttributes(
+		attribute.String("defaultTarget.service", defaultTarget.Service),
+		attribute.String("defaultTarget.namespace", defaultTarget.Namespace),
+	)
 
 	service, err := k.getWebService(ctx, id.AppName, *defaultTarget)
 	if err != nil {
-		setSpanError(span, err)
+		return err
+	}
+
+	backends, err := k.prefixBackends(ctx, id, service, o.Prefixes)
+	if err != nil {
 		return err
 	}
 
@@ -117,7 +153,7 @@ func (k *IngressService) Ensure(ctx context.Context, id router.InstanceID, o rou
 		vhost = fmt.Sprintf("%v.%v.%v", o.Opts.DomainPrefix, id.AppName, domainSuffix)
 	}
 
-	ingress := &v1beta1.Ingress{
+	ingress := &networkingv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      k.ingressName(id),
 			Namespace: ns,
@@ -133,18 +169,50 @@ func (k *IngressService) Ensure(ctx context.Context, id router.InstanceID, o rou
 				}),
 			},
 		},
-		Spec: buildIngressSpec(vhost, o.Opts.Route, service),
+		Spec: buildIngressSpec(vhost, o.Opts.Route, backends, ingressClient.pathType()),
 	}
 	k.fillIngressMeta(ingress, o.Opts, id)
+	ingressClient.convertClassAnnotation(ingress)
+	ownBackends := ingress.DeepCopy()
+
+	// a swapped app keeps serving the backends of its partner, those are
+	// kept up to date by the Ensure of the partner itself
+	var swap *swapState
+	var partnerIngress, swappedBackends *networkingv1.Ingress
+	if existingIngress != nil {
+		swap = getSwapState(existingIngress.ObjectMeta)
+	}
+	if swap != nil {
+		partnerIngress, err = k.get(ctx, swap.partner)
+		if k8sErrors.IsNotFound(err) {
+			// the partner was removed, there is nothing left to swap with
+			swap = nil
+		} else if err != nil {
+			return errors.Wrapf(err, "could not get swap partner %q", swap.partner.AppName)
+		}
+	}
+	if swap != nil {
+		setSwapMeta(&ingress.ObjectMeta, swap)
+		swappedBackends = partnerIngress
+		if !swap.cnameOnly {
+			swappedBackends = existingIngress
+			setIngressBackends(ingress, existingIngress)
+		}
+	}
 	if len(o.CNames) > 0 {
 		ingress.Annotations[AnnotationsCNames] = strings.Join(o.CNames, ",")
 	}
+	err = k.storeEnsureOpts(&ingress.ObjectMeta, id, o)
+	if err != nil {
+		return err
+	}
 
-	var existingCNames []string
+	var existingCNames, preservedCNames []string
 	if existingIngress != nil {
 		existingCNames = strings.Split(existingIngress.Annotations[AnnotationsCNames], ",")
+		preservedCNames = splitCNames(existingIngress.Annotations[annotationPreservedCNames])
 	}
-	_, cnamesToRemove := diffCNames(existingCNames, o.CNames)
+	cnamesToAdd, cnamesToRemove := diffCNames(existingCNames, o.CNames)
 
 	for _, cname := range o.CNames {
 		err = k.ensureCNameBackend(ctx, ensureCNameBackendOpts{
@@ -152,19 +220,30 @@ func (k *IngressService) Ensure(ctx context.Context, id router.InstanceID, o rou
 			id:         id,
 			cname:      cname,
 			service:    service,
+			backends:   backends,
+			swapped:    swappedBackends,
+			swap:       swap,
 			routerOpts: o.Opts,
 		})
 		if err != nil {
-			err = errors.Wrapf(err, "could not ensure CName: %q", cname)
-			setSpanError(span, err)
-			return err
+			return errors.Wrapf(err, "could not ensure CName: %q", cname)
 		}
 	}
 
+	// CNAMEs kept by PreserveOldCNames are recorded so CollectGarbage
+	// leaves them alone, they are removed by the next Ensure not
+	// preserving them
+	_, stalePreserved := diffCNames(preservedCNames, o.CNames)
 	if o.PreserveOldCNames {
+		preserved := mergeCNames(stalePreserved, cnamesToRemove)
+		if len(preserved) > 0 {
+			ingress.Annotations[annotationPreservedCNames] = strings.Join(preserved, ",")
+		}
 		cnamesToRemove = []string{}
+	} else {
+		cnamesToRemove = append(cnamesToRemove, stalePreserved...)
 	}
-	span.LogKV("cnamesToRemove", cnamesToRemove)
+	span.AddEvent("cnamesToRemove", trace.WithAttributes(attribute.StringSlice("cnamesToRemove", cnamesToRemove)))
 	for _, cname := range cnamesToRemove {
 		err = k.removeCNameBackend(ctx, ensureCNameBackendOpts{
 			namespace:  ns,
@@ -174,53 +253,91 @@ func (k *IngressService) Ensure(ctx context.Context, id router.InstanceID, o rou
 			routerOpts: o.Opts,
 		})
 		if err != nil {
-			err = errors.Wrapf(err, "could not remove CName: %q", cname)
-			setSpanError(span, err)
-			return err
+			return errors.Wrapf(err, "could not remove CName: %q", cname)
 		}
 	}
-	if isNew {
-		_, err = ingressClient.Create(ctx, ingress, metav1.CreateOptions{})
+	hosts := append([]string{vhost}, o.CNames...)
+	if swap != nil {
+		hosts = swappedHosts(vhost, partnerIngress, swap.cnameOnly)
+	}
+	err = k.ensureCanaryIngresses(ctx, ensureCanaryOpts{
+		namespace: ns,
+		id:        id,
+		hosts:     hosts,
+		opts:      o,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not ensure canaries")
+	}
+	if swap != nil {
+		err = k.ensurePartnerBackends(ctx, ingressClient, swap, partnerIngress, ownBackends)
 		if err != nil {
-			setSpanError(span, err)
+			return errors.Wrap(err, "could not ensure swapped backends")
 		}
-		return err
 	}
-
-	hasChanges := ingressHasChanges(span, existingIngress, ingress)
-	if hasChanges {
-		ingress.ObjectMeta.ResourceVersion = existingIngress.ObjectMeta.ResourceVersion
-		if existingIngress.Spec.Backend != nil {
-			ingress.Spec.Backend = existingIngress.Spec.Backend
-		}
-		_, err = ingressClient.Update(ctx, ingress, metav1.UpdateOptions{})
+	if existingIngress != nil {
+		// spec.tls is replaced as a whole, the certificates added to the
+		// ingress are kept
+		certificates, err := k.certificatesTLS(ctx, ns, id, existingIngress)
 		if err != nil {
-			setSpanError(span, err)
+			return err
 		}
+		secrets := map[string]bool{}
+		for _, tls := range ingress.Spec.TLS {
+			secrets[tls.SecretName] = true
+		}
+		for _, tls := range certificates {
+			if !secrets[tls.SecretName] {
+				ingress.Spec.TLS = append(ingress.Spec.TLS, tls)
+			}
+		}
+		// the ingress is merged with the one read, which must not have
+		// changed since
+		ingress.ResourceVersion = existingIngress.ResourceVersion
+	}
+	applied, err := ingressClient.Apply(ctx, ingress)
+	if err != nil {
 		return err
 	}
-
+	k.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonEnsured, "ingress %s ensured for host %s", applied.Name, vhost)
+	for _, cname := range cnamesToAdd {
+		k.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonCNameAdded, "CNAME %s added", cname)
+	}
+	for _, cname := range cnamesToRemove {
+		if cname != "" {
+			k.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonCNameRemoved, "CNAME %s removed", cname)
+		}
+	}
 	return nil
 }
 
-func buildIngressSpec(host, path string, service *v1.Service) v1beta1.IngressSpec {
-	pathType := v1beta1.PathTypeImplementationSpecific
-	return v1beta1.IngressSpec{
-		Rules: []v1beta1.IngressRule{
+func buildIngressSpec(host, route string, backends []prefixBackend, pathType networkingv1.PathType) networkingv1.IngressSpec {
+	paths := make([]networkingv1.HTTPIngressPath, 0, len(backends))
+	for _, backend := range backends {
+		ingressPath := prefixPath(route, backend.prefix)
+		if ingressPath == "" && pathType == networkingv1.PathTypePrefix {
+			ingressPath = "/"
+		}
+		paths = append(paths, networkingv1.HTTPIngressPath{
+			Path:     ingressPath,
+			PathType: &pathType,
+			Backend: networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{
+					Name: backend.service.Name,
+					Port: networkingv1.ServiceBackendPort{
+						Number: backend.service.Spec.Ports[0].Port,
+					},
+				},
+			},
+		})
+	}
+	return networkingv1.IngressSpec{
+		Rules: []networkingv1.IngressRule{
 			{
 				Host: host,
-				IngressRuleValue: v1beta1.IngressRuleValue{
-					HTTP: &v1beta1.HTTPIngressRuleValue{
-						Paths: []v1beta1.HTTPIngressPath{
-							{
-								Path:     path,
-								PathType: &pathType,
-								Backend: v1beta1.IngressBackend{
-									ServiceName: service.Name,
-									ServicePort: intstr.FromInt(int(service.Spec.Ports[0].Port)),
-								},
-							},
-						},
+				IngressRuleValue: networkingv1.IngressRuleValue{
+					HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: paths,
 					},
 				},
 			},
@@ -228,40 +345,29 @@ func buildIngressSpec(host, path string, service *v1.Service) v1beta1.IngressSpe
 	}
 }
 
-func setSpanError(span opentracing.Span, err error) {
-	span.SetTag("error", true)
-	span.LogKV("error.message", err.Error())
-}
-
 type ensureCNameBackendOpts struct {
 	namespace  string
 	id         router.InstanceID
 	cname      string
 	service    *v1.Service
+	backends   []prefixBackend
+	swapped    *networkingv1.Ingress
+	swap       *swapState
 	routerOpts router.Opts
 }
 
 func (k *IngressService) ensureCNameBackend(ctx context.Context, opts ensureCNameBackendOpts) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ensureIngressCName")
-	defer span.Finish()
+	ctx, span := observability.Tracer().Start(ctx, "ensureIngressCName")
+	defer span.End()
 
-	span.SetTag("cname", opts.cname)
+	span.SetAttributes(attribute.String("cname", opts.cname))
 
 	ingressClient, err := k.ingressClient(opts.namespace)
 	if err != nil {
 		return err
 	}
-	isNew := false
-	existingIngress, err := ingressClient.Get(ctx, k.ingressCName(opts.id, opts.cname), metav1.GetOptions{})
-	if err != nil {
-		if !k8sErrors.IsNotFound(err) {
-			return err
-
-		}
-		isNew = true
-	}
 
-	ingress := &v1beta1.Ingress{
+	ingress := &networkingv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      k.ingressCName(opts.id, opts.cname),
 			Namespace: opts.namespace,
@@ -278,15 +384,20 @@ func (k *IngressService) ensureCNameBackend(ctx context.Context, opts ensureCNam
 				}),
 			},
 		},
-		Spec: buildIngressSpec(opts.cname, opts.routerOpts.Route, opts.service),
+		Spec: buildIngressSpec(opts.cname, opts.routerOpts.Route, opts.backends, ingressClient.pathType()),
 	}
 
 	k.fillIngressMeta(ingress, opts.routerOpts, opts.id)
+	ingressClient.convertClassAnnotation(ingress)
+	if opts.swapped != nil {
+		setIngressBackends(ingress, opts.swapped)
+		setSwapMeta(&ingress.ObjectMeta, opts.swap)
+	}
 
 	if ingress.Annotations[AnnotationsACMEKey] == "true" {
-		log.Printf("Acme-tls is enabled on ingress, creating TLS secret for CNAME.")
+		slog.DebugContext(ctx, "Acme-tls is enabled on ingress, creating TLS secret for CNAME", "cname", opts.cname)
 		ingress.Spec.TLS = append(ingress.Spec.TLS,
-			[]v1beta1.IngressTLS{
+			[]networkingv1.IngressTLS{
 				{
 					Hosts:      []string{opts.cname},
 					SecretName: k.secretName(opts.id, opts.cname),
@@ -294,29 +405,222 @@ func (k *IngressService) ensureCNameBackend(ctx context.Context, opts ensureCNam
 			}...)
 	}
 
-	if isNew {
-		_, err = ingressClient.Create(ctx, ingress, metav1.CreateOptions{})
-		return err
+	_, err = ingressClient.Apply(ctx, ingress)
+	return err
+}
+
+// setIngressBackends copies the backends and the base service labels of
+// source to the main rule of ingress
+func setIngressBackends(ingress, source *networkingv1.Ingress) {
+	if len(source.Spec.Rules) > 0 && len(ingress.Spec.Rules) > 0 {
+		ingress.Spec.Rules[0].HTTP = source.Spec.Rules[0].HTTP.DeepCopy()
+	}
+	if ingress.Labels == nil {
+		ingress.Labels = map[string]string{}
+	}
+	for _, label := range []string{appBaseServiceNamespaceLabel, appBaseServiceNameLabel} {
+		ingress.Labels[label] = source.Labels[label]
 	}
+}
 
-	hasChanges := ingressHasChanges(span, existingIngress, ingress)
-	if hasChanges {
-		ingress.ObjectMeta.ResourceVersion = existingIngress.ObjectMeta.ResourceVersion
-		if existingIngress.Spec.Backend != nil {
-			ingress.Spec.Backend = existingIngress.Spec.Backend
+// setIngressHosts replicates the main rule of ingress for each host
+func setIngressHosts(ingress *networkingv1.Ingress, hosts []string) {
+	if len(ingress.Spec.Rules) == 0 || len(hosts) == 0 {
+		return
+	}
+	rules := make([]networkingv1.IngressRule, 0, len(hosts))
+	for _, host := range hosts {
+		rule := *ingress.Spec.Rules[0].DeepCopy()
+		rule.Host = host
+		rules = append(rules, rule)
+	}
+	ingress.Spec.Rules = rules
+}
+
+func ingressCNames(ingress *networkingv1.Ingress) []string {
+	var cnames []string
+	for _, cname := range strings.Split(ingress.Annotations[AnnotationsCNames], ",") {
+		if cname != "" {
+			cnames = append(cnames, cname)
 		}
-		_, err = ingressClient.Update(ctx, ingress, metav1.UpdateOptions{})
+	}
+	return cnames
+}
+
+// swappedHosts returns the hosts serving the backends of an app swapped with
+// the owner of partner: the partner cnames and either the partner main host
+// or, when only cnames were swapped, vhost
+func swappedHosts(vhost string, partner *networkingv1.Ingress, cnameOnly bool) []string {
+	hosts := []string{vhost}
+	if !cnameOnly {
+		hosts = []string{ingressHost(partner)}
+	}
+	return append(hosts, ingressCNames(partner)...)
+}
+
+// ensurePartnerBackends writes the backends of a swapped app to the
+// ingresses of its partner serving them: the partner cname ingresses and,
+// unless only cnames were swapped, the partner main ingress
+func (k *IngressService) ensurePartnerBackends(ctx context.Context, ingressClient *versionedIngressClient, swap *swapState, partner, backends *networkingv1.Ingress) error {
+	var targets []*networkingv1.Ingress
+	if !swap.cnameOnly {
+		targets = append(targets, partner)
+	}
+	for _, cname := range ingressCNames(partner) {
+		cnameIngress, err := ingressClient.Get(ctx, k.ingressCName(swap.partner, cname), metav1.GetOptions{})
+		if err != nil {
+			if k8sErrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		targets = append(targets, cnameIngress)
+	}
+	for _, target := range targets {
+		setIngressBackends(target, backends)
+		_, err := ingressClient.Apply(ctx, target)
+		if err != nil {
+			return errors.Wrapf(err, "could not update ingress %q", target.Name)
+		}
+	}
+	return nil
+}
+
+// Swap exchanges the hosts serving the backends of two apps, the main and
+// cname hosts or only the cname ones, along with their canary ingresses. All
+// ingresses are restored when any update fails
+func (k *IngressService) Swap(ctx context.Context, src, dst router.InstanceID, opts router.SwapOpts) error {
+	srcIngress, err := k.get(ctx, src)
+	if err != nil {
 		return err
 	}
+	dstIngress, err := k.get(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if srcIngress.Namespace != dstIngress.Namespace {
+		return router.ErrSwapDifferentNamespaces
+	}
+	unswap, cnameOnly, err := checkSwap(srcIngress.ObjectMeta, dstIngress.ObjectMeta, src, dst, opts)
+	if err != nil {
+		return err
+	}
+	ingressClient, err := k.ingressClient(srcIngress.Namespace)
+	if err != nil {
+		return err
+	}
+
+	newSrc, newDst := srcIngress.DeepCopy(), dstIngress.DeepCopy()
+	if !cnameOnly && len(newSrc.Spec.Rules) > 0 && len(newDst.Spec.Rules) > 0 {
+		newSrc.Spec.Rules[0].HTTP, newDst.Spec.Rules[0].HTTP = newDst.Spec.Rules[0].HTTP, newSrc.Spec.Rules[0].HTTP
+	}
+	swapObjectMeta(&newSrc.ObjectMeta, &newDst.ObjectMeta, src, dst, unswap, cnameOnly)
+
+	// cnames serve the backends of the main ingress of their app, which
+	// belong to the partner on full swaps, or the backends of the partner
+	// main ingress when only cnames are swapped
+	srcBackends, dstBackends := newSrc, newDst
+	if cnameOnly && !unswap {
+		srcBackends, dstBackends = newDst, newSrc
+	}
+	srcUpdates, err := k.swappedIngresses(ctx, ingressClient, src, newSrc, newDst, srcBackends)
+	if err != nil {
+		return err
+	}
+	dstUpdates, err := k.swappedIngresses(ctx, ingressClient, dst, newDst, newSrc, dstBackends)
+	if err != nil {
+		return err
+	}
+	updates := append([]*networkingv1.Ingress{newSrc}, srcUpdates...)
+	updates = append(updates, newDst)
+	updates = append(updates, dstUpdates...)
+	err = updateSwappedIngresses(ctx, ingressClient, updates)
+	if err != nil {
+		return err
+	}
+	k.recordEvent(ctx, srcIngress, v1.EventTypeNormal, eventReasonSwapped, "swapped with %s", dst.AppName)
+	k.recordEvent(ctx, dstIngress, v1.EventTypeNormal, eventReasonSwapped, "swapped with %s", src.AppName)
+	return nil
+}
+
+// swappedIngresses returns the cname and canary ingresses of an app updated
+// after its main ingress is swapped with the partner one
+func (k *IngressService) swappedIngresses(ctx context.Context, ingressClient *versionedIngressClient, id router.InstanceID, ingress, partner, backends *networkingv1.Ingress) ([]*networkingv1.Ingress, error) {
+	swap := getSwapState(ingress.ObjectMeta)
+	var updates []*networkingv1.Ingress
+	for _, cname := range ingressCNames(ingress) {
+		cnameIngress, err := ingressClient.Get(ctx, k.ingressCName(id, cname), metav1.GetOptions{})
+		if err != nil {
+			if k8sErrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		setIngressBackends(cnameIngress, backends)
+		setSwapMeta(&cnameIngress.ObjectMeta, swap)
+		updates = append(updates, cnameIngress)
+	}
+
+	hosts := append([]string{ingressHost(ingress)}, ingressCNames(ingress)...)
+	if swap != nil {
+		hosts = swappedHosts(ingressHost(ingress), partner, swap.cnameOnly)
+	}
+	canaries, err := ingressClient.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			appLabel:           id.AppName,
+			labelCanaryIngress: "true",
+		}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range canaries.Items {
+		canary := &canaries.Items[i]
+		if canary.Name != k.ingressCanary(id, canary.Annotations[annotationCanaryPrefix]) {
+			continue
+		}
+		setIngressHosts(canary, hosts)
+		updates = append(updates, canary)
+	}
+	return updates, nil
+}
 
+// updateSwappedIngresses updates the ingresses in order, restoring the ones
+// already updated when an update fails
+func updateSwappedIngresses(ctx context.Context, ingressClient *versionedIngressClient, ingresses []*networkingv1.Ingress) error {
+	originals := make([]*networkingv1.Ingress, 0, len(ingresses))
+	for _, ingress := range ingresses {
+		original, err := ingressClient.Get(ctx, ingress.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		originals = append(originals, original)
+	}
+	for i, ingress := range ingresses {
+		_, err := ingressClient.Update(ctx, ingress, metav1.UpdateOptions{})
+		if err == nil {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			current, rollbackErr := ingressClient.Get(ctx, originals[j].Name, metav1.GetOptions{})
+			if rollbackErr == nil {
+				originals[j].ResourceVersion = current.ResourceVersion
+				_, rollbackErr = ingressClient.Update(ctx, originals[j], metav1.UpdateOptions{})
+			}
+			if rollbackErr != nil {
+				return errors.Wrapf(err, "failed to rollback swap: %v", rollbackErr)
+			}
+		}
+		return err
+	}
 	return nil
 }
 
 func (k *IngressService) removeCNameBackend(ctx context.Context, opts ensureCNameBackendOpts) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "removeIngressCName")
-	defer span.Finish()
+	ctx, span := observability.Tracer().Start(ctx, "removeIngressCName")
+	defer span.End()
 
-	span.SetTag("cname", opts.cname)
+	span.SetAttributes(attribute.String("cname", opts.cname))
 
 	ingressClient, err := k.ingressClient(opts.namespace)
 	if err != nil {
@@ -329,7 +633,8 @@ func (k *IngressService) removeCNameBackend(ctx context.Context, opts ensureCNam
 	return nil
 }
 
-// Remove removes the Ingress resource associated with the app
+// Remove removes the Ingress resource associated with the app, along with
+// its CNAME ingresses and certificate secrets
 func (k *IngressService) Remove(ctx context.Context, id router.InstanceID) error {
 	ns, err := k.getAppNamespace(ctx, id.AppName)
 	if err != nil {
@@ -339,12 +644,43 @@ func (k *IngressService) Remove(ctx context.Context, id router.InstanceID) error
 	if err != nil {
 		return err
 	}
+	// the Reconciler repairs CNAME and canary ingresses with the opts stored
+	// on the main ingress, they must be forgotten before any removal
+	err = k.forgetEnsureOpts(ctx, func(ctx context.Context, data []byte) error {
+		return client.Patch(ctx, k.ingressName(id), types.MergePatchType, data, metav1.PatchOptions{})
+	})
+	if err != nil {
+		return err
+	}
+	err = k.removeCanaryIngresses(ctx, client, id, nil)
+	if err != nil {
+		return err
+	}
+	err = k.removeCNameIngresses(ctx, client, id)
+	if err != nil {
+		return err
+	}
+	err = k.removeCertificateSecrets(ctx, ns, id)
+	if err != nil {
+		return err
+	}
+	ingress, err := client.Get(ctx, k.ingressName(id), metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	deletePropagation := metav1.DeletePropagationForeground
-	err = client.Delete(ctx, k.ingressName(id), metav1.DeleteOptions{PropagationPolicy: &deletePropagation})
+	err = client.Delete(ctx, ingress.Name, metav1.DeleteOptions{PropagationPolicy: &deletePropagation})
 	if k8sErrors.IsNotFound(err) {
 		return nil
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	k.recordRemovalEvent(ctx, ingress, v1.EventTypeNormal, eventReasonRemoved, "ingress %s removed", ingress.Name)
+	return nil
 }
 
 // Get gets the address of the loadbalancer associated with
@@ -374,7 +710,11 @@ func (k *IngressService) GetStatus(ctx context.Context, id router.InstanceID) (r
 		}
 		return router.BackendStatusNotReady, "", err
 	}
-	if isIngressReady(ingress) {
+	prefixesDetail, prefixesReady, err := k.prefixesStatus(ctx, ingress)
+	if err != nil {
+		return router.BackendStatusNotReady, "", err
+	}
+	if isIngressReady(ingress) && prefixesReady {
 		return router.BackendStatusReady, "", nil
 	}
 	detail, err := k.getStatusForRuntimeObject(ctx, ingress.Namespace, "Ingress", ingress.UID)
@@ -382,10 +722,49 @@ func (k *IngressService) GetStatus(ctx context.Context, id router.InstanceID) (r
 		return router.BackendStatusNotReady, "", err
 	}
 
-	return router.BackendStatusNotReady, detail, nil
+	return router.BackendStatusNotReady, prefixesDetail + detail, nil
+}
+
+// prefixesStatus checks whether every path of the ingress points to a
+// service with ready endpoints, reporting one line per path not ready
+func (k *IngressService) prefixesStatus(ctx context.Context, ingress *networkingv1.Ingress) (string, bool, error) {
+	if len(ingress.Spec.Rules) == 0 || ingress.Spec.Rules[0].HTTP == nil {
+		return "", true, nil
+	}
+	client, err := k.getClient()
+	if err != nil {
+		return "", false, err
+	}
+	var detail strings.Builder
+	ready := true
+	for _, ingressPath := range ingress.Spec.Rules[0].HTTP.Paths {
+		if ingressPath.Backend.Service == nil {
+			continue
+		}
+		serviceName := ingressPath.Backend.Service.Name
+		endpoints, err := client.CoreV1().Endpoints(ingress.Namespace).Get(ctx, serviceName, metav1.GetOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return "", false, err
+		}
+		if endpoints != nil && hasReadyEndpoints(endpoints) {
+			continue
+		}
+		ready = false
+		fmt.Fprintf(&detail, "path %q: service %q has no ready endpoints\n", ingressPath.Path, serviceName)
+	}
+	return detail.String(), ready, nil
+}
+
+func hasReadyEndpoints(endpoints *v1.Endpoints) bool {
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
-func (k *IngressService) get(ctx context.Context, id router.InstanceID) (*v1beta1.Ingress, error) {
+func (k *IngressService) get(ctx context.Context, id router.InstanceID) (*networkingv1.Ingress, error) {
 	ns, err := k.getAppNamespace(ctx, id.AppName)
 	if err != nil {
 		return nil, err
@@ -401,12 +780,19 @@ func (k *IngressService) get(ctx context.Context, id router.InstanceID) (*v1beta
 	return ingress, nil
 }
 
-func (k *IngressService) ingressClient(namespace string) (typedV1beta1.IngressInterface, error) {
+func (k *IngressService) ingressClient(namespace string) (*versionedIngressClient, error) {
 	client, err := k.getClient()
 	if err != nil {
 		return nil, err
 	}
-	return client.ExtensionsV1beta1().Ingresses(namespace), nil
+	servesV1, err := k.ServesResource(networkingv1.SchemeGroupVersion, "ingresses")
+	if err != nil {
+		return nil, err
+	}
+	if servesV1 {
+		return &versionedIngressClient{v1: client.NetworkingV1().Ingresses(namespace)}, nil
+	}
+	return &versionedIngressClient{legacy: client.ExtensionsV1beta1().Ingresses(namespace)}, nil
 }
 
 func (k *IngressService) secretClient(namespace string) (typedV1.SecretInterface, error) {
@@ -438,6 +824,11 @@ func (s *IngressService) annotationWithPrefix(suffix string) string {
 
 // AddCertificate adds certificates to app ingress
 func (k *IngressService) AddCertificate(ctx context.Context, id router.InstanceID, certCname string, cert router.CertData) error {
+	ctx, span := observability.Tracer().Start(ctx, "addIngressCertificate")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("cname", certCname))
+
 	ns, err := k.getAppNamespace(ctx, id.AppName)
 	if err != nil {
 		return err
@@ -450,40 +841,106 @@ func (k *IngressService) AddCertificate(ctx context.Context, id router.InstanceI
 	if err != nil {
 		return err
 	}
-	ingress, err := k.get(ctx, id)
+	var updated *networkingv1.Ingress
+	var rotated bool
+	err = retryOnConflict(ctx, "addIngressCertificate", func() error {
+		ingress, err := k.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		tlsSecret := v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      k.secretName(id, certCname),
+				Namespace: ns,
+				Labels: map[string]string{
+					appLabel:                id.AppName,
+					domainLabel:             certCname,
+					labelIngressCertificate: "true",
+				},
+				Annotations: make(map[string]string),
+			},
+			Type: "kubernetes.io/tls",
+			Data: map[string][]byte{
+				"tls.key": []byte(cert.Key),
+				"tls.crt": []byte(cert.Certificate),
+			},
+		}
+		var retSecret *v1.Secret
+		err = apply(ctx, &tlsSecret, secretGVK, secretApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+			var err error
+			retSecret, err = secret.Patch(ctx, tlsSecret.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		// a certificate already added for the cname is replaced
+		tls := removeIngressTLS(ingress.Spec.TLS, certCname)
+		rotated = len(tls) < len(ingress.Spec.TLS)
+		ingress.Spec.TLS = append(tls,
+			[]networkingv1.IngressTLS{
+				{
+					Hosts:      []string{certCname},
+					SecretName: retSecret.Name,
+				},
+			}...)
+		updated, err = ingressClient.Update(ctx, ingress, metav1.UpdateOptions{})
+		return err
+	})
 	if err != nil {
+		setSpanError(span, err)
 		return err
 	}
-	tlsSecret := v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      k.secretName(id, certCname),
-			Namespace: ns,
-			Labels: map[string]string{
-				appLabel:    id.AppName,
-				domainLabel: certCname,
-			},
-			Annotations: make(map[string]string),
-		},
-		Type: "kubernetes.io/tls",
-		StringData: map[string]string{
-			"tls.key": cert.Key,
-			"tls.crt": cert.Certificate,
-		},
+	if rotated {
+		k.recordEvent(ctx, updated, v1.EventTypeNormal, eventReasonCertificateRotated, "certificate rotated for %s", certCname)
+	} else {
+		k.recordEvent(ctx, updated, v1.EventTypeNormal, eventReasonCertificateAdded, "certificate added for %s", certCname)
 	}
-	retSecret, err := secret.Create(ctx, &tlsSecret, metav1.CreateOptions{})
-	if err != nil {
-		return err
+	return nil
+}
+
+// removeIngressTLS returns the TLS entries not serving host
+func removeIngressTLS(entries []networkingv1.IngressTLS, host string) []networkingv1.IngressTLS {
+	result := make([]networkingv1.IngressTLS, 0, len(entries))
+	for _, tls := range entries {
+		if !containsString(tls.Hosts, host) {
+			result = append(result, tls)
+		}
 	}
+	return result
+}
 
-	ingress.Spec.TLS = append(ingress.Spec.TLS,
-		[]v1beta1.IngressTLS{
-			{
-				Hosts:      []string{certCname},
-				SecretName: retSecret.Name,
-			},
-		}...)
-	_, err = ingressClient.Update(ctx, ingress, metav1.UpdateOptions{})
-	return err
+// certificatesTLS returns the TLS entries of ingress serving the
+// certificates added by AddCertificate
+func (k *IngressService) certificatesTLS(ctx context.Context, namespace string, id router.InstanceID, ingress *networkingv1.Ingress) ([]networkingv1.IngressTLS, error) {
+	if len(ingress.Spec.TLS) == 0 {
+		return nil, nil
+	}
+	secret, err := k.secretClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := secret.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{appLabel: id.AppName}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	certificates := map[string]bool{}
+	for _, s := range secrets.Items {
+		certName := s.Labels[domainLabel]
+		if certName != "" && s.Name == k.secretName(id, certName) {
+			certificates[s.Name] = true
+		}
+	}
+	var result []networkingv1.IngressTLS
+	for _, tls := range ingress.Spec.TLS {
+		if certificates[tls.SecretName] {
+			result = append(result, tls)
+		}
+	}
+	return result, nil
 }
 
 // GetCertificate get certificates from app ingress
@@ -509,6 +966,11 @@ func (k *IngressService) GetCertificate(ctx context.Context, id router.InstanceI
 
 // RemoveCertificate delete certificates from app ingress
 func (k *IngressService) RemoveCertificate(ctx context.Context, id router.InstanceID, certCname string) error {
+	ctx, span := observability.Tracer().Start(ctx, "removeIngressCertificate")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("cname", certCname))
+
 	ns, err := k.getAppNamespace(ctx, id.AppName)
 	if err != nil {
 		return err
@@ -517,27 +979,36 @@ func (k *IngressService) RemoveCertificate(ctx context.Context, id router.Instan
 	if err != nil {
 		return err
 	}
-	ingress, err := k.get(ctx, id)
-	if err != nil {
-		return err
-	}
 	secret, err := k.secretClient(ns)
 	if err != nil {
 		return err
 	}
-	for k := range ingress.Spec.TLS {
-		for _, host := range ingress.Spec.TLS[k].Hosts {
-			if strings.Compare(certCname, host) == 0 {
-				ingress.Spec.TLS = append(ingress.Spec.TLS[:k], ingress.Spec.TLS[k+1:]...)
+	var updated *networkingv1.Ingress
+	err = retryOnConflict(ctx, "removeIngressCertificate", func() error {
+		ingress, err := k.get(ctx, id)
+		if err != nil {
+			return err
+		}
+		for k := range ingress.Spec.TLS {
+			for _, host := range ingress.Spec.TLS[k].Hosts {
+				if strings.Compare(certCname, host) == 0 {
+					ingress.Spec.TLS = append(ingress.Spec.TLS[:k], ingress.Spec.TLS[k+1:]...)
+				}
 			}
 		}
-	}
-	_, err = ingressClient.Update(ctx, ingress, metav1.UpdateOptions{})
+		updated, err = ingressClient.Update(ctx, ingress, metav1.UpdateOptions{})
+		return err
+	})
 	if err != nil {
+		setSpanError(span, err)
 		return err
 	}
 	err = secret.Delete(ctx, k.secretName(id, certCname), metav1.DeleteOptions{})
-	return err
+	if err != nil {
+		return err
+	}
+	k.recordEvent(ctx, updated, v1.EventTypeNormal, eventReasonCertificateRemoved, "certificate removed for %s", certCname)
+	return nil
 }
 
 // SupportedOptions returns the supported options
@@ -557,7 +1028,18 @@ func (s *IngressService) SupportedOptions(ctx context.Context) map[string]string
 	return opts
 }
 
-func (s *IngressService) fillIngressMeta(i *v1beta1.Ingress, routerOpts router.Opts, id router.InstanceID) {
+// OptionsSchema returns the schema of the supported options
+func (s *IngressService) OptionsSchema(ctx context.Context) map[string]router.OptionSchema {
+	return map[string]router.OptionSchema{
+		router.Domain:       {Type: router.OptionTypeDomain},
+		router.DomainSuffix: {Type: router.OptionTypeDomain},
+		router.DomainPrefix: {Type: router.OptionTypeDomain},
+		router.Acme:         {Type: router.OptionTypeBool},
+		router.Route:        {Type: router.OptionTypePath},
+	}
+}
+
+func (s *IngressService) fillIngressMeta(i *networkingv1.Ingress, routerOpts router.Opts, id router.InstanceID) {
 	if i.ObjectMeta.Labels == nil {
 		i.ObjectMeta.Labels = map[string]string{}
 	}
@@ -599,7 +1081,7 @@ func (s *IngressService) fillIngressMeta(i *v1beta1.Ingress, routerOpts router.O
 		return
 	}
 	if len(i.Spec.Rules) > 0 {
-		i.Spec.TLS = []v1beta1.IngressTLS{
+		i.Spec.TLS = []networkingv1.IngressTLS{
 			{
 				Hosts:      []string{i.Spec.Rules[0].Host},
 				SecretName: s.secretName(id, i.Spec.Rules[0].Host),
@@ -609,52 +1091,31 @@ func (s *IngressService) fillIngressMeta(i *v1beta1.Ingress, routerOpts router.O
 	i.ObjectMeta.Annotations[AnnotationsACMEKey] = "true"
 }
 
-func ingressHasChanges(span opentracing.Span, existing *v1beta1.Ingress, ing *v1beta1.Ingress) (hasChanges bool) {
+// ingressChanges returns the fields of existing changed by ing: the spec,
+// the cnames annotations and the annotations and labels set by ing. Plans
+// describe applies with it, the server itself skips applies changing nothing
+func ingressChanges(existing *networkingv1.Ingress, ing *networkingv1.Ingress) []string {
+	var fields []string
 	if !reflect.DeepEqual(existing.Spec, ing.Spec) {
-		span.LogKV(
-			"message", "ingress has changed the spec",
-			"ingress", existing.Name,
-		)
-		return true
+		fields = append(fields, "spec")
 	}
-
-	if existing.Annotations[AnnotationsCNames] != ing.Annotations[AnnotationsCNames] {
-		return true
-	}
-
-	for key, value := range ing.Annotations {
-		if existing.Annotations[key] != value {
-			span.LogKV(
-				"message", "ingress has changed the annotation",
-				"ingress", existing.Name,
-				"annotation", key,
-				"existingValue", existing.Annotations[key],
-				"newValue", value,
-			)
-
-			return true
+	for _, key := range []string{AnnotationsCNames, annotationPreservedCNames} {
+		if existing.Annotations[key] != ing.Annotations[key] {
+			fields = append(fields, "metadata.annotations."+key)
 		}
 	}
-	for key, value := range ing.Labels {
-		if existing.Labels[key] != value {
-			span.LogKV(
-				"message", "ingress has changed the label",
-				"ingress", existing.Name,
-				"label", key,
-				"existingValue", existing.Labels[key],
-				"newValue", value,
-			)
-			return true
+	for _, key := range changedKeys(existing.Annotations, ing.Annotations) {
+		if key != AnnotationsCNames && key != annotationPreservedCNames {
+			fields = append(fields, "metadata.annotations."+key)
 		}
 	}
-	span.LogKV(
-		"message", "ingress has no changes",
-		"ingress", existing.Name,
-	)
-	return false
+	for _, key := range changedKeys(existing.Labels, ing.Labels) {
+		fields = append(fields, "metadata.labels."+key)
+	}
+	return fields
 }
 
-func isIngressReady(ingress *v1beta1.Ingress) bool {
+func isIngressReady(ingress *networkingv1.Ingress) bool {
 	if len(ingress.Status.LoadBalancer.Ingress) == 0 {
 		return false
 	}
@@ -6,14 +6,19 @@ package kubernetes
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tsuru/kubernetes-router/router"
+	tsuruv1 "github.com/tsuru/tsuru/provision/kubernetes/pkg/apis/tsuru/v1"
 	faketsuru "github.com/tsuru/tsuru/provision/kubernetes/pkg/client/clientset/versioned/fake"
 	v1 "k8s.io/api/core/v1"
 	v1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
 	fakeapiextensions "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,11 +26,13 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
 	ktesting "k8s.io/client-go/testing"
 )
 
 func createFakeService() IngressService {
 	client := fake.NewSimpleClientset()
+	fakeApply(client, kubescheme.Scheme)
 	err := createAppWebService(client, "default", "test")
 	if err != nil {
 		panic(err)
@@ -42,14 +49,18 @@ func createFakeService() IngressService {
 }
 
 func createAppWebService(client kubernetes.Interface, namespace, appName string) error {
+	return createAppProcessService(client, namespace, appName, "web")
+}
+
+func createAppProcessService(client kubernetes.Interface, namespace, appName, process string) error {
 	_, err := client.CoreV1().Services(namespace).Create(context.TODO(), &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: appName + "-web",
+			Name: appName + "-" + process,
 		},
 		Spec: v1.ServiceSpec{
 			Selector: map[string]string{
 				"tsuru.io/app-name":    appName,
-				"tsuru.io/app-process": "web",
+				"tsuru.io/app-process": process,
 			},
 			Ports: []v1.ServicePort{
 				{
@@ -105,15 +116,18 @@ func TestIngressEnsure(t *testing.T) {
 	expectedIngress.Labels["XPTO"] = "true"
 	expectedIngress.Annotations["ann1"] = "val1"
 	expectedIngress.Annotations["ann2"] = "val2"
+	expectedIngress.Annotations["router.tsuru.io/opts"] = `{"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`
 
 	assert.Equal(t, expectedIngress, ingressFound)
 }
 
 func TestIngressEnsureWithCNames(t *testing.T) {
 	svc := createFakeService()
+	err := createAppProcessService(svc.Client, svc.Namespace, "test", "subscriber")
+	require.NoError(t, err)
 	svc.Labels = map[string]string{"controller": "my-controller", "XPTO": "true"}
 	svc.Annotations = map[string]string{"ann1": "val1", "ann2": "val2"}
-	err := svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
 		Opts: router.Opts{
 			Route: "/admin",
 		},
@@ -140,13 +154,23 @@ func TestIngressEnsureWithCNames(t *testing.T) {
 
 	expectedIngress := defaultIngress("test", "default")
 	pathType := v1beta1.PathTypeImplementationSpecific
+	subscriberPath := v1beta1.HTTPIngressPath{
+		Path:     "/admin/subscriber",
+		PathType: &pathType,
+		Backend: v1beta1.IngressBackend{
+			ServiceName: "test-subscriber",
+			ServicePort: intstr.FromInt(8888),
+		},
+	}
 
 	expectedIngress.Spec.Rules[0].HTTP.Paths[0].Path = "/admin"
+	expectedIngress.Spec.Rules[0].HTTP.Paths = append([]v1beta1.HTTPIngressPath{subscriberPath}, expectedIngress.Spec.Rules[0].HTTP.Paths...)
 	expectedIngress.Labels["controller"] = "my-controller"
 	expectedIngress.Labels["XPTO"] = "true"
 	expectedIngress.Annotations["ann1"] = "val1"
 	expectedIngress.Annotations["ann2"] = "val2"
 	expectedIngress.Annotations["router.tsuru.io/cnames"] = "test.io,www.test.io"
+	expectedIngress.Annotations["router.tsuru.io/opts"] = `{"Route":"/admin","app":"test","cnames":["test.io","www.test.io"],"prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}},{"prefix":"subscriber","target":{"namespace":"default","service":"test-subscriber"}}]}`
 
 	assert.Equal(t, expectedIngress, foundIngress)
 
@@ -156,12 +180,14 @@ func TestIngressEnsureWithCNames(t *testing.T) {
 	expectedIngress.Name = "kubernetes-router-cname-test.io"
 	expectedIngress.Labels["router.tsuru.io/is-cname-ingress"] = "true"
 	delete(expectedIngress.Annotations, "router.tsuru.io/cnames")
+	delete(expectedIngress.Annotations, "router.tsuru.io/opts")
 
 	expectedIngress.Spec.Rules[0] = v1beta1.IngressRule{
 		Host: "test.io",
 		IngressRuleValue: v1beta1.IngressRuleValue{
 			HTTP: &v1beta1.HTTPIngressRuleValue{
 				Paths: []v1beta1.HTTPIngressPath{
+					subscriberPath,
 					{
 						Path:     "/admin",
 						PathType: &pathType,
@@ -186,6 +212,7 @@ func TestIngressEnsureWithCNames(t *testing.T) {
 		IngressRuleValue: v1beta1.IngressRuleValue{
 			HTTP: &v1beta1.HTTPIngressRuleValue{
 				Paths: []v1beta1.HTTPIngressPath{
+					subscriberPath,
 					{
 						Path:     "/admin",
 						PathType: &pathType,
@@ -260,6 +287,302 @@ func TestIngressEnsureWithCNames(t *testing.T) {
 	assert.Equal(t, foundIngress.Annotations[AnnotationsCNames], "")
 }
 
+func TestIngressEnsureWithPrefixes(t *testing.T) {
+	svc := createFakeService()
+	err := createAppProcessService(svc.Client, svc.Namespace, "test", "api")
+	require.NoError(t, err)
+	prefixes := []router.BackendPrefix{
+		{
+			Target: router.BackendTarget{
+				Service:   "test-web",
+				Namespace: "default",
+			},
+		},
+		{
+			Prefix: "api",
+			Target: router.BackendTarget{
+				Service:   "test-api",
+				Namespace: "default",
+			},
+		},
+	}
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		CNames:   []string{"test.io"},
+		Prefixes: prefixes,
+	})
+	require.NoError(t, err)
+
+	pathType := v1beta1.PathTypeImplementationSpecific
+	expectedPaths := []v1beta1.HTTPIngressPath{
+		{
+			Path:     "/api",
+			PathType: &pathType,
+			Backend: v1beta1.IngressBackend{
+				ServiceName: "test-api",
+				ServicePort: intstr.FromInt(8888),
+			},
+		},
+		{
+			Path:     "",
+			PathType: &pathType,
+			Backend: v1beta1.IngressBackend{
+				ServiceName: "test-web",
+				ServicePort: intstr.FromInt(8888),
+			},
+		},
+	}
+	for _, name := range []string{"kubernetes-router-test-ingress", "kubernetes-router-cname-test.io"} {
+		foundIngress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, expectedPaths, foundIngress.Spec.Rules[0].HTTP.Paths)
+	}
+
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		CNames:   []string{"test.io"},
+		Prefixes: prefixes[:1],
+	})
+	require.NoError(t, err)
+
+	for _, name := range []string{"kubernetes-router-test-ingress", "kubernetes-router-cname-test.io"} {
+		foundIngress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, expectedPaths[1:], foundIngress.Spec.Rules[0].HTTP.Paths)
+	}
+}
+
+func TestIngressEnsureWithPrefixNoService(t *testing.T) {
+	svc := createFakeService()
+	err := svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-web",
+					Namespace: "default",
+				},
+			},
+			{
+				Prefix: "api",
+				Target: router.BackendTarget{
+					Service:   "test-api",
+					Namespace: "default",
+				},
+			},
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `could not find service for prefix "api"`)
+}
+
+func TestIngressGetStatusWithPrefixes(t *testing.T) {
+	svc := createFakeService()
+	err := createAppProcessService(svc.Client, svc.Namespace, "test", "api")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-web",
+					Namespace: "default",
+				},
+			},
+			{
+				Prefix: "api",
+				Target: router.BackendTarget{
+					Service:   "test-api",
+					Namespace: "default",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	ingress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	ingress.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.10.1"}}
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Update(ctx, ingress, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	_, err = svc.Client.CoreV1().Endpoints(svc.Namespace).Create(ctx, &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-web"},
+		Subsets: []v1.EndpointSubset{
+			{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	status, detail, err := svc.GetStatus(ctx, idForApp("test"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "path \"/api\": service \"test-api\" has no ready endpoints\n", detail)
+
+	_, err = svc.Client.CoreV1().Endpoints(svc.Namespace).Create(ctx, &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-api"},
+		Subsets: []v1.EndpointSubset{
+			{Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}}},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	status, detail, err = svc.GetStatus(ctx, idForApp("test"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusReady, status)
+	assert.Equal(t, "", detail)
+}
+
+func TestIngressEnsureNetworkingV1(t *testing.T) {
+	svc := createFakeService()
+	enableNetworkingV1(svc.Client)
+	svc.IngressClass = "nginx"
+	err := svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		CNames: []string{"test.io"},
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-web",
+					Namespace: "default",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	legacyList, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, legacyList.Items, 0)
+
+	className := "nginx"
+	pathType := networkingv1.PathTypePrefix
+	expectedSpec := func(host string) networkingv1.IngressSpec {
+		return networkingv1.IngressSpec{
+			IngressClassName: &className,
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: host,
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{
+									Path:     "/",
+									PathType: &pathType,
+									Backend: networkingv1.IngressBackend{
+										Service: &networkingv1.IngressServiceBackend{
+											Name: "test-web",
+											Port: networkingv1.ServiceBackendPort{Number: defaultServicePort},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	foundIngress, err := svc.Client.NetworkingV1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expectedSpec("test."), foundIngress.Spec)
+	assert.NotContains(t, foundIngress.Annotations, "kubernetes.io/ingress.class")
+
+	foundIngress, err = svc.Client.NetworkingV1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-cname-test.io", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, expectedSpec("test.io"), foundIngress.Spec)
+	assert.NotContains(t, foundIngress.Annotations, "kubernetes.io/ingress.class")
+}
+
+func TestIngressEnsureNetworkingV1MigratesExistingIngress(t *testing.T) {
+	svc := createFakeService()
+	enableNetworkingV1(svc.Client)
+	svc.IngressClass = "nginx"
+	pathType := networkingv1.PathTypeImplementationSpecific
+	_, err := svc.Client.NetworkingV1().Ingresses(svc.Namespace).Create(ctx, &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubernetes-router-test-ingress",
+			Namespace: svc.Namespace,
+			Annotations: map[string]string{
+				"kubernetes.io/ingress.class": "nginx",
+			},
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: "test.",
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{
+									PathType: &pathType,
+									Backend: networkingv1.IngressBackend{
+										Service: &networkingv1.IngressServiceBackend{
+											Name: "test-web",
+											Port: networkingv1.ServiceBackendPort{Number: defaultServicePort},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-web",
+					Namespace: "default",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	foundIngress, err := svc.Client.NetworkingV1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, foundIngress.Annotations, "kubernetes.io/ingress.class")
+	require.NotNil(t, foundIngress.Spec.IngressClassName)
+	assert.Equal(t, "nginx", *foundIngress.Spec.IngressClassName)
+	paths := foundIngress.Spec.Rules[0].HTTP.Paths
+	require.Len(t, paths, 1)
+	assert.Equal(t, "/", paths[0].Path)
+	assert.Equal(t, networkingv1.PathTypePrefix, *paths[0].PathType)
+}
+
+func TestIngressCertificateNetworkingV1(t *testing.T) {
+	svc := createFakeService()
+	enableNetworkingV1(svc.Client)
+	err := svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-web",
+					Namespace: "default",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	err = svc.AddCertificate(ctx, idForApp("test"), "mycert", router.CertData{Certificate: "Certz", Key: "keyz"})
+	require.NoError(t, err)
+
+	foundIngress, err := svc.Client.NetworkingV1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []networkingv1.IngressTLS{
+		{
+			Hosts:      []string{"mycert"},
+			SecretName: "kr-test-mycert",
+		},
+	}, foundIngress.Spec.TLS)
+
+	err = svc.RemoveCertificate(ctx, idForApp("test"), "mycert")
+	require.NoError(t, err)
+	foundIngress, err = svc.Client.NetworkingV1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Len(t, foundIngress.Spec.TLS, 0)
+}
+
 func TestIngressCreateDefaultClass(t *testing.T) {
 	svc := createFakeService()
 	svc.Labels = map[string]string{"controller": "my-controller", "XPTO": "true"}
@@ -289,6 +612,7 @@ func TestIngressCreateDefaultClass(t *testing.T) {
 	expectedIngress.Annotations["ann2"] = "val2"
 	expectedIngress.Annotations["kubernetes.io/ingress.class"] = "nginx"
 	expectedIngress.Annotations["my-opt"] = "v1"
+	expectedIngress.Annotations["router.tsuru.io/opts"] = `{"AdditionalOpts":{"my-opt":"v1"},"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`
 
 	assert.Equal(t, expectedIngress, foundIngress)
 }
@@ -321,6 +645,7 @@ func TestIngressEnsureDefaultClassOverride(t *testing.T) {
 	expectedIngress.Annotations["ann1"] = "val1"
 	expectedIngress.Annotations["ann2"] = "val2"
 	expectedIngress.Annotations["kubernetes.io/ingress.class"] = "xyz"
+	expectedIngress.Annotations["router.tsuru.io/opts"] = `{"AdditionalOpts":{"class":"xyz"},"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`
 
 	assert.Equal(t, expectedIngress, foundIngress)
 }
@@ -358,6 +683,7 @@ func TestIngressEnsureDefaultPrefix(t *testing.T) {
 	expectedIngress.Annotations["ann2"] = "val2"
 	expectedIngress.Annotations["my.prefix.com/foo1"] = "xyz"
 	expectedIngress.Annotations["prefixed/foo2"] = "abc"
+	expectedIngress.Annotations["router.tsuru.io/opts"] = `{"AdditionalOpts":{"foo1":"xyz","prefixed/foo2":"abc"},"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`
 
 	assert.Equal(t, expectedIngress, foundIngress)
 }
@@ -390,6 +716,7 @@ func TestIngressEnsureRemoveAnnotation(t *testing.T) {
 	expectedIngress.Labels["controller"] = "my-controller"
 	expectedIngress.Labels["XPTO"] = "true"
 	expectedIngress.Annotations["ann2"] = "val2"
+	expectedIngress.Annotations["router.tsuru.io/opts"] = `{"AdditionalOpts":{"ann1-":""},"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`
 
 	assert.Equal(t, expectedIngress, foundIngress)
 }
@@ -401,11 +728,10 @@ func TestIngressCreateDefaultPort(t *testing.T) {
 	err = createAppWebService(svc.Client, svc.Namespace, "myapp")
 	require.NoError(t, err)
 
-	svc.BaseService.Client.(*fake.Clientset).PrependReactor("create", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
-		newIng, ok := action.(ktesting.UpdateAction).GetObject().(*v1beta1.Ingress)
-		if !ok {
-			t.Errorf("Error creating ingress.")
-		}
+	svc.BaseService.Client.(*fake.Clientset).PrependReactor("patch", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
+		var newIng v1beta1.Ingress
+		err := json.Unmarshal(action.(ktesting.PatchAction).GetPatch(), &newIng)
+		require.NoError(t, err)
 		port := newIng.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort
 		require.Equal(t, intstr.FromInt(8888), port)
 		return false, nil, nil
@@ -431,42 +757,24 @@ func TestIngressCreateDefaultPort(t *testing.T) {
 
 func TestEnsureExistingIngress(t *testing.T) {
 	svc := createFakeService()
-	svcName := "test"
-	svcPort := 8000
-	resourceVersion := "123"
 	svc.Labels = map[string]string{"controller": "my-controller", "XPTO": "true"}
 	svc.Annotations = map[string]string{"ann1": "val1", "ann2": "val2"}
-
-	svc.BaseService.Client.(*fake.Clientset).PrependReactor("get", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
-		ingress := &v1beta1.Ingress{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:            svcName,
-				ResourceVersion: resourceVersion,
-			},
-			Spec: v1beta1.IngressSpec{
-				Backend: &v1beta1.IngressBackend{
-					ServiceName: svcName,
-					ServicePort: intstr.FromInt(svcPort),
-				},
+	_, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Create(ctx, &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "kubernetes-router-test-ingress",
+			ResourceVersion: "123",
+			Annotations:     map[string]string{"cert-manager.io/cluster-issuer": "letsencrypt"},
+		},
+		Spec: v1beta1.IngressSpec{
+			Backend: &v1beta1.IngressBackend{
+				ServiceName: "default-backend",
+				ServicePort: intstr.FromInt(8000),
 			},
-		}
-		return true, ingress, nil
-	})
-	svc.BaseService.Client.(*fake.Clientset).PrependReactor("update", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
-		newIng, ok := action.(ktesting.UpdateAction).GetObject().(*v1beta1.Ingress)
-		if !ok {
-			t.Fatalf("Error updating ingress.")
-		}
-		if newIng.ObjectMeta.ResourceVersion != resourceVersion {
-			t.Errorf("Expected ResourceVersion %q. Got %s", resourceVersion, newIng.ObjectMeta.ResourceVersion)
-		}
-		if newIng.Spec.Backend == nil || newIng.Spec.Backend.ServiceName != svcName || newIng.Spec.Backend.ServicePort.IntValue() != svcPort {
-			t.Errorf("Expected Backend with name %q and port %d. Got %v", svcName, svcPort, newIng.Spec.Backend)
-		}
-		return true, newIng, nil
-	})
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
 
-	err := svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
 		Opts: router.Opts{
 			Pool: "mypool",
 			AdditionalOpts: map[string]string{
@@ -483,6 +791,14 @@ func TestEnsureExistingIngress(t *testing.T) {
 		},
 	})
 	require.NoError(t, err)
+
+	foundIngress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "123", foundIngress.ResourceVersion)
+	assert.Equal(t, "letsencrypt", foundIngress.Annotations["cert-manager.io/cluster-issuer"])
+	assert.Equal(t, "val1", foundIngress.Annotations["ann1"])
+	assert.Equal(t, &v1beta1.IngressBackend{ServiceName: "default-backend", ServicePort: intstr.FromInt(8000)}, foundIngress.Spec.Backend)
+	assert.Equal(t, "test-web", foundIngress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
 }
 
 func TestEnsureIngressAppNamespace(t *testing.T) {
@@ -653,6 +969,46 @@ func TestAddCertificate(t *testing.T) {
 	assert.Equal(t, certTest.Spec.TLS, ingress.Spec.TLS)
 }
 
+func TestEnsureKeepsCertificates(t *testing.T) {
+	svc := createFakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "test-blue")
+	require.NoError(t, err)
+	// acme makes Ensure apply spec.tls, which is replaced as a whole
+	opts := router.EnsureBackendOpts{
+		Opts: router.Opts{
+			DomainSuffix: "apps.example.org",
+			Acme:         true,
+		},
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-blue-web",
+					Namespace: svc.Namespace,
+				},
+			},
+		},
+	}
+	err = svc.Ensure(ctx, idForApp("test-blue"), opts)
+	require.NoError(t, err)
+	err = svc.AddCertificate(ctx, idForApp("test-blue"), "mycert", router.CertData{Certificate: "Certz", Key: "keyz"})
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("test-blue"), opts)
+	require.NoError(t, err)
+
+	ingress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-blue-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1beta1.IngressTLS{
+		{
+			Hosts:      []string{"test-blue.apps.example.org"},
+			SecretName: svc.secretName(idForApp("test-blue"), "test-blue.apps.example.org"),
+		},
+		{
+			Hosts:      []string{"mycert"},
+			SecretName: svc.secretName(idForApp("test-blue"), "mycert"),
+		},
+	}, ingress.Spec.TLS)
+}
+
 func TestGetCertificate(t *testing.T) {
 	svc := createFakeService()
 	err := createAppWebService(svc.Client, svc.Namespace, "test-blue")
@@ -690,6 +1046,16 @@ func TestGetCertificate(t *testing.T) {
 	assert.Equal(t, &router.CertData{Certificate: "", Key: ""}, cert)
 }
 
+func enableNetworkingV1(client kubernetes.Interface) {
+	fakeClient := client.(*fake.Clientset)
+	fakeClient.Resources = append(fakeClient.Resources, &metav1.APIResourceList{
+		GroupVersion: networkingv1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{
+			{Name: "ingresses", Namespaced: true, Kind: "Ingress"},
+		},
+	})
+}
+
 func defaultIngress(name, namespace string) *v1beta1.Ingress {
 	serviceName := name + "-web"
 	blockOwnerDeletion := true
@@ -739,3 +1105,351 @@ func defaultIngress(name, namespace string) *v1beta1.Ingress {
 		},
 	}
 }
+
+func TestIngressSwap(t *testing.T) {
+	svc := createFakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "other")
+	require.NoError(t, err)
+	ensureApp := func(app string, cnames []string) {
+		err := svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			CNames: cnames,
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{Service: app + "-web", Namespace: svc.Namespace},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	ensureApp("test", []string{"test.io"})
+	ensureApp("other", nil)
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.NoError(t, err)
+
+	ingressClient := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace)
+	assertBackend := func(name, service, swappedWith string) {
+		ingress, err := ingressClient.Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, service, ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+		assert.Equal(t, service, ingress.Labels[appBaseServiceNameLabel])
+		assert.Equal(t, swappedWith, ingress.Labels[swapLabel])
+	}
+	assertBackend("kubernetes-router-test-ingress", "other-web", "other")
+	assertBackend("kubernetes-router-cname-test.io", "other-web", "other")
+	assertBackend("kubernetes-router-other-ingress", "test-web", "test")
+
+	ensureApp("test", []string{"test.io"})
+	assertBackend("kubernetes-router-test-ingress", "other-web", "other")
+	assertBackend("kubernetes-router-cname-test.io", "other-web", "other")
+
+	err = svc.Swap(ctx, idForApp("other"), idForApp("test"), router.SwapOpts{})
+	require.NoError(t, err)
+	assertBackend("kubernetes-router-test-ingress", "test-web", "")
+	assertBackend("kubernetes-router-cname-test.io", "test-web", "")
+	assertBackend("kubernetes-router-other-ingress", "other-web", "")
+}
+
+func TestIngressSwapRollback(t *testing.T) {
+	svc := createFakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "other")
+	require.NoError(t, err)
+	for _, app := range []string{"test", "other"} {
+		err = svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{Service: app + "-web", Namespace: svc.Namespace},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	svc.Client.(*fake.Clientset).PrependReactor("update", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
+		ingress := action.(ktesting.UpdateAction).GetObject().(*v1beta1.Ingress)
+		if ingress.Name == "kubernetes-router-other-ingress" {
+			return true, nil, errors.New("update failed")
+		}
+		return false, nil, nil
+	})
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.EqualError(t, err, "update failed")
+
+	ingress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "test-web", ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+	assert.Equal(t, "", ingress.Labels[swapLabel])
+}
+
+func TestIngressSwapDifferentNamespaces(t *testing.T) {
+	svc := createFakeService()
+	err := createAppWebService(svc.Client, "other-namespace", "other")
+	require.NoError(t, err)
+	err = createCRD(svc.BaseService, "other", "other-namespace", nil)
+	require.NoError(t, err)
+	_, err = svc.TsuruClient.TsuruV1().Apps(svc.Namespace).Create(ctx, &tsuruv1.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec:       tsuruv1.AppSpec{NamespaceName: svc.Namespace},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	for _, target := range []router.BackendTarget{
+		{Service: "test-web", Namespace: svc.Namespace},
+		{Service: "other-web", Namespace: "other-namespace"},
+	} {
+		app := strings.TrimSuffix(target.Service, "-web")
+		err = svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			Prefixes: []router.BackendPrefix{{Target: target}},
+		})
+		require.NoError(t, err)
+	}
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	assert.Equal(t, router.ErrSwapDifferentNamespaces, err)
+}
+
+func TestIngressEnsureSwappedUpdatesPartner(t *testing.T) {
+	svc := createFakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "other")
+	require.NoError(t, err)
+	err = createAppProcessService(svc.Client, svc.Namespace, "test", "v2")
+	require.NoError(t, err)
+	ensureApp := func(app, service string, cnames []string) {
+		err := svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			CNames: cnames,
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{Service: service, Namespace: svc.Namespace},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	ensureApp("test", "test-web", nil)
+	ensureApp("other", "other-web", []string{"other.io"})
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.NoError(t, err)
+	ensureApp("test", "test-v2", []string{"test.io"})
+
+	ingressClient := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace)
+	assertBackend := func(name, service string) {
+		ingress, err := ingressClient.Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, service, ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+		assert.Equal(t, service, ingress.Labels[appBaseServiceNameLabel])
+	}
+	assertBackend("kubernetes-router-test-ingress", "other-web")
+	assertBackend("kubernetes-router-cname-test.io", "other-web")
+	assertBackend("kubernetes-router-other-ingress", "test-v2")
+	assertBackend("kubernetes-router-cname-other.io", "test-v2")
+}
+
+func TestIngressSwapCNameOnly(t *testing.T) {
+	svc := createFakeService()
+	for _, app := range []string{"other", "third"} {
+		err := createAppWebService(svc.Client, svc.Namespace, app)
+		require.NoError(t, err)
+	}
+	ensureApp := func(app string) {
+		err := svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			CNames: []string{app + ".io"},
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{Service: app + "-web", Namespace: svc.Namespace},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	for _, app := range []string{"test", "other", "third"} {
+		ensureApp(app)
+	}
+
+	err := svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{CNameOnly: true})
+	require.NoError(t, err)
+
+	ingressClient := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace)
+	assertBackend := func(name, service, swappedWith string) {
+		ingress, err := ingressClient.Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, service, ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+		assert.Equal(t, service, ingress.Labels[appBaseServiceNameLabel])
+		assert.Equal(t, swappedWith, ingress.Labels[swapLabel])
+	}
+	assertSwapped := func() {
+		assertBackend("kubernetes-router-test-ingress", "test-web", "other")
+		assertBackend("kubernetes-router-cname-test.io", "other-web", "other")
+		assertBackend("kubernetes-router-other-ingress", "other-web", "test")
+		assertBackend("kubernetes-router-cname-other.io", "test-web", "test")
+	}
+	assertSwapped()
+	ingress, err := ingressClient.Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "true", ingress.Annotations[swapCNameOnlyAnnotation])
+
+	ensureApp("test")
+	ensureApp("other")
+	assertSwapped()
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("third"), router.SwapOpts{})
+	assert.Equal(t, router.ErrSwapAlreadySwapped, err)
+
+	err = svc.Swap(ctx, idForApp("other"), idForApp("test"), router.SwapOpts{})
+	require.NoError(t, err)
+	assertBackend("kubernetes-router-test-ingress", "test-web", "")
+	assertBackend("kubernetes-router-cname-test.io", "test-web", "")
+	assertBackend("kubernetes-router-other-ingress", "other-web", "")
+	assertBackend("kubernetes-router-cname-other.io", "other-web", "")
+}
+
+func TestIngressSwapCanaries(t *testing.T) {
+	svc := createFakeService()
+	svc.AnnotationsPrefix = nginxAnnotationsPrefix
+	err := createAppWebService(svc.Client, svc.Namespace, "other")
+	require.NoError(t, err)
+	err = createAppProcessService(svc.Client, svc.Namespace, "test", "canary")
+	require.NoError(t, err)
+	stable := router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}
+	canary := router.BackendTarget{Service: "test-canary", Namespace: svc.Namespace}
+	ensureTest := func(canaryWeight int32) {
+		err := svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+			CNames: []string{"test.io"},
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: stable,
+					Targets: []router.WeightedBackendTarget{
+						{BackendTarget: stable, Weight: 100 - canaryWeight},
+						{BackendTarget: canary, Weight: canaryWeight},
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	ensureTest(10)
+	err = svc.Ensure(ctx, idForApp("other"), router.EnsureBackendOpts{
+		CNames: []string{"other.io"},
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "other-web", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	ingressClient := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace)
+	assertCanary := func(weight string, hosts ...string) {
+		canaryIngress, err := ingressClient.Get(ctx, "kubernetes-router-test-canary-ingress", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, weight, canaryIngress.Annotations["nginx.ingress.kubernetes.io/canary-weight"])
+		require.Len(t, canaryIngress.Spec.Rules, len(hosts))
+		for i, host := range hosts {
+			assert.Equal(t, host, canaryIngress.Spec.Rules[i].Host)
+			assert.Equal(t, "test-canary", canaryIngress.Spec.Rules[i].HTTP.Paths[0].Backend.ServiceName)
+		}
+	}
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.NoError(t, err)
+	assertCanary("10", "other.", "other.io")
+
+	ensureTest(30)
+	assertCanary("30", "other.", "other.io")
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.NoError(t, err)
+	assertCanary("30", "test.", "test.io")
+}
+
+func TestIngressEnsureWeightedTargets(t *testing.T) {
+	svc := createFakeService()
+	svc.AnnotationsPrefix = nginxAnnotationsPrefix
+	err := createAppProcessService(svc.Client, svc.Namespace, "test", "canary")
+	require.NoError(t, err)
+	stable := router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}
+	canary := router.BackendTarget{Service: "test-canary", Namespace: svc.Namespace}
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		CNames: []string{"test.io"},
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: stable,
+				Targets: []router.WeightedBackendTarget{
+					{BackendTarget: stable, Weight: 90},
+					{BackendTarget: canary, Weight: 10},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	foundIngress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "test-web", foundIngress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName)
+
+	canaryIngress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-canary-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "true", canaryIngress.Labels[labelCanaryIngress])
+	assert.Equal(t, "true", canaryIngress.Annotations["nginx.ingress.kubernetes.io/canary"])
+	assert.Equal(t, "10", canaryIngress.Annotations["nginx.ingress.kubernetes.io/canary-weight"])
+	require.Len(t, canaryIngress.Spec.Rules, 2)
+	for i, host := range []string{"test.", "test.io"} {
+		assert.Equal(t, host, canaryIngress.Spec.Rules[i].Host)
+		assert.Equal(t, "test-canary", canaryIngress.Spec.Rules[i].HTTP.Paths[0].Backend.ServiceName)
+	}
+
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		CNames:   []string{"test.io"},
+		Prefixes: []router.BackendPrefix{{Target: stable}},
+	})
+	require.NoError(t, err)
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-canary-ingress", metav1.GetOptions{})
+	assert.True(t, k8sErrors.IsNotFound(err))
+}
+
+func TestIngressRemoveDeletesCanaries(t *testing.T) {
+	svc := createFakeService()
+	svc.AnnotationsPrefix = nginxAnnotationsPrefix
+	err := createAppProcessService(svc.Client, svc.Namespace, "test", "canary")
+	require.NoError(t, err)
+	stable := router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}
+	canary := router.BackendTarget{Service: "test-canary", Namespace: svc.Namespace}
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: stable,
+				Targets: []router.WeightedBackendTarget{
+					{BackendTarget: stable, Weight: 50},
+					{BackendTarget: canary, Weight: 50},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	err = svc.Remove(ctx, idForApp("test"))
+	require.NoError(t, err)
+	ingressList, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, ingressList.Items, 0)
+}
+
+func TestIngressValidateWeightedTargets(t *testing.T) {
+	svc := createFakeService()
+	prefixes := []router.BackendPrefix{
+		{
+			Targets: []router.WeightedBackendTarget{
+				{BackendTarget: router.BackendTarget{Service: "test-web", Namespace: "default"}, Weight: 50},
+				{BackendTarget: router.BackendTarget{Service: "test-canary", Namespace: "default"}, Weight: 25},
+				{BackendTarget: router.BackendTarget{Service: "test-other", Namespace: "default"}, Weight: 25},
+			},
+		},
+	}
+	err := svc.ValidateWeightedTargets(ctx, prefixes)
+	assert.Equal(t, errWeightedRequireNginx, err)
+
+	svc.AnnotationsPrefix = nginxAnnotationsPrefix
+	err = svc.ValidateWeightedTargets(ctx, prefixes)
+	assert.EqualError(t, err, `ingress-nginx supports a single canary target per prefix, prefix "" has 3 targets`)
+	err = svc.ValidateWeightedTargets(ctx, []router.BackendPrefix{{Targets: prefixes[0].Targets[1:]}})
+	assert.NoError(t, err)
+}
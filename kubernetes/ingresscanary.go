@@ -0,0 +1,165 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tsuru/kubernetes-router/observability"
+	"github.com/tsuru/kubernetes-router/router"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const nginxAnnotationsPrefix = "nginx.ingress.kubernetes.io"
+
+var (
+	labelCanaryIngress      = "router.tsuru.io/is-canary-ingress"
+	annotationCanaryPrefix  = "router.tsuru.io/canary-prefix"
+	errWeightedRequireNginx = errors.New("weighted targets are only supported by ingress-nginx")
+
+	_ router.RouterWeighted = &IngressService{}
+)
+
+// ValidateWeightedTargets accepts weighted prefixes with one stable and one
+// canary target, the only split supported by ingress-nginx canaries
+func (k *IngressService) ValidateWeightedTargets(ctx context.Context, prefixes []router.BackendPrefix) error {
+	if k.AnnotationsPrefix != nginxAnnotationsPrefix {
+		return errWeightedRequireNginx
+	}
+	for _, prefix := range prefixes {
+		if prefix.IsWeighted() && len(prefix.Targets) != 2 {
+			return fmt.Errorf("ingress-nginx supports a single canary target per prefix, prefix %q has %d targets", prefix.Prefix, len(prefix.Targets))
+		}
+	}
+	return nil
+}
+
+func (s *IngressService) ingressCanary(id router.InstanceID, prefix string) string {
+	name := "kubernetes-router-" + id.AppName + "-canary"
+	if prefix != "" {
+		name += "-" + strings.Trim(strings.ReplaceAll(prefix, "/", "-"), "-")
+	}
+	return s.hashedResourceName(id, name+"-ingress", 253)
+}
+
+type ensureCanaryOpts struct {
+	namespace string
+	id        router.InstanceID
+	hosts     []string
+	opts      router.EnsureBackendOpts
+}
+
+// ensureCanaryIngresses creates one ingress-nginx canary ingress for each
+// weighted prefix, removing the canaries of prefixes no longer weighted
+func (k *IngressService) ensureCanaryIngresses(ctx context.Context, opts ensureCanaryOpts) error {
+	ctx, span := observability.Tracer().Start(ctx, "ensureIngressCanaries")
+	defer span.End()
+
+	ingressClient, err := k.ingressClient(opts.namespace)
+	if err != nil {
+		return err
+	}
+	canaries := map[string]struct{}{}
+	for _, prefix := range opts.opts.Prefixes {
+		if !prefix.IsWeighted() {
+			continue
+		}
+		var canaryTarget *router.WeightedBackendTarget
+		for i := range prefix.Targets {
+			if prefix.Targets[i].BackendTarget != prefix.Target {
+				canaryTarget = &prefix.Targets[i]
+				break
+			}
+		}
+		if canaryTarget == nil {
+			continue
+		}
+		service, err := k.getWebService(ctx, opts.id.AppName, canaryTarget.BackendTarget)
+		if err != nil {
+			return err
+		}
+		ingress := k.buildCanaryIngress(opts, ingressClient, prefix.Prefix, service, canaryTarget.Weight)
+		canaries[ingress.Name] = struct{}{}
+		_, err = ingressClient.Apply(ctx, ingress)
+		if err != nil {
+			return err
+		}
+	}
+	return k.removeCanaryIngresses(ctx, ingressClient, opts.id, canaries)
+}
+
+func (k *IngressService) buildCanaryIngress(opts ensureCanaryOpts, ingressClient *versionedIngressClient, prefix string, service *v1.Service, weight int32) *networkingv1.Ingress {
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      k.ingressCanary(opts.id, prefix),
+			Namespace: opts.namespace,
+			Labels: map[string]string{
+				appBaseServiceNamespaceLabel: service.Namespace,
+				appBaseServiceNameLabel:      service.Name,
+				labelCanaryIngress:           "true",
+			},
+			Annotations: map[string]string{
+				annotationCanaryPrefix: prefix,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(service, schema.GroupVersionKind{
+					Group:   v1.SchemeGroupVersion.Group,
+					Version: v1.SchemeGroupVersion.Version,
+					Kind:    "Service",
+				}),
+			},
+		},
+		Spec: buildIngressSpec(opts.hosts[0], opts.opts.Opts.Route, []prefixBackend{{prefix: prefix, service: service}}, ingressClient.pathType()),
+	}
+	setIngressHosts(ingress, opts.hosts)
+	k.fillIngressMeta(ingress, opts.opts.Opts, opts.id)
+	ingressClient.convertClassAnnotation(ingress)
+
+	// certificates are served by the main ingresses, ingress-nginx ignores
+	// the TLS section of canaries
+	ingress.Spec.TLS = nil
+	delete(ingress.Annotations, AnnotationsACMEKey)
+
+	ingress.Annotations[k.annotationWithPrefix("canary")] = "true"
+	ingress.Annotations[k.annotationWithPrefix("canary-weight")] = strconv.Itoa(int(weight))
+	return ingress
+}
+
+// removeCanaryIngresses deletes the canary ingresses of the instance not
+// present in keep
+func (k *IngressService) removeCanaryIngresses(ctx context.Context, ingressClient *versionedIngressClient, id router.InstanceID, keep map[string]struct{}) error {
+	list, err := ingressClient.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{
+			appLabel:           id.AppName,
+			labelCanaryIngress: "true",
+		}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, ingress := range list.Items {
+		if _, ok := keep[ingress.Name]; ok {
+			continue
+		}
+		// canaries of other instances of the app share the same labels
+		if ingress.Name != k.ingressCanary(id, ingress.Annotations[annotationCanaryPrefix]) {
+			continue
+		}
+		err = ingressClient.Delete(ctx, ingress.Name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
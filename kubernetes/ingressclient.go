@@ -0,0 +1,307 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/tsuru/kubernetes-router/router"
+	v1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	typedV1beta1 "k8s.io/client-go/kubernetes/typed/extensions/v1beta1"
+	typedNetworkingV1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+)
+
+// versionedIngressClient handles ingresses using the networking.k8s.io/v1
+// API when served by the cluster, falling back to extensions/v1beta1 on
+// older clusters. Objects are always exposed as networking.k8s.io/v1.
+type versionedIngressClient struct {
+	v1     typedNetworkingV1.IngressInterface
+	legacy typedV1beta1.IngressInterface
+}
+
+func (c *versionedIngressClient) isLegacy() bool {
+	return c.legacy != nil
+}
+
+// pathType returns the path type used on ingress rules, legacy ingresses
+// keep the implementation specific behavior.
+func (c *versionedIngressClient) pathType() networkingv1.PathType {
+	if c.isLegacy() {
+		return networkingv1.PathTypeImplementationSpecific
+	}
+	return networkingv1.PathTypePrefix
+}
+
+// convertClassAnnotation moves the ingress class annotation to the
+// ingressClassName field, which replaces it on networking.k8s.io/v1.
+func (c *versionedIngressClient) convertClassAnnotation(ingress *networkingv1.Ingress) {
+	if c.isLegacy() {
+		return
+	}
+	classAnnotation := defaultOptsAsAnnotations[defaultClassOpt]
+	class, ok := ingress.Annotations[classAnnotation]
+	if !ok {
+		return
+	}
+	delete(ingress.Annotations, classAnnotation)
+	if class != "" {
+		ingress.Spec.IngressClassName = &class
+	}
+}
+
+func (c *versionedIngressClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*networkingv1.Ingress, error) {
+	if !c.isLegacy() {
+		return c.v1.Get(ctx, name, opts)
+	}
+	ingress, err := c.legacy.Get(ctx, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ingressFromV1beta1(ingress), nil
+}
+
+func (c *versionedIngressClient) List(ctx context.Context, opts metav1.ListOptions) (*networkingv1.IngressList, error) {
+	if !c.isLegacy() {
+		return c.v1.List(ctx, opts)
+	}
+	ingressList, err := c.legacy.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	result := &networkingv1.IngressList{ListMeta: ingressList.ListMeta}
+	for i := range ingressList.Items {
+		result.Items = append(result.Items, *ingressFromV1beta1(&ingressList.Items[i]))
+	}
+	return result, nil
+}
+
+// Apply writes the fields of the ingress owned by the router with a
+// server-side apply, as a dry-run added to the plan of ctx when planning.
+// The class annotation of the current ingress, kept by the apply as it is
+// not owned by the router, is removed once ingressClassName replaces it.
+func (c *versionedIngressClient) Apply(ctx context.Context, ingress *networkingv1.Ingress) (*networkingv1.Ingress, error) {
+	var current *networkingv1.Ingress
+	setsClassName := !c.isLegacy() && ingress.Spec.IngressClassName != nil
+	if planFromContext(ctx) != nil || setsClassName {
+		var err error
+		current, err = c.Get(ctx, ingress.Name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			current = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	var applied *networkingv1.Ingress
+	var err error
+	if !c.isLegacy() {
+		err = apply(ctx, ingress, networkingv1.SchemeGroupVersion.WithKind("Ingress"), ingressApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+			var err error
+			applied, err = c.v1.Patch(ctx, ingress.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+	} else {
+		err = apply(ctx, ingressToV1beta1(ingress), v1beta1.SchemeGroupVersion.WithKind("Ingress"), ingressApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+			legacyApplied, err := c.legacy.Patch(ctx, ingress.Name, types.ApplyPatchType, data, opts)
+			if err == nil {
+				applied = ingressFromV1beta1(legacyApplied)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	classAnnotation := defaultOptsAsAnnotations[defaultClassOpt]
+	if current != nil && setsClassName {
+		if _, ok := current.Annotations[classAnnotation]; ok {
+			applied, err = c.removeAnnotation(ctx, ingress.Name, classAnnotation)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if current == nil {
+		planChange(ctx, router.ChangeCreate, "Ingress", nil, applied, nil)
+	} else if fields := ingressChanges(current, applied); len(fields) > 0 {
+		planChange(ctx, router.ChangeUpdate, "Ingress", current, applied, fields)
+	}
+	return applied, nil
+}
+
+func (c *versionedIngressClient) Update(ctx context.Context, ingress *networkingv1.Ingress, opts metav1.UpdateOptions) (*networkingv1.Ingress, error) {
+	if !c.isLegacy() {
+		return c.v1.Update(ctx, ingress, opts)
+	}
+	updated, err := c.legacy.Update(ctx, ingressToV1beta1(ingress), opts)
+	if err != nil {
+		return nil, err
+	}
+	return ingressFromV1beta1(updated), nil
+}
+
+// Delete deletes the ingress, as a dry-run added to the plan of ctx when
+// planning
+func (c *versionedIngressClient) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
+	opts.DryRun = dryRun(ctx)
+	var current *networkingv1.Ingress
+	if opts.DryRun != nil {
+		var err error
+		current, err = c.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	if !c.isLegacy() {
+		err = c.v1.Delete(ctx, name, opts)
+	} else {
+		err = c.legacy.Delete(ctx, name, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		planChange(ctx, router.ChangeDelete, "Ingress", current, nil, nil)
+	}
+	return nil
+}
+
+// removeAnnotation removes the annotation of the ingress with a merge
+// patch, it is a dry-run when planning
+func (c *versionedIngressClient) removeAnnotation(ctx context.Context, name, annotation string) (*networkingv1.Ingress, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{annotation: nil},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.v1.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{DryRun: dryRun(ctx)})
+}
+
+func (c *versionedIngressClient) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) error {
+	opts.DryRun = dryRun(ctx)
+	if !c.isLegacy() {
+		_, err := c.v1.Patch(ctx, name, pt, data, opts)
+		return err
+	}
+	_, err := c.legacy.Patch(ctx, name, pt, data, opts)
+	return err
+}
+
+func ingressToV1beta1(in *networkingv1.Ingress) *v1beta1.Ingress {
+	out := &v1beta1.Ingress{
+		ObjectMeta: in.ObjectMeta,
+		Spec: v1beta1.IngressSpec{
+			IngressClassName: in.Spec.IngressClassName,
+		},
+		Status: v1beta1.IngressStatus{
+			LoadBalancer: in.Status.LoadBalancer,
+		},
+	}
+	if in.Spec.DefaultBackend != nil {
+		backend := backendToV1beta1(*in.Spec.DefaultBackend)
+		out.Spec.Backend = &backend
+	}
+	for _, tls := range in.Spec.TLS {
+		out.Spec.TLS = append(out.Spec.TLS, v1beta1.IngressTLS{
+			Hosts:      tls.Hosts,
+			SecretName: tls.SecretName,
+		})
+	}
+	for _, rule := range in.Spec.Rules {
+		outRule := v1beta1.IngressRule{Host: rule.Host}
+		if rule.HTTP != nil {
+			outRule.HTTP = &v1beta1.HTTPIngressRuleValue{}
+			for _, path := range rule.HTTP.Paths {
+				outPath := v1beta1.HTTPIngressPath{
+					Path:    path.Path,
+					Backend: backendToV1beta1(path.Backend),
+				}
+				if path.PathType != nil {
+					pathType := v1beta1.PathType(*path.PathType)
+					outPath.PathType = &pathType
+				}
+				outRule.HTTP.Paths = append(outRule.HTTP.Paths, outPath)
+			}
+		}
+		out.Spec.Rules = append(out.Spec.Rules, outRule)
+	}
+	return out
+}
+
+func ingressFromV1beta1(in *v1beta1.Ingress) *networkingv1.Ingress {
+	out := &networkingv1.Ingress{
+		ObjectMeta: in.ObjectMeta,
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: in.Spec.IngressClassName,
+		},
+		Status: networkingv1.IngressStatus{
+			LoadBalancer: in.Status.LoadBalancer,
+		},
+	}
+	if in.Spec.Backend != nil {
+		backend := backendFromV1beta1(*in.Spec.Backend)
+		out.Spec.DefaultBackend = &backend
+	}
+	for _, tls := range in.Spec.TLS {
+		out.Spec.TLS = append(out.Spec.TLS, networkingv1.IngressTLS{
+			Hosts:      tls.Hosts,
+			SecretName: tls.SecretName,
+		})
+	}
+	for _, rule := range in.Spec.Rules {
+		outRule := networkingv1.IngressRule{Host: rule.Host}
+		if rule.HTTP != nil {
+			outRule.HTTP = &networkingv1.HTTPIngressRuleValue{}
+			for _, path := range rule.HTTP.Paths {
+				outPath := networkingv1.HTTPIngressPath{
+					Path:    path.Path,
+					Backend: backendFromV1beta1(path.Backend),
+				}
+				if path.PathType != nil {
+					pathType := networkingv1.PathType(*path.PathType)
+					outPath.PathType = &pathType
+				}
+				outRule.HTTP.Paths = append(outRule.HTTP.Paths, outPath)
+			}
+		}
+		out.Spec.Rules = append(out.Spec.Rules, outRule)
+	}
+	return out
+}
+
+func backendToV1beta1(in networkingv1.IngressBackend) v1beta1.IngressBackend {
+	out := v1beta1.IngressBackend{Resource: in.Resource}
+	if in.Service != nil {
+		out.ServiceName = in.Service.Name
+		if in.Service.Port.Name != "" {
+			out.ServicePort = intstr.FromString(in.Service.Port.Name)
+		} else {
+			out.ServicePort = intstr.FromInt(int(in.Service.Port.Number))
+		}
+	}
+	return out
+}
+
+func backendFromV1beta1(in v1beta1.IngressBackend) networkingv1.IngressBackend {
+	out := networkingv1.IngressBackend{Resource: in.Resource}
+	if in.ServiceName != "" {
+		out.Service = &networkingv1.IngressServiceBackend{Name: in.ServiceName}
+		if in.ServicePort.Type == intstr.String {
+			out.Service.Port.Name = in.ServicePort.StrVal
+		} else {
+			out.Service.Port.Number = in.ServicePort.IntVal
+		}
+	}
+	return out
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	v1beta1 "k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+func TestIngressV1beta1Conversion(t *testing.T) {
+	className := "nginx"
+	pathType := v1beta1.PathTypeImplementationSpecific
+	legacy := &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "myingress",
+			Namespace:   "default",
+			Labels:      map[string]string{"a": "b"},
+			Annotations: map[string]string{"c": "d"},
+		},
+		Spec: v1beta1.IngressSpec{
+			IngressClassName: &className,
+			Backend: &v1beta1.IngressBackend{
+				ServiceName: "default-backend",
+				ServicePort: intstr.FromString("http"),
+			},
+			TLS: []v1beta1.IngressTLS{
+				{Hosts: []string{"myapp.io"}, SecretName: "mysecret"},
+			},
+			Rules: []v1beta1.IngressRule{
+				{
+					Host: "myapp.io",
+					IngressRuleValue: v1beta1.IngressRuleValue{
+						HTTP: &v1beta1.HTTPIngressRuleValue{
+							Paths: []v1beta1.HTTPIngressPath{
+								{
+									Path:     "/api",
+									PathType: &pathType,
+									Backend: v1beta1.IngressBackend{
+										ServiceName: "myapp-api",
+										ServicePort: intstr.FromInt(8888),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Status: v1beta1.IngressStatus{
+			LoadBalancer: v1.LoadBalancerStatus{
+				Ingress: []v1.LoadBalancerIngress{{IP: "10.0.0.1"}},
+			},
+		},
+	}
+
+	converted := ingressFromV1beta1(legacy)
+	assert.Equal(t, legacy.ObjectMeta, converted.ObjectMeta)
+	assert.Equal(t, &className, converted.Spec.IngressClassName)
+	assert.Equal(t, &networkingv1.IngressBackend{
+		Service: &networkingv1.IngressServiceBackend{
+			Name: "default-backend",
+			Port: networkingv1.ServiceBackendPort{Name: "http"},
+		},
+	}, converted.Spec.DefaultBackend)
+	assert.Equal(t, networkingv1.IngressBackend{
+		Service: &networkingv1.IngressServiceBackend{
+			Name: "myapp-api",
+			Port: networkingv1.ServiceBackendPort{Number: 8888},
+		},
+	}, converted.Spec.Rules[0].HTTP.Paths[0].Backend)
+	assert.Equal(t, networkingv1.PathTypeImplementationSpecific, *converted.Spec.Rules[0].HTTP.Paths[0].PathType)
+	assert.Equal(t, legacy.Status.LoadBalancer, converted.Status.LoadBalancer)
+
+	assert.Equal(t, legacy, ingressToV1beta1(converted))
+}
+
+func TestVersionedIngressClientConvertClassAnnotation(t *testing.T) {
+	newIngress := func() *networkingv1.Ingress {
+		return &networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": "nginx",
+					"other":                       "value",
+				},
+			},
+		}
+	}
+
+	legacyClient := &versionedIngressClient{legacy: fake.NewSimpleClientset().ExtensionsV1beta1().Ingresses("default")}
+	ingress := newIngress()
+	legacyClient.convertClassAnnotation(ingress)
+	assert.Nil(t, ingress.Spec.IngressClassName)
+	assert.Equal(t, "nginx", ingress.Annotations["kubernetes.io/ingress.class"])
+	assert.Equal(t, networkingv1.PathTypeImplementationSpecific, legacyClient.pathType())
+
+	v1Client := &versionedIngressClient{v1: fake.NewSimpleClientset().NetworkingV1().Ingresses("default")}
+	ingress = newIngress()
+	v1Client.convertClassAnnotation(ingress)
+	assert.Equal(t, map[string]string{"other": "value"}, ingress.Annotations)
+	assert.Equal(t, "nginx", *ingress.Spec.IngressClassName)
+	assert.Equal(t, networkingv1.PathTypePrefix, v1Client.pathType())
+}
+
+func TestVersionedIngressClientApplyRemovesClassAnnotation(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	fakeApply(client, kubescheme.Scheme)
+	_, err := client.NetworkingV1().Ingresses("default").Create(context.Background(), &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "myingress",
+			Annotations: map[string]string{
+				"kubernetes.io/ingress.class": "nginx",
+				"other":                       "value",
+			},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	v1Client := &versionedIngressClient{v1: client.NetworkingV1().Ingresses("default")}
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "myingress",
+			Annotations: map[string]string{
+				"kubernetes.io/ingress.class": "nginx",
+			},
+		},
+	}
+	v1Client.convertClassAnnotation(ingress)
+	applied, err := v1Client.Apply(context.Background(), ingress)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"other": "value"}, applied.Annotations)
+	assert.Equal(t, "nginx", *applied.Spec.IngressClassName)
+
+	found, err := client.NetworkingV1().Ingresses("default").Get(context.Background(), "myingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"other": "value"}, found.Annotations)
+}
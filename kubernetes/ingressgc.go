@@ -0,0 +1,243 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/tsuru/kubernetes-router/router"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// gcGracePeriod protects resources just created by an Ensure or an
+// AddCertificate, which are referenced by the main ingress only at the end
+const gcGracePeriod = 10 * time.Minute
+
+var (
+	// labelIngressCertificate is added to the secrets created by
+	// AddCertificate, older secrets are recognized by their name
+	labelIngressCertificate = "router.tsuru.io/is-ingress-certificate"
+
+	// annotationPreservedCNames lists, on the main ingress, the CNAMEs kept
+	// by an Ensure with PreserveOldCNames
+	annotationPreservedCNames = "router.tsuru.io/preserved-cnames"
+
+	_ router.RouterGarbageCollector = &IngressService{}
+)
+
+// removeCNameIngresses deletes every CNAME ingress of the instance, even the
+// ones no longer listed on the main ingress
+func (k *IngressService) removeCNameIngresses(ctx context.Context, client *versionedIngressClient, id router.InstanceID) error {
+	ingresses, err := client.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{appLabel: id.AppName, labelCNameIngress: "true"}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, ingress := range ingresses.Items {
+		host := ingressHost(&ingress)
+		if host == "" || ingress.Name != k.ingressCName(id, host) {
+			continue
+		}
+		err = client.Delete(ctx, ingress.Name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCertificateSecrets deletes the secrets of every certificate added
+// to the instance
+func (k *IngressService) removeCertificateSecrets(ctx context.Context, namespace string, id router.InstanceID) error {
+	secret, err := k.secretClient(namespace)
+	if err != nil {
+		return err
+	}
+	secrets, err := secret.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{appLabel: id.AppName}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets.Items {
+		certName := s.Labels[domainLabel]
+		if certName == "" || s.Name != k.secretName(id, certName) {
+			continue
+		}
+		err = secret.Delete(ctx, s.Name, metav1.DeleteOptions{DryRun: dryRun(ctx)})
+		if k8sErrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		planChange(ctx, router.ChangeDelete, "Secret", &s, nil, nil)
+	}
+	return nil
+}
+
+// CollectGarbage finds, in every namespace, the CNAME ingresses no longer
+// listed or preserved on the main ingress of their instance and the
+// certificate secrets no longer referenced by it, deleting them unless dryRun
+// is set. CNAME ingresses of apps whose main ingress does not store its
+// instance are left alone.
+func (k *IngressService) CollectGarbage(ctx context.Context, dryRun bool) ([]router.GarbageResource, error) {
+	ingressClient, err := k.ingressClient(metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+	ingresses, err := ingressClient.List(ctx, metav1.ListOptions{LabelSelector: appLabel})
+	if err != nil {
+		return nil, err
+	}
+	secretClient, err := k.secretClient(metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := secretClient.List(ctx, metav1.ListOptions{LabelSelector: appLabel})
+	if err != nil {
+		return nil, err
+	}
+
+	// apps maps namespace/app to whether every main ingress of the app
+	// stores its instance, cnameIngresses holds the names of the CNAME
+	// ingresses still in use
+	apps := map[string]bool{}
+	cnameIngresses := map[string]bool{}
+	secretNames := map[string]bool{}
+	for _, ingress := range ingresses.Items {
+		if ingress.Labels[labelCNameIngress] == "true" || ingress.Labels[labelCanaryIngress] == "true" {
+			continue
+		}
+		appKey := ingress.Namespace + "/" + ingress.Labels[appLabel]
+		if _, ok := apps[appKey]; !ok {
+			apps[appKey] = true
+		}
+		for _, tls := range ingress.Spec.TLS {
+			secretNames[ingress.Namespace+"/"+tls.SecretName] = true
+		}
+		id, _, ok, err := router.EnsureBackendOptsFromAnnotations(&ingress.ObjectMeta)
+		if err != nil || !ok {
+			apps[appKey] = false
+			continue
+		}
+		cnames := strings.Split(ingress.Annotations[AnnotationsCNames], ",")
+		cnames = append(cnames, splitCNames(ingress.Annotations[annotationPreservedCNames])...)
+		for _, cname := range cnames {
+			cnameIngresses[ingress.Namespace+"/"+k.ingressCName(id, cname)] = true
+		}
+	}
+
+	var garbage []router.GarbageResource
+	for _, ingress := range ingresses.Items {
+		if ingress.Labels[labelCNameIngress] != "true" || !isCollectable(ingress.ObjectMeta) {
+			continue
+		}
+		if !apps[ingress.Namespace+"/"+ingress.Labels[appLabel]] || cnameIngresses[ingress.Namespace+"/"+ingress.Name] {
+			continue
+		}
+		garbage = append(garbage, router.GarbageResource{
+			Kind:      "Ingress",
+			Namespace: ingress.Namespace,
+			Name:      ingress.Name,
+			App:       ingress.Labels[appLabel],
+		})
+	}
+	for _, secret := range secrets.Items {
+		if !isIngressCertificate(secret.ObjectMeta, apps) {
+			continue
+		}
+		if secretNames[secret.Namespace+"/"+secret.Name] || !isCollectable(secret.ObjectMeta) {
+			continue
+		}
+		garbage = append(garbage, router.GarbageResource{
+			Kind:      "Secret",
+			Namespace: secret.Namespace,
+			Name:      secret.Name,
+			App:       secret.Labels[appLabel],
+		})
+	}
+	if dryRun {
+		return garbage, nil
+	}
+
+	for _, resource := range garbage {
+		if resource.Kind == "Ingress" {
+			client, err := k.ingressClient(resource.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			err = client.Delete(ctx, resource.Name, metav1.DeleteOptions{})
+			if err != nil && !k8sErrors.IsNotFound(err) {
+				return nil, err
+			}
+			continue
+		}
+		client, err := k.secretClient(resource.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		err = client.Delete(ctx, resource.Name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	return garbage, nil
+}
+
+// isIngressCertificate returns whether the secret was created by
+// AddCertificate, secrets created before labelIngressCertificate are
+// recognized by their name in the namespace of an app with a main ingress
+func isIngressCertificate(meta metav1.ObjectMeta, apps map[string]bool) bool {
+	if meta.Labels[labelIngressCertificate] == "true" {
+		return true
+	}
+	app := meta.Labels[appLabel]
+	if _, ok := apps[meta.Namespace+"/"+app]; !ok {
+		return false
+	}
+	return meta.Labels[domainLabel] != "" && strings.HasPrefix(meta.Name, "kr-"+app+"-")
+}
+
+// splitCNames returns the CNAMEs of a comma separated annotation
+func splitCNames(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// mergeCNames returns the non empty CNAMEs of the lists without duplicates
+func mergeCNames(lists ...[]string) []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, list := range lists {
+		for _, cname := range list {
+			if cname == "" || seen[cname] {
+				continue
+			}
+			seen[cname] = true
+			result = append(result, cname)
+		}
+	}
+	return result
+}
+
+func isCollectable(meta metav1.ObjectMeta) bool {
+	return !isFrozen(meta) && time.Since(meta.CreationTimestamp.Time) > gcGracePeriod
+}
+
+func ingressHost(ingress *networkingv1.Ingress) string {
+	if len(ingress.Spec.Rules) == 0 {
+		return ""
+	}
+	return ingress.Spec.Rules[0].Host
+}
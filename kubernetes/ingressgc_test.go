@@ -0,0 +1,163 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/router"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIngressRemoveDeletesCNamesAndCertificates(t *testing.T) {
+	svc := createFakeService()
+	id := idForApp("test")
+	opts := router.EnsureBackendOpts{
+		CNames:   []string{"test.io", "www.test.io"},
+		Prefixes: []router.BackendPrefix{{Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}}},
+	}
+	err := svc.Ensure(ctx, id, opts)
+	require.NoError(t, err)
+	opts.CNames = []string{"test.io"}
+	opts.PreserveOldCNames = true
+	err = svc.Ensure(ctx, id, opts)
+	require.NoError(t, err)
+	err = svc.AddCertificate(ctx, id, "test.io", router.CertData{Certificate: "cert", Key: "key"})
+	require.NoError(t, err)
+
+	err = svc.Remove(ctx, id)
+	require.NoError(t, err)
+	ingressList, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, ingressList.Items, 0)
+	_, err = svc.Client.CoreV1().Secrets(svc.Namespace).Get(ctx, svc.secretName(id, "test.io"), metav1.GetOptions{})
+	assert.True(t, k8sErrors.IsNotFound(err))
+}
+
+func TestIngressCollectGarbage(t *testing.T) {
+	svc := createFakeService()
+	id := idForApp("test")
+	opts := router.EnsureBackendOpts{
+		CNames:   []string{"test.io", "www.test.io"},
+		Prefixes: []router.BackendPrefix{{Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}}},
+	}
+	err := svc.Ensure(ctx, id, opts)
+	require.NoError(t, err)
+	opts.CNames = []string{"test.io"}
+	opts.PreserveOldCNames = true
+	err = svc.Ensure(ctx, id, opts)
+	require.NoError(t, err)
+	err = svc.AddCertificate(ctx, id, "test.io", router.CertData{Certificate: "cert", Key: "key"})
+	require.NoError(t, err)
+	blue := router.InstanceID{AppName: "test", InstanceName: "blue"}
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Create(ctx, &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svc.ingressCName(blue, "test.io"),
+			Namespace: svc.Namespace,
+			Labels: map[string]string{
+				appLabel:          "test",
+				labelCNameIngress: "true",
+			},
+		},
+		Spec: v1beta1.IngressSpec{Rules: []v1beta1.IngressRule{{Host: "test.io"}}},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	for _, secret := range []*v1.Secret{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      svc.secretName(id, "old.test.io"),
+				Namespace: svc.Namespace,
+				Labels: map[string]string{
+					appLabel:                "test",
+					domainLabel:             "old.test.io",
+					labelIngressCertificate: "true",
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      svc.secretName(id, "legacy.test.io"),
+				Namespace: svc.Namespace,
+				Labels: map[string]string{
+					appLabel:    "test",
+					domainLabel: "legacy.test.io",
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "other-secret",
+				Namespace: svc.Namespace,
+				Labels:    map[string]string{appLabel: "test"},
+			},
+		},
+	} {
+		_, err = svc.Client.CoreV1().Secrets(svc.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	expected := []router.GarbageResource{
+		{Kind: "Ingress", Namespace: svc.Namespace, Name: svc.ingressCName(blue, "test.io"), App: "test"},
+		{Kind: "Secret", Namespace: svc.Namespace, Name: svc.secretName(id, "legacy.test.io"), App: "test"},
+		{Kind: "Secret", Namespace: svc.Namespace, Name: svc.secretName(id, "old.test.io"), App: "test"},
+	}
+	garbage, err := svc.CollectGarbage(ctx, true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, garbage)
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressCName(blue, "test.io"), metav1.GetOptions{})
+	require.NoError(t, err)
+
+	garbage, err = svc.CollectGarbage(ctx, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, garbage)
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressCName(blue, "test.io"), metav1.GetOptions{})
+	assert.True(t, k8sErrors.IsNotFound(err))
+	for _, name := range []string{svc.secretName(id, "old.test.io"), svc.secretName(id, "legacy.test.io")} {
+		_, err = svc.Client.CoreV1().Secrets(svc.Namespace).Get(ctx, name, metav1.GetOptions{})
+		assert.True(t, k8sErrors.IsNotFound(err))
+	}
+	for _, cname := range []string{"test.io", "www.test.io"} {
+		_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressCName(id, cname), metav1.GetOptions{})
+		require.NoError(t, err)
+	}
+	for _, name := range []string{svc.secretName(id, "test.io"), "other-secret"} {
+		_, err = svc.Client.CoreV1().Secrets(svc.Namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+	}
+}
+
+func TestIngressEnsureRemovesPreservedCNames(t *testing.T) {
+	svc := createFakeService()
+	id := idForApp("test")
+	opts := router.EnsureBackendOpts{
+		CNames:   []string{"test.io", "www.test.io"},
+		Prefixes: []router.BackendPrefix{{Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}}},
+	}
+	err := svc.Ensure(ctx, id, opts)
+	require.NoError(t, err)
+	opts.CNames = []string{"test.io"}
+	opts.PreserveOldCNames = true
+	err = svc.Ensure(ctx, id, opts)
+	require.NoError(t, err)
+	ingress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressName(id), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "www.test.io", ingress.Annotations[annotationPreservedCNames])
+
+	opts.PreserveOldCNames = false
+	err = svc.Ensure(ctx, id, opts)
+	require.NoError(t, err)
+	ingress, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressName(id), metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, ingress.Annotations, annotationPreservedCNames)
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressCName(id, "www.test.io"), metav1.GetOptions{})
+	assert.True(t, k8sErrors.IsNotFound(err))
+	_, err = svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, svc.ingressCName(id, "test.io"), metav1.GetOptions{})
+	require.NoError(t, err)
+}
@@ -6,25 +6,51 @@ package kubernetes
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 
 	"github.com/tsuru/kubernetes-router/router"
+	"go.opentelemetry.io/otel/attribute"
 	apiNetworking "istio.io/api/networking/v1beta1"
 	networking "istio.io/client-go/pkg/apis/networking/v1beta1"
 	networkingClientSet "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1beta1"
+	v1 "k8s.io/api/core/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	typedV1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 const (
-	hostsAnnotation = "tsuru.io/additional-hosts"
+	hostsAnnotation         = "tsuru.io/additional-hosts"
+	weightedHostsAnnotation = "tsuru.io/weighted-hosts"
+
+	defaultIstioGatewayNamespace = "istio-system"
 )
 
 var (
-	_ router.Router = &IstioGateway{}
+	_ router.Router         = &IstioGateway{}
+	_ router.RouterTLS      = &IstioGateway{}
+	_ router.RouterStatus   = &IstioGateway{}
+	_ router.RouterSwap     = &IstioGateway{}
+	_ router.RouterWeighted = &IstioGateway{}
+	_ router.RouterPlanner  = &IstioGateway{}
+
+	virtualServicesResource = schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "virtualservices"}
+
+	// virtualServiceApplyFields are the fields of virtualservices owned by
+	// the router
+	virtualServiceApplyFields = []string{
+		"metadata.labels",
+		"metadata.annotations",
+		"spec",
+	}
 )
 
 // IstioGateway manages gateways in a Kubernetes cluster with istio enabled.
@@ -33,6 +59,10 @@ type IstioGateway struct {
 	istioClient     networkingClientSet.NetworkingV1beta1Interface
 	DomainSuffix    string
 	GatewaySelector map[string]string
+
+	// GatewayNamespace is the namespace of the ingress gateway workload,
+	// certificate secrets must be stored there to be found by istio
+	GatewayNamespace string
 }
 
 func (k *IstioGateway) gatewayName(id router.InstanceID) string {
@@ -50,6 +80,25 @@ func (k *IstioGateway) gatewayHost(id router.InstanceID) string {
 	return fmt.Sprintf("%v.instance.%v.%v", id.InstanceName, id.AppName, k.DomainSuffix)
 }
 
+func (k *IstioGateway) secretName(id router.InstanceID, certName string) string {
+	return k.hashedResourceName(id, "kr-"+id.AppName+"-"+certName, 253)
+}
+
+func (k *IstioGateway) gatewayNamespace() string {
+	if k.GatewayNamespace != "" {
+		return k.GatewayNamespace
+	}
+	return defaultIstioGatewayNamespace
+}
+
+func (k *IstioGateway) secretClient() (typedV1.SecretInterface, error) {
+	client, err := k.BaseService.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.CoreV1().Secrets(k.gatewayNamespace()), nil
+}
+
 func (k *IstioGateway) updateObjectMeta(result *metav1.ObjectMeta, appName string, routerOpts router.Opts) {
 	if result.Labels == nil {
 		result.Labels = make(map[string]string)
@@ -152,11 +201,17 @@ func vsRemoveHost(v *networking.VirtualService, host string) {
 	v.Annotations[hostsAnnotation] = strings.Join(hosts, ",")
 }
 
-func (k *IstioGateway) updateVirtualService(v *networking.VirtualService, id router.InstanceID, dstHost string) {
+func (k *IstioGateway) updateVirtualService(v *networking.VirtualService, id router.InstanceID, serviceHost string) {
 	v.Spec.Gateways = addToSet(v.Spec.Gateways, k.gatewayName(id))
 	v.Spec.Hosts = addToSet(v.Spec.Hosts, k.gatewayHost(id))
-	v.Spec.Hosts = addToSet(v.Spec.Hosts, dstHost)
+	v.Spec.Hosts = addToSet(v.Spec.Hosts, serviceHost)
+
+	if len(v.Spec.Http) == 0 {
+		v.Spec.Http = append(v.Spec.Http, &apiNetworking.HTTPRoute{})
+	}
+}
 
+func setDestination(v *networking.VirtualService, dstHost string) {
 	if len(v.Spec.Http) == 0 {
 		v.Spec.Http = append(v.Spec.Http, &apiNetworking.HTTPRoute{})
 	}
@@ -177,8 +232,99 @@ func (k *IstioGateway) updateVirtualService(v *networking.VirtualService, id rou
 	}
 }
 
+// setAppDestinations routes the virtualservice to the default and weighted
+// targets of the app, replacing the ones set by its previous Ensure
+func (k *IstioGateway) setAppDestinations(ctx context.Context, v *networking.VirtualService, id router.InstanceID, namespace string, webService *v1.Service, o router.EnsureBackendOpts, defaultTarget router.BackendTarget) error {
+	removeWeightedDestinations(v)
+	replaceDestinationHost(v, v.Labels[appBaseServiceNameLabel], webService.Name)
+	setDestination(v, webService.Name)
+	v.Labels[appBaseServiceNamespaceLabel] = defaultTarget.Namespace
+	v.Labels[appBaseServiceNameLabel] = defaultTarget.Service
+	if defaultPrefix := defaultBackendPrefix(o.Prefixes); defaultPrefix != nil && defaultPrefix.IsWeighted() {
+		return k.setWeightedDestinations(ctx, v, id, namespace, defaultPrefix.Targets)
+	}
+	return nil
+}
+
+// removeWeightedDestinations drops the destinations previously added for
+// weighted targets, they are rebuilt on every Ensure
+func removeWeightedDestinations(v *networking.VirtualService) {
+	hostsRaw := v.Annotations[weightedHostsAnnotation]
+	delete(v.Annotations, weightedHostsAnnotation)
+	if hostsRaw == "" || len(v.Spec.Http) == 0 {
+		return
+	}
+	v.Spec.Http[0].Route = destinationsWithoutHosts(v.Spec.Http[0].Route, strings.Split(hostsRaw, ","))
+}
+
+func (k *IstioGateway) setWeightedDestinations(ctx context.Context, v *networking.VirtualService, id router.InstanceID, namespace string, targets []router.WeightedBackendTarget) error {
+	var destinations []*apiNetworking.HTTPRouteDestination
+	var hosts []string
+	for _, target := range targets {
+		service, err := k.getWebService(ctx, id.AppName, target.BackendTarget)
+		if err != nil {
+			return err
+		}
+		host := service.Name
+		if service.Namespace != "" && service.Namespace != namespace {
+			host = fmt.Sprintf("%s.%s.svc.cluster.local", service.Name, service.Namespace)
+		}
+		hosts = append(hosts, host)
+		destinations = append(destinations, &apiNetworking.HTTPRouteDestination{
+			Destination: &apiNetworking.Destination{Host: host},
+			Weight:      target.Weight,
+		})
+	}
+	v.Spec.Http[0].Route = append(destinationsWithoutHosts(v.Spec.Http[0].Route, hosts), destinations...)
+	sort.Strings(hosts)
+	v.Annotations[weightedHostsAnnotation] = strings.Join(hosts, ",")
+	return nil
+}
+
+func destinationsWithoutHosts(routes []*apiNetworking.HTTPRouteDestination, hosts []string) []*apiNetworking.HTTPRouteDestination {
+	var result []*apiNetworking.HTTPRouteDestination
+	for _, dst := range routes {
+		if dst.Destination != nil && containsString(hosts, dst.Destination.Host) {
+			continue
+		}
+		result = append(result, dst)
+	}
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateWeightedTargets only accepts weighted targets on the default
+// prefix, the only one routed by the virtualservice
+func (k *IstioGateway) ValidateWeightedTargets(ctx context.Context, prefixes []router.BackendPrefix) error {
+	for _, prefix := range prefixes {
+		if prefix.IsWeighted() && prefix.Prefix != "" {
+			return fmt.Errorf("weighted targets are only supported on the default prefix, got prefix %q", prefix.Prefix)
+		}
+	}
+	return nil
+}
+
 // Create adds a new gateway and a virtualservice for the app
-func (k *IstioGateway) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) error {
+func (k *IstioGateway) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (err error) {
+	ctx, span := startSpan(ctx, "ensureIstioGateway", id)
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		// gateways are expected to exist on every Ensure after the first
+		if err != nil && err != router.ErrIngressAlreadyExists {
+			k.recordEnsureFailure(ctx, id, o, k.currentVS(ctx, id), err)
+		}
+	}()
+
+	span.SetAttributes(attribute.StringSlice("cnames", o.CNames))
+
 	cli, err := k.getClient()
 	if err != nil {
 		return err
@@ -192,6 +338,10 @@ func (k *IstioGateway) Ensure(ctx context.Context, id router.InstanceID, o route
 	if err != nil {
 		return err
 	}
+	span.SetAttributes(
+		attribute.String("defaultTarget.service", defaultTarget.Service),
+		attribute.String("defaultTarget.namespace", defaultTarget.Namespace),
+	)
 
 	gateway := &networking.Gateway{
 		ObjectMeta: metav1.ObjectMeta{
@@ -214,23 +364,43 @@ func (k *IstioGateway) Ensure(ctx context.Context, id router.InstanceID, o route
 
 	k.updateObjectMeta(&gateway.ObjectMeta, id.AppName, o.Opts)
 
-	_, err = cli.Gateways(namespace).Create(ctx, gateway, metav1.CreateOptions{})
+	createdGateway, err := cli.Gateways(namespace).Create(ctx, gateway, metav1.CreateOptions{DryRun: dryRun(ctx)})
 	isAlreadyExists := false
 	if k8sErrors.IsAlreadyExists(err) {
 		isAlreadyExists = true
 	} else if err != nil {
 		return err
+	} else {
+		planChange(ctx, router.ChangeCreate, "Gateway", nil, createdGateway, nil)
 	}
 
-	existingSvc := true
+	err = retryOnConflict(ctx, "ensureIstioGateway", func() error {
+		return k.ensureVirtualService(ctx, cli, id, namespace, o, *defaultTarget)
+	})
+	if err != nil {
+		return err
+	}
+
+	if isAlreadyExists {
+		return router.ErrIngressAlreadyExists
+	}
+	return nil
+}
+
+// ensureVirtualService reads the virtualservice of the app and merges it
+// with o, it is retried as a whole when changed concurrently
+func (k *IstioGateway) ensureVirtualService(ctx context.Context, cli networkingClientSet.NetworkingV1beta1Interface, id router.InstanceID, namespace string, o router.EnsureBackendOpts, defaultTarget router.BackendTarget) error {
 	virtualSvc, err := k.getVS(ctx, cli, id)
 
 	if err != nil && !k8sErrors.IsNotFound(err) {
 		return err
 	}
 
+	var existingVS *networking.VirtualService
+	if err == nil {
+		existingVS = virtualSvc.DeepCopy()
+	}
 	if k8sErrors.IsNotFound(err) {
-		existingSvc = false
 		virtualSvc = &networking.VirtualService{
 			ObjectMeta: metav1.ObjectMeta{
 				Name: k.vsName(id),
@@ -242,15 +412,41 @@ func (k *IstioGateway) Ensure(ctx context.Context, id router.InstanceID, o route
 	}
 
 	k.updateObjectMeta(&virtualSvc.ObjectMeta, id.AppName, o.Opts)
+	err = k.storeEnsureOpts(&virtualSvc.ObjectMeta, id, o)
+	if err != nil {
+		return err
+	}
 
-	webService, err := k.getWebService(ctx, id.AppName, *defaultTarget)
+	webService, err := k.getWebService(ctx, id.AppName, defaultTarget)
 	if err != nil {
 		return err
 	}
 
 	k.updateVirtualService(virtualSvc, id, webService.Name)
-	virtualSvc.Labels[appBaseServiceNamespaceLabel] = defaultTarget.Namespace
-	virtualSvc.Labels[appBaseServiceNameLabel] = defaultTarget.Service
+	// swapped virtualservices keep routing to the destinations of the other
+	// app, the destinations of the app are set on the partner instead
+	var partnerVS *networking.VirtualService
+	if swap := getSwapState(virtualSvc.ObjectMeta); swap != nil {
+		partnerVS, err = k.getVS(ctx, cli, swap.partner)
+		if k8sErrors.IsNotFound(err) {
+			// the partner was removed, there is nothing left to swap with
+			partnerVS = nil
+			setSwapMeta(&virtualSvc.ObjectMeta, nil)
+		} else if err != nil {
+			return err
+		}
+	}
+	if partnerVS != nil {
+		err = k.ensurePartnerDestinations(ctx, cli, partnerVS, id, namespace, webService, o, defaultTarget)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = k.setAppDestinations(ctx, virtualSvc, id, namespace, webService, o, defaultTarget)
+		if err != nil {
+			return err
+		}
+	}
 
 	existingCNames := hostsFromAnnotation(virtualSvc.Annotations)
 	cnamesToAdd, cnamesToRemove := diffCNames(existingCNames, o.CNames)
@@ -261,38 +457,370 @@ func (k *IstioGateway) Ensure(ctx context.Context, id router.InstanceID, o route
 		vsRemoveHost(virtualSvc, cname)
 	}
 
-	if existingSvc {
-		_, err = cli.VirtualServices(namespace).Update(ctx, virtualSvc, metav1.UpdateOptions{})
-	} else {
-		_, err = cli.VirtualServices(namespace).Create(ctx, virtualSvc, metav1.CreateOptions{})
-	}
+	applied, err := applyVirtualService(ctx, cli, namespace, existingVS, virtualSvc)
 	if err != nil {
 		return err
 	}
-
-	if isAlreadyExists {
-		return router.ErrIngressAlreadyExists
+	k.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonEnsured, "virtualservice %s ensured", applied.Name)
+	for _, cname := range cnamesToAdd {
+		k.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonCNameAdded, "CNAME %s added", cname)
+	}
+	for _, cname := range cnamesToRemove {
+		k.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonCNameRemoved, "CNAME %s removed", cname)
 	}
 	return nil
 }
 
+// currentVS returns the virtualservice of the app, nil when it can't be read
+func (k *IstioGateway) currentVS(ctx context.Context, id router.InstanceID) runtime.Object {
+	cli, err := k.getClient()
+	if err != nil {
+		return nil
+	}
+	virtualSvc, err := k.getVS(ctx, cli, id)
+	if err != nil {
+		return nil
+	}
+	return virtualSvc
+}
+
 // Get returns the address in the gateway
 func (k *IstioGateway) GetAddresses(ctx context.Context, id router.InstanceID) ([]string, error) {
 	return []string{k.gatewayHost(id)}, nil
 }
 
-// Swap is not implemented
-func (k *IstioGateway) Swap(ctx context.Context, srcApp, dstApp router.InstanceID) error {
-	return errors.New("swap is not supported, the virtualservice should be edited manually")
+// ensurePartnerDestinations sets the destinations of a swapped app on the
+// virtualservice of its partner
+func (k *IstioGateway) ensurePartnerDestinations(ctx context.Context, cli networkingClientSet.NetworkingV1beta1Interface, partnerVS *networking.VirtualService, id router.InstanceID, namespace string, webService *v1.Service, o router.EnsureBackendOpts, defaultTarget router.BackendTarget) error {
+	updated := partnerVS.DeepCopy()
+	if updated.Labels == nil {
+		updated.Labels = map[string]string{}
+	}
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	err := k.setAppDestinations(ctx, updated, id, namespace, webService, o, defaultTarget)
+	if err != nil {
+		return err
+	}
+	_, err = applyVirtualService(ctx, cli, updated.Namespace, partnerVS, updated)
+	return err
+}
+
+// applyVirtualService writes the fields of v owned by the router with a
+// server-side apply, as a dry-run added to the plan of ctx when planning,
+// and returns the virtualservice applied
+func applyVirtualService(ctx context.Context, cli networkingClientSet.NetworkingV1beta1Interface, namespace string, current, v *networking.VirtualService) (*networking.VirtualService, error) {
+	var result *networking.VirtualService
+	err := apply(ctx, v, networking.SchemeGroupVersion.WithKind("VirtualService"), virtualServiceApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+		var err error
+		result, err = cli.VirtualServices(namespace).Patch(ctx, v.Name, types.ApplyPatchType, data, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		planChange(ctx, router.ChangeCreate, "VirtualService", nil, result, nil)
+	} else if fields := virtualServiceChanges(current, result); len(fields) > 0 {
+		planChange(ctx, router.ChangeUpdate, "VirtualService", current, result, fields)
+	}
+	return result, nil
+}
+
+// virtualServiceChanges returns the fields of existing changed by v, plans
+// describe applies with it
+func virtualServiceChanges(existing, v *networking.VirtualService) []string {
+	var fields []string
+	if !reflect.DeepEqual(existing.Spec, v.Spec) {
+		fields = append(fields, "spec")
+	}
+	if !reflect.DeepEqual(existing.Labels, v.Labels) {
+		fields = append(fields, "metadata.labels")
+	}
+	if !reflect.DeepEqual(existing.Annotations, v.Annotations) {
+		fields = append(fields, "metadata.annotations")
+	}
+	return fields
+}
+
+// Swap exchanges the destinations of the virtualservices of two apps,
+// including the weighted ones, rolling back the first app when the second
+// fails
+func (k *IstioGateway) Swap(ctx context.Context, src, dst router.InstanceID, opts router.SwapOpts) (err error) {
+	ctx, span := startSpan(ctx, "swapIstioGateway", src)
+	defer func() { endSpan(span, err) }()
+
+	span.SetAttributes(attribute.String("dst.app", dst.AppName))
+
+	if opts.CNameOnly {
+		return router.ErrSwapCNameOnlyUnsupported
+	}
+	cli, err := k.getClient()
+	if err != nil {
+		return err
+	}
+	srcVS, err := k.getVS(ctx, cli, src)
+	if err != nil {
+		return err
+	}
+	dstVS, err := k.getVS(ctx, cli, dst)
+	if err != nil {
+		return err
+	}
+	if srcVS.Namespace != dstVS.Namespace {
+		return router.ErrSwapDifferentNamespaces
+	}
+	unswap, _, err := checkSwap(srcVS.ObjectMeta, dstVS.ObjectMeta, src, dst, opts)
+	if err != nil {
+		return err
+	}
+	virtualServices := cli.VirtualServices(srcVS.Namespace)
+	original := srcVS.DeepCopy()
+	swapVirtualServices(srcVS, dstVS)
+	swapObjectMeta(&srcVS.ObjectMeta, &dstVS.ObjectMeta, src, dst, unswap, false)
+	srcVS, err = virtualServices.Update(ctx, srcVS, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = virtualServices.Update(ctx, dstVS, metav1.UpdateOptions{})
+	if err != nil {
+		original.ResourceVersion = srcVS.ResourceVersion
+		_, rollbackErr := virtualServices.Update(ctx, original, metav1.UpdateOptions{})
+		if rollbackErr != nil {
+			return fmt.Errorf("failed to rollback swap: %v: %w", rollbackErr, err)
+		}
+		return err
+	}
+	k.recordEvent(ctx, srcVS, v1.EventTypeNormal, eventReasonSwapped, "swapped with %s", dst.AppName)
+	k.recordEvent(ctx, dstVS, v1.EventTypeNormal, eventReasonSwapped, "swapped with %s", src.AppName)
+	return nil
+}
+
+// swapVirtualServices exchanges every destination of the default route of
+// two virtualservices, along with the record of the weighted ones
+func swapVirtualServices(src, dst *networking.VirtualService) {
+	for _, v := range []*networking.VirtualService{src, dst} {
+		if len(v.Spec.Http) == 0 {
+			v.Spec.Http = append(v.Spec.Http, &apiNetworking.HTTPRoute{})
+		}
+		if v.Annotations == nil {
+			v.Annotations = map[string]string{}
+		}
+	}
+	src.Spec.Http[0].Route, dst.Spec.Http[0].Route = dst.Spec.Http[0].Route, src.Spec.Http[0].Route
+	srcWeighted, dstWeighted := src.Annotations[weightedHostsAnnotation], dst.Annotations[weightedHostsAnnotation]
+	delete(src.Annotations, weightedHostsAnnotation)
+	delete(dst.Annotations, weightedHostsAnnotation)
+	if dstWeighted != "" {
+		src.Annotations[weightedHostsAnnotation] = dstWeighted
+	}
+	if srcWeighted != "" {
+		dst.Annotations[weightedHostsAnnotation] = srcWeighted
+	}
+}
+
+func replaceDestinationHost(v *networking.VirtualService, from, to string) {
+	for _, route := range v.Spec.Http {
+		for _, dst := range route.Route {
+			if dst.Destination != nil && dst.Destination.Host == from {
+				dst.Destination.Host = to
+			}
+		}
+	}
 }
 
 // Remove removes the application gateway and removes it from the virtualservice
-func (k *IstioGateway) Remove(ctx context.Context, id router.InstanceID) error {
+func (k *IstioGateway) Remove(ctx context.Context, id router.InstanceID) (err error) {
+	ctx, span := startSpan(ctx, "removeIstioGateway", id)
+	defer func() { endSpan(span, err) }()
+
 	cli, err := k.getClient()
 	if err != nil {
 		return err
 	}
-	virtualSvc, err := k.getVS(ctx, cli, id)
+	err = k.removeCertificateSecrets(ctx, id)
+	if err != nil {
+		return err
+	}
+	ns, err := k.getAppNamespace(ctx, id.AppName)
+	if err != nil {
+		return err
+	}
+	var updatedVS *networking.VirtualService
+	err = retryOnConflict(ctx, "removeIstioGateway", func() error {
+		virtualSvc, err := k.getVS(ctx, cli, id)
+		if err != nil {
+			return err
+		}
+		var gateways []string
+		for _, g := range virtualSvc.Spec.Gateways {
+			if g != k.gatewayName(id) {
+				gateways = append(gateways, g)
+			}
+		}
+		existingVS := virtualSvc.DeepCopy()
+		virtualSvc.Spec.Gateways = gateways
+		// the virtualservice is kept, it must not be restored by the Reconciler
+		delete(virtualSvc.Annotations, router.OptsAnnotation)
+		updatedVS, err = applyVirtualService(ctx, cli, ns, existingVS, virtualSvc)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var gateway *networking.Gateway
+	if planFromContext(ctx) != nil {
+		gateway, err = cli.Gateways(ns).Get(ctx, k.gatewayName(id), metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = cli.Gateways(ns).Delete(ctx, k.gatewayName(id), metav1.DeleteOptions{DryRun: dryRun(ctx)})
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+	if gateway != nil && err == nil {
+		planChange(ctx, router.ChangeDelete, "Gateway", gateway, nil, nil)
+	}
+	k.recordEvent(ctx, updatedVS, v1.EventTypeNormal, eventReasonRemoved, "gateway %s removed", k.gatewayName(id))
+	return nil
+}
+
+func (k *IstioGateway) removeCertificateSecrets(ctx context.Context, id router.InstanceID) error {
+	secret, err := k.secretClient()
+	if err != nil {
+		return err
+	}
+	secrets, err := secret.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{appLabel: id.AppName}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets.Items {
+		certName := s.Labels[domainLabel]
+		if certName == "" || s.Name != k.secretName(id, certName) {
+			continue
+		}
+		err = secret.Delete(ctx, s.Name, metav1.DeleteOptions{DryRun: dryRun(ctx)})
+		if k8sErrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		planChange(ctx, router.ChangeDelete, "Secret", &s, nil, nil)
+	}
+	return nil
+}
+
+// AddCertificate stores the certificate as a secret in the gateway namespace
+// and adds an HTTPS server using it to the app gateway
+func (k *IstioGateway) AddCertificate(ctx context.Context, id router.InstanceID, certCname string, cert router.CertData) (err error) {
+	ctx, span := startSpan(ctx, "addIstioGatewayCertificate", id)
+	defer func() { endSpan(span, err) }()
+
+	span.SetAttributes(attribute.String("cname", certCname))
+
+	cli, err := k.getClient()
+	if err != nil {
+		return err
+	}
+	ns, err := k.getAppNamespace(ctx, id.AppName)
+	if err != nil {
+		return err
+	}
+	secret, err := k.secretClient()
+	if err != nil {
+		return err
+	}
+	return retryOnConflict(ctx, "addIstioGatewayCertificate", func() error {
+		return k.addCertificate(ctx, cli, secret, id, ns, certCname, cert)
+	})
+}
+
+// addCertificate stores the certificate and adds its HTTPS server to the
+// gateway read
+func (k *IstioGateway) addCertificate(ctx context.Context, cli networkingClientSet.NetworkingV1beta1Interface, secret typedV1.SecretInterface, id router.InstanceID, ns, certCname string, cert router.CertData) error {
+	gateway, err := cli.Gateways(ns).Get(ctx, k.gatewayName(id), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	tlsSecret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      k.secretName(id, certCname),
+			Namespace: k.gatewayNamespace(),
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSPrivateKeyKey: []byte(cert.Key),
+			v1.TLSCertKey:       []byte(cert.Certificate),
+		},
+	}
+	k.updateObjectMeta(&tlsSecret.ObjectMeta, id.AppName, router.Opts{})
+	tlsSecret.Labels[domainLabel] = certCname
+	err = apply(ctx, tlsSecret, secretGVK, secretApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+		_, err := secret.Patch(ctx, tlsSecret.Name, types.ApplyPatchType, data, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	servers := removeTLSServer(gateway.Spec.Servers, tlsSecret.Name)
+	rotated := len(servers) < len(gateway.Spec.Servers)
+	gateway.Spec.Servers = append(servers, &apiNetworking.Server{
+		Port: &apiNetworking.Port{
+			Number:   443,
+			Name:     "https-" + tlsSecret.Name,
+			Protocol: "HTTPS",
+		},
+		Hosts: []string{certCname},
+		Tls: &apiNetworking.ServerTLSSettings{
+			Mode:           apiNetworking.ServerTLSSettings_SIMPLE,
+			CredentialName: tlsSecret.Name,
+		},
+	})
+	updated, err := cli.Gateways(ns).Update(ctx, gateway, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	if rotated {
+		k.recordEvent(ctx, updated, v1.EventTypeNormal, eventReasonCertificateRotated, "certificate rotated for %s", certCname)
+	} else {
+		k.recordEvent(ctx, updated, v1.EventTypeNormal, eventReasonCertificateAdded, "certificate added for %s", certCname)
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate stored for the app
+func (k *IstioGateway) GetCertificate(ctx context.Context, id router.InstanceID, certCname string) (*router.CertData, error) {
+	secret, err := k.secretClient()
+	if err != nil {
+		return nil, err
+	}
+	retSecret, err := secret.Get(ctx, k.secretName(id, certCname), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	certificate := string(retSecret.Data[v1.TLSCertKey])
+	key := string(retSecret.Data[v1.TLSPrivateKeyKey])
+	return &router.CertData{Certificate: certificate, Key: key}, nil
+}
+
+// RemoveCertificate removes the HTTPS server from the app gateway and
+// deletes the certificate secret
+func (k *IstioGateway) RemoveCertificate(ctx context.Context, id router.InstanceID, certCname string) (err error) {
+	ctx, span := startSpan(ctx, "removeIstioGatewayCertificate", id)
+	defer func() { endSpan(span, err) }()
+
+	span.SetAttributes(attribute.String("cname", certCname))
+
+	cli, err := k.getClient()
 	if err != nil {
 		return err
 	}
@@ -300,18 +828,224 @@ func (k *IstioGateway) Remove(ctx context.Context, id router.InstanceID) error {
 	if err != nil {
 		return err
 	}
-	var gateways []string
-	for _, g := range virtualSvc.Spec.Gateways {
-		if g != k.gatewayName(id) {
-			gateways = append(gateways, g)
+	name := k.secretName(id, certCname)
+	var updated *networking.Gateway
+	err = retryOnConflict(ctx, "removeIstioGatewayCertificate", func() error {
+		gateway, err := cli.Gateways(ns).Get(ctx, k.gatewayName(id), metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
+		servers := removeTLSServer(gateway.Spec.Servers, name)
+		if len(servers) == len(gateway.Spec.Servers) {
+			return nil
+		}
+		gateway.Spec.Servers = servers
+		updated, err = cli.Gateways(ns).Update(ctx, gateway, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
 	}
-	virtualSvc.Spec.Gateways = gateways
-	_, err = cli.VirtualServices(ns).Update(ctx, virtualSvc, metav1.UpdateOptions{})
+	secret, err := k.secretClient()
 	if err != nil {
 		return err
 	}
-	return cli.Gateways(ns).Delete(ctx, k.gatewayName(id), metav1.DeleteOptions{})
+	err = secret.Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return err
+	}
+	if updated != nil {
+		k.recordEvent(ctx, updated, v1.EventTypeNormal, eventReasonCertificateRemoved, "certificate removed for %s", certCname)
+	}
+	return nil
+}
+
+func removeTLSServer(servers []*apiNetworking.Server, credentialName string) []*apiNetworking.Server {
+	var result []*apiNetworking.Server
+	for _, server := range servers {
+		if server.Tls != nil && server.Tls.CredentialName == credentialName {
+			continue
+		}
+		result = append(result, server)
+	}
+	return result
+}
+
+// GetStatus checks that the gateway and virtualservice of the app exist, that
+// the gateway selector matches running pods and that every destination has
+// ready endpoints
+func (k *IstioGateway) GetStatus(ctx context.Context, id router.InstanceID) (router.BackendStatus, string, error) {
+	cli, err := k.getClient()
+	if err != nil {
+		return router.BackendStatusNotReady, "", err
+	}
+	virtualSvc, err := k.getVS(ctx, cli, id)
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return router.BackendStatusNotReady, "waiting for deploy", nil
+		}
+		return router.BackendStatusNotReady, "", err
+	}
+	var detail strings.Builder
+	ready := true
+	gateway, err := cli.Gateways(virtualSvc.Namespace).Get(ctx, k.gatewayName(id), metav1.GetOptions{})
+	if err != nil && !k8sErrors.IsNotFound(err) {
+		return router.BackendStatusNotReady, "", err
+	}
+	if err != nil {
+		ready = false
+		fmt.Fprintf(&detail, "gateway %q not found\n", k.gatewayName(id))
+		gateway = nil
+	} else {
+		podsReady, err := k.gatewayPodsReady(ctx, gateway.Spec.Selector)
+		if err != nil {
+			return router.BackendStatusNotReady, "", err
+		}
+		if !podsReady {
+			ready = false
+			fmt.Fprintf(&detail, "gateway selector %q matches no running pods\n", labels.SelectorFromSet(gateway.Spec.Selector).String())
+		}
+	}
+	destinationsDetail, destinationsReady, err := k.destinationsStatus(ctx, virtualSvc)
+	if err != nil {
+		return router.BackendStatusNotReady, "", err
+	}
+	validationDetail, valid, err := k.validationStatus(ctx, virtualSvc)
+	if err != nil {
+		return router.BackendStatusNotReady, "", err
+	}
+	detail.WriteString(destinationsDetail)
+	detail.WriteString(validationDetail)
+	if ready && destinationsReady && valid {
+		return router.BackendStatusReady, "", nil
+	}
+
+	eventsDetail, err := k.getStatusForRuntimeObject(ctx, virtualSvc.Namespace, "VirtualService", virtualSvc.UID)
+	if err != nil {
+		return router.BackendStatusNotReady, "", err
+	}
+	detail.WriteString(eventsDetail)
+	if gateway != nil {
+		eventsDetail, err = k.getStatusForRuntimeObject(ctx, gateway.Namespace, "Gateway", gateway.UID)
+		if err != nil {
+			return router.BackendStatusNotReady, "", err
+		}
+		detail.WriteString(eventsDetail)
+	}
+	return router.BackendStatusNotReady, detail.String(), nil
+}
+
+func (k *IstioGateway) gatewayPodsReady(ctx context.Context, selector map[string]string) (bool, error) {
+	if len(selector) == 0 {
+		return true, nil
+	}
+	client, err := k.BaseService.getClient()
+	if err != nil {
+		return false, err
+	}
+	pods, err := client.CoreV1().Pods(k.gatewayNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(selector).String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// destinationsStatus checks whether every destination of the virtualservice
+// is a service with ready endpoints, reporting one line per destination not ready
+func (k *IstioGateway) destinationsStatus(ctx context.Context, virtualSvc *networking.VirtualService) (string, bool, error) {
+	client, err := k.BaseService.getClient()
+	if err != nil {
+		return "", false, err
+	}
+	var detail strings.Builder
+	ready := true
+	checked := map[string]bool{}
+	for _, route := range virtualSvc.Spec.Http {
+		for _, dst := range route.Route {
+			if dst.Destination == nil || checked[dst.Destination.Host] {
+				continue
+			}
+			checked[dst.Destination.Host] = true
+			name, namespace, ok := destinationService(dst.Destination.Host, virtualSvc.Namespace)
+			if !ok {
+				// external hosts have no endpoints to check
+				continue
+			}
+			endpoints, err := client.CoreV1().Endpoints(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil && !k8sErrors.IsNotFound(err) {
+				return "", false, err
+			}
+			if endpoints != nil && hasReadyEndpoints(endpoints) {
+				continue
+			}
+			ready = false
+			fmt.Fprintf(&detail, "destination %q has no ready endpoints\n", dst.Destination.Host)
+		}
+	}
+	return detail.String(), ready, nil
+}
+
+// destinationService returns the service name and namespace of a destination
+// host, which may be a short name or a service FQDN. Any other host is
+// external to the cluster and reported as not ok.
+func destinationService(host, defaultNamespace string) (string, string, bool) {
+	if !strings.Contains(host, ".") {
+		return host, defaultNamespace, true
+	}
+	for _, suffix := range []string{".svc", ".svc.cluster.local"} {
+		if !strings.HasSuffix(host, suffix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(host, suffix), ".")
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// validationStatus reports the validation messages set by istio analysis on
+// the virtualservice status, any message with Error level invalidates it
+func (k *IstioGateway) validationStatus(ctx context.Context, virtualSvc *networking.VirtualService) (string, bool, error) {
+	dynamicClient, err := k.getDynamicClient()
+	if err != nil {
+		return "", false, err
+	}
+	obj, err := dynamicClient.Resource(virtualServicesResource).Namespace(virtualSvc.Namespace).Get(ctx, virtualSvc.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return "", true, nil
+		}
+		return "", false, err
+	}
+	messages, _, _ := unstructured.NestedSlice(obj.Object, "status", "validationMessages")
+	var detail strings.Builder
+	valid := true
+	for _, rawMessage := range messages {
+		message, ok := rawMessage.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		level, _, _ := unstructured.NestedString(message, "level")
+		code, _, _ := unstructured.NestedString(message, "type", "code")
+		description, _, _ := unstructured.NestedString(message, "description")
+		if strings.EqualFold(level, "Error") {
+			valid = false
+		}
+		fmt.Fprintf(&detail, "%s - %s - %s\n", level, code, description)
+	}
+	return detail.String(), valid, nil
 }
 
 func diffCNames(existing []string, expected []string) (toAdd []string, toRemove []string) {
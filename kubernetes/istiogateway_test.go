@@ -15,20 +15,32 @@ import (
 	apiNetworking "istio.io/api/networking/v1beta1"
 	networking "istio.io/client-go/pkg/apis/networking/v1beta1"
 	fakeistio "istio.io/client-go/pkg/clientset/versioned/fake"
+	istioscheme "istio.io/client-go/pkg/clientset/versioned/scheme"
 	networkingClientSet "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1beta1"
+	v1 "k8s.io/api/core/v1"
 	fakeapiextensions "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
 )
 
 func fakeService() (IstioGateway, networkingClientSet.NetworkingV1beta1Interface) {
-	fakeIstio := fakeistio.NewSimpleClientset().NetworkingV1beta1()
+	istioClient := fakeistio.NewSimpleClientset()
+	fakeApply(istioClient, istioscheme.Scheme)
+	fakeIstio := istioClient.NetworkingV1beta1()
+	client := fake.NewSimpleClientset()
+	fakeApply(client, kubescheme.Scheme)
 	return IstioGateway{
 		BaseService: &BaseService{
 			Namespace:        "default",
-			Client:           fake.NewSimpleClientset(),
+			Client:           client,
 			TsuruClient:      faketsuru.NewSimpleClientset(),
 			ExtensionsClient: fakeapiextensions.NewSimpleClientset(),
+			DynamicClient:    dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
 		},
 		istioClient:     fakeIstio,
 		DomainSuffix:    "my.domain",
@@ -79,7 +91,9 @@ func TestIstioGateway_Ensure(t *testing.T) {
 		"router.tsuru.io/base-service-name":      "myapp-web",
 		"router.tsuru.io/base-service-namespace": "default",
 	}, virtualSvc.Labels)
-	assert.Equal(t, map[string]string{}, virtualSvc.Annotations)
+	assert.Equal(t, map[string]string{
+		"router.tsuru.io/opts": `{"app":"myapp","prefixes":[{"prefix":"","target":{"namespace":"default","service":"myapp-web"}}]}`,
+	}, virtualSvc.Annotations)
 	assert.Equal(t, apiNetworking.VirtualService{
 		Gateways: []string{
 			"mesh",
@@ -149,6 +163,7 @@ func TestIstioGateway_EnsureWithCNames(t *testing.T) {
 	}, virtualSvc.Labels)
 	assert.Equal(t, map[string]string{
 		"tsuru.io/additional-hosts": "test.io,www.test.io",
+		"router.tsuru.io/opts":      `{"app":"myapp","cnames":["test.io","www.test.io"],"prefixes":[{"prefix":"","target":{"namespace":"default","service":"myapp-web"}}]}`,
 	}, virtualSvc.Annotations)
 	assert.Equal(t, apiNetworking.VirtualService{
 		Gateways: []string{
@@ -244,7 +259,9 @@ func TestIstioGateway_Create_existingVirtualService(t *testing.T) {
 		"router.tsuru.io/base-service-name":      "myapp-web",
 		"router.tsuru.io/base-service-namespace": "default",
 	}, virtualSvc.Labels)
-	assert.Equal(t, map[string]string{}, virtualSvc.Annotations)
+	assert.Equal(t, map[string]string{
+		"router.tsuru.io/opts": `{"app":"myapp","prefixes":[{"prefix":"","target":{"namespace":"default","service":"myapp-web"}}]}`,
+	}, virtualSvc.Annotations)
 	assert.Equal(t, apiNetworking.VirtualService{
 		Gateways: []string{
 			"myapp",
@@ -392,3 +409,410 @@ func TestIstioGateway_CNameLifeCycle(t *testing.T) {
 		})
 	}
 }
+
+func TestIstioGateway_CertificateLifeCycle(t *testing.T) {
+	svc, istio := fakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		CNames: []string{"myapp.io"},
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "myapp-web",
+					Namespace: svc.Namespace,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	expectedCert := router.CertData{Certificate: "Certz", Key: "keyz"}
+	err = svc.AddCertificate(ctx, idForApp("myapp"), "myapp.io", expectedCert)
+	require.NoError(t, err)
+
+	cert, err := svc.GetCertificate(ctx, idForApp("myapp"), "myapp.io")
+	require.NoError(t, err)
+	assert.Equal(t, &expectedCert, cert)
+
+	secret, err := svc.Client.CoreV1().Secrets("istio-system").Get(ctx, "kr-myapp-myapp.io", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"tsuru.io/app-name":    "myapp",
+		"tsuru.io/domain-name": "myapp.io",
+	}, secret.Labels)
+
+	gateway, err := istio.Gateways("default").Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []*apiNetworking.Server{
+		{
+			Port: &apiNetworking.Port{
+				Number:   80,
+				Name:     "http2",
+				Protocol: "HTTP2",
+			},
+			Hosts: []string{"*"},
+		},
+		{
+			Port: &apiNetworking.Port{
+				Number:   443,
+				Name:     "https-kr-myapp-myapp.io",
+				Protocol: "HTTPS",
+			},
+			Hosts: []string{"myapp.io"},
+			Tls: &apiNetworking.ServerTLSSettings{
+				Mode:           apiNetworking.ServerTLSSettings_SIMPLE,
+				CredentialName: "kr-myapp-myapp.io",
+			},
+		},
+	}, gateway.Spec.Servers)
+
+	updatedCert := router.CertData{Certificate: "Certz2", Key: "keyz2"}
+	err = svc.AddCertificate(ctx, idForApp("myapp"), "myapp.io", updatedCert)
+	require.NoError(t, err)
+	cert, err = svc.GetCertificate(ctx, idForApp("myapp"), "myapp.io")
+	require.NoError(t, err)
+	assert.Equal(t, &updatedCert, cert)
+	gateway, err = istio.Gateways("default").Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Len(t, gateway.Spec.Servers, 2)
+
+	err = svc.RemoveCertificate(ctx, idForApp("myapp"), "myapp.io")
+	require.NoError(t, err)
+	_, err = svc.GetCertificate(ctx, idForApp("myapp"), "myapp.io")
+	assert.True(t, k8sErrors.IsNotFound(err))
+	gateway, err = istio.Gateways("default").Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, gateway.Spec.Servers, 1)
+	assert.Nil(t, gateway.Spec.Servers[0].Tls)
+
+	err = svc.RemoveCertificate(ctx, idForApp("myapp"), "myapp.io")
+	require.NoError(t, err)
+}
+
+func TestIstioGateway_RemoveDeletesCertificates(t *testing.T) {
+	svc, _ := fakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "myapp-web",
+					Namespace: svc.Namespace,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	err = svc.AddCertificate(ctx, idForApp("myapp"), "myapp.io", router.CertData{Certificate: "Certz", Key: "keyz"})
+	require.NoError(t, err)
+
+	err = svc.Remove(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	secrets, err := svc.Client.CoreV1().Secrets("istio-system").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, secrets.Items, 0)
+}
+
+func TestIstioGateway_GetStatus(t *testing.T) {
+	svc, _ := fakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+
+	status, detail, err := svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "waiting for deploy", detail)
+
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "myapp-web",
+					Namespace: svc.Namespace,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	status, detail, err = svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "gateway selector \"istio=ingress\" matches no running pods\ndestination \"myapp-web\" has no ready endpoints\n", detail)
+
+	_, err = svc.Client.CoreV1().Pods("istio-system").Create(ctx, &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "istio-ingressgateway-1",
+			Namespace: "istio-system",
+			Labels:    map[string]string{"istio": "ingress"},
+		},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = svc.Client.CoreV1().Endpoints(svc.Namespace).Create(ctx, &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "myapp-web", Namespace: svc.Namespace},
+		Subsets: []v1.EndpointSubset{
+			{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	status, detail, err = svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusReady, status)
+	assert.Equal(t, "", detail)
+
+	_, err = svc.DynamicClient.Resource(virtualServicesResource).Namespace(svc.Namespace).Create(ctx, &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "networking.istio.io/v1beta1",
+			"kind":       "VirtualService",
+			"metadata": map[string]interface{}{
+				"name":      "myapp",
+				"namespace": svc.Namespace,
+			},
+			"status": map[string]interface{}{
+				"validationMessages": []interface{}{
+					map[string]interface{}{
+						"level":       "Error",
+						"type":        map[string]interface{}{"code": "IST0101"},
+						"description": "Referenced host not found",
+					},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	status, detail, err = svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "Error - IST0101 - Referenced host not found\n", detail)
+}
+
+func TestIstioGateway_GetStatusGatewayNotFound(t *testing.T) {
+	svc, istio := fakeService()
+	svc.GatewaySelector = nil
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "myapp-web",
+					Namespace: svc.Namespace,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	err = istio.Gateways(svc.Namespace).Delete(ctx, "myapp", metav1.DeleteOptions{})
+	require.NoError(t, err)
+
+	status, detail, err := svc.GetStatus(ctx, idForApp("myapp"))
+	require.NoError(t, err)
+	assert.Equal(t, router.BackendStatusNotReady, status)
+	assert.Equal(t, "gateway \"myapp\" not found\ndestination \"myapp-web\" has no ready endpoints\n", detail)
+}
+
+func TestIstioGateway_Swap(t *testing.T) {
+	svc, istio := fakeService()
+	for _, app := range []string{"myapp", "otherapp"} {
+		err := createAppWebService(svc.Client, svc.Namespace, app)
+		require.NoError(t, err)
+		err = svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{
+						Service:   app + "-web",
+						Namespace: svc.Namespace,
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	err := svc.Swap(ctx, idForApp("myapp"), idForApp("otherapp"), router.SwapOpts{})
+	require.NoError(t, err)
+
+	assertDestination := func(app, host, swappedWith string) {
+		virtualSvc, err := istio.VirtualServices("default").Get(ctx, app, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []*apiNetworking.HTTPRouteDestination{
+			{
+				Destination: &apiNetworking.Destination{Host: host},
+			},
+		}, virtualSvc.Spec.Http[0].Route)
+		assert.Equal(t, host, virtualSvc.Labels[appBaseServiceNameLabel])
+		assert.Equal(t, swappedWith, virtualSvc.Labels[swapLabel])
+		assert.Contains(t, virtualSvc.Spec.Hosts, app+"-web")
+	}
+	assertDestination("myapp", "otherapp-web", "otherapp")
+	assertDestination("otherapp", "myapp-web", "myapp")
+
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "myapp-web",
+					Namespace: svc.Namespace,
+				},
+			},
+		},
+	})
+	require.Equal(t, router.ErrIngressAlreadyExists, err)
+	assertDestination("myapp", "otherapp-web", "otherapp")
+
+	err = svc.Swap(ctx, idForApp("myapp"), idForApp("otherapp"), router.SwapOpts{})
+	require.NoError(t, err)
+	assertDestination("myapp", "myapp-web", "")
+	assertDestination("otherapp", "otherapp-web", "")
+}
+
+func TestIstioGateway_SwapWeightedTargets(t *testing.T) {
+	svc, istio := fakeService()
+	for _, app := range []string{"myapp", "otherapp"} {
+		err := createAppWebService(svc.Client, svc.Namespace, app)
+		require.NoError(t, err)
+	}
+	err := createAppProcessService(svc.Client, svc.Namespace, "myapp", "canary")
+	require.NoError(t, err)
+	stable := router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace}
+	canary := router.BackendTarget{Service: "myapp-canary", Namespace: svc.Namespace}
+	ensureMyapp := func(canaryWeight int32) {
+		err := svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: stable,
+					Targets: []router.WeightedBackendTarget{
+						{BackendTarget: stable, Weight: 100 - canaryWeight},
+						{BackendTarget: canary, Weight: canaryWeight},
+					},
+				},
+			},
+		})
+		if err != router.ErrIngressAlreadyExists {
+			require.NoError(t, err)
+		}
+	}
+	ensureMyapp(20)
+	err = svc.Ensure(ctx, idForApp("otherapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{Target: router.BackendTarget{Service: "otherapp-web", Namespace: svc.Namespace}},
+		},
+	})
+	require.NoError(t, err)
+
+	err = svc.Swap(ctx, idForApp("myapp"), idForApp("otherapp"), router.SwapOpts{})
+	require.NoError(t, err)
+
+	assertRoute := func(app, weightedHosts string, route []*apiNetworking.HTTPRouteDestination) {
+		virtualSvc, err := istio.VirtualServices("default").Get(ctx, app, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, route, virtualSvc.Spec.Http[0].Route)
+		assert.Equal(t, weightedHosts, virtualSvc.Annotations[weightedHostsAnnotation])
+	}
+	assertRoute("myapp", "", []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "otherapp-web"}},
+	})
+	assertRoute("otherapp", "myapp-canary,myapp-web", []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "myapp-web"}, Weight: 80},
+		{Destination: &apiNetworking.Destination{Host: "myapp-canary"}, Weight: 20},
+	})
+
+	ensureMyapp(50)
+	assertRoute("myapp", "", []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "otherapp-web"}},
+	})
+	assertRoute("otherapp", "myapp-canary,myapp-web", []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "myapp-web"}, Weight: 50},
+		{Destination: &apiNetworking.Destination{Host: "myapp-canary"}, Weight: 50},
+	})
+
+	err = svc.Swap(ctx, idForApp("myapp"), idForApp("otherapp"), router.SwapOpts{})
+	require.NoError(t, err)
+	assertRoute("myapp", "myapp-canary,myapp-web", []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "myapp-web"}, Weight: 50},
+		{Destination: &apiNetworking.Destination{Host: "myapp-canary"}, Weight: 50},
+	})
+	assertRoute("otherapp", "", []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "otherapp-web"}},
+	})
+
+	err = svc.Swap(ctx, idForApp("myapp"), idForApp("otherapp"), router.SwapOpts{CNameOnly: true})
+	assert.Equal(t, router.ErrSwapCNameOnlyUnsupported, err)
+}
+
+func TestIstioGateway_EnsureWeightedTargets(t *testing.T) {
+	svc, istio := fakeService()
+	err := createAppWebService(svc.Client, svc.Namespace, "myapp")
+	require.NoError(t, err)
+	err = createAppProcessService(svc.Client, svc.Namespace, "myapp", "canary")
+	require.NoError(t, err)
+	stable := router.BackendTarget{Service: "myapp-web", Namespace: svc.Namespace}
+	canary := router.BackendTarget{Service: "myapp-canary", Namespace: svc.Namespace}
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: stable,
+				Targets: []router.WeightedBackendTarget{
+					{BackendTarget: stable, Weight: 80},
+					{BackendTarget: canary, Weight: 20},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	virtualSvc, err := istio.VirtualServices("default").Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "myapp-web"}, Weight: 80},
+		{Destination: &apiNetworking.Destination{Host: "myapp-canary"}, Weight: 20},
+	}, virtualSvc.Spec.Http[0].Route)
+	assert.Equal(t, "myapp-canary,myapp-web", virtualSvc.Annotations[weightedHostsAnnotation])
+
+	err = svc.Ensure(ctx, idForApp("myapp"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{{Target: stable}},
+	})
+	require.Equal(t, router.ErrIngressAlreadyExists, err)
+	virtualSvc, err = istio.VirtualServices("default").Get(ctx, "myapp", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []*apiNetworking.HTTPRouteDestination{
+		{Destination: &apiNetworking.Destination{Host: "myapp-web"}},
+	}, virtualSvc.Spec.Http[0].Route)
+	assert.NotContains(t, virtualSvc.Annotations, weightedHostsAnnotation)
+}
+
+func TestIstioGateway_ValidateWeightedTargets(t *testing.T) {
+	svc, _ := fakeService()
+	targets := []router.WeightedBackendTarget{
+		{BackendTarget: router.BackendTarget{Service: "myapp-web", Namespace: "default"}, Weight: 50},
+		{BackendTarget: router.BackendTarget{Service: "myapp-canary", Namespace: "default"}, Weight: 50},
+	}
+	err := svc.ValidateWeightedTargets(ctx, []router.BackendPrefix{{Targets: targets}})
+	assert.NoError(t, err)
+	err = svc.ValidateWeightedTargets(ctx, []router.BackendPrefix{{Prefix: "api", Targets: targets}})
+	assert.EqualError(t, err, `weighted targets are only supported on the default prefix, got prefix "api"`)
+}
+
+func TestIstioGateway_DestinationService(t *testing.T) {
+	tests := []struct {
+		host              string
+		name, namespace   string
+		isClusterInternal bool
+	}{
+		{host: "myapp-web", name: "myapp-web", namespace: "default", isClusterInternal: true},
+		{host: "myapp-web.other.svc", name: "myapp-web", namespace: "other", isClusterInternal: true},
+		{host: "myapp-web.other.svc.cluster.local", name: "myapp-web", namespace: "other", isClusterInternal: true},
+		{host: "example.com"},
+		{host: "www.example.com"},
+	}
+	for _, tt := range tests {
+		name, namespace, ok := destinationService(tt.host, "default")
+		assert.Equal(t, tt.isClusterInternal, ok, tt.host)
+		assert.Equal(t, tt.name, name, tt.host)
+		assert.Equal(t, tt.namespace, namespace, tt.host)
+	}
+}
@@ -9,14 +9,17 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/opentracing/opentracing-go"
 	"github.com/tsuru/kubernetes-router/router"
+	"go.opentelemetry.io/otel/attribute"
 	v1 "k8s.io/api/core/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
@@ -27,17 +30,35 @@ const (
 	// exposeAllPortsOpt is the flag used to expose all ports in the LB
 	exposeAllPortsOpt = "expose-all-ports"
 
+	// portsOpt is the option used to map LB ports to ports of the app,
+	// ie: 80:8888/TCP,53:5353/UDP
+	portsOpt = "ports"
+
 	annotationOptPrefix = "svc-annotation-"
 )
 
 var (
 	// ErrLoadBalancerNotReady is returned when a given LB has no IP
 	ErrLoadBalancerNotReady = errors.New("load balancer is not ready")
+
+	// serviceApplyFields are the fields of load balancer services owned by
+	// the router, the cluster IP and the annotations set by others are kept
+	serviceApplyFields = []string{
+		"metadata.labels",
+		"metadata.annotations",
+		"spec.type",
+		"spec.selector",
+		"spec.ports",
+		"spec.externalTrafficPolicy",
+	}
 )
 
 var (
-	_ router.Router       = &LBService{}
-	_ router.RouterStatus = &LBService{}
+	_ router.Router              = &LBService{}
+	_ router.RouterStatus        = &LBService{}
+	_ router.RouterSwap          = &LBService{}
+	_ router.RouterOptionsSchema = &LBService{}
+	_ router.RouterPlanner       = &LBService{}
 )
 
 // LBService manages LoadBalancer services
@@ -55,7 +76,10 @@ type LBService struct {
 }
 
 // Remove removes the LoadBalancer service
-func (s *LBService) Remove(ctx context.Context, id router.InstanceID) error {
+func (s *LBService) Remove(ctx context.Context, id router.InstanceID) (err error) {
+	ctx, span := startSpan(ctx, "removeLoadbalancer", id)
+	defer func() { endSpan(span, err) }()
+
 	client, err := s.getClient()
 	if err != nil {
 		return err
@@ -71,11 +95,23 @@ func (s *LBService) Remove(ctx context.Context, id router.InstanceID) error {
 	if err != nil {
 		return err
 	}
-	err = client.CoreV1().Services(ns).Delete(ctx, service.Name, metav1.DeleteOptions{})
+	err = s.forgetEnsureOpts(ctx, func(ctx context.Context, data []byte) error {
+		_, err := client.CoreV1().Services(ns).Patch(ctx, service.Name, types.MergePatchType, data, metav1.PatchOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = client.CoreV1().Services(ns).Delete(ctx, service.Name, metav1.DeleteOptions{DryRun: dryRun(ctx)})
 	if k8sErrors.IsNotFound(err) {
 		return nil
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	planChange(ctx, router.ChangeDelete, "Service", service, nil, nil)
+	s.recordRemovalEvent(ctx, service, v1.EventTypeNormal, eventReasonRemoved, "service %s removed", service.Name)
+	return nil
 }
 
 // Get returns the LoadBalancer IP
@@ -89,6 +125,9 @@ func (s *LBService) GetAddresses(ctx context.Context, id router.InstanceID) ([]s
 	}
 	var addr string
 	lbs := service.Status.LoadBalancer.Ingress
+	if hasPortsOpt(service) {
+		return portsAddresses(service), nil
+	}
 	if service.Annotations[externalDNSHostnameLabel] != "" {
 		hostnames := strings.Split(service.Annotations[externalDNSHostnameLabel], ",")
 		return hostnames, nil
@@ -111,6 +150,7 @@ func (s *LBService) SupportedOptions(ctx context.Context) map[string]string {
 	opts := map[string]string{
 		router.ExposedPort: "",
 		exposeAllPortsOpt:  "Expose all ports used by application in the Load Balancer. Defaults to false.",
+		portsOpt:           "Comma separated list of ports exposed by the Load Balancer as <port>:<target port>[/<protocol>], ie: 80:8888/TCP,53:5353/UDP. Overrides exposed-port.",
 	}
 	for k, v := range s.OptsAsLabels {
 		opts[k] = v
@@ -121,6 +161,19 @@ func (s *LBService) SupportedOptions(ctx context.Context) map[string]string {
 	return opts
 }
 
+// OptionsSchema returns the schema of the supported options
+func (s *LBService) OptionsSchema(ctx context.Context) map[string]router.OptionSchema {
+	return map[string]router.OptionSchema{
+		router.ExposedPort:           {Type: router.OptionTypePort},
+		router.Domain:                {Type: router.OptionTypeDomain},
+		router.DomainSuffix:          {Type: router.OptionTypeDomain},
+		router.DomainPrefix:          {Type: router.OptionTypeDomain},
+		router.ExternalTrafficPolicy: {Type: router.OptionTypeString, Values: []string{"Cluster", "Local"}},
+		exposeAllPortsOpt:            {Type: router.OptionTypeBool},
+		portsOpt:                     {Type: router.OptionTypeString},
+	}
+}
+
 func (s *LBService) GetStatus(ctx context.Context, id router.InstanceID) (router.BackendStatus, string, error) {
 	service, err := s.getLBService(ctx, id)
 	if err != nil {
@@ -140,6 +193,58 @@ func (s *LBService) GetStatus(ctx context.Context, id router.InstanceID) (router
 	return router.BackendStatusNotReady, detail, nil
 }
 
+// Swap exchanges the selectors of the LoadBalancer services of two apps,
+// rolling back the first app when the second fails
+func (s *LBService) Swap(ctx context.Context, src, dst router.InstanceID, opts router.SwapOpts) (err error) {
+	ctx, span := startSpan(ctx, "swapLoadbalancer", src)
+	defer func() { endSpan(span, err) }()
+
+	span.SetAttributes(attribute.String("dst.app", dst.AppName))
+
+	if opts.CNameOnly {
+		return router.ErrSwapCNameOnlyUnsupported
+	}
+	srcService, err := s.getLBService(ctx, src)
+	if err != nil {
+		return err
+	}
+	dstService, err := s.getLBService(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if srcService.Namespace != dstService.Namespace {
+		return router.ErrSwapDifferentNamespaces
+	}
+	unswap, _, err := checkSwap(srcService.ObjectMeta, dstService.ObjectMeta, src, dst, opts)
+	if err != nil {
+		return err
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	services := client.CoreV1().Services(srcService.Namespace)
+	original := srcService.DeepCopy()
+	srcService.Spec.Selector, dstService.Spec.Selector = dstService.Spec.Selector, srcService.Spec.Selector
+	swapObjectMeta(&srcService.ObjectMeta, &dstService.ObjectMeta, src, dst, unswap, false)
+	srcService, err = services.Update(ctx, srcService, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = services.Update(ctx, dstService, metav1.UpdateOptions{})
+	if err != nil {
+		original.ResourceVersion = srcService.ResourceVersion
+		_, rollbackErr := services.Update(ctx, original, metav1.UpdateOptions{})
+		if rollbackErr != nil {
+			return fmt.Errorf("failed to rollback swap: %v: %w", rollbackErr, err)
+		}
+		return err
+	}
+	s.recordEvent(ctx, srcService, v1.EventTypeNormal, eventReasonSwapped, "swapped with %s", dst.AppName)
+	s.recordEvent(ctx, dstService, v1.EventTypeNormal, eventReasonSwapped, "swapped with %s", src.AppName)
+	return nil
+}
+
 func (s *LBService) getLBService(ctx context.Context, id router.InstanceID) (*v1.Service, error) {
 	client, err := s.getClient()
 	if err != nil {
@@ -167,42 +272,55 @@ func isReady(service *v1.Service) bool {
 // Ensure creates or updates the LoadBalancer service copying the web service
 // labels, selectors, annotations and ports
 
-func (s *LBService) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) error {
-	span, ctx := opentracing.StartSpanFromContext(ctx, "ensureLoadbalancer")
-	defer span.Finish()
+func (s *LBService) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (err error) {
+	ctx, span := startSpan(ctx, "ensureLoadbalancer", id)
+	defer func() { endSpan(span, err) }()
 
+	span.SetAttributes(attribute.String("pool", o.Opts.Pool))
+
+	err = retryOnConflict(ctx, "ensureLoadbalancer", func() error {
+		return s.ensure(ctx, id, o)
+	})
+	if err != nil {
+		var current runtime.Object
+		if service, getErr := s.getLBService(ctx, id); getErr == nil {
+			current = service
+		}
+		s.recordEnsureFailure(ctx, id, o, current, err)
+	}
+	return err
+}
+
+// ensure reads the services of the app and merges them with o, it is
+// retried as a whole when they are changed concurrently
+func (s *LBService) ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) error {
 	app, err := s.getApp(ctx, id.AppName)
 	if err != nil {
 		return err
 	}
-	isNew := false
 	existingLBService, err := s.getLBService(ctx, id)
-	var lbService *v1.Service
 	if err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return err
 		}
-		isNew = true
-		ns := s.Namespace
-		if app != nil {
-			ns = app.Spec.NamespaceName
-		}
-		lbService = &v1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      s.serviceName(id),
-				Namespace: ns,
-			},
-			Spec: v1.ServiceSpec{
-				Type: v1.ServiceTypeLoadBalancer,
-			},
-		}
-	}
-	if !isNew {
-		lbService = existingLBService.DeepCopy()
+		existingLBService = nil
 	}
-	if isFrozenSvc(lbService) {
+	if isFrozenSvc(existingLBService) {
 		return nil
 	}
+	ns := s.Namespace
+	if app != nil {
+		ns = app.Spec.NamespaceName
+	}
+	lbService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.serviceName(id),
+			Namespace: ns,
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+		},
+	}
 
 	if o.Opts.ExternalTrafficPolicy == "Cluster" || o.Opts.ExternalTrafficPolicy == "Local" {
 		lbService.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyType(o.Opts.ExternalTrafficPolicy)
@@ -218,36 +336,101 @@ func (s *LBService) Ensure(ctx context.Context, id router.InstanceID, o router.E
 		return err
 	}
 
-	lbService.Spec.Selector = webService.Spec.Selector
+	// swapped services keep selecting the pods of the other app, the
+	// selector of the partner service is updated instead
+	var swap *swapState
+	var partnerService *v1.Service
+	if existingLBService != nil {
+		swap = getSwapState(existingLBService.ObjectMeta)
+	}
+	if swap != nil {
+		partnerService, err = s.getLBService(ctx, swap.partner)
+		if k8sErrors.IsNotFound(err) {
+			swap = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if swap == nil {
+		lbService.Spec.Selector = webService.Spec.Selector
+	} else {
+		lbService.Spec.Selector = existingLBService.Spec.Selector
+	}
 
 	err = s.fillLabelsAndAnnotations(ctx, lbService, id, webService, o.Opts, *defaultTarget)
 	if err != nil {
 		return err
 	}
-
-	ports, err := s.portsForService(lbService, o.Opts, webService)
+	setSwapMeta(&lbService.ObjectMeta, swap)
+	if swap != nil {
+		for _, label := range []string{appBaseServiceNamespaceLabel, appBaseServiceNameLabel} {
+			lbService.Labels[label] = existingLBService.Labels[label]
+		}
+	}
+	err = s.storeEnsureOpts(&lbService.ObjectMeta, id, o)
 	if err != nil {
 		return err
 	}
-	lbService.Spec.Ports = ports
-	client, err := s.getClient()
+
+	var existingPorts []v1.ServicePort
+	if existingLBService != nil {
+		existingPorts = existingLBService.Spec.Ports
+	}
+	ports, err := s.portsForService(existingPorts, o.Opts, webService)
 	if err != nil {
 		return err
 	}
+	lbService.Spec.Ports = ports
 
-	if isNew {
-		_, err = client.CoreV1().Services(lbService.Namespace).Create(ctx, lbService, metav1.CreateOptions{})
+	if swap != nil {
+		updated := partnerService.DeepCopy()
+		updated.Spec.Selector = webService.Spec.Selector
+		if updated.Labels == nil {
+			updated.Labels = map[string]string{}
+		}
+		updated.Labels[appBaseServiceNamespaceLabel] = defaultTarget.Namespace
+		updated.Labels[appBaseServiceNameLabel] = defaultTarget.Service
+		_, err = s.applyService(ctx, partnerService, updated)
+		if err != nil {
+			return err
+		}
+	}
+	if existingLBService != nil {
+		// the service is merged with the one read, which must not have
+		// changed since
+		lbService.ResourceVersion = existingLBService.ResourceVersion
+	}
+	applied, err := s.applyService(ctx, existingLBService, lbService)
+	if err != nil {
 		return err
 	}
+	s.recordEvent(ctx, applied, v1.EventTypeNormal, eventReasonEnsured, "service %s ensured", applied.Name)
+	return nil
+}
 
-	hasChanges := serviceHasChanges(span, existingLBService, lbService)
-
-	if hasChanges {
-		_, err = client.CoreV1().Services(lbService.Namespace).Update(ctx, lbService, metav1.UpdateOptions{})
+// applyService writes the fields of svc owned by the router with a
+// server-side apply, as a dry-run added to the plan of ctx when planning,
+// and returns the service applied
+func (s *LBService) applyService(ctx context.Context, current, svc *v1.Service) (*v1.Service, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	var result *v1.Service
+	err = apply(ctx, svc, v1.SchemeGroupVersion.WithKind("Service"), serviceApplyFields, func(ctx context.Context, data []byte, opts metav1.PatchOptions) error {
+		var err error
+		result, err = client.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, types.ApplyPatchType, data, opts)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	if current == nil {
+		planChange(ctx, router.ChangeCreate, "Service", nil, result, nil)
+	} else if fields := serviceChanges(current, result); len(fields) > 0 {
+		planChange(ctx, router.ChangeUpdate, "Service", current, result, fields)
+	}
+	return result, nil
 }
 
 func (s *LBService) fillLabelsAndAnnotations(ctx context.Context, svc *v1.Service, id router.InstanceID, webService *v1.Service, opts router.Opts, backendTarget router.BackendTarget) error {
@@ -326,19 +509,128 @@ func (s *LBService) fillLabelsAndAnnotations(ctx context.Context, svc *v1.Servic
 	return nil
 }
 
-func (s *LBService) portsForService(svc *v1.Service, opts router.Opts, baseSvc *v1.Service) ([]v1.ServicePort, error) {
+// hasPortsOpt returns whether the service was ensured with the ports option
+func hasPortsOpt(service *v1.Service) bool {
+	opts, err := router.OptsFromAnnotations(&service.ObjectMeta)
+	if err != nil {
+		return false
+	}
+	return opts.AdditionalOpts[portsOpt] != ""
+}
+
+// portsAddresses lists every port of the service for each of its addresses,
+// ie: 10.0.0.1:53/UDP
+func portsAddresses(service *v1.Service) []string {
+	var hosts []string
+	if service.Annotations[externalDNSHostnameLabel] != "" {
+		hosts = strings.Split(service.Annotations[externalDNSHostnameLabel], ",")
+	}
+	for _, lb := range service.Status.LoadBalancer.Ingress {
+		if lb.Hostname != "" {
+			hosts = append(hosts, lb.Hostname)
+		} else if lb.IP != "" {
+			hosts = append(hosts, lb.IP)
+		}
+	}
+	if len(hosts) == 0 {
+		return []string{""}
+	}
+	var addrs []string
+	for _, host := range hosts {
+		for _, port := range service.Spec.Ports {
+			addrs = append(addrs, fmt.Sprintf("%s:%d/%s", host, port.Port, portProtocol(port)))
+		}
+	}
+	return addrs
+}
+
+// parsePortsOpt parses the ports option, ie: 80:8888/TCP,53:5353/UDP, the
+// protocol defaults to TCP
+func parsePortsOpt(value string) ([]v1.ServicePort, error) {
+	var ports []v1.ServicePort
+	seen := map[portKey]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		mapping, protocol := entry, v1.ProtocolTCP
+		if idx := strings.Index(entry, "/"); idx != -1 {
+			mapping = entry[:idx]
+			protocol = v1.Protocol(strings.ToUpper(entry[idx+1:]))
+		}
+		switch protocol {
+		case v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+		default:
+			return nil, fmt.Errorf("invalid protocol %q in ports option entry %q", protocol, entry)
+		}
+		parts := strings.Split(mapping, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid ports option entry %q, expected <port>:<target port>[/<protocol>]", entry)
+		}
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q in ports option entry %q", parts[0], entry)
+		}
+		targetPort := intstr.Parse(parts[1])
+		if (targetPort.Type == intstr.Int && (targetPort.IntVal < 1 || targetPort.IntVal > 65535)) || parts[1] == "" {
+			return nil, fmt.Errorf("invalid target port %q in ports option entry %q", parts[1], entry)
+		}
+		key := portKey{port: int32(port), protocol: protocol}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicated port %d/%s in ports option", port, protocol)
+		}
+		seen[key] = true
+		ports = append(ports, v1.ServicePort{
+			Name:       fmt.Sprintf("port-%d-%s", port, strings.ToLower(string(protocol))),
+			Protocol:   protocol,
+			Port:       int32(port),
+			TargetPort: targetPort,
+		})
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("ports option must have at least one entry")
+	}
+	return ports, nil
+}
+
+type portKey struct {
+	port     int32
+	protocol v1.Protocol
+}
+
+func portProtocol(port v1.ServicePort) v1.Protocol {
+	if port.Protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+func (s *LBService) portsForService(currentPorts []v1.ServicePort, opts router.Opts, baseSvc *v1.Service) ([]v1.ServicePort, error) {
 	additionalPort, _ := strconv.Atoi(opts.ExposedPort)
 	if additionalPort == 0 {
 		additionalPort = defaultLBPort
 	}
 
-	existingPorts := map[int32]*v1.ServicePort{}
-	for i, port := range svc.Spec.Ports {
-		existingPorts[port.Port] = &svc.Spec.Ports[i]
+	existingPorts := map[portKey]*v1.ServicePort{}
+	for i, port := range currentPorts {
+		existingPorts[portKey{port: port.Port, protocol: portProtocol(port)}] = &currentPorts[i]
 	}
 
 	exposeAllPorts, _ := strconv.ParseBool(opts.AdditionalOpts[exposeAllPortsOpt])
 
+	if portsValue, ok := opts.AdditionalOpts[portsOpt]; ok {
+		if exposeAllPorts {
+			return nil, fmt.Errorf("%s and %s options cannot be used together", portsOpt, exposeAllPortsOpt)
+		}
+		wantedPorts, err := parsePortsOpt(portsValue)
+		if err != nil {
+			return nil, err
+		}
+		keepNodePorts(wantedPorts, existingPorts)
+		return wantedPorts, nil
+	}
+
 	var basePorts, wantedPorts []v1.ServicePort
 	if baseSvc != nil {
 		basePorts = baseSvc.Spec.Ports
@@ -380,53 +672,48 @@ func (s *LBService) portsForService(svc *v1.Service, opts router.Opts, baseSvc *
 		})
 	}
 
+	keepNodePorts(wantedPorts, existingPorts)
+
+	return wantedPorts, nil
+}
+
+func keepNodePorts(wantedPorts []v1.ServicePort, existingPorts map[portKey]*v1.ServicePort) {
 	for i := range wantedPorts {
-		existingPort, ok := existingPorts[wantedPorts[i].Port]
+		existingPort, ok := existingPorts[portKey{port: wantedPorts[i].Port, protocol: portProtocol(wantedPorts[i])}]
 		if ok {
 			wantedPorts[i].NodePort = existingPort.NodePort
 		}
 	}
-
-	return wantedPorts, nil
 }
 
-func serviceHasChanges(span opentracing.Span, existing *v1.Service, svc *v1.Service) (hasChanges bool) {
+// serviceChanges returns the fields of existing changed by svc: the spec and
+// the annotations and labels set by svc. Plans describe applies with it, the
+// server itself skips applies changing nothing
+func serviceChanges(existing *v1.Service, svc *v1.Service) []string {
+	var fields []string
 	if !reflect.DeepEqual(existing.Spec, svc.Spec) {
-		span.LogKV(
-			"message", "service has changed the spec",
-			"service", existing.Name,
-		)
-		return true
-	}
-	for key, value := range svc.Annotations {
-		if existing.Annotations[key] != value {
-			span.LogKV(
-				"message", "service has changed the annotation",
-				"service", existing.Name,
-				"annotation", key,
-				"existingValue", existing.Annotations[key],
-				"newValue", value,
-			)
-			return true
-		}
-	}
-	for key, value := range svc.Labels {
-		if existing.Labels[key] != value {
-			span.LogKV(
-				"message", "service has changed the label",
-				"service", existing.Name,
-				"label", key,
-				"existingValue", existing.Labels[key],
-				"newValue", value,
-			)
-			return true
-		}
-	}
-	span.LogKV(
-		"message", "service has no changes",
-		"service", existing.Name,
-	)
-	return false
+		fields = append(fields, "spec")
+	}
+	for _, key := range changedKeys(existing.Annotations, svc.Annotations) {
+		fields = append(fields, "metadata.annotations."+key)
+	}
+	for _, key := range changedKeys(existing.Labels, svc.Labels) {
+		fields = append(fields, "metadata.labels."+key)
+	}
+	return fields
+}
+
+// changedKeys returns, sorted, the keys of desired whose values differ on
+// existing
+func changedKeys(existing, desired map[string]string) []string {
+	var keys []string
+	for key, value := range desired {
+		if existing[key] != value {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func mergeMaps(entries ...map[string]string) map[string]string {
@@ -6,6 +6,8 @@ package kubernetes
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -22,16 +24,19 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
 	ktesting "k8s.io/client-go/testing"
 )
 
 var ctx = context.Background()
 
 func createFakeLBService() LBService {
+	client := fake.NewSimpleClientset()
+	fakeApply(client, kubescheme.Scheme)
 	return LBService{
 		BaseService: &BaseService{
 			Namespace:        "default",
-			Client:           fake.NewSimpleClientset(),
+			Client:           client,
 			TsuruClient:      faketsuru.NewSimpleClientset(),
 			ExtensionsClient: fakeapiextensions.NewSimpleClientset(),
 		},
@@ -70,7 +75,7 @@ func TestLBEnsure(t *testing.T) {
 	expectedAnnotations := map[string]string{
 		"annotation": "annval",
 		"external-dns.alpha.kubernetes.io/hostname": "test.myapps.io",
-		"router.tsuru.io/opts":                      `{"Pool":"mypool","DomainSuffix":"myapps.io","AdditionalOpts":{"my-opt":"value"}}`,
+		"router.tsuru.io/opts":                      `{"Pool":"mypool","DomainSuffix":"myapps.io","AdditionalOpts":{"my-opt":"value"},"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`,
 	}
 	expectedService := defaultService("test", "default", svc.Labels, expectedAnnotations, nil)
 	assert.Equal(t, expectedService, foundService)
@@ -104,7 +109,7 @@ func TestLBEnsureWithExternalTrafficPolicy(t *testing.T) {
 	expectedAnnotations := map[string]string{
 		"annotation": "annval",
 		"external-dns.alpha.kubernetes.io/hostname": "test.myapps.io",
-		"router.tsuru.io/opts":                      `{"Pool":"mypool","DomainSuffix":"myapps.io","ExternalTrafficPolicy":"Local"}`,
+		"router.tsuru.io/opts":                      `{"Pool":"mypool","DomainSuffix":"myapps.io","ExternalTrafficPolicy":"Local","app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`,
 	}
 	expectedService := defaultService("test", "default", svc.Labels, expectedAnnotations, nil)
 	expectedService.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
@@ -146,7 +151,7 @@ func TestLBEnsureWithDomain(t *testing.T) {
 	expectedAnnotations := map[string]string{
 		"annotation": "annval",
 		"external-dns.alpha.kubernetes.io/hostname": "myappdomain.zone.io",
-		"router.tsuru.io/opts":                      `{"Pool":"mypool","Domain":"myappdomain.zone.io","AdditionalOpts":{"my-opt":"value"}}`,
+		"router.tsuru.io/opts":                      `{"Pool":"mypool","Domain":"myappdomain.zone.io","AdditionalOpts":{"my-opt":"value"},"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`,
 	}
 	expectedService := defaultService("test", "default", svc.Labels, expectedAnnotations, nil)
 	assert.Equal(t, expectedService, foundService)
@@ -192,7 +197,7 @@ func TestLBEnsureCustomAnnotation(t *testing.T) {
 		"ann2":                 "val2",
 		"other-opt":            "other-value",
 		"a.b/x.y":              "true",
-		"router.tsuru.io/opts": `{"Pool":"mypool","AdditionalOpts":{"ann1-":"","my-opt":"value","other-opt":"other-value","svc-annotation-a:b/x:y":"true"}}`,
+		"router.tsuru.io/opts": `{"Pool":"mypool","AdditionalOpts":{"ann1-":"","my-opt":"value","other-opt":"other-value","svc-annotation-a:b/x:y":"true"},"app":"test","prefixes":[{"prefix":"","target":{"namespace":"default","service":"test-web"}}]}`,
 	}
 	expectedService := defaultService("test", "default", svc.Labels, expectedAnnotations, nil)
 	assert.Equal(t, expectedService, foundService)
@@ -206,10 +211,11 @@ func TestLBEnsureDefaultPort(t *testing.T) {
 	err = createAppWebService(svc.Client, svc.Namespace, "myapp")
 	require.NoError(t, err)
 
-	svc.BaseService.Client.(*fake.Clientset).PrependReactor("create", "services", func(action ktesting.Action) (bool, runtime.Object, error) {
-		newSvc, ok := action.(ktesting.CreateAction).GetObject().(*v1.Service)
-		if !ok {
-			t.Errorf("Error creating service.")
+	svc.BaseService.Client.(*fake.Clientset).PrependReactor("patch", "services", func(action ktesting.Action) (bool, runtime.Object, error) {
+		var newSvc v1.Service
+		err := json.Unmarshal(action.(ktesting.PatchAction).GetPatch(), &newSvc)
+		if err != nil {
+			t.Errorf("Error applying service: %v", err)
 		}
 		ports := newSvc.Spec.Ports
 		if len(ports) != 1 || ports[0].TargetPort != intstr.FromInt(8888) {
@@ -247,6 +253,7 @@ func TestLBSupportedOptions(t *testing.T) {
 		"exposed-port":     "",
 		"my-opt":           "my-opt-as-label",
 		"expose-all-ports": "Expose all ports used by application in the Load Balancer. Defaults to false.",
+		"ports":            "Comma separated list of ports exposed by the Load Balancer as <port>:<target port>[/<protocol>], ie: 80:8888/TCP,53:5353/UDP. Overrides exposed-port.",
 	}
 	if !reflect.DeepEqual(options, expectedOptions) {
 		t.Errorf("Expected %v. Got %v", expectedOptions, options)
@@ -1080,3 +1087,223 @@ func setIP(t *testing.T, svc LBService, appName string) {
 		t.Fatalf("Expected err to be nil. Got %v", err)
 	}
 }
+
+func TestLBSwap(t *testing.T) {
+	svc := createFakeLBService()
+	for _, app := range []string{"test", "other"} {
+		err := createAppWebService(svc.Client, svc.Namespace, app)
+		require.NoError(t, err)
+		err = svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{Service: app + "-web", Namespace: svc.Namespace},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	err := svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.NoError(t, err)
+
+	assertSelector := func(app, selectedApp, swappedWith string) {
+		service, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, app+"-router-lb", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, selectedApp, service.Spec.Selector[appLabel])
+		assert.Equal(t, selectedApp+"-web", service.Labels[appBaseServiceNameLabel])
+		assert.Equal(t, swappedWith, service.Labels[swapLabel])
+	}
+	assertSelector("test", "other", "other")
+	assertSelector("other", "test", "test")
+
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+	assertSelector("test", "other", "other")
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.NoError(t, err)
+	assertSelector("test", "test", "")
+	assertSelector("other", "other", "")
+}
+
+func TestLBEnsureSwappedUpdatesPartner(t *testing.T) {
+	svc := createFakeLBService()
+	for _, app := range []string{"test", "other"} {
+		err := createAppWebService(svc.Client, svc.Namespace, app)
+		require.NoError(t, err)
+		err = svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{Service: app + "-web", Namespace: svc.Namespace},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	err := svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.NoError(t, err)
+
+	err = createAppProcessService(svc.Client, svc.Namespace, "test", "v2")
+	require.NoError(t, err)
+	err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "test-v2", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	service, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "other", service.Spec.Selector[appLabel])
+	assert.Equal(t, "other-web", service.Labels[appBaseServiceNameLabel])
+	assert.Equal(t, "other", service.Labels[swapLabel])
+	service, err = svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "other-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{appLabel: "test", processLabel: "v2"}, service.Spec.Selector)
+	assert.Equal(t, "test-v2", service.Labels[appBaseServiceNameLabel])
+
+	err = svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{CNameOnly: true})
+	assert.Equal(t, router.ErrSwapCNameOnlyUnsupported, err)
+}
+
+func TestLBSwapRollback(t *testing.T) {
+	svc := createFakeLBService()
+	for _, app := range []string{"test", "other"} {
+		err := createAppWebService(svc.Client, svc.Namespace, app)
+		require.NoError(t, err)
+		err = svc.Ensure(ctx, idForApp(app), router.EnsureBackendOpts{
+			Prefixes: []router.BackendPrefix{
+				{
+					Target: router.BackendTarget{Service: app + "-web", Namespace: svc.Namespace},
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	svc.Client.(*fake.Clientset).PrependReactor("update", "services", func(action ktesting.Action) (bool, runtime.Object, error) {
+		service := action.(ktesting.UpdateAction).GetObject().(*v1.Service)
+		if service.Name == "other-router-lb" {
+			return true, nil, errors.New("update failed")
+		}
+		return false, nil, nil
+	})
+
+	err := svc.Swap(ctx, idForApp("test"), idForApp("other"), router.SwapOpts{})
+	require.Error(t, err)
+
+	service, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "test", service.Spec.Selector[appLabel])
+	assert.Equal(t, "", service.Labels[swapLabel])
+}
+
+func TestLBEnsureWithPortsOpt(t *testing.T) {
+	svc := createFakeLBService()
+	err := createAppWebService(svc.Client, svc.Namespace, "test")
+	require.NoError(t, err)
+	opts := router.EnsureBackendOpts{
+		Opts: router.Opts{AdditionalOpts: map[string]string{"ports": "80:8888/TCP, 53:5353/udp,53:5353"}},
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{
+					Service:   "test-web",
+					Namespace: svc.Namespace,
+				},
+			},
+		},
+	}
+	err = svc.Ensure(ctx, idForApp("test"), opts)
+	require.NoError(t, err)
+	foundService, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1.ServicePort{
+		{Name: "port-80-tcp", Protocol: v1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(8888)},
+		{Name: "port-53-udp", Protocol: v1.ProtocolUDP, Port: 53, TargetPort: intstr.FromInt(5353)},
+		{Name: "port-53-tcp", Protocol: v1.ProtocolTCP, Port: 53, TargetPort: intstr.FromInt(5353)},
+	}, foundService.Spec.Ports)
+	assert.NotContains(t, foundService.Annotations, "ports")
+
+	foundService.Spec.Ports[0].NodePort = 31000
+	foundService.Spec.Ports[1].NodePort = 31001
+	foundService.Spec.Ports[2].NodePort = 31002
+	foundService.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "66.66.66.66"}}
+	_, err = svc.Client.CoreV1().Services(svc.Namespace).Update(ctx, foundService, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	opts.Opts.AdditionalOpts["ports"] = "53:5353/UDP,8080:8888"
+	err = svc.Ensure(ctx, idForApp("test"), opts)
+	require.NoError(t, err)
+	foundService, err = svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1.ServicePort{
+		{Name: "port-53-udp", Protocol: v1.ProtocolUDP, Port: 53, TargetPort: intstr.FromInt(5353), NodePort: 31001},
+		{Name: "port-8080-tcp", Protocol: v1.ProtocolTCP, Port: 8080, TargetPort: intstr.FromInt(8888)},
+	}, foundService.Spec.Ports)
+
+	addresses, err := svc.GetAddresses(ctx, idForApp("test"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"66.66.66.66:53/UDP", "66.66.66.66:8080/TCP"}, addresses)
+}
+
+func TestLBEnsureWithInvalidPortsOpt(t *testing.T) {
+	tests := []struct {
+		opts        map[string]string
+		expectedErr string
+	}{
+		{
+			opts:        map[string]string{"ports": "80"},
+			expectedErr: `invalid ports option entry "80", expected <port>:<target port>[/<protocol>]`,
+		},
+		{
+			opts:        map[string]string{"ports": "80:8888/HTTP"},
+			expectedErr: `invalid protocol "HTTP" in ports option entry "80:8888/HTTP"`,
+		},
+		{
+			opts:        map[string]string{"ports": "70000:8888"},
+			expectedErr: `invalid port "70000" in ports option entry "70000:8888"`,
+		},
+		{
+			opts:        map[string]string{"ports": "80:0/UDP"},
+			expectedErr: `invalid target port "0" in ports option entry "80:0/UDP"`,
+		},
+		{
+			opts:        map[string]string{"ports": "80:8888,80:8080/TCP"},
+			expectedErr: "duplicated port 80/TCP in ports option",
+		},
+		{
+			opts:        map[string]string{"ports": ","},
+			expectedErr: "ports option must have at least one entry",
+		},
+		{
+			opts:        map[string]string{"ports": "80:8888", "expose-all-ports": "true"},
+			expectedErr: "ports and expose-all-ports options cannot be used together",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.opts["ports"], func(t *testing.T) {
+			svc := createFakeLBService()
+			err := createAppWebService(svc.Client, svc.Namespace, "test")
+			require.NoError(t, err)
+			err = svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+				Opts: router.Opts{AdditionalOpts: tt.opts},
+				Prefixes: []router.BackendPrefix{
+					{
+						Target: router.BackendTarget{
+							Service:   "test-web",
+							Namespace: svc.Namespace,
+						},
+					},
+				},
+			})
+			assert.EqualError(t, err, tt.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,588 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/kubernetes-router/observability"
+	"github.com/tsuru/kubernetes-router/router"
+	"k8s.io/api/extensions/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	reconcileResultRepaired  = "repaired"
+	reconcileResultUnchanged = "unchanged"
+	reconcileResultFrozen    = "frozen"
+	reconcileResultSkipped   = "skipped"
+	reconcileResultFailed    = "failed"
+
+	defaultReconcileWorkers     = 2
+	defaultReconcileLockTimeout = 30 * time.Second
+	defaultCacheSyncTimeout     = 5 * time.Minute
+)
+
+var (
+	servicesResource = schema.GroupVersionResource{Version: "v1", Resource: "services"}
+
+	reconcileTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubernetes_router_reconcile_total",
+		Help: "The number of reconciliations of router managed resources by resource and result.",
+	}, []string{"resource", "result"})
+
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "kubernetes_router_reconcile_duration_seconds",
+		Help: "The duration of reconciliations of router managed resources.",
+	}, []string{"resource"})
+
+	managedResourcesDesc = prometheus.NewDesc(
+		"kubernetes_router_managed_resources",
+		"The number of resources managed by the routers in the informer caches by resource.",
+		[]string{"resource"}, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reconcileTotal, reconcileDuration)
+}
+
+// Locker serializes the changes on the same app, it is satisfied by the
+// lockers of the API
+type Locker interface {
+	Lock(ctx context.Context, key string, lost func()) (func(), error)
+}
+
+// Reconciler watches the resources managed by the routers and replays the
+// Ensure stored on them in the router.OptsAnnotation, repairing resources
+// edited or deleted outside of the router. CNAME and canary ingresses are
+// repaired by the Ensure stored on their main ingress. Frozen resources are
+// left alone.
+type Reconciler struct {
+	*BaseService
+
+	// Routers are the routers whose resources are reconciled, keyed by mode
+	Routers map[string]router.Router
+
+	// ResyncPeriod is the interval in which every resource is reconciled
+	// even without changes, zero disables it
+	ResyncPeriod time.Duration
+
+	// Workers is the number of resources reconciled concurrently
+	Workers int
+
+	// Locker, when set, is locked on the key of the app, as done by the
+	// API, before replaying an Ensure. LockTimeout bounds the wait, 30s
+	// by default, the resource is reconciled again later when it expires.
+	Locker      Locker
+	LockTimeout time.Duration
+
+	// CacheSyncTimeout bounds the wait for the first listing of the
+	// resources, 5m by default
+	CacheSyncTimeout time.Duration
+
+	queue     workqueue.RateLimitingInterface
+	informers map[schema.GroupVersionResource]informers.GenericInformer
+
+	// deleted holds the last state of deleted resources until they are
+	// reconciled
+	deletedMu sync.Mutex
+	deleted   map[reconcileKey]*unstructured.Unstructured
+}
+
+type reconcileKey struct {
+	resource  schema.GroupVersionResource
+	namespace string
+	name      string
+}
+
+// Run starts watching the resources and reconciling them until ctx is done
+func (r *Reconciler) Run(ctx context.Context) error {
+	client, err := r.getDynamicClient()
+	if err != nil {
+		return err
+	}
+	resources, err := r.watchedResources(ctx)
+	if err != nil {
+		return err
+	}
+	r.queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "kubernetes-router")
+	defer r.queue.ShutDown()
+	// the informers are stopped along with Run
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.deleted = map[reconcileKey]*unstructured.Unstructured{}
+	r.informers = map[schema.GroupVersionResource]informers.GenericInformer{}
+	for resource, selector := range resources {
+		selector := selector
+		informer := dynamicinformer.NewFilteredDynamicInformer(client, resource, metav1.NamespaceAll, r.ResyncPeriod, cache.Indexers{}, func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector
+		})
+		informer.Informer().AddEventHandler(r.eventHandler(resource))
+		r.informers[resource] = informer
+		go informer.Informer().Run(ctx.Done())
+	}
+	syncTimeout := r.CacheSyncTimeout
+	if syncTimeout <= 0 {
+		syncTimeout = defaultCacheSyncTimeout
+	}
+	syncCtx, syncCancel := context.WithTimeout(ctx, syncTimeout)
+	defer syncCancel()
+	for resource, informer := range r.informers {
+		if !cache.WaitForCacheSync(syncCtx.Done(), informer.Informer().HasSynced) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Errorf("timed out after %v waiting for the cache of %s to sync", syncTimeout, resource.Resource)
+		}
+		slog.InfoContext(ctx, "Reconciling resources managed by the router", "resource", resource.Resource)
+	}
+	err = prometheus.Register(r)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to register the metrics of the managed resources", "error", err)
+	} else {
+		defer prometheus.Unregister(r)
+	}
+	workers := r.Workers
+	if workers <= 0 {
+		workers = defaultReconcileWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() {
+			for r.processNextItem(ctx) {
+			}
+		}, time.Second, ctx.Done())
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// Describe implements prometheus.Collector
+func (r *Reconciler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- managedResourcesDesc
+}
+
+// Collect implements prometheus.Collector, counting the managed resources
+// in the informer caches
+func (r *Reconciler) Collect(ch chan<- prometheus.Metric) {
+	for resource, informer := range r.informers {
+		count := len(informer.Informer().GetStore().ListKeys())
+		ch <- prometheus.MustNewConstMetric(managedResourcesDesc, prometheus.GaugeValue, float64(count), resource.Resource)
+	}
+}
+
+// watchedResources returns the label selector of the resources managed by
+// each configured router, resources not served by the cluster are left out
+func (r *Reconciler) watchedResources(ctx context.Context) (map[schema.GroupVersionResource]string, error) {
+	resources := map[schema.GroupVersionResource]string{}
+	for mode, rt := range r.Routers {
+		var resource schema.GroupVersionResource
+		var selector string
+		switch rt.(type) {
+		case *LBService:
+			resource = servicesResource
+			selector = labels.SelectorFromSet(labels.Set{managedServiceLabel: "true"}).String()
+		case *IngressService:
+			var err error
+			resource, err = r.ingressesResource()
+			if err != nil {
+				return nil, err
+			}
+			selector = ingressSelector()
+		case *IstioGateway:
+			resource = virtualServicesResource
+			selector = labels.NewSelector().Add(mustRequirement(appLabel, selection.Exists)).String()
+		default:
+			continue
+		}
+		served, err := r.ServesResource(resource.GroupVersion(), resource.Resource)
+		if err != nil {
+			return nil, err
+		}
+		if !served {
+			slog.WarnContext(ctx, "Resources of mode not served by the cluster, not reconciling them", "mode", mode, "resource", resource.String())
+			continue
+		}
+		resources[resource] = selector
+	}
+	return resources, nil
+}
+
+func (r *Reconciler) ingressesResource() (schema.GroupVersionResource, error) {
+	servesV1, err := r.ServesResource(networkingv1.SchemeGroupVersion, "ingresses")
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	if servesV1 {
+		return networkingv1.SchemeGroupVersion.WithResource("ingresses"), nil
+	}
+	return v1beta1.SchemeGroupVersion.WithResource("ingresses"), nil
+}
+
+// ingressSelector selects every ingress of the apps, including CNAME and
+// canary ingresses
+func ingressSelector() string {
+	return labels.NewSelector().Add(mustRequirement(appLabel, selection.Exists)).String()
+}
+
+func isSecondaryIngress(obj *unstructured.Unstructured) bool {
+	return obj.GetLabels()[labelCNameIngress] == "true" || obj.GetLabels()[labelCanaryIngress] == "true"
+}
+
+func mustRequirement(key string, op selection.Operator) labels.Requirement {
+	req, err := labels.NewRequirement(key, op, nil)
+	if err != nil {
+		panic(err)
+	}
+	return *req
+}
+
+func (r *Reconciler) eventHandler(resource schema.GroupVersionResource) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			r.enqueue(resource, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			r.enqueue(resource, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			key := reconcileKey{resource: resource, namespace: u.GetNamespace(), name: u.GetName()}
+			r.deletedMu.Lock()
+			r.deleted[key] = u
+			r.deletedMu.Unlock()
+			r.queue.Add(key)
+		},
+	}
+}
+
+func (r *Reconciler) enqueue(resource schema.GroupVersionResource, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	r.queue.Add(reconcileKey{resource: resource, namespace: u.GetNamespace(), name: u.GetName()})
+}
+
+func (r *Reconciler) processNextItem(ctx context.Context) bool {
+	item, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(item)
+	key := item.(reconcileKey)
+	ctx = observability.WithLogAttrs(ctx,
+		slog.String("resource", key.resource.Resource),
+		slog.String("namespace", key.namespace),
+		slog.String("name", key.name),
+	)
+	err := r.reconcile(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to reconcile", "error", err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(key)
+	return true
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, key reconcileKey) error {
+	obj, deleted, err := r.currentObject(key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		return nil
+	}
+	start := time.Now()
+	result, err := r.repair(ctx, key.resource, obj, deleted)
+	reconcileDuration.WithLabelValues(key.resource.Resource).Observe(time.Since(start).Seconds())
+	if err != nil {
+		result = reconcileResultFailed
+	}
+	reconcileTotal.WithLabelValues(key.resource.Resource, result).Inc()
+	if result == reconcileResultRepaired {
+		slog.InfoContext(ctx, "Repaired resource drifted from the router")
+	}
+	if err == nil && deleted {
+		r.deletedMu.Lock()
+		delete(r.deleted, key)
+		r.deletedMu.Unlock()
+	}
+	return err
+}
+
+// currentObject returns the resource from the informer cache or, when it
+// was deleted, its last known state
+func (r *Reconciler) currentObject(key reconcileKey) (*unstructured.Unstructured, bool, error) {
+	informer, ok := r.informers[key.resource]
+	if !ok {
+		return nil, false, nil
+	}
+	obj, exists, err := informer.Informer().GetIndexer().GetByKey(key.namespace + "/" + key.name)
+	if err != nil {
+		return nil, false, err
+	}
+	if exists {
+		r.deletedMu.Lock()
+		delete(r.deleted, key)
+		r.deletedMu.Unlock()
+		u, _ := obj.(*unstructured.Unstructured)
+		return u, false, nil
+	}
+	r.deletedMu.Lock()
+	defer r.deletedMu.Unlock()
+	return r.deleted[key], true, nil
+}
+
+// repair replays the Ensure stored on the resource, reporting whether the
+// resource had drifted from it
+func (r *Reconciler) repair(ctx context.Context, resource schema.GroupVersionResource, obj *unstructured.Unstructured, deleted bool) (string, error) {
+	if isFrozen(metav1.ObjectMeta{Labels: obj.GetLabels()}) {
+		return reconcileResultFrozen, nil
+	}
+	rt := r.routerFor(resource, obj)
+	if rt == nil {
+		return reconcileResultSkipped, nil
+	}
+	owner := obj
+	if resource.Resource == "ingresses" && isSecondaryIngress(obj) {
+		var err error
+		owner, err = r.mainIngress(ctx, resource, rt, obj)
+		if err != nil {
+			return "", err
+		}
+		if owner == nil {
+			return reconcileResultSkipped, nil
+		}
+	}
+	meta := metav1.ObjectMeta{
+		Labels:      owner.GetLabels(),
+		Annotations: owner.GetAnnotations(),
+	}
+	if isFrozen(meta) {
+		return reconcileResultFrozen, nil
+	}
+	id, opts, ok, err := router.EnsureBackendOptsFromAnnotations(&meta)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return reconcileResultSkipped, nil
+	}
+	resourceVersion := obj.GetResourceVersion()
+	if r.Locker != nil {
+		var unlock func()
+		ctx, unlock, err = r.lock(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+		// the operation holding the lock may have changed the resource,
+		// the Ensure replayed is the one stored when it finished
+		if !deleted || owner != obj {
+			current, err := r.currentState(ctx, resource, owner)
+			if err != nil {
+				return "", err
+			}
+			if current == nil {
+				return reconcileResultSkipped, nil
+			}
+			if owner == obj {
+				resourceVersion = current.GetResourceVersion()
+			}
+			meta = metav1.ObjectMeta{
+				Labels:      current.GetLabels(),
+				Annotations: current.GetAnnotations(),
+			}
+			if isFrozen(meta) {
+				return reconcileResultFrozen, nil
+			}
+			id, opts, ok, err = router.EnsureBackendOptsFromAnnotations(&meta)
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				return reconcileResultSkipped, nil
+			}
+		}
+	}
+	ctx = observability.WithLogAttrs(ctx,
+		slog.String(observability.LogKeyApp, id.AppName),
+		slog.String(observability.LogKeyInstance, id.InstanceName),
+	)
+	err = rt.Ensure(ctx, id, opts)
+	if err != nil && err != router.ErrIngressAlreadyExists {
+		if _, noService := errors.Cause(err).(ErrNoService); noService {
+			// the app is gone, the resource is removed along with it
+			return reconcileResultSkipped, nil
+		}
+		return "", err
+	}
+	if deleted {
+		return reconcileResultRepaired, nil
+	}
+	client, err := r.getDynamicClient()
+	if err != nil {
+		return "", err
+	}
+	current, err := client.Resource(resource).Namespace(obj.GetNamespace()).Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if current.GetResourceVersion() != resourceVersion {
+		return reconcileResultRepaired, nil
+	}
+	return reconcileResultUnchanged, nil
+}
+
+// lock waits for the lock of the app of id, for up to LockTimeout. The
+// context returned is canceled if the lock is lost.
+func (r *Reconciler) lock(ctx context.Context, id router.InstanceID) (context.Context, func(), error) {
+	timeout := r.LockTimeout
+	if timeout <= 0 {
+		timeout = defaultReconcileLockTimeout
+	}
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	opCtx, cancelOp := context.WithCancel(ctx)
+	unlock, err := r.Locker.Lock(lockCtx, router.LockKey(id), cancelOp)
+	if err != nil {
+		cancelOp()
+		return nil, nil, errors.Wrapf(err, "could not lock %s", router.LockKey(id))
+	}
+	return opCtx, func() {
+		unlock()
+		cancelOp()
+	}, nil
+}
+
+// currentState returns obj as stored by the API server, nil when it no
+// longer exists
+func (r *Reconciler) currentState(ctx context.Context, resource schema.GroupVersionResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	client, err := r.getDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+	current, err := client.Resource(resource).Namespace(obj.GetNamespace()).Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return current, err
+}
+
+// mainIngress returns the current state of the main ingress whose Ensure
+// manages the CNAME or canary ingress obj, nil when there is none
+func (r *Reconciler) mainIngress(ctx context.Context, resource schema.GroupVersionResource, rt router.Router, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	svc, ok := rt.(*IngressService)
+	if !ok {
+		return nil, nil
+	}
+	informer, ok := r.informers[resource]
+	if !ok {
+		return nil, nil
+	}
+	items, err := informer.Lister().ByNamespace(obj.GetNamespace()).List(labels.SelectorFromSet(labels.Set{
+		appLabel: obj.GetLabels()[appLabel],
+	}))
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		candidate, ok := item.(*unstructured.Unstructured)
+		if !ok || isSecondaryIngress(candidate) {
+			continue
+		}
+		id, _, ok, err := router.EnsureBackendOptsFromAnnotations(&metav1.ObjectMeta{Annotations: candidate.GetAnnotations()})
+		if err != nil || !ok || !svc.managesIngress(id, obj) {
+			continue
+		}
+		// the cache may be stale, the main ingress could be being removed
+		client, err := r.getDynamicClient()
+		if err != nil {
+			return nil, err
+		}
+		current, err := client.Resource(resource).Namespace(candidate.GetNamespace()).Get(ctx, candidate.GetName(), metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return current, err
+	}
+	return nil, nil
+}
+
+// managesIngress returns whether the CNAME or canary ingress obj belongs to
+// the instance
+func (k *IngressService) managesIngress(id router.InstanceID, obj *unstructured.Unstructured) bool {
+	if obj.GetLabels()[labelCanaryIngress] == "true" {
+		return obj.GetName() == k.ingressCanary(id, obj.GetAnnotations()[annotationCanaryPrefix])
+	}
+	rules, _, _ := unstructured.NestedSlice(obj.Object, "spec", "rules")
+	if len(rules) == 0 {
+		return false
+	}
+	rule, _ := rules[0].(map[string]interface{})
+	host, _, _ := unstructured.NestedString(rule, "host")
+	return host != "" && obj.GetName() == k.ingressCName(id, host)
+}
+
+// routerFor returns the router managing the resource, ingresses are managed
+// by the router using the same ingress class
+func (r *Reconciler) routerFor(resource schema.GroupVersionResource, obj *unstructured.Unstructured) router.Router {
+	var ingressFallback router.Router
+	for _, rt := range r.Routers {
+		switch svc := rt.(type) {
+		case *LBService:
+			if resource == servicesResource {
+				return svc
+			}
+		case *IstioGateway:
+			if resource == virtualServicesResource {
+				return svc
+			}
+		case *IngressService:
+			if resource.Resource != "ingresses" {
+				continue
+			}
+			if svc.IngressClass == ingressClass(obj) {
+				return svc
+			}
+			if svc.IngressClass == "" {
+				ingressFallback = svc
+			}
+		}
+	}
+	return ingressFallback
+}
+
+func ingressClass(obj *unstructured.Unstructured) string {
+	class, _, _ := unstructured.NestedString(obj.Object, "spec", "ingressClassName")
+	if class != "" {
+		return class
+	}
+	return obj.GetAnnotations()[defaultOptsAsAnnotations[defaultClassOpt]]
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/router"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReconcilerRepairDeletedLBService(t *testing.T) {
+	svc := createFakeLBService()
+	err := createAppWebService(svc.Client, svc.Namespace, "test")
+	require.NoError(t, err)
+	opts := router.EnsureBackendOpts{
+		Opts:     router.Opts{Pool: "mypool"},
+		Prefixes: []router.BackendPrefix{{Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}}},
+	}
+	err = svc.Ensure(ctx, idForApp("test"), opts)
+	require.NoError(t, err)
+	lbService, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(lbService)
+	require.NoError(t, err)
+	err = svc.Client.CoreV1().Services(svc.Namespace).Delete(ctx, "test-router-lb", metav1.DeleteOptions{})
+	require.NoError(t, err)
+
+	reconciler := &Reconciler{BaseService: svc.BaseService, Routers: map[string]router.Router{"service": &svc}}
+	result, err := reconciler.repair(ctx, servicesResource, &unstructured.Unstructured{Object: obj}, true)
+	require.NoError(t, err)
+	assert.Equal(t, reconcileResultRepaired, result)
+	repaired, err := svc.Client.CoreV1().Services(svc.Namespace).Get(ctx, "test-router-lb", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, lbService.Annotations, repaired.Annotations)
+	assert.Equal(t, lbService.Spec.Ports, repaired.Spec.Ports)
+}
+
+type fakeLocker struct {
+	keys []string
+	err  error
+}
+
+func (l *fakeLocker) Lock(ctx context.Context, key string, lost func()) (func(), error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	l.keys = append(l.keys, key)
+	return func() {}, nil
+}
+
+func TestReconcilerRepairLocksApp(t *testing.T) {
+	svc := createFakeLBService()
+	err := createAppWebService(svc.Client, svc.Namespace, "test")
+	require.NoError(t, err)
+	annotations, err := (&router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{{Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace}}},
+	}).ToAnnotations(router.InstanceID{AppName: "test", InstanceName: "blue"})
+	require.NoError(t, err)
+	deleted := &unstructured.Unstructured{}
+	deleted.SetName("test-router-lb")
+	deleted.SetNamespace(svc.Namespace)
+	deleted.SetAnnotations(annotations)
+
+	locker := &fakeLocker{err: context.DeadlineExceeded}
+	reconciler := &Reconciler{BaseService: svc.BaseService, Routers: map[string]router.Router{"service": &svc}, Locker: locker}
+	_, err = reconciler.repair(ctx, servicesResource, deleted, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "could not lock test/blue")
+
+	locker.err = nil
+	result, err := reconciler.repair(ctx, servicesResource, deleted, true)
+	require.NoError(t, err)
+	assert.Equal(t, reconcileResultRepaired, result)
+	assert.Equal(t, []string{"test/blue"}, locker.keys)
+}
+
+func TestReconcilerWatchedResourcesServed(t *testing.T) {
+	svc := createFakeLBService()
+	svc.Client.(*fake.Clientset).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{{Name: "services", Namespaced: true, Kind: "Service"}},
+		},
+	}
+	reconciler := &Reconciler{BaseService: svc.BaseService, Routers: map[string]router.Router{
+		"service":       &svc,
+		"istio-gateway": &IstioGateway{BaseService: svc.BaseService},
+	}}
+	resources, err := reconciler.watchedResources(ctx)
+	require.NoError(t, err)
+	// istio is not installed, its virtualservices are not watched
+	assert.Equal(t, map[schema.GroupVersionResource]string{
+		servicesResource: managedServiceLabel + "=true",
+	}, resources)
+}
+
+func TestReconcilerRepairSkipsFrozenAndUnmanaged(t *testing.T) {
+	svc := createFakeLBService()
+	reconciler := &Reconciler{BaseService: svc.BaseService, Routers: map[string]router.Router{"service": &svc}}
+	annotations, err := (&router.EnsureBackendOpts{}).ToAnnotations(idForApp("test"))
+	require.NoError(t, err)
+
+	frozen := &unstructured.Unstructured{}
+	frozen.SetLabels(map[string]string{routerFreezeLabel: "true"})
+	frozen.SetAnnotations(annotations)
+	result, err := reconciler.repair(ctx, servicesResource, frozen, true)
+	require.NoError(t, err)
+	assert.Equal(t, reconcileResultFrozen, result)
+
+	unmanaged := &unstructured.Unstructured{}
+	result, err = reconciler.repair(ctx, servicesResource, unmanaged, true)
+	require.NoError(t, err)
+	assert.Equal(t, reconcileResultSkipped, result)
+}
+
+func TestReconcilerRouterForIngressClass(t *testing.T) {
+	ingress := &IngressService{BaseService: &BaseService{}}
+	nginx := &IngressService{BaseService: &BaseService{}, IngressClass: "nginx"}
+	reconciler := &Reconciler{Routers: map[string]router.Router{"ingress": ingress, "ingress-nginx": nginx}}
+	resource := networkingv1.SchemeGroupVersion.WithResource("ingresses")
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	assert.Equal(t, ingress, reconciler.routerFor(resource, obj))
+
+	err := unstructured.SetNestedField(obj.Object, "nginx", "spec", "ingressClassName")
+	require.NoError(t, err)
+	assert.Equal(t, nginx, reconciler.routerFor(resource, obj))
+
+	assert.Nil(t, reconciler.routerFor(servicesResource, obj))
+}
+
+func TestIngressManagesIngress(t *testing.T) {
+	svc := createFakeService()
+	cname := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"rules": []interface{}{map[string]interface{}{"host": "test.io"}},
+		},
+	}}
+	cname.SetName(svc.ingressCName(idForApp("test"), "test.io"))
+	cname.SetLabels(map[string]string{labelCNameIngress: "true"})
+	assert.True(t, svc.managesIngress(idForApp("test"), cname))
+	assert.False(t, svc.managesIngress(idForApp("other"), cname))
+
+	canary := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	canary.SetName(svc.ingressCanary(idForApp("test"), "api"))
+	canary.SetLabels(map[string]string{labelCanaryIngress: "true"})
+	canary.SetAnnotations(map[string]string{annotationCanaryPrefix: "api"})
+	assert.True(t, svc.managesIngress(idForApp("test"), canary))
+	assert.False(t, svc.managesIngress(idForApp("other"), canary))
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/util/retry"
+)
+
+var conflictRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kubernetes_router_conflict_retries_total",
+	Help: "The number of retries of router operations whose writes conflicted with concurrent changes by operation.",
+}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(conflictRetries)
+}
+
+// retryOnConflict runs fn, which must read, merge and write the resources
+// it changes, again with backoff while its writes conflict with concurrent
+// changes of the same resources. The retries are tagged in the span of ctx
+// and counted by operation, the changes planned by failed attempts are
+// discarded.
+func retryOnConflict(ctx context.Context, operation string, fn func() error) error {
+	plan := planFromContext(ctx)
+	var planned int
+	if plan != nil {
+		planned = len(plan.Changes)
+	}
+	retries := -1
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		retries++
+		if retries > 0 {
+			conflictRetries.WithLabelValues(operation).Inc()
+			if plan != nil {
+				plan.Changes = plan.Changes[:planned]
+			}
+		}
+		return fn()
+	})
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("conflictRetries", retries))
+	return err
+}
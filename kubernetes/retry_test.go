@@ -0,0 +1,136 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/kubernetes-router/router"
+	v1beta1 "k8s.io/api/extensions/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func conflictError(name string) error {
+	return k8sErrors.NewConflict(schema.GroupResource{Group: "extensions", Resource: "ingresses"}, name, errors.New("the object has been modified"))
+}
+
+func TestRetryOnConflict(t *testing.T) {
+	retries := testutil.ToFloat64(conflictRetries.WithLabelValues("test"))
+	calls := 0
+	err := retryOnConflict(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return conflictError("test")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, retries+2, testutil.ToFloat64(conflictRetries.WithLabelValues("test")))
+
+	calls = 0
+	err = retryOnConflict(context.Background(), "test", func() error {
+		calls++
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryOnConflictDiscardsPlannedChanges(t *testing.T) {
+	plan, err := planned(context.Background(), func(ctx context.Context) error {
+		planChange(ctx, router.ChangeDelete, "Ingress", &v1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "before"}}, nil, nil)
+		calls := 0
+		return retryOnConflict(ctx, "test", func() error {
+			calls++
+			planChange(ctx, router.ChangeCreate, "Ingress", nil, &v1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "test"}}, nil)
+			if calls == 1 {
+				return conflictError("test")
+			}
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	require.Len(t, plan.Changes, 2)
+	assert.Equal(t, "before", plan.Changes[0].Name)
+	assert.Equal(t, "test", plan.Changes[1].Name)
+}
+
+func TestIngressEnsureRetriesConflicts(t *testing.T) {
+	svc := createFakeService()
+	opts := router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace},
+			},
+		},
+	}
+	err := svc.Ensure(ctx, idForApp("test"), opts)
+	require.NoError(t, err)
+
+	conflicts := 1
+	svc.Client.(*fake.Clientset).PrependReactor("patch", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(ktesting.PatchAction)
+		if patchAction.GetPatchType() == types.ApplyPatchType && patchAction.GetName() == "kubernetes-router-test-ingress" && conflicts > 0 {
+			conflicts--
+			return true, nil, conflictError(patchAction.GetName())
+		}
+		return false, nil, nil
+	})
+	retries := testutil.ToFloat64(conflictRetries.WithLabelValues("ensureIngress"))
+
+	opts.CNames = []string{"test.io"}
+	err = svc.Ensure(ctx, idForApp("test"), opts)
+	require.NoError(t, err)
+	assert.Equal(t, retries+1, testutil.ToFloat64(conflictRetries.WithLabelValues("ensureIngress")))
+
+	ingress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "test.io", ingress.Annotations[AnnotationsCNames])
+}
+
+func TestIngressAddCertificateRetriesConflicts(t *testing.T) {
+	svc := createFakeService()
+	err := svc.Ensure(ctx, idForApp("test"), router.EnsureBackendOpts{
+		Prefixes: []router.BackendPrefix{
+			{
+				Target: router.BackendTarget{Service: "test-web", Namespace: svc.Namespace},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	conflicts := 1
+	svc.Client.(*fake.Clientset).PrependReactor("update", "ingresses", func(action ktesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			conflicts--
+			ingress := action.(ktesting.UpdateAction).GetObject().(*v1beta1.Ingress)
+			return true, nil, conflictError(ingress.Name)
+		}
+		return false, nil, nil
+	})
+	retries := testutil.ToFloat64(conflictRetries.WithLabelValues("addIngressCertificate"))
+
+	err = svc.AddCertificate(ctx, idForApp("test"), "mycert", router.CertData{Certificate: "cert", Key: "key"})
+	require.NoError(t, err)
+	assert.Equal(t, retries+1, testutil.ToFloat64(conflictRetries.WithLabelValues("addIngressCertificate")))
+
+	ingress, err := svc.Client.ExtensionsV1beta1().Ingresses(svc.Namespace).Get(ctx, "kubernetes-router-test-ingress", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1beta1.IngressTLS{
+		{Hosts: []string{"mycert"}, SecretName: svc.secretName(idForApp("test"), "mycert")},
+	}, ingress.Spec.TLS)
+}
@@ -8,13 +8,15 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"errors"
 	"fmt"
 	"net/http"
+	"path"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/tsuru/kubernetes-router/observability"
 	"github.com/tsuru/kubernetes-router/router"
 	tsuruv1 "github.com/tsuru/tsuru/provision/kubernetes/pkg/apis/tsuru/v1"
@@ -25,9 +27,12 @@ import (
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/transport"
 )
 
@@ -41,6 +46,14 @@ const (
 	appBaseServiceNamespaceLabel = "router.tsuru.io/base-service-namespace"
 	appBaseServiceNameLabel      = "router.tsuru.io/base-service-name"
 	routerFreezeLabel            = "router.tsuru.io/freeze"
+	// swapLabel holds the name of the app whose backends were swapped with
+	// the ones of the app owning the resource
+	swapLabel = "router.tsuru.io/swapped-with"
+	// swapInstanceAnnotation holds the instance of the app whose backends
+	// were swapped, when it is not the default one
+	swapInstanceAnnotation = "router.tsuru.io/swapped-with-instance"
+	// swapCNameOnlyAnnotation is set when only the cnames were swapped
+	swapCNameOnlyAnnotation = "router.tsuru.io/swap-cname-only"
 
 	externalDNSHostnameLabel = "external-dns.alpha.kubernetes.io/hostname"
 
@@ -54,7 +67,7 @@ const (
 )
 
 var (
-	ErrNoBackendTarget = errors.New("No default backend target found")
+	ErrNoBackendTarget error = router.NewError(router.ErrorCodeNoBackendTarget, errors.New("No default backend target found"))
 )
 
 // ErrNoService indicates that the app has no service running
@@ -64,6 +77,10 @@ func (e ErrNoService) Error() string {
 	return fmt.Sprintf("no service found for app %q", e.App)
 }
 
+func (e ErrNoService) ErrorCode() router.ErrorCode {
+	return router.ErrorCodeServiceNotFound
+}
+
 // BaseService has the base functionality needed by router.Service implementations
 // targeting kubernetes
 type BaseService struct {
@@ -73,8 +90,26 @@ type BaseService struct {
 	Client           kubernetes.Interface
 	TsuruClient      tsuruv1clientset.Interface
 	ExtensionsClient apiextensionsclientset.Interface
+	DynamicClient    dynamic.Interface
 	Labels           map[string]string
 	Annotations      map[string]string
+
+	// EventRecorder emits the events of the router on the managed objects,
+	// defaults to a recorder writing them with Client
+	EventRecorder    record.EventRecorder
+	eventRecorderMu  sync.Mutex
+	eventBroadcaster record.EventBroadcaster
+	eventsClosed     bool
+
+	// servedResources caches the discovery of resources served by the
+	// cluster, keyed by group version and resource name
+	servedResourcesMu sync.Mutex
+	servedResources   map[string]bool
+
+	// hasAppCRD caches that the cluster has the tsuru app CRD, which is
+	// not expected to be removed
+	hasAppCRDMu sync.Mutex
+	hasAppCRD   bool
 }
 
 // SupportedOptions returns the options supported by all services
@@ -82,6 +117,11 @@ func (k *BaseService) SupportedOptions(ctx context.Context) map[string]string {
 	return nil
 }
 
+// OptionsSchema returns the schema of the options supported by all services
+func (k *BaseService) OptionsSchema(ctx context.Context) map[string]router.OptionSchema {
+	return nil
+}
+
 // Healthcheck uses the kubernetes client to check the connectivity
 func (k *BaseService) Healthcheck(ctx context.Context) error {
 	client, err := k.getClient()
@@ -104,6 +144,18 @@ func (k *BaseService) getClient() (kubernetes.Interface, error) {
 	return k.Client, err
 }
 
+func (k *BaseService) getDynamicClient() (dynamic.Interface, error) {
+	if k.DynamicClient != nil {
+		return k.DynamicClient, nil
+	}
+	config, err := k.getConfig()
+	if err != nil {
+		return nil, err
+	}
+	k.DynamicClient, err = dynamic.NewForConfig(config)
+	return k.DynamicClient, err
+}
+
 func (k *BaseService) getTsuruClient() (tsuruv1clientset.Interface, error) {
 	if k.TsuruClient != nil {
 		return k.TsuruClient, nil
@@ -187,6 +239,12 @@ func (k *BaseService) getAppNamespace(ctx context.Context, appName string) (stri
 }
 
 func (k *BaseService) hasCRD(ctx context.Context) (bool, error) {
+	k.hasAppCRDMu.Lock()
+	found := k.hasAppCRD
+	k.hasAppCRDMu.Unlock()
+	if found {
+		return true, nil
+	}
 	eclient, err := k.getExtensionsClient()
 	if err != nil {
 		return false, err
@@ -198,17 +256,123 @@ func (k *BaseService) hasCRD(ctx context.Context) (bool, error) {
 		}
 		return false, err
 	}
+	k.hasAppCRDMu.Lock()
+	k.hasAppCRD = true
+	k.hasAppCRDMu.Unlock()
 	return true, nil
 }
 
+// ServesResource checks, using the discovery API, whether the cluster serves
+// the resource in the given group version. Results are cached for the
+// lifetime of the service.
+func (k *BaseService) ServesResource(gv schema.GroupVersion, resource string) (bool, error) {
+	key := gv.String() + "/" + resource
+	k.servedResourcesMu.Lock()
+	defer k.servedResourcesMu.Unlock()
+	if served, ok := k.servedResources[key]; ok {
+		return served, nil
+	}
+	client, err := k.getClient()
+	if err != nil {
+		return false, err
+	}
+	served, err := discoverResource(client, gv, resource)
+	if err != nil {
+		return false, err
+	}
+	if k.servedResources == nil {
+		k.servedResources = map[string]bool{}
+	}
+	k.servedResources[key] = served
+	return served, nil
+}
+
+func discoverResource(client kubernetes.Interface, gv schema.GroupVersion, resource string) (bool, error) {
+	groups, err := client.Discovery().ServerGroups()
+	if err != nil {
+		return false, err
+	}
+	hasVersion := false
+	for _, group := range groups.Groups {
+		if group.Name != gv.Group {
+			continue
+		}
+		for _, version := range group.Versions {
+			if version.Version == gv.Version {
+				hasVersion = true
+			}
+		}
+	}
+	if !hasVersion {
+		return false, nil
+	}
+	resources, err := client.Discovery().ServerResourcesForGroupVersion(gv.String())
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if resources == nil {
+		return false, nil
+	}
+	for _, apiResource := range resources.APIResources {
+		if apiResource.Name == resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (s *BaseService) getDefaultBackendTarget(prefixes []router.BackendPrefix) (*router.BackendTarget, error) {
+	if prefix := defaultBackendPrefix(prefixes); prefix != nil {
+		return &prefix.Target, nil
+	}
+
+	return nil, ErrNoBackendTarget
+}
+
+func defaultBackendPrefix(prefixes []router.BackendPrefix) *router.BackendPrefix {
+	for i := range prefixes {
+		if prefixes[i].Prefix == "" {
+			return &prefixes[i]
+		}
+	}
+	return nil
+}
+
+// prefixBackend is a router.BackendPrefix with its target service already
+// resolved
+type prefixBackend struct {
+	prefix  string
+	service *v1.Service
+}
+
+// prefixBackends resolves the services of every prefix, the default target
+// is always the last one and is represented by the already resolved service
+func (k *BaseService) prefixBackends(ctx context.Context, id router.InstanceID, defaultService *v1.Service, prefixes []router.BackendPrefix) ([]prefixBackend, error) {
+	var backends []prefixBackend
 	for _, prefix := range prefixes {
 		if prefix.Prefix == "" {
-			return &prefix.Target, nil
+			continue
+		}
+		service, err := k.getWebService(ctx, id.AppName, prefix.Target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not find service for prefix %q", prefix.Prefix)
 		}
+		backends = append(backends, prefixBackend{prefix: prefix.Prefix, service: service})
 	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].prefix < backends[j].prefix
+	})
+	return append(backends, prefixBackend{service: defaultService}), nil
+}
 
-	return nil, ErrNoBackendTarget
+func prefixPath(route, prefix string) string {
+	if prefix == "" {
+		return route
+	}
+	return path.Join("/", route, prefix)
 }
 
 func (s *BaseService) hashedResourceName(id router.InstanceID, name string, limit int) string {
@@ -260,10 +424,127 @@ func (s *BaseService) getStatusForRuntimeObject(ctx context.Context, ns string,
 	return buf.String(), nil
 }
 
+// swapState is the swap recorded in the metadata of a resource
+type swapState struct {
+	partner   router.InstanceID
+	cnameOnly bool
+}
+
+// getSwapState returns the swap recorded in meta, nil when the resource is
+// not swapped
+func getSwapState(meta metav1.ObjectMeta) *swapState {
+	if meta.Labels[swapLabel] == "" {
+		return nil
+	}
+	return &swapState{
+		partner: router.InstanceID{
+			AppName:      meta.Labels[swapLabel],
+			InstanceName: meta.Annotations[swapInstanceAnnotation],
+		},
+		cnameOnly: meta.Annotations[swapCNameOnlyAnnotation] == "true",
+	}
+}
+
+// checkSwap reports whether swapping src and dst undoes a previous swap
+// between them and whether only their cnames are swapped, failing when any
+// of them is swapped with a third instance
+func checkSwap(srcMeta, dstMeta metav1.ObjectMeta, src, dst router.InstanceID, opts router.SwapOpts) (unswap, cnameOnly bool, err error) {
+	srcState, dstState := getSwapState(srcMeta), getSwapState(dstMeta)
+	if srcState == nil && dstState == nil {
+		return false, opts.CNameOnly, nil
+	}
+	if srcState != nil && dstState != nil && srcState.partner == dst && dstState.partner == src {
+		return true, srcState.cnameOnly, nil
+	}
+	return false, false, router.ErrSwapAlreadySwapped
+}
+
+// setSwapMeta records state in meta, a nil state removes the swap mark
+func setSwapMeta(meta *metav1.ObjectMeta, state *swapState) {
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	delete(meta.Labels, swapLabel)
+	delete(meta.Annotations, swapInstanceAnnotation)
+	delete(meta.Annotations, swapCNameOnlyAnnotation)
+	if state == nil {
+		return
+	}
+	meta.Labels[swapLabel] = state.partner.AppName
+	if state.partner.InstanceName != "" {
+		meta.Annotations[swapInstanceAnnotation] = state.partner.InstanceName
+	}
+	if state.cnameOnly {
+		meta.Annotations[swapCNameOnlyAnnotation] = "true"
+	}
+}
+
+// swapObjectMeta exchanges the base service labels of two resources, unless
+// only their cnames are swapped, and marks them as swapped with each other,
+// undoing a swap removes the mark
+func swapObjectMeta(srcMeta, dstMeta *metav1.ObjectMeta, src, dst router.InstanceID, unswap, cnameOnly bool) {
+	if srcMeta.Labels == nil {
+		srcMeta.Labels = map[string]string{}
+	}
+	if dstMeta.Labels == nil {
+		dstMeta.Labels = map[string]string{}
+	}
+	if !cnameOnly {
+		for _, label := range []string{appBaseServiceNamespaceLabel, appBaseServiceNameLabel} {
+			srcMeta.Labels[label], dstMeta.Labels[label] = dstMeta.Labels[label], srcMeta.Labels[label]
+		}
+	}
+	if unswap {
+		setSwapMeta(srcMeta, nil)
+		setSwapMeta(dstMeta, nil)
+		return
+	}
+	setSwapMeta(srcMeta, &swapState{partner: dst, cnameOnly: cnameOnly})
+	setSwapMeta(dstMeta, &swapState{partner: src, cnameOnly: cnameOnly})
+}
+
 func isFrozenSvc(svc *v1.Service) bool {
-	if svc == nil || svc.Labels == nil {
+	if svc == nil {
 		return false
 	}
-	frozen, _ := strconv.ParseBool(svc.Labels[routerFreezeLabel])
+	return isFrozen(svc.ObjectMeta)
+}
+
+func isFrozen(meta metav1.ObjectMeta) bool {
+	frozen, _ := strconv.ParseBool(meta.Labels[routerFreezeLabel])
 	return frozen
 }
+
+// storeEnsureOpts annotates the resource with the opts of the Ensure,
+// allowing the Reconciler to repair it
+func (k *BaseService) storeEnsureOpts(meta *metav1.ObjectMeta, id router.InstanceID, o router.EnsureBackendOpts) error {
+	annotations, err := o.ToAnnotations(id)
+	if err != nil {
+		return err
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		meta.Annotations[k] = v
+	}
+	return nil
+}
+
+// forgetEnsureOpts removes the opts stored by storeEnsureOpts from a resource
+// about to be removed, so the Reconciler does not restore it. Plans skip it,
+// nothing is removed by them.
+func (k *BaseService) forgetEnsureOpts(ctx context.Context, patch func(ctx context.Context, data []byte) error) error {
+	if planFromContext(ctx) != nil {
+		return nil
+	}
+	data := fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, router.OptsAnnotation)
+	err := patch(ctx, []byte(data))
+	if k8sErrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
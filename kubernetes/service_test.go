@@ -17,6 +17,7 @@ import (
 	v1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	fakeapiextensions "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
 )
@@ -70,6 +71,43 @@ func TestGetWebService(t *testing.T) {
 	assert.Equal(t, "namespacedApp-web", webService.Name)
 }
 
+func TestServesResource(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "networking.k8s.io/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "networkpolicies", Namespaced: true, Kind: "NetworkPolicy"},
+			},
+		},
+		{
+			GroupVersion: "networking.k8s.io/v1beta1",
+			APIResources: []metav1.APIResource{
+				{Name: "ingresses", Namespaced: true, Kind: "Ingress"},
+			},
+		},
+	}
+	svc := BaseService{
+		Namespace: "default",
+		Client:    client,
+	}
+
+	served, err := svc.ServesResource(schema.GroupVersion{Group: "networking.k8s.io", Version: "v1"}, "ingresses")
+	require.NoError(t, err)
+	assert.False(t, served)
+	served, err = svc.ServesResource(schema.GroupVersion{Group: "networking.k8s.io", Version: "v1beta1"}, "ingresses")
+	require.NoError(t, err)
+	assert.True(t, served)
+	served, err = svc.ServesResource(schema.GroupVersion{Group: "gateway.networking.k8s.io", Version: "v1"}, "httproutes")
+	require.NoError(t, err)
+	assert.False(t, served)
+
+	client.Resources = nil
+	served, err = svc.ServesResource(schema.GroupVersion{Group: "networking.k8s.io", Version: "v1beta1"}, "ingresses")
+	require.NoError(t, err)
+	assert.True(t, served, "discovery results should be cached")
+}
+
 func createCRD(svc *BaseService, app string, namespace string, configs *provision.TsuruYamlKubernetesConfig) error {
 	_, err := svc.ExtensionsClient.ApiextensionsV1beta1().CustomResourceDefinitions().Create(ctx, &v1beta1.CustomResourceDefinition{
 		ObjectMeta: metav1.ObjectMeta{Name: "apps.tsuru.io"},
@@ -0,0 +1,36 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/tsuru/kubernetes-router/observability"
+	"github.com/tsuru/kubernetes-router/router"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts the span of an operation on the app instance id
+func startSpan(ctx context.Context, operation string, id router.InstanceID) (context.Context, trace.Span) {
+	return observability.Tracer().Start(ctx, operation, trace.WithAttributes(
+		attribute.String("app", id.AppName),
+		attribute.String("instance", id.InstanceName),
+	))
+}
+
+// endSpan ends span, marking it as failed when err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		setSpanError(span, err)
+	}
+	span.End()
+}
+
+func setSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package observability
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes of the log entries identifying what they relate to
+const (
+	LogKeyRequestID = "request_id"
+	LogKeyApp       = "app"
+	LogKeyInstance  = "instance"
+	LogKeyMode      = "mode"
+	LogKeyCluster   = "cluster"
+	LogKeyTraceID   = "trace_id"
+)
+
+var logLevel = new(slog.LevelVar)
+
+type logAttrsKey struct{}
+
+type requestLogKey struct{}
+
+// requestLog holds the attributes added while serving a request, which are
+// reported by its access log
+type requestLog struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+func (l *requestLog) add(attrs []slog.Attr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attrs = append(l.attrs, attrs...)
+}
+
+func (l *requestLog) get() []slog.Attr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]slog.Attr(nil), l.attrs...)
+}
+
+// InitLogger sets the default slog logger writing to w in format, json or
+// text, the entries logged with a context carry the attributes added to it
+// by WithLogAttrs and the ID of its trace
+func InitLogger(w io.Writer, format string, level slog.Level) error {
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, use json or text", format)
+	}
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}))
+	return nil
+}
+
+// WithLogAttrs returns a copy of ctx whose log entries carry attrs, they
+// are also reported by the access log of the request served with ctx
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	if l, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		l.add(attrs)
+	}
+	current, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(current)+len(attrs))
+	merged = append(merged, current...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+// contextHandler adds the attributes of the context to each entry
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String(LogKeyTraceID, spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// LogLevelHandler serves the level of the logger on GET and changes it on
+// PUT with a body like {"level": "debug"}
+func LogLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type levelBody struct {
+			Level string `json:"level"`
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body levelBody
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var level slog.Level
+			err = level.UnmarshalText([]byte(body.Level))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if level != logLevel.Level() {
+				slog.InfoContext(r.Context(), "Changing log level", "from", logLevel.Level().String(), "to", level.String())
+				logLevel.Set(level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(levelBody{Level: strings.ToLower(logLevel.Level().String())})
+	})
+}
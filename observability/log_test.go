@@ -0,0 +1,75 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package observability
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestContextLogAttrs(t *testing.T) {
+	defaultLogger := slog.Default()
+	defer slog.SetDefault(defaultLogger)
+	var buf bytes.Buffer
+	err := InitLogger(&buf, "json", slog.LevelInfo)
+	require.NoError(t, err)
+
+	provider := sdktrace.NewTracerProvider()
+	ctx, span := provider.Tracer("test").Start(context.Background(), "test")
+	defer span.End()
+	ctx = WithLogAttrs(ctx, slog.String(LogKeyRequestID, "req1"))
+	appCtx := WithLogAttrs(ctx, slog.String(LogKeyApp, "myapp"))
+
+	slog.InfoContext(appCtx, "Ensuring")
+	slog.DebugContext(appCtx, "Hidden")
+	slog.InfoContext(ctx, "Served")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "Ensuring", entry["msg"])
+	assert.Equal(t, "req1", entry[LogKeyRequestID])
+	assert.Equal(t, "myapp", entry[LogKeyApp])
+	assert.Equal(t, span.SpanContext().TraceID().String(), entry[LogKeyTraceID])
+	entry = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	assert.Equal(t, "req1", entry[LogKeyRequestID])
+	assert.NotContains(t, entry, LogKeyApp)
+
+	assert.Error(t, InitLogger(&buf, "xml", slog.LevelInfo))
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	logLevel.Set(slog.LevelInfo)
+	handler := LogLevelHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/log-level", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"level": "info"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/log-level", strings.NewReader(`{"level": "debug"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"level": "debug"}`, rec.Body.String())
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/log-level", strings.NewReader(`{"level": "verbose"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+}
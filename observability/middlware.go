@@ -5,14 +5,23 @@
 package observability
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
 	"net/http"
+	"time"
 
-	"github.com/opentracing/opentracing-go"
-	opentracingExt "github.com/opentracing/opentracing-go/ext"
-	"github.com/uber/jaeger-client-go"
 	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Middleware traces the requests and logs them once served, identified by
+// their X-Request-ID, generated when missing
 func Middleware() negroni.Handler {
 	return &middleware{}
 }
@@ -20,28 +29,28 @@ func Middleware() negroni.Handler {
 type middleware struct{}
 
 func (*middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	tracer := opentracing.GlobalTracer()
-	tags := []opentracing.StartSpanOption{
-		opentracingExt.SpanKindRPCServer,
-		opentracing.Tag{Key: "component", Value: "api"},
-		opentracing.Tag{Key: "request_id", Value: r.Header.Get("X-Request-ID")},
-		opentracing.Tag{Key: "http.method", Value: r.Method},
-		opentracing.Tag{Key: "http.url", Value: r.RequestURI},
+	start := time.Now()
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = newRequestID()
+		r.Header.Set("X-Request-ID", requestID)
 	}
-	wireContext, err := tracer.Extract(
-		opentracing.HTTPHeaders,
-		opentracing.HTTPHeadersCarrier(r.Header))
-
-	if err == nil {
-		jaegerContext, isJaeger := wireContext.(*jaeger.SpanContext)
-		if !isJaeger || jaegerContext.IsSampled() {
-			// it's force all unsampled spans to be re-calculated and enforces use of const sampler with param 1
-			tags = append(tags, opentracing.ChildOf(wireContext))
-		}
-	}
-	span := tracer.StartSpan(r.Method, tags...)
-	defer span.Finish()
-	ctx := opentracing.ContextWithSpan(r.Context(), span)
+	rw.Header().Set("X-Request-ID", requestID)
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := Tracer().Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("component", "api"),
+			attribute.String("request_id", requestID),
+			attribute.String("http.method", r.Method),
+			attribute.String("http.url", r.RequestURI),
+		),
+	)
+	defer span.End()
+	ctx = WithLogAttrs(ctx, slog.String(LogKeyRequestID, requestID))
+	reqLog := &requestLog{}
+	ctx = context.WithValue(ctx, requestLogKey{}, reqLog)
 	newR := r.WithContext(ctx)
 
 	next(rw, newR)
@@ -49,8 +58,26 @@ func (*middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.
 	if statusCode == 0 {
 		statusCode = 200
 	}
-	span.SetTag("http.status_code", statusCode)
+	span.SetAttributes(attribute.Int("http.status_code", statusCode))
 	if statusCode >= http.StatusInternalServerError {
-		opentracingExt.Error.Set(span, true)
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
 	}
+
+	level := slog.LevelInfo
+	if statusCode >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := append(reqLog.get(),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", statusCode),
+		slog.Duration("duration", time.Since(start)),
+	)
+	slog.LogAttrs(ctx, level, "Request served", attrs...)
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
 }
@@ -5,35 +5,81 @@
 package observability
 
 import (
-	opentracing "github.com/opentracing/opentracing-go"
-	jaegerConfig "github.com/uber/jaeger-client-go/config"
-	"github.com/uber/jaeger-client-go/zipkin"
-	"istio.io/pkg/log"
+	"context"
+	"os"
+
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "kubernetes-router"
+	tracerName  = "github.com/tsuru/kubernetes-router"
 )
 
 func init() {
-	// We decided to use B3 Format, in the future plan to move to W3C context propagation
-	// https://github.com/w3c/trace-context
-	zipkinPropagator := zipkin.NewZipkinB3HTTPHeaderPropagator()
+	// spans are propagated with W3C trace context and with B3, used by
+	// the previous versions of the router and by the tsuru API
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)),
+	))
+}
 
-	// setup opentracing
-	cfg, err := jaegerConfig.FromEnv()
+// Tracer returns the tracer of the spans of the router
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// InitTracing sets up the OpenTelemetry SDK configured by the standard
+// OTEL_* env vars, like OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_TRACES_SAMPLER
+// and OTEL_SERVICE_NAME. Tracing stays disabled unless an OTLP endpoint or
+// OTEL_TRACES_EXPORTER is set, or when OTEL_SDK_DISABLED is true. The
+// function returned flushes the pending spans.
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if !tracingEnabled() {
+		return noop, nil
+	}
+	exporter, err := autoexport.NewSpanExporter(ctx)
 	if err != nil {
-		log.Fatal(err.Error())
+		return noop, err
 	}
-	cfg.ServiceName = "kubernetes-router"
-
-	tracer, _, err := cfg.NewTracer(
-		jaegerConfig.Injector(opentracing.HTTPHeaders, zipkinPropagator),
-		jaegerConfig.Extractor(opentracing.HTTPHeaders, zipkinPropagator),
-		jaegerConfig.Injector(opentracing.TextMap, zipkinPropagator),
-		jaegerConfig.Extractor(opentracing.TextMap, zipkinPropagator),
+	if autoexport.IsNoneSpanExporter(exporter) {
+		return noop, nil
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
 	)
-	if err == nil {
-		opentracing.SetGlobalTracer(tracer)
-	} else {
-		// FIXME: we need to mark that traces are disabled
-		log.Debugf("Could not initialize jaeger tracer: %s", err.Error())
+	if err != nil {
+		return noop, err
 	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
 
+func tracingEnabled() bool {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return false
+	}
+	for _, env := range []string{"OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+		if os.Getenv(env) != "" {
+			return true
+		}
+	}
+	return false
 }
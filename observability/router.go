@@ -0,0 +1,186 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package observability
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/kubernetes-router/router"
+)
+
+const resultSuccess = "success"
+
+var (
+	routerOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "kubernetes_router_operation_duration_seconds",
+		Help: "The duration of the operations of the routers by mode, operation, cluster and result.",
+	}, []string{"mode", "operation", "cluster", "result"})
+
+	routerOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubernetes_router_operations_total",
+		Help: "The number of operations of the routers by mode, operation, cluster and result.",
+	}, []string{"mode", "operation", "cluster", "result"})
+
+	errNotSupported = errors.New("operation not supported by this router mode")
+)
+
+func init() {
+	prometheus.MustRegister(routerOperationDuration, routerOperationsTotal)
+}
+
+var (
+	_ router.Router                 = &instrumentedRouter{}
+	_ router.RouterStatus           = &instrumentedRouter{}
+	_ router.RouterTLS              = &instrumentedRouter{}
+	_ router.RouterSwap             = &instrumentedRouter{}
+	_ router.RouterWeighted         = &instrumentedRouter{}
+	_ router.RouterGarbageCollector = &instrumentedRouter{}
+	_ router.RouterOptionsSchema    = &instrumentedRouter{}
+	_ router.RouterPlanner          = &instrumentedRouter{}
+	_ router.Wrapper                = &instrumentedRouter{}
+)
+
+// InstrumentRouter returns r recording the duration and the result of its
+// operations, labelled by mode and cluster. The router returned implements
+// every optional router interface, failing with the not_supported code the
+// operations r lacks, so what it supports is checked on router.Unwrap.
+func InstrumentRouter(r router.Router, mode, cluster string) router.Router {
+	return &instrumentedRouter{router: r, mode: mode, cluster: cluster}
+}
+
+type instrumentedRouter struct {
+	router  router.Router
+	mode    string
+	cluster string
+}
+
+// observe records an operation started at start, the result is the code of
+// err when it failed
+func (r *instrumentedRouter) observe(operation string, start time.Time, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = string(router.AsError(err).Code)
+	}
+	routerOperationDuration.WithLabelValues(r.mode, operation, r.cluster, result).Observe(time.Since(start).Seconds())
+	routerOperationsTotal.WithLabelValues(r.mode, operation, r.cluster, result).Inc()
+}
+
+func notSupported() error {
+	return router.NewError(router.ErrorCodeNotSupported, errNotSupported)
+}
+
+func (r *instrumentedRouter) Unwrap() router.Router {
+	return r.router
+}
+
+func (r *instrumentedRouter) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (err error) {
+	defer func(start time.Time) { r.observe("ensure", start, err) }(time.Now())
+	return r.router.Ensure(ctx, id, o)
+}
+
+func (r *instrumentedRouter) Remove(ctx context.Context, id router.InstanceID) (err error) {
+	defer func(start time.Time) { r.observe("remove", start, err) }(time.Now())
+	return r.router.Remove(ctx, id)
+}
+
+func (r *instrumentedRouter) GetAddresses(ctx context.Context, id router.InstanceID) (addresses []string, err error) {
+	defer func(start time.Time) { r.observe("addresses", start, err) }(time.Now())
+	return r.router.GetAddresses(ctx, id)
+}
+
+func (r *instrumentedRouter) SupportedOptions(ctx context.Context) map[string]string {
+	return r.router.SupportedOptions(ctx)
+}
+
+func (r *instrumentedRouter) OptionsSchema(ctx context.Context) map[string]router.OptionSchema {
+	schemaRouter, ok := r.router.(router.RouterOptionsSchema)
+	if !ok {
+		return nil
+	}
+	return schemaRouter.OptionsSchema(ctx)
+}
+
+func (r *instrumentedRouter) GetStatus(ctx context.Context, id router.InstanceID) (status router.BackendStatus, detail string, err error) {
+	defer func(start time.Time) { r.observe("status", start, err) }(time.Now())
+	statusRouter, ok := r.router.(router.RouterStatus)
+	if !ok {
+		return "", "", notSupported()
+	}
+	return statusRouter.GetStatus(ctx, id)
+}
+
+func (r *instrumentedRouter) AddCertificate(ctx context.Context, id router.InstanceID, certName string, cert router.CertData) (err error) {
+	defer func(start time.Time) { r.observe("cert_add", start, err) }(time.Now())
+	tlsRouter, ok := r.router.(router.RouterTLS)
+	if !ok {
+		return notSupported()
+	}
+	return tlsRouter.AddCertificate(ctx, id, certName, cert)
+}
+
+func (r *instrumentedRouter) GetCertificate(ctx context.Context, id router.InstanceID, certName string) (cert *router.CertData, err error) {
+	defer func(start time.Time) { r.observe("cert_get", start, err) }(time.Now())
+	tlsRouter, ok := r.router.(router.RouterTLS)
+	if !ok {
+		return nil, notSupported()
+	}
+	return tlsRouter.GetCertificate(ctx, id, certName)
+}
+
+func (r *instrumentedRouter) RemoveCertificate(ctx context.Context, id router.InstanceID, certName string) (err error) {
+	defer func(start time.Time) { r.observe("cert_remove", start, err) }(time.Now())
+	tlsRouter, ok := r.router.(router.RouterTLS)
+	if !ok {
+		return notSupported()
+	}
+	return tlsRouter.RemoveCertificate(ctx, id, certName)
+}
+
+func (r *instrumentedRouter) Swap(ctx context.Context, src, dst router.InstanceID, opts router.SwapOpts) (err error) {
+	defer func(start time.Time) { r.observe("swap", start, err) }(time.Now())
+	swapRouter, ok := r.router.(router.RouterSwap)
+	if !ok {
+		return notSupported()
+	}
+	return swapRouter.Swap(ctx, src, dst, opts)
+}
+
+func (r *instrumentedRouter) ValidateWeightedTargets(ctx context.Context, prefixes []router.BackendPrefix) error {
+	weightedRouter, ok := r.router.(router.RouterWeighted)
+	if !ok {
+		return notSupported()
+	}
+	return weightedRouter.ValidateWeightedTargets(ctx, prefixes)
+}
+
+func (r *instrumentedRouter) CollectGarbage(ctx context.Context, dryRun bool) (garbage []router.GarbageResource, err error) {
+	defer func(start time.Time) { r.observe("gc", start, err) }(time.Now())
+	gcRouter, ok := r.router.(router.RouterGarbageCollector)
+	if !ok {
+		return nil, notSupported()
+	}
+	return gcRouter.CollectGarbage(ctx, dryRun)
+}
+
+func (r *instrumentedRouter) PlanEnsure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (plan *router.Plan, err error) {
+	defer func(start time.Time) { r.observe("plan_ensure", start, err) }(time.Now())
+	planner, ok := r.router.(router.RouterPlanner)
+	if !ok {
+		return nil, notSupported()
+	}
+	return planner.PlanEnsure(ctx, id, o)
+}
+
+func (r *instrumentedRouter) PlanRemove(ctx context.Context, id router.InstanceID) (plan *router.Plan, err error) {
+	defer func(start time.Time) { r.observe("plan_remove", start, err) }(time.Now())
+	planner, ok := r.router.(router.RouterPlanner)
+	if !ok {
+		return nil, notSupported()
+	}
+	return planner.PlanRemove(ctx, id)
+}
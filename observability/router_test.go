@@ -0,0 +1,63 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package observability
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/tsuru/kubernetes-router/router"
+)
+
+type fakeRouter struct {
+	err error
+}
+
+func (r *fakeRouter) Ensure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) error {
+	return r.err
+}
+
+func (r *fakeRouter) Remove(ctx context.Context, id router.InstanceID) error {
+	return r.err
+}
+
+func (r *fakeRouter) GetAddresses(ctx context.Context, id router.InstanceID) ([]string, error) {
+	return []string{"myapp.io"}, r.err
+}
+
+func (r *fakeRouter) SupportedOptions(ctx context.Context) map[string]string {
+	return nil
+}
+
+func TestInstrumentRouter(t *testing.T) {
+	inner := &fakeRouter{}
+	rt := InstrumentRouter(inner, "service", "my-cluster")
+	assert.Same(t, inner, router.Unwrap(rt))
+
+	success := testutil.ToFloat64(routerOperationsTotal.WithLabelValues("service", "ensure", "my-cluster", "success"))
+	err := rt.Ensure(context.Background(), router.InstanceID{AppName: "myapp"}, router.EnsureBackendOpts{})
+	assert.NoError(t, err)
+	assert.Equal(t, success+1, testutil.ToFloat64(routerOperationsTotal.WithLabelValues("service", "ensure", "my-cluster", "success")))
+
+	inner.err = router.NewError(router.ErrorCodeServiceNotFound, errors.New("service not found"))
+	failed := testutil.ToFloat64(routerOperationsTotal.WithLabelValues("service", "addresses", "my-cluster", "service_not_found"))
+	_, err = rt.GetAddresses(context.Background(), router.InstanceID{AppName: "myapp"})
+	assert.Equal(t, inner.err, err)
+	assert.Equal(t, failed+1, testutil.ToFloat64(routerOperationsTotal.WithLabelValues("service", "addresses", "my-cluster", "service_not_found")))
+}
+
+func TestInstrumentRouterNotSupported(t *testing.T) {
+	rt := InstrumentRouter(&fakeRouter{}, "service", "local")
+	_, ok := router.Unwrap(rt).(router.RouterTLS)
+	assert.False(t, ok)
+
+	notSupported := testutil.ToFloat64(routerOperationsTotal.WithLabelValues("service", "cert_add", "local", "not_supported"))
+	err := rt.(router.RouterTLS).AddCertificate(context.Background(), router.InstanceID{AppName: "myapp"}, "mycert", router.CertData{})
+	assert.Equal(t, router.ErrorCodeNotSupported, router.AsError(err).Code)
+	assert.Equal(t, notSupported+1, testutil.ToFloat64(routerOperationsTotal.WithLabelValues("service", "cert_add", "local", "not_supported")))
+}
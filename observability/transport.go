@@ -6,47 +6,170 @@ package observability
 
 import (
 	"io"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
-	opentracingHTTP "github.com/opentracing-contrib/go-stdlib/nethttp"
-	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var kubernetesRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "kubernetes_router_kubernetes_request_duration_seconds",
+	Help: "The latency of the requests to the Kubernetes API by verb and resource.",
+}, []string{"verb", "resource"})
+
+func init() {
+	prometheus.MustRegister(kubernetesRequestDuration)
+}
+
 func WrapTransport(rt http.RoundTripper) http.RoundTripper {
-	return &AutoOpentracingTransport{RoundTripper: rt}
+	return &instrumentedTransport{RoundTripper: &tracingTransport{RoundTripper: rt}}
 }
 
-type AutoOpentracingTransport struct {
+// instrumentedTransport records the latency of the requests to the
+// Kubernetes API, until their response headers are received, and logs them
+// with the context of the operation making them
+type instrumentedTransport struct {
 	http.RoundTripper
 }
 
-func (t *AutoOpentracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := t.RoundTripper.RoundTrip(req)
+	duration := time.Since(start)
+	verb, resource := requestInfo(req)
+	kubernetesRequestDuration.WithLabelValues(verb, resource).Observe(duration.Seconds())
+
+	ctx := req.Context()
+	attrs := []slog.Attr{
+		slog.String("verb", verb),
+		slog.String("resource", resource),
+		slog.String("url", req.URL.String()),
+		slog.Duration("duration", duration),
+	}
+	switch {
+	case err != nil:
+		slog.LogAttrs(ctx, slog.LevelWarn, "Kubernetes request failed", append(attrs, slog.Any("error", err))...)
+	case response.StatusCode >= http.StatusInternalServerError:
+		slog.LogAttrs(ctx, slog.LevelWarn, "Kubernetes request failed", append(attrs, slog.Int("status", response.StatusCode))...)
+	case response.StatusCode >= http.StatusBadRequest && response.StatusCode != http.StatusNotFound:
+		slog.LogAttrs(ctx, slog.LevelInfo, "Kubernetes request rejected", append(attrs, slog.Int("status", response.StatusCode))...)
+	default:
+		slog.LogAttrs(ctx, slog.LevelDebug, "Kubernetes request", append(attrs, slog.Int("status", response.StatusCode))...)
+	}
+	return response, err
+}
+
+// requestInfo returns the verb and the resource of a request to the
+// Kubernetes API, like list and ingresses.networking.k8s.io. Subresources
+// follow their resource, like services/status.
+func requestInfo(req *http.Request) (string, string) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	var group string
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		group = parts[1]
+		parts = parts[3:]
+	default:
+		return strings.ToLower(req.Method), "other"
+	}
+	if len(parts) == 0 {
+		return strings.ToLower(req.Method), "discovery"
+	}
+	if len(parts) > 2 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+	resource := parts[0]
+	if len(parts) > 2 {
+		resource += "/" + parts[2]
+	}
+	if group != "" {
+		resource += "." + group
+	}
+	hasName := len(parts) > 1
+	switch req.Method {
+	case http.MethodGet:
+		if req.URL.Query().Get("watch") == "true" {
+			return "watch", resource
+		}
+		if hasName {
+			return "get", resource
+		}
+		return "list", resource
+	case http.MethodPost:
+		return "create", resource
+	case http.MethodPut:
+		return "update", resource
+	case http.MethodPatch:
+		return "patch", resource
+	case http.MethodDelete:
+		if hasName {
+			return "delete", resource
+		}
+		return "deletecollection", resource
+	}
+	return strings.ToLower(req.Method), resource
+}
+
+// tracingTransport traces the requests made within a traced operation,
+// propagating its span to the Kubernetes API
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	rt := t.RoundTripper
-	tracer := opentracing.GlobalTracer()
 	if rt == nil {
 		rt = http.DefaultTransport
 	}
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return rt.RoundTrip(req)
+	}
+	verb, resource := requestInfo(req)
+	ctx, span := Tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("component", "kubernetes"),
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.String()),
+			attribute.String("kubernetes.verb", verb),
+			attribute.String("kubernetes.resource", resource),
+		),
+	)
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-	req, ht := opentracingHTTP.TraceRequest(tracer, req)
-
-	transport := &opentracingHTTP.Transport{RoundTripper: rt}
-	response, err := transport.RoundTrip(req)
-
+	response, err := rt.RoundTrip(req)
 	if err != nil {
-		ht.Finish()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
 		return nil, err
 	}
-	response.Body = &autoCloseTracer{ht: ht, ReadCloser: response.Body}
+	span.SetAttributes(attribute.Int("http.status_code", response.StatusCode))
+	if response.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(response.StatusCode))
+	}
+	response.Body = &autoCloseSpan{span: span, ReadCloser: response.Body}
 	return response, nil
 }
 
-type autoCloseTracer struct {
+// autoCloseSpan ends the span of a request once its response is read
+type autoCloseSpan struct {
 	io.ReadCloser
-	ht *opentracingHTTP.Tracer
+	span trace.Span
 }
 
-func (a *autoCloseTracer) Close() error {
+func (a *autoCloseSpan) Close() error {
 	err := a.ReadCloser.Close()
-	a.ht.Finish()
+	a.span.End()
 	return err
 }
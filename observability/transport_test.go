@@ -0,0 +1,78 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package observability
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestRequestInfo(t *testing.T) {
+	tests := []struct {
+		method, url    string
+		verb, resource string
+	}{
+		{http.MethodGet, "/api/v1/namespaces/tsuru/services/myapp", "get", "services"},
+		{http.MethodGet, "/api/v1/namespaces/tsuru/services", "list", "services"},
+		{http.MethodGet, "/api/v1/services?watch=true", "watch", "services"},
+		{http.MethodGet, "/api/v1/namespaces/tsuru", "get", "namespaces"},
+		{http.MethodPut, "/api/v1/namespaces/tsuru/services/myapp/status", "update", "services/status"},
+		{http.MethodPatch, "/apis/extensions/v1beta1/namespaces/tsuru/ingresses/myapp", "patch", "ingresses.extensions"},
+		{http.MethodPost, "/apis/networking.istio.io/v1alpha3/namespaces/tsuru/virtualservices", "create", "virtualservices.networking.istio.io"},
+		{http.MethodDelete, "/apis/coordination.k8s.io/v1/namespaces/tsuru/leases/mylease", "delete", "leases.coordination.k8s.io"},
+		{http.MethodDelete, "/api/v1/namespaces/tsuru/secrets", "deletecollection", "secrets"},
+		{http.MethodGet, "/apis/networking.k8s.io/v1", "get", "discovery"},
+		{http.MethodGet, "/version", "get", "other"},
+	}
+	for _, tt := range tests {
+		verb, resource := requestInfo(httptest.NewRequest(tt.method, tt.url, nil))
+		assert.Equal(t, tt.verb, verb, tt.url)
+		assert.Equal(t, tt.resource, resource, tt.url)
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: WrapTransport(http.DefaultTransport)}
+
+	response, err := client.Get(server.URL + "/api/v1/namespaces/tsuru/services/myapp")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Empty(t, headers.Get("traceparent"))
+	assert.Empty(t, recorder.Ended())
+
+	ctx, span := Tracer().Start(context.Background(), "test")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/v1/namespaces/tsuru/services/myapp", nil)
+	require.NoError(t, err)
+	response, err = client.Do(req)
+	require.NoError(t, err)
+	response.Body.Close()
+	span.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "HTTP GET", spans[0].Name())
+	assert.Equal(t, span.SpanContext().TraceID(), spans[0].SpanContext().TraceID())
+	assert.Contains(t, headers.Get("traceparent"), span.SpanContext().TraceID().String())
+	assert.Equal(t, span.SpanContext().TraceID().String(), headers.Get("X-B3-TraceId"))
+}
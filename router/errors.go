@@ -0,0 +1,117 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"net"
+
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ErrorCode is the stable identifier of a kind of error, clients may rely
+// on it to react to errors
+type ErrorCode string
+
+const (
+	ErrorCodeInternal            = ErrorCode("internal")
+	ErrorCodeBadRequest          = ErrorCode("bad_request")
+	ErrorCodeInvalid             = ErrorCode("invalid")
+	ErrorCodeNotFound            = ErrorCode("not_found")
+	ErrorCodeNotSupported        = ErrorCode("not_supported")
+	ErrorCodeServiceNotFound     = ErrorCode("service_not_found")
+	ErrorCodeNoBackendTarget     = ErrorCode("no_backend_target")
+	ErrorCodeCertificateNotFound = ErrorCode("certificate_not_found")
+	ErrorCodeAlreadyExists       = ErrorCode("already_exists")
+	ErrorCodeConflict            = ErrorCode("conflict")
+	ErrorCodeForbidden           = ErrorCode("forbidden")
+	ErrorCodeUnavailable         = ErrorCode("unavailable")
+	ErrorCodeLocked              = ErrorCode("locked")
+)
+
+// Error is an error with a stable code, Details holds structured data about
+// it, like the fields of a validation error
+type Error struct {
+	Code    ErrorCode   `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+
+	err error
+}
+
+// NewError returns an Error with the code wrapping err, the message of err
+// is used as the message of the Error
+func NewError(code ErrorCode, err error) *Error {
+	return &Error{Code: code, Message: err.Error(), err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// CodedError is implemented by errors knowing their code, like the errors
+// of the routers
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+}
+
+var sentinelCodes = map[error]ErrorCode{
+	ErrIngressAlreadyExists:     ErrorCodeAlreadyExists,
+	ErrInvalidWeights:           ErrorCodeInvalid,
+	ErrSwapDifferentNamespaces:  ErrorCodeBadRequest,
+	ErrSwapAlreadySwapped:       ErrorCodeConflict,
+	ErrSwapCNameOnlyUnsupported: ErrorCodeBadRequest,
+}
+
+var reasonCodes = map[metav1.StatusReason]ErrorCode{
+	metav1.StatusReasonNotFound:           ErrorCodeNotFound,
+	metav1.StatusReasonAlreadyExists:      ErrorCodeAlreadyExists,
+	metav1.StatusReasonConflict:           ErrorCodeConflict,
+	metav1.StatusReasonForbidden:          ErrorCodeForbidden,
+	metav1.StatusReasonInvalid:            ErrorCodeInvalid,
+	metav1.StatusReasonBadRequest:         ErrorCodeBadRequest,
+	metav1.StatusReasonServiceUnavailable: ErrorCodeUnavailable,
+	metav1.StatusReasonTimeout:            ErrorCodeUnavailable,
+	metav1.StatusReasonServerTimeout:      ErrorCodeUnavailable,
+	metav1.StatusReasonTooManyRequests:    ErrorCodeUnavailable,
+}
+
+// AsError classifies err, returning it as an Error. Errors of the Kubernetes
+// API are classified by their reason and network errors as unavailable,
+// anything else is internal.
+func AsError(err error) *Error {
+	var routerErr *Error
+	if errors.As(err, &routerErr) {
+		return routerErr
+	}
+	code := ErrorCodeInternal
+	var codedErr CodedError
+	var statusErr k8sErrors.APIStatus
+	var netErr net.Error
+	switch {
+	case errors.As(err, &codedErr):
+		code = codedErr.ErrorCode()
+	case errors.As(err, &statusErr):
+		if reasonCode, ok := reasonCodes[statusErr.Status().Reason]; ok {
+			code = reasonCode
+		}
+	case errors.As(err, &netErr):
+		code = ErrorCodeUnavailable
+	default:
+		for sentinel, sentinelCode := range sentinelCodes {
+			if errors.Is(err, sentinel) {
+				code = sentinelCode
+				break
+			}
+		}
+	}
+	return NewError(code, err)
+}
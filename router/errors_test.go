@@ -0,0 +1,52 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type codedError struct{}
+
+func (codedError) Error() string {
+	return "coded"
+}
+
+func (codedError) ErrorCode() ErrorCode {
+	return ErrorCodeServiceNotFound
+}
+
+func TestAsError(t *testing.T) {
+	ingresses := schema.GroupResource{Resource: "ingresses"}
+	tests := []struct {
+		err  error
+		code ErrorCode
+	}{
+		{err: errors.New("unexpected"), code: ErrorCodeInternal},
+		{err: NewError(ErrorCodeNoBackendTarget, errors.New("no target")), code: ErrorCodeNoBackendTarget},
+		{err: fmt.Errorf("wrapped: %w", codedError{}), code: ErrorCodeServiceNotFound},
+		{err: fmt.Errorf("wrapped: %w", ErrIngressAlreadyExists), code: ErrorCodeAlreadyExists},
+		{err: ErrSwapAlreadySwapped, code: ErrorCodeConflict},
+		{err: ErrInvalidWeights, code: ErrorCodeInvalid},
+		{err: k8sErrors.NewNotFound(ingresses, "myapp"), code: ErrorCodeNotFound},
+		{err: fmt.Errorf("wrapped: %w", k8sErrors.NewConflict(ingresses, "myapp", errors.New("modified"))), code: ErrorCodeConflict},
+		{err: k8sErrors.NewForbidden(ingresses, "myapp", errors.New("denied")), code: ErrorCodeForbidden},
+		{err: k8sErrors.NewTooManyRequests("slow down", 1), code: ErrorCodeUnavailable},
+		{err: k8sErrors.NewInternalError(errors.New("boom")), code: ErrorCodeInternal},
+		{err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, code: ErrorCodeUnavailable},
+	}
+	for _, tt := range tests {
+		routerErr := AsError(tt.err)
+		assert.Equal(t, tt.code, routerErr.Code, tt.err.Error())
+		assert.Equal(t, tt.err.Error(), routerErr.Message)
+	}
+}
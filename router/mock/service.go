@@ -23,6 +23,12 @@ type RouterMock struct {
 	AddCertificateFn         func(router.InstanceID, string, router.CertData) error
 	RemoveCertificateFn      func(router.InstanceID, string) error
 	SupportedOptionsFn       func() map[string]string
+	OptionsSchemaFn          func() map[string]router.OptionSchema
+	SwapFn                   func(router.InstanceID, router.InstanceID, router.SwapOpts) error
+	ValidateWeightedFn       func([]router.BackendPrefix) error
+	CollectGarbageFn         func(bool) ([]router.GarbageResource, error)
+	PlanEnsureFn             func(router.InstanceID, router.EnsureBackendOpts) (*router.Plan, error)
+	PlanRemoveFn             func(router.InstanceID) (*router.Plan, error)
 	RemoveInvoked            bool
 	EnsureInvoked            bool
 	GetAddressesInvoked      bool
@@ -31,6 +37,8 @@ type RouterMock struct {
 	RemoveCertificateInvoked bool
 	SupportedOptionsInvoked  bool
 	GetStatusInvoked         bool
+	SwapInvoked              bool
+	CollectGarbageInvoked    bool
 }
 
 // Remove calls RemoveFn
@@ -74,8 +82,43 @@ func (s *RouterMock) RemoveCertificate(ctx context.Context, id router.InstanceID
 	return s.RemoveCertificateFn(id, certName)
 }
 
+// Swap calls SwapFn
+func (s *RouterMock) Swap(ctx context.Context, src, dst router.InstanceID, opts router.SwapOpts) error {
+	s.SwapInvoked = true
+	return s.SwapFn(src, dst, opts)
+}
+
+// ValidateWeightedTargets calls ValidateWeightedFn
+func (s *RouterMock) ValidateWeightedTargets(ctx context.Context, prefixes []router.BackendPrefix) error {
+	return s.ValidateWeightedFn(prefixes)
+}
+
+// CollectGarbage calls CollectGarbageFn
+func (s *RouterMock) CollectGarbage(ctx context.Context, dryRun bool) ([]router.GarbageResource, error) {
+	s.CollectGarbageInvoked = true
+	return s.CollectGarbageFn(dryRun)
+}
+
 // SupportedOptions calls SupportedOptionsFn
 func (s *RouterMock) SupportedOptions(ctx context.Context) map[string]string {
 	s.SupportedOptionsInvoked = true
 	return s.SupportedOptionsFn()
 }
+
+// OptionsSchema calls OptionsSchemaFn, returning no schema when it is not set
+func (s *RouterMock) OptionsSchema(ctx context.Context) map[string]router.OptionSchema {
+	if s.OptionsSchemaFn == nil {
+		return nil
+	}
+	return s.OptionsSchemaFn()
+}
+
+// PlanEnsure calls PlanEnsureFn
+func (s *RouterMock) PlanEnsure(ctx context.Context, id router.InstanceID, o router.EnsureBackendOpts) (*router.Plan, error) {
+	return s.PlanEnsureFn(id, o)
+}
+
+// PlanRemove calls PlanRemoveFn
+func (s *RouterMock) PlanRemove(ctx context.Context, id router.InstanceID) (*router.Plan, error) {
+	return s.PlanRemoveFn(id)
+}
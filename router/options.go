@@ -0,0 +1,155 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// OptionType is the type of the value of an option
+type OptionType string
+
+const (
+	OptionTypeString = OptionType("string")
+	OptionTypeBool   = OptionType("bool")
+	OptionTypePort   = OptionType("port")
+	OptionTypeDomain = OptionType("domain")
+	OptionTypePath   = OptionType("path")
+)
+
+// OptionSchema describes the values accepted by an option, Values lists the
+// allowed values when the option is an enumeration
+type OptionSchema struct {
+	Type     OptionType `json:"type"`
+	Values   []string   `json:"values,omitempty"`
+	Required bool       `json:"required,omitempty"`
+}
+
+// RouterOptionsSchema could declare the schema of its supported options,
+// which are validated before every Ensure
+type RouterOptionsSchema interface {
+	Router
+	OptionsSchema(ctx context.Context) map[string]OptionSchema
+}
+
+// Violation is a field of an EnsureBackendOpts failing the validation
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// OptionValues returns the options set as a map of option name to value,
+// merging the known options with AdditionalOpts
+func (o *Opts) OptionValues() map[string]string {
+	values := map[string]string{}
+	for k, v := range o.AdditionalOpts {
+		values[k] = v
+	}
+	known := map[string]string{
+		ExposedPort:           o.ExposedPort,
+		Domain:                o.Domain,
+		Route:                 o.Route,
+		DomainSuffix:          o.DomainSuffix,
+		DomainPrefix:          o.DomainPrefix,
+		ExternalTrafficPolicy: o.ExternalTrafficPolicy,
+	}
+	for k, v := range known {
+		if v != "" {
+			values[k] = v
+		}
+	}
+	if o.Acme {
+		values[Acme] = "true"
+	}
+	return values
+}
+
+// Validate checks the options against schema and the cnames as DNS names,
+// options missing from schema are not checked. Every violation found is
+// returned as the Details of an Error with the invalid code.
+func (o *EnsureBackendOpts) Validate(schema map[string]OptionSchema) error {
+	var violations []Violation
+	values := o.Opts.OptionValues()
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := values[name]
+		if !ok || value == "" {
+			if schema[name].Required {
+				violations = append(violations, Violation{Field: "opts." + name, Message: "is required"})
+			}
+			continue
+		}
+		if msg := schema[name].validate(value); msg != "" {
+			violations = append(violations, Violation{Field: "opts." + name, Message: msg})
+		}
+	}
+	for i, cname := range o.CNames {
+		if msg := validateDomain(cname, true); msg != "" {
+			violations = append(violations, Violation{Field: fmt.Sprintf("cnames[%d]", i), Message: msg})
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(violations))
+	for i, violation := range violations {
+		msgs[i] = violation.Field + ": " + violation.Message
+	}
+	return &Error{
+		Code:    ErrorCodeInvalid,
+		Message: "invalid options: " + strings.Join(msgs, ", "),
+		Details: violations,
+	}
+}
+
+func (s OptionSchema) validate(value string) string {
+	if len(s.Values) > 0 {
+		for _, allowed := range s.Values {
+			if value == allowed {
+				return ""
+			}
+		}
+		return fmt.Sprintf("%q must be one of %s", value, strings.Join(s.Values, ", "))
+	}
+	switch s.Type {
+	case OptionTypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Sprintf("%q is not a boolean", value)
+		}
+	case OptionTypePort:
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Sprintf("%q is not a port between 1 and 65535", value)
+		}
+	case OptionTypeDomain:
+		return validateDomain(value, false)
+	case OptionTypePath:
+		if !strings.HasPrefix(value, "/") {
+			return fmt.Sprintf("%q must start with /", value)
+		}
+	}
+	return ""
+}
+
+func validateDomain(value string, allowWildcard bool) string {
+	if allowWildcard && strings.HasPrefix(value, "*.") {
+		if len(validation.IsWildcardDNS1123Subdomain(value)) == 0 {
+			return ""
+		}
+	} else if len(validation.IsDNS1123Subdomain(value)) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%q is not a valid DNS name", value)
+}
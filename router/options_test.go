@@ -0,0 +1,81 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureBackendOptsValidate(t *testing.T) {
+	schema := map[string]OptionSchema{
+		ExposedPort:  {Type: OptionTypePort},
+		Domain:       {Type: OptionTypeDomain},
+		Route:        {Type: OptionTypePath},
+		"expose-all": {Type: OptionTypeBool},
+	}
+	tests := []struct {
+		opts       EnsureBackendOpts
+		violations []Violation
+	}{
+		{
+			opts: EnsureBackendOpts{
+				Opts: Opts{
+					ExposedPort:    "8080",
+					Domain:         "myapp.tsuru.io",
+					Route:          "/api",
+					AdditionalOpts: map[string]string{"expose-all": "true", "unknown": "anything"},
+				},
+				CNames: []string{"myapp.io", "*.myapp.io"},
+			},
+		},
+		{
+			opts: EnsureBackendOpts{
+				Opts: Opts{
+					ExposedPort:    "http",
+					Route:          "api",
+					AdditionalOpts: map[string]string{"expose-all": "maybe"},
+				},
+				CNames: []string{"MyApp.io"},
+			},
+			violations: []Violation{
+				{Field: "opts.expose-all", Message: `"maybe" is not a boolean`},
+				{Field: "opts.exposed-port", Message: `"http" is not a port between 1 and 65535`},
+				{Field: "opts.route", Message: `"api" must start with /`},
+				{Field: "cnames[0]", Message: `"MyApp.io" is not a valid DNS name`},
+			},
+		},
+		{
+			opts: EnsureBackendOpts{
+				Opts: Opts{ExposedPort: "0", Domain: "*.tsuru.io"},
+			},
+			violations: []Violation{
+				{Field: "opts.domain", Message: `"*.tsuru.io" is not a valid DNS name`},
+				{Field: "opts.exposed-port", Message: `"0" is not a port between 1 and 65535`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		err := tt.opts.Validate(schema)
+		if tt.violations == nil {
+			assert.NoError(t, err)
+			continue
+		}
+		var routerErr *Error
+		require.True(t, errors.As(err, &routerErr))
+		assert.Equal(t, ErrorCodeInvalid, routerErr.Code)
+		assert.Equal(t, tt.violations, routerErr.Details)
+	}
+}
+
+func TestEnsureBackendOptsValidateWithoutSchema(t *testing.T) {
+	opts := EnsureBackendOpts{Opts: Opts{ExposedPort: "http"}}
+	assert.NoError(t, opts.Validate(nil))
+	opts.CNames = []string{"my app.io"}
+	assert.EqualError(t, opts.Validate(nil), `invalid options: cnames[0]: "my app.io" is not a valid DNS name`)
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import "context"
+
+// ChangeAction is the action a router would take on a resource
+type ChangeAction string
+
+const (
+	ChangeCreate = ChangeAction("create")
+	ChangeUpdate = ChangeAction("update")
+	ChangeDelete = ChangeAction("delete")
+)
+
+// PlannedChange is a change of a resource planned by a dry-run. Fields
+// lists what an update changes, Current and Desired are the resource
+// before and after the change, they are omitted for secrets.
+type PlannedChange struct {
+	Action    ChangeAction `json:"action"`
+	Kind      string       `json:"kind"`
+	Namespace string       `json:"namespace,omitempty"`
+	Name      string       `json:"name"`
+	Fields    []string     `json:"fields,omitempty"`
+	Current   interface{}  `json:"current,omitempty"`
+	Desired   interface{}  `json:"desired,omitempty"`
+}
+
+// Plan holds the changes an Ensure or a Remove would make, in order
+type Plan struct {
+	Changes []PlannedChange `json:"changes"`
+}
+
+// Add appends a change to the plan
+func (p *Plan) Add(change PlannedChange) {
+	p.Changes = append(p.Changes, change)
+}
+
+// RouterPlanner could compute the changes of an Ensure or a Remove
+// without applying them
+type RouterPlanner interface {
+	Router
+	PlanEnsure(ctx context.Context, id InstanceID, o EnsureBackendOpts) (*Plan, error)
+	PlanRemove(ctx context.Context, id InstanceID) (*Plan, error)
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -34,19 +35,45 @@ const (
 
 	ExternalTrafficPolicy = "external-traffic-policy"
 
-	// optsAnnotation is the name of the annotation used to store opts.
-	optsAnnotation = "router.tsuru.io/opts"
+	// OptsAnnotation is the name of the annotation used to store opts,
+	// along with the instance, cnames and prefixes of the last Ensure.
+	OptsAnnotation = "router.tsuru.io/opts"
 )
 
 // ErrIngressAlreadyExists is the error returned by the service when
 // trying to create a service that already exists
 var ErrIngressAlreadyExists = errors.New("ingress already exists")
 
+// ErrInvalidWeights is the error returned when the weights of the targets of
+// a prefix are not positive or do not sum up to 100
+var ErrInvalidWeights = errors.New("weights of the targets of a prefix must be positive and sum up to 100")
+
+// ErrSwapDifferentNamespaces is the error returned when trying to swap
+// the backends of apps running in different namespaces
+var ErrSwapDifferentNamespaces = errors.New("cannot swap backends of apps in different namespaces")
+
+// ErrSwapAlreadySwapped is the error returned when trying to swap the
+// backends of an instance already swapped with a third one
+var ErrSwapAlreadySwapped = errors.New("cannot swap backends of an instance already swapped with another one")
+
+// ErrSwapCNameOnlyUnsupported is the error returned by routers unable to
+// swap only the cnames of two instances
+var ErrSwapCNameOnlyUnsupported = errors.New("swapping only cnames is not supported by this router")
+
 type InstanceID struct {
 	InstanceName string
 	AppName      string
 }
 
+// LockKey returns the key serializing the changes on the backends of the
+// instance, shared by the API and the reconciler
+func LockKey(id InstanceID) string {
+	if id.InstanceName == "" {
+		return id.AppName
+	}
+	return id.AppName + "/" + id.InstanceName
+}
+
 type BackendStatus string
 
 var (
@@ -77,6 +104,41 @@ type RouterTLS interface {
 	RemoveCertificate(ctx context.Context, id InstanceID, certName string) error
 }
 
+// RouterSwap could exchange the backends of two instances
+type RouterSwap interface {
+	Router
+	Swap(ctx context.Context, src, dst InstanceID, opts SwapOpts) error
+}
+
+// SwapOpts holds the options of a swap, CNameOnly swaps the cnames of the
+// instances while keeping their main hosts in place
+type SwapOpts struct {
+	CNameOnly bool
+}
+
+// RouterWeighted could split the traffic of a prefix between several
+// weighted targets
+type RouterWeighted interface {
+	Router
+	ValidateWeightedTargets(ctx context.Context, prefixes []BackendPrefix) error
+}
+
+// RouterGarbageCollector could find and remove resources orphaned by its
+// Remove or left behind by failed operations
+type RouterGarbageCollector interface {
+	Router
+	CollectGarbage(ctx context.Context, dryRun bool) ([]GarbageResource, error)
+}
+
+// GarbageResource is a resource collected, or to be collected on dry-runs,
+// by a RouterGarbageCollector
+type GarbageResource struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	App       string `json:"app"`
+}
+
 // Opts used when creating/updating routers
 type Opts struct {
 	Pool                  string            `json:",omitempty"`
@@ -100,6 +162,16 @@ type CertData struct {
 type BackendPrefix struct {
 	Prefix string        `json:"prefix"`
 	Target BackendTarget `json:"target"`
+
+	// Targets splits the traffic of the prefix between several targets,
+	// Target must be one of them and is used as the stable one
+	Targets []WeightedBackendTarget `json:"targets,omitempty"`
+}
+
+// IsWeighted returns whether the traffic of the prefix is split between
+// several targets
+func (p BackendPrefix) IsWeighted() bool {
+	return len(p.Targets) > 0
 }
 
 type EnsureBackendOpts struct {
@@ -115,23 +187,129 @@ type BackendTarget struct {
 	Service   string `json:"service"`
 }
 
+// WeightedBackendTarget is a target receiving a percentage of the traffic
+// of a prefix
+type WeightedBackendTarget struct {
+	BackendTarget
+	Weight int32 `json:"weight"`
+}
+
+// HasWeightedTargets returns whether any prefix splits its traffic between
+// several targets
+func (o *EnsureBackendOpts) HasWeightedTargets() bool {
+	for _, prefix := range o.Prefixes {
+		if prefix.IsWeighted() {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeWeightedTargets validates the weights of every weighted prefix,
+// using its heaviest target as the stable one when Target is not set
+func (o *EnsureBackendOpts) NormalizeWeightedTargets() error {
+	for i, prefix := range o.Prefixes {
+		if !prefix.IsWeighted() {
+			continue
+		}
+		var total int32
+		heaviest := prefix.Targets[0]
+		hasTarget := false
+		for _, target := range prefix.Targets {
+			if target.Weight <= 0 {
+				return ErrInvalidWeights
+			}
+			total += target.Weight
+			if target.Weight > heaviest.Weight {
+				heaviest = target
+			}
+			if target.BackendTarget == prefix.Target {
+				hasTarget = true
+			}
+		}
+		if total != 100 {
+			return ErrInvalidWeights
+		}
+		if prefix.Target == (BackendTarget{}) {
+			o.Prefixes[i].Target = heaviest.BackendTarget
+			continue
+		}
+		if !hasTarget {
+			return fmt.Errorf("target %s/%s of prefix %q must be one of its weighted targets", prefix.Target.Namespace, prefix.Target.Service, prefix.Prefix)
+		}
+	}
+	return nil
+}
+
 func (o *Opts) ToAnnotations() (map[string]string, error) {
 	data, err := json.Marshal(o)
 	if err != nil {
 		return nil, err
 	}
 	return map[string]string{
-		optsAnnotation: string(data),
+		OptsAnnotation: string(data),
+	}, nil
+}
+
+// rawJSONOpts encodes Opts without its custom UnmarshalJSON
+type rawJSONOpts Opts
+
+// ensureAnnotationData extends the opts stored in OptsAnnotation with the
+// instance, cnames and prefixes of the Ensure
+type ensureAnnotationData struct {
+	rawJSONOpts
+	App      string          `json:"app,omitempty"`
+	Instance string          `json:"instance,omitempty"`
+	CNames   []string        `json:"cnames,omitempty"`
+	Prefixes []BackendPrefix `json:"prefixes,omitempty"`
+}
+
+// ToAnnotations returns the annotations storing everything needed to
+// replay an Ensure of the instance with EnsureBackendOptsFromAnnotations,
+// the opts are still readable by OptsFromAnnotations
+func (o *EnsureBackendOpts) ToAnnotations(id InstanceID) (map[string]string, error) {
+	data, err := json.Marshal(ensureAnnotationData{
+		rawJSONOpts: rawJSONOpts(o.Opts),
+		App:         id.AppName,
+		Instance:    id.InstanceName,
+		CNames:      o.CNames,
+		Prefixes:    o.Prefixes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		OptsAnnotation: string(data),
 	}, nil
 }
 
+// EnsureBackendOptsFromAnnotations returns the instance and the opts stored
+// by EnsureBackendOpts.ToAnnotations, ok is false when they are not stored
+func EnsureBackendOptsFromAnnotations(meta *metav1.ObjectMeta) (id InstanceID, o EnsureBackendOpts, ok bool, err error) {
+	if meta.Annotations == nil || meta.Annotations[OptsAnnotation] == "" {
+		return id, o, false, nil
+	}
+	var data ensureAnnotationData
+	err = json.Unmarshal([]byte(meta.Annotations[OptsAnnotation]), &data)
+	if err != nil {
+		return id, o, false, err
+	}
+	if data.App == "" {
+		return id, o, false, nil
+	}
+	id = InstanceID{AppName: data.App, InstanceName: data.Instance}
+	o.Opts = Opts(data.rawJSONOpts)
+	o.CNames = data.CNames
+	o.Prefixes = data.Prefixes
+	return id, o, true, nil
+}
+
 func OptsFromAnnotations(meta *metav1.ObjectMeta) (Opts, error) {
-	if meta.Annotations == nil || meta.Annotations[optsAnnotation] == "" {
+	if meta.Annotations == nil || meta.Annotations[OptsAnnotation] == "" {
 		return Opts{}, nil
 	}
-	type rawJsonOpts Opts
-	var o rawJsonOpts
-	err := json.Unmarshal([]byte(meta.Annotations[optsAnnotation]), &o)
+	var o rawJSONOpts
+	err := json.Unmarshal([]byte(meta.Annotations[OptsAnnotation]), &o)
 	return Opts(o), err
 }
 
@@ -213,3 +391,21 @@ func DescribedOptions() map[string]string {
 type HealthcheckableRouter interface {
 	Healthcheck() error
 }
+
+// Wrapper is implemented by routers wrapping another one, like the
+// instrumented ones, which implement every optional interface
+type Wrapper interface {
+	Unwrap() Router
+}
+
+// Unwrap returns the router wrapped by r, the one whose optional interfaces
+// tell what r supports
+func Unwrap(r Router) Router {
+	for {
+		wrapper, ok := r.(Wrapper)
+		if !ok {
+			return r
+		}
+		r = wrapper.Unwrap()
+	}
+}
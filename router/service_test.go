@@ -9,6 +9,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestUnmarshalOpts(t *testing.T) {
@@ -57,3 +59,110 @@ func TestUnmarshalOptsWithHeaderOpts(t *testing.T) {
 	}
 	assert.Equal(t, expected, routerOpts)
 }
+
+func TestNormalizeWeightedTargets(t *testing.T) {
+	stable := BackendTarget{Namespace: "default", Service: "myapp-web"}
+	canary := BackendTarget{Namespace: "default", Service: "myapp-canary-web"}
+	tests := []struct {
+		prefixes       []BackendPrefix
+		expectedTarget BackendTarget
+		expectedErr    string
+	}{
+		{
+			prefixes: []BackendPrefix{
+				{Target: stable},
+			},
+			expectedTarget: stable,
+		},
+		{
+			prefixes: []BackendPrefix{
+				{Targets: []WeightedBackendTarget{{BackendTarget: canary, Weight: 10}, {BackendTarget: stable, Weight: 90}}},
+			},
+			expectedTarget: stable,
+		},
+		{
+			prefixes: []BackendPrefix{
+				{Target: canary, Targets: []WeightedBackendTarget{{BackendTarget: canary, Weight: 10}, {BackendTarget: stable, Weight: 90}}},
+			},
+			expectedTarget: canary,
+		},
+		{
+			prefixes: []BackendPrefix{
+				{Targets: []WeightedBackendTarget{{BackendTarget: canary, Weight: 10}, {BackendTarget: stable, Weight: 80}}},
+			},
+			expectedErr: ErrInvalidWeights.Error(),
+		},
+		{
+			prefixes: []BackendPrefix{
+				{Targets: []WeightedBackendTarget{{BackendTarget: canary, Weight: 0}, {BackendTarget: stable, Weight: 100}}},
+			},
+			expectedErr: ErrInvalidWeights.Error(),
+		},
+		{
+			prefixes: []BackendPrefix{
+				{Target: BackendTarget{Namespace: "default", Service: "other"}, Targets: []WeightedBackendTarget{{BackendTarget: canary, Weight: 10}, {BackendTarget: stable, Weight: 90}}},
+			},
+			expectedErr: `target default/other of prefix "" must be one of its weighted targets`,
+		},
+	}
+	for _, tt := range tests {
+		opts := EnsureBackendOpts{Prefixes: tt.prefixes}
+		err := opts.NormalizeWeightedTargets()
+		if tt.expectedErr != "" {
+			assert.EqualError(t, err, tt.expectedErr)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expectedTarget, opts.Prefixes[0].Target)
+	}
+}
+
+func TestUnmarshalWeightedTargets(t *testing.T) {
+	js := `{"prefixes": [{"prefix": "", "targets": [{"namespace": "default", "service": "myapp-web", "weight": 90}, {"namespace": "default", "service": "myapp-canary-web", "weight": 10}]}]}`
+	var opts EnsureBackendOpts
+	err := json.Unmarshal([]byte(js), &opts)
+	assert.NoError(t, err)
+	assert.True(t, opts.HasWeightedTargets())
+	assert.Equal(t, []WeightedBackendTarget{
+		{BackendTarget: BackendTarget{Namespace: "default", Service: "myapp-web"}, Weight: 90},
+		{BackendTarget: BackendTarget{Namespace: "default", Service: "myapp-canary-web"}, Weight: 10},
+	}, opts.Prefixes[0].Targets)
+}
+
+func TestEnsureBackendOptsAnnotations(t *testing.T) {
+	id := InstanceID{AppName: "myapp", InstanceName: "blue"}
+	opts := EnsureBackendOpts{
+		Opts:   Opts{Pool: "mypool", Acme: true, AdditionalOpts: map[string]string{"custom-opt": "val"}},
+		CNames: []string{"myapp.io"},
+		Prefixes: []BackendPrefix{
+			{Target: BackendTarget{Namespace: "default", Service: "myapp-web"}},
+			{Prefix: "api", Target: BackendTarget{Namespace: "default", Service: "myapp-api"}},
+		},
+	}
+	annotations, err := opts.ToAnnotations(id)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"router.tsuru.io/opts": `{"Pool":"mypool","Acme":true,"AdditionalOpts":{"custom-opt":"val"},"app":"myapp","instance":"blue","cnames":["myapp.io"],"prefixes":[{"prefix":"","target":{"namespace":"default","service":"myapp-web"}},{"prefix":"api","target":{"namespace":"default","service":"myapp-api"}}]}`,
+	}, annotations)
+
+	storedOpts, err := OptsFromAnnotations(&metav1.ObjectMeta{Annotations: annotations})
+	require.NoError(t, err)
+	assert.Equal(t, opts.Opts, storedOpts)
+
+	storedID, storedEnsureOpts, ok, err := EnsureBackendOptsFromAnnotations(&metav1.ObjectMeta{Annotations: annotations})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, id, storedID)
+	assert.Equal(t, opts, storedEnsureOpts)
+
+	_, _, ok, err = EnsureBackendOptsFromAnnotations(&metav1.ObjectMeta{})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// opts stored without an Ensure, ie: by older versions, can't be replayed
+	optsAnnotations, err := opts.Opts.ToAnnotations()
+	require.NoError(t, err)
+	_, _, ok, err = EnsureBackendOptsFromAnnotations(&metav1.ObjectMeta{Annotations: optsAnnotations})
+	require.NoError(t, err)
+	assert.False(t, ok)
+}